@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json" // Added for JSON encoding
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +39,12 @@ type BackupConfig struct {
 	SourcePaths     []string `json:"sourcePaths"`
 	DestinationPath string   `json:"destinationPath"`
 	IgnorePatterns  []string `json:"ignorePatterns"`
+	// Storage selects remote storage such as an S3 bucket for the repository.
+	// DestinationPath then only holds the local progress and resume state.
+	Storage backend.StorageConfig `json:"storage"`
+	// Tags and Description are recorded in every snapshot the backup makes
+	Tags        []string `json:"tags,omitempty"`
+	Description string   `json:"description,omitempty"`
 }
 
 // DeploymentState represents the current state of a deployment operation
@@ -48,6 +57,32 @@ type DeploymentState struct {
 	LastUpdateTime  time.Time                     `json:"lastUpdateTime"`
 }
 
+// CheckState represents the current state of a repository check
+type CheckState struct {
+	ID              string                `json:"id"`
+	Status          string                `json:"status"` // "running", "stopped", "completed", "failed"
+	DestinationPath string                `json:"destinationPath"`
+	Progress        backend.CheckProgress `json:"progress"`
+	Report          *backend.CheckReport  `json:"report,omitempty"`
+	Error           string                `json:"error,omitempty"`
+	StartTime       time.Time             `json:"startTime"`
+	LastUpdateTime  time.Time             `json:"lastUpdateTime"`
+}
+
+// CopyState represents the current state of a snapshot copy between repositories
+type CopyState struct {
+	ID              string                 `json:"id"`
+	Status          string                 `json:"status"` // "running", "stopped", "completed", "failed"
+	SourcePath      string                 `json:"sourcePath"`
+	DestinationPath string                 `json:"destinationPath"`
+	Filter          backend.SnapshotFilter `json:"filter"`
+	Progress        backend.CopyProgress   `json:"progress"`
+	Stats           *backend.CopyStats     `json:"stats,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+	StartTime       time.Time              `json:"startTime"`
+	LastUpdateTime  time.Time              `json:"lastUpdateTime"`
+}
+
 // App struct
 type App struct {
 	ctx              context.Context
@@ -59,6 +94,14 @@ type App struct {
 	deploymentState  *DeploymentState
 	deploymentCancel context.CancelFunc
 	deploymentMutex  sync.RWMutex
+	checkState       *CheckState
+	checkCancel      context.CancelFunc
+	checkMutex       sync.RWMutex
+	copyState        *CopyState
+	copyCancel       context.CancelFunc
+	copyMutex        sync.RWMutex
+	passphrases      map[string]string // Repository passphrases by destination, kept in memory only
+	passphraseMutex  sync.RWMutex
 }
 
 type eventMessage struct {
@@ -139,6 +182,13 @@ func (a *App) checkAndRestoreInterruptedBackups() {
 	
 	for _, dest := range destinations {
 		fmt.Fprintf(os.Stderr, "DEBUG: Checking destination: %s\n", dest)
+		if backend.IsRemoteLocation(dest) {
+			// Remote destinations are swept when the next backup opens them
+		} else if removed, err := backend.SweepTempFiles(dest); err != nil {
+			a.emitEvent("app:log", fmt.Sprintf("Warning: Failed to remove incomplete files in %s: %v", dest, err))
+		} else if removed > 0 {
+			a.emitEvent("app:log", fmt.Sprintf("Removed %d incomplete files left by an interrupted backup in %s", removed, dest))
+		}
 		if state, err := a.loadBackupState(dest); err == nil && state != nil {
 			fmt.Fprintf(os.Stderr, "DEBUG: Found backup state in %s with status: %s\n", dest, state.Status)
 			
@@ -154,7 +204,7 @@ func (a *App) checkAndRestoreInterruptedBackups() {
 					// Save the updated state
 					updatedData, err := json.MarshalIndent(state, "", "  ")
 					if err == nil {
-						os.WriteFile(filepath.Join(dest, ".backup_state.json"), updatedData, 0644)
+						os.WriteFile(filepath.Join(localStateDir(dest), ".backup_state.json"), updatedData, 0644)
 					}
 				}
 				
@@ -201,6 +251,47 @@ func (a *App) SetSavedBackups(backups []BackupConfig) {
 	}
 }
 
+// savedStorageConfig returns the storage config of the saved backup with the destination,
+// so that deployments read from the same remote storage the backup was written to.
+func (a *App) savedStorageConfig(destinationPath string) backend.StorageConfig {
+	a.backupMutex.RLock()
+	defer a.backupMutex.RUnlock()
+
+	for _, backup := range a.savedBackups {
+		if backup.DestinationPath == destinationPath {
+			return backup.Storage
+		}
+	}
+	return backend.StorageConfig{}
+}
+
+// savedBackupConfig returns the saved backup with the destination and source paths, or nil,
+// so that backups started with the same settings are recorded as made by it. The caller
+// must hold a.backupMutex.
+func (a *App) savedBackupConfig(destinationPath string, sourcePaths []string) *BackupConfig {
+	for i, backup := range a.savedBackups {
+		if backup.DestinationPath == destinationPath && slices.Equal(backup.SourcePaths, sourcePaths) {
+			return &a.savedBackups[i]
+		}
+	}
+	return nil
+}
+
+// localStateDir returns the local directory that holds the progress and resume state of
+// backups to a destination. For a remote destination such as an sftp:// URL it is a
+// directory in the user's cache directory named after the destination.
+func localStateDir(destinationPath string) string {
+	if !backend.IsRemoteLocation(destinationPath) {
+		return destinationPath
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(destinationPath))
+	return filepath.Join(cacheDir, "bbackup", "state", hex.EncodeToString(sum[:8]))
+}
+
 // getBackupDestinations returns a list of all backup destinations to check for state files
 func (a *App) getBackupDestinations() []string {
 	var destinations []string
@@ -427,8 +518,13 @@ func (a *App) SelectDestinationDirectory() (string, error) {
 
 // StartBackup initiates the backup process.
 // It runs in a goroutine to avoid blocking the main thread.
-func (a *App) StartBackup(casBaseDir string, sourcePaths []string, ignorePatterns []string) {
+// An empty passphrase uses the one already set for the destination, if any.
+// The storage config selects remote storage for the repository; leave it empty for a local destination.
+func (a *App) StartBackup(casBaseDir string, sourcePaths []string, ignorePatterns []string, passphrase string, storage backend.StorageConfig) {
 	fmt.Fprintf(os.Stderr, "DEBUG: StartBackup called with casBaseDir=%s, sourcePaths=%v\n", casBaseDir, sourcePaths)
+	if passphrase != "" {
+		a.SetRepositoryPassphrase(casBaseDir, passphrase)
+	}
 	
 	// Check if backup is already running
 	fmt.Fprintf(os.Stderr, "DEBUG: Checking if backup already running\n")
@@ -447,6 +543,13 @@ func (a *App) StartBackup(casBaseDir string, sourcePaths []string, ignorePattern
 		SourcePaths:     sourcePaths,
 		DestinationPath: casBaseDir,
 		IgnorePatterns:  ignorePatterns,
+		Storage:         storage,
+	}
+	if saved := a.savedBackupConfig(casBaseDir, sourcePaths); saved != nil {
+		config.ID = saved.ID
+		config.Name = saved.Name
+		config.Tags = saved.Tags
+		config.Description = saved.Description
 	}
 	fmt.Fprintf(os.Stderr, "DEBUG: Backup config created: ID=%s\n", config.ID)
 	
@@ -524,7 +627,7 @@ func (a *App) runBackupWithResume(config *BackupConfig, resume bool) {
 	// Use SQLite for file tracking if possible, fallback to map if needed?
 	// For now, let's use SQLite if we can.
 	// We need a path for the SQLite DB. Let's put it in the destination path.
-	trackerDbPath := filepath.Join(config.DestinationPath, ".backup_progress.db")
+	trackerDbPath := filepath.Join(localStateDir(config.DestinationPath), ".backup_progress.db")
 	sqliteTracker, err := backend.NewSQLiteFileTracker(trackerDbPath)
 	if err != nil {
 		a.emitEvent("app:log", fmt.Sprintf("Warning: Failed to initialize SQLite tracker: %v. Falling back to memory.", err))
@@ -581,8 +684,9 @@ func (a *App) runBackupWithResume(config *BackupConfig, resume bool) {
 	}
 	fmt.Fprintf(os.Stderr, "DEBUG: Validation passed, about to create directory\n")
 
-	// Ensure the CAS root exists with timeout
-	fmt.Fprintf(os.Stderr, "DEBUG: About to create directory: %s\n", config.DestinationPath)
+	// Ensure the CAS root (or the local state directory of a remote destination) exists with timeout
+	stateDir := localStateDir(config.DestinationPath)
+	fmt.Fprintf(os.Stderr, "DEBUG: About to create directory: %s\n", stateDir)
 	
 	// Use a goroutine to implement timeout for directory creation
 	type mkdirResult struct {
@@ -591,7 +695,7 @@ func (a *App) runBackupWithResume(config *BackupConfig, resume bool) {
 	
 	resultChan := make(chan mkdirResult, 1)
 	go func() {
-		err := os.MkdirAll(config.DestinationPath, 0755)
+		err := os.MkdirAll(stateDir, 0755)
 		resultChan <- mkdirResult{err: err}
 	}()
 	
@@ -701,7 +805,7 @@ func (a *App) runBackupWithResume(config *BackupConfig, resume bool) {
 		
 		// Save outside the mutex to avoid deadlock
 		if stateToCopy != nil {
-			stateFile := filepath.Join(stateToCopy.Config.DestinationPath, ".backup_state.json")
+			stateFile := filepath.Join(localStateDir(stateToCopy.Config.DestinationPath), ".backup_state.json")
 			data, err := json.MarshalIndent(stateToCopy, "", "  ")
 			if err == nil {
 				os.WriteFile(stateFile, data, 0644)
@@ -710,7 +814,17 @@ func (a *App) runBackupWithResume(config *BackupConfig, resume bool) {
 	}
 
 	fmt.Fprintf(os.Stderr, "DEBUG: About to call backend.RunBackup\n")
-	err = backend.RunBackup(backupCtx, config.DestinationPath, config.SourcePaths, config.IgnorePatterns, tracker, progressCb)
+	options := backend.BackupOptions{
+		Passphrase:  a.repositoryPassphrase(config.DestinationPath),
+		Batch:       backend.DefaultBatchConfig(),
+		Storage:     config.Storage,
+		OnMigrate:   a.logMigration,
+		ConfigID:    config.ID,
+		ConfigName:  config.Name,
+		Tags:        config.Tags,
+		Description: config.Description,
+	}
+	err = backend.RunBackupWithOptions(backupCtx, config.DestinationPath, config.SourcePaths, config.IgnorePatterns, tracker, progressCb, options)
 	fmt.Fprintf(os.Stderr, "DEBUG: backend.RunBackup returned with err=%v\n", err)
 	
 	// Update final state
@@ -738,7 +852,7 @@ func (a *App) runBackupWithResume(config *BackupConfig, resume bool) {
 		} else {
 			a.backupState.Status = "completed"
 			// Clean up state file on successful completion
-			stateFile := filepath.Join(config.DestinationPath, ".backup_state.json")
+			stateFile := filepath.Join(localStateDir(config.DestinationPath), ".backup_state.json")
 			os.Remove(stateFile)
 			a.emitEvent("app:backup:status", "Completed")
 		}
@@ -797,6 +911,11 @@ func (a *App) GetSystemInfo() (map[string]interface{}, error) {
 
 // ValidateBackupPath checks if a path is valid for backup
 func (a *App) ValidateBackupPath(path string) (bool, error) {
+	// Remote destinations are checked by connecting to them
+	if backend.IsRemoteLocation(path) {
+		return backend.CheckRemoteLocation(path)
+	}
+
 	// Check if path exists
 	_, err := os.Stat(path)
 	if err != nil {
@@ -816,6 +935,659 @@ func (a *App) ValidateBackupPath(path string) (bool, error) {
 	return true, nil
 }
 
+// SetRepositoryPassphrase remembers the passphrase for the repository at the given destination
+// for the rest of the session. Passphrases are never written to disk.
+func (a *App) SetRepositoryPassphrase(destinationPath string, passphrase string) {
+	a.passphraseMutex.Lock()
+	defer a.passphraseMutex.Unlock()
+	if a.passphrases == nil {
+		a.passphrases = make(map[string]string)
+	}
+	if passphrase == "" {
+		delete(a.passphrases, destinationPath)
+		return
+	}
+	a.passphrases[destinationPath] = passphrase
+}
+
+// repositoryPassphrase returns the passphrase set for the given destination, or "" if none
+func (a *App) repositoryPassphrase(destinationPath string) string {
+	a.passphraseMutex.RLock()
+	defer a.passphraseMutex.RUnlock()
+	return a.passphrases[destinationPath]
+}
+
+// openRepository opens the repository at the given destination with the saved storage
+// settings and passphrase for it
+func (a *App) openRepository(destinationPath string) (*backend.Repository, error) {
+	repo, err := backend.OpenRepositoryWithConfig(destinationPath, a.savedStorageConfig(destinationPath), a.repositoryPassphrase(destinationPath))
+	if err != nil {
+		return nil, err
+	}
+	repo.OnMigrate(a.logMigration)
+	return repo, nil
+}
+
+// logMigration reports that a repository was saved in the current format
+func (a *App) logMigration(repo *backend.Repository, from, to int) {
+	a.emitEvent("app:log", fmt.Sprintf("Migrated repository %s from format version %d to %d", repo.Location(), from, to))
+}
+
+// InitRepository creates a new repository with the default settings at the given destination.
+// If a passphrase is given, the repository is encrypted and the passphrase is kept for the session.
+// hashAlgorithm is "sha256" (the default if empty) or the faster "blake3"; it can't be changed later.
+func (a *App) InitRepository(destinationPath string, passphrase string, hashAlgorithm string) (backend.RepoConfig, error) {
+	config := backend.DefaultRepoConfig()
+	if hashAlgorithm != "" {
+		config.HashAlgorithm = hashAlgorithm
+	}
+	repo, err := backend.InitRepositoryWithSettings(destinationPath, a.savedStorageConfig(destinationPath), config, passphrase)
+	if err != nil {
+		return backend.RepoConfig{}, err
+	}
+	defer repo.Close()
+	a.SetRepositoryPassphrase(destinationPath, passphrase)
+	a.emitEvent("app:log", fmt.Sprintf("Initialized repository %s at %s", repo.Config().ID, destinationPath))
+	return repo.Config(), nil
+}
+
+// GetRepositoryConfig returns the settings of the repository at the given destination.
+// Repositories in an older format are reported as upgraded; the upgrade is saved by the
+// next backup or other change.
+func (a *App) GetRepositoryConfig(destinationPath string) (backend.RepoConfig, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return backend.RepoConfig{}, err
+	}
+	defer repo.Close()
+	return repo.Config(), nil
+}
+
+// SetCompressionLevel sets the zstd level used for new objects in the repository at the given destination
+func (a *App) SetCompressionLevel(destinationPath string, level int) error {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	if err := repo.SetCompressionLevel(level); err != nil {
+		return err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Compression level for %s set to %d", destinationPath, level))
+	return nil
+}
+
+// PruneRepository removes objects that no snapshot of the repository at the given destination
+// references any more. Unreferenced objects are marked first and deleted by a later prune once
+// the grace period is over; with dryRun set, nothing is marked or deleted.
+func (a *App) PruneRepository(destinationPath string, dryRun bool) (backend.PruneStats, error) {
+	a.backupMutex.RLock()
+	busy := a.backupState != nil && a.backupState.Config.DestinationPath == destinationPath &&
+		(a.backupState.Status == "running" || a.backupState.Status == "paused")
+	a.backupMutex.RUnlock()
+	if busy && !dryRun {
+		return backend.PruneStats{}, fmt.Errorf("a backup to %s is in progress", destinationPath)
+	}
+
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return backend.PruneStats{}, err
+	}
+	defer repo.Close()
+	stats, err := repo.Prune(context.Background(), backend.PruneOptions{DryRun: dryRun})
+	if err != nil {
+		return backend.PruneStats{}, err
+	}
+	if dryRun {
+		a.emitEvent("app:log", fmt.Sprintf("Prune dry run for %s: %d unreferenced objects (%d bytes), %d ready to delete (%d bytes)",
+			destinationPath, stats.UnreferencedObjects, stats.UnreferencedBytes, stats.DeletableObjects, stats.DeletableBytes))
+	} else {
+		a.emitEvent("app:log", fmt.Sprintf("Pruned %s: deleted %d objects (%d bytes), %d newly marked, %d waiting for the grace period",
+			destinationPath, stats.DeletedObjects, stats.DeletedBytes, stats.NewlyMarked, stats.PendingObjects))
+	}
+	return *stats, nil
+}
+
+// SetParity turns on Reed-Solomon parity for the repository at the given destination, with
+// parityShards parity blocks for every dataShards blocks, or turns it off if both are 0.
+// Files stored before get parity from RepairRepository.
+func (a *App) SetParity(destinationPath string, dataShards int, parityShards int) error {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	if err := repo.SetParity(backend.ParityConfig{DataShards: dataShards, ParityShards: parityShards}); err != nil {
+		return err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Parity for %s set to %d+%d blocks", destinationPath, dataShards, parityShards))
+	return nil
+}
+
+// RepairRepository reads every pack and loose object of the repository at the given
+// destination and repairs damaged ones from their parity. Progress is reported with
+// app:repair:progress events.
+func (a *App) RepairRepository(destinationPath string) (*backend.RepairReport, error) {
+	a.backupMutex.RLock()
+	busy := a.backupState != nil && a.backupState.Config.DestinationPath == destinationPath &&
+		(a.backupState.Status == "running" || a.backupState.Status == "paused")
+	a.backupMutex.RUnlock()
+	if busy {
+		return nil, fmt.Errorf("a backup to %s is in progress", destinationPath)
+	}
+
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	report, err := repo.Repair(context.Background(), func(progress backend.RepairProgress) {
+		a.emitEvent("app:repair:progress", progress)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Repair of %s: %d files checked, %d repaired, %d unrepairable, parity added to %d",
+		destinationPath, report.CheckedFiles, len(report.RepairedFiles), len(report.UnrepairableFiles), report.AddedParity))
+	for _, issue := range report.UnrepairableFiles {
+		a.emitEvent("app:log", fmt.Sprintf("Repair: %s: %s", issue.ID, issue.Error))
+	}
+	return report, nil
+}
+
+// EnableAppendOnly turns on append-only mode for the repository at the given destination
+// and returns the maintenance key needed to remove snapshots, prune or turn it off again
+func (a *App) EnableAppendOnly(destinationPath string) (string, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Close()
+	key, err := repo.EnableAppendOnly()
+	if err != nil {
+		return "", err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Repository %s is now append-only", destinationPath))
+	return key, nil
+}
+
+// DisableAppendOnly turns off append-only mode for the repository at the given destination
+func (a *App) DisableAppendOnly(destinationPath string, maintenanceKey string) error {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	if err := repo.AuthorizeMaintenance(maintenanceKey); err != nil {
+		return err
+	}
+	if err := repo.DisableAppendOnly(); err != nil {
+		return err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Repository %s is no longer append-only", destinationPath))
+	return nil
+}
+
+// RemoveSnapshot removes a snapshot from the repository at the given destination. For
+// append-only repositories a tombstone is recorded instead and true is returned.
+func (a *App) RemoveSnapshot(destinationPath string, snapshotID string) (bool, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return false, err
+	}
+	defer repo.Close()
+	tombstoned, err := repo.RemoveSnapshot(context.Background(), snapshotID)
+	if err != nil {
+		return false, err
+	}
+	if tombstoned {
+		a.emitEvent("app:log", fmt.Sprintf("Snapshot %s marked for removal; apply the tombstones with the maintenance key to remove it", snapshotID))
+	} else {
+		a.emitEvent("app:log", fmt.Sprintf("Snapshot %s removed", snapshotID))
+	}
+	return tombstoned, nil
+}
+
+// ListSnapshots returns the snapshots of the repository at the given destination that the
+// query selects, oldest first, with the host, user, backup configuration and summary of
+// the backup that made them
+func (a *App) ListSnapshots(destinationPath string, query backend.SnapshotQuery) ([]*backend.Snapshot, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	snapshots, err := repo.ListSnapshots(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	selected := []*backend.Snapshot{}
+	for _, snapshot := range snapshots {
+		if query.Matches(snapshot) {
+			selected = append(selected, snapshot)
+		}
+	}
+	return selected, nil
+}
+
+// GetSnapshot returns a snapshot of the repository at the given destination by its ID
+func (a *App) GetSnapshot(destinationPath string, snapshotID string) (*backend.Snapshot, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.GetSnapshot(context.Background(), snapshotID)
+}
+
+// FindLatestSnapshot returns the newest snapshot of the repository at the given destination
+// that the query selects, or nil if there is none
+func (a *App) FindLatestSnapshot(destinationPath string, query backend.SnapshotQuery) (*backend.Snapshot, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.FindLatest(context.Background(), query)
+}
+
+// BrowseSnapshot lists a directory of a snapshot in the repository at the given destination.
+// dir is relative to the snapshot's source with the given index, "" for its root; only the
+// directories on the way are read.
+func (a *App) BrowseSnapshot(destinationPath string, snapshotID string, source int, dir string) ([]backend.TreeNode, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	snapshot, err := repo.LoadSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListSnapshotDir(context.Background(), snapshot, source, dir)
+}
+
+// DiffSnapshots returns the files added, removed or changed between two snapshots of the
+// repository at the given destination. Directories that are the same in both are skipped.
+func (a *App) DiffSnapshots(destinationPath string, oldSnapshotID string, newSnapshotID string) ([]backend.SnapshotChange, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	old, err := repo.LoadSnapshot(oldSnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	new, err := repo.LoadSnapshot(newSnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	changes := []backend.SnapshotChange{}
+	err = repo.DiffSnapshots(context.Background(), old, new, func(change backend.SnapshotChange) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// GetTombstones returns the snapshot removals waiting to be applied in the repository at the
+// given destination
+func (a *App) GetTombstones(destinationPath string) ([]backend.Tombstone, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.ListTombstones(context.Background())
+}
+
+// ApplyTombstones removes the tombstoned snapshots of the append-only repository at the
+// given destination, authorised by the maintenance key
+func (a *App) ApplyTombstones(destinationPath string, maintenanceKey string) (int, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return 0, err
+	}
+	defer repo.Close()
+	if repo.Config().AppendOnly {
+		if err := repo.AuthorizeMaintenance(maintenanceKey); err != nil {
+			return 0, err
+		}
+	}
+	applied, err := repo.ApplyTombstones(context.Background())
+	if err != nil {
+		return applied, err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Removed %d tombstoned snapshots from %s", applied, destinationPath))
+	return applied, nil
+}
+
+// SetQuota sets the size limit of the repository at the given destination; a zero maxBytes
+// removes it. Backups warn near the limit and apply the retention policy, if it keeps any
+// snapshots, once the repository is over it.
+func (a *App) SetQuota(destinationPath string, quota backend.QuotaConfig) error {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	if err := repo.SetQuota(quota); err != nil {
+		return err
+	}
+	if quota.MaxBytes == 0 {
+		a.emitEvent("app:log", fmt.Sprintf("Quota for %s removed", destinationPath))
+	} else {
+		a.emitEvent("app:log", fmt.Sprintf("Quota for %s set to %.2f MB", destinationPath, float64(quota.MaxBytes)/1024/1024))
+	}
+	return nil
+}
+
+// SetMaxFileSize sets the largest file written to the repository at the given destination;
+// larger objects and packs are stored as segments. 0 leaves only the limit detected from the
+// destination filesystem, such as 4 GB on FAT32.
+func (a *App) SetMaxFileSize(destinationPath string, maxFileSize int64) error {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	if err := repo.SetMaxFileSize(maxFileSize); err != nil {
+		return err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Maximum file size for %s set to %d bytes", destinationPath, maxFileSize))
+	return nil
+}
+
+// GetQuotaStatus returns how much of its quota the repository at the given destination uses
+func (a *App) GetQuotaStatus(destinationPath string) (*backend.QuotaStatus, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.QuotaStatus(context.Background())
+}
+
+// ApplyRetention removes the snapshots of the repository at the given destination that the
+// policy doesn't keep, and prunes it. A dry run only reports what would be removed.
+func (a *App) ApplyRetention(destinationPath string, policy backend.RetentionPolicy, dryRun bool) (*backend.RetentionResult, error) {
+	a.backupMutex.RLock()
+	busy := a.backupState != nil && a.backupState.Config.DestinationPath == destinationPath &&
+		(a.backupState.Status == "running" || a.backupState.Status == "paused")
+	a.backupMutex.RUnlock()
+	if busy {
+		return nil, fmt.Errorf("a backup to %s is in progress", destinationPath)
+	}
+
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	result, err := repo.ApplyRetention(context.Background(), policy, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Retention for %s: %s %d snapshots, keeping %d", destinationPath, verb, len(result.Removed), len(result.Kept)))
+	return result, nil
+}
+
+// GetRepositoryStats returns the space used by the repository at the given destination and by
+// each of its snapshots
+func (a *App) GetRepositoryStats(destinationPath string) (*backend.RepositoryStats, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.Stats(context.Background())
+}
+
+// GetRepositoryLocks returns the locks currently held on the repository at the given destination
+func (a *App) GetRepositoryLocks(destinationPath string) ([]backend.LockInfo, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.ListLocks(context.Background())
+}
+
+// UnlockRepository removes locks left on the repository at the given destination by processes
+// that crashed. Only stale locks are removed unless all is set.
+func (a *App) UnlockRepository(destinationPath string, all bool) (int, error) {
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return 0, err
+	}
+	defer repo.Close()
+	removed, err := repo.RemoveLocks(context.Background(), all)
+	if err != nil {
+		return removed, err
+	}
+	a.emitEvent("app:log", fmt.Sprintf("Removed %d locks from %s", removed, destinationPath))
+	return removed, nil
+}
+
+// StartCheck verifies the repository at the given destination in the background: every
+// snapshot is read, every referenced object must exist and readDataPercent percent of the
+// stored objects are read back to detect corruption. Progress is reported with
+// app:check:progress events and the result is available from GetCheckState.
+func (a *App) StartCheck(destinationPath string, readDataPercent float64) error {
+	a.checkMutex.Lock()
+	defer a.checkMutex.Unlock()
+
+	if a.checkState != nil && a.checkState.Status == "running" {
+		return fmt.Errorf("a check of %s is already running", a.checkState.DestinationPath)
+	}
+	repo, err := a.openRepository(destinationPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.checkCancel = cancel
+	a.checkState = &CheckState{
+		ID:              fmt.Sprintf("check-%d", time.Now().Unix()),
+		Status:          "running",
+		DestinationPath: destinationPath,
+		StartTime:       time.Now(),
+		LastUpdateTime:  time.Now(),
+	}
+
+	go a.runCheck(ctx, repo, readDataPercent)
+	return nil
+}
+
+// runCheck executes a repository check started by StartCheck
+func (a *App) runCheck(ctx context.Context, repo *backend.Repository, readDataPercent float64) {
+	defer repo.Close()
+	a.emitEvent("app:log", fmt.Sprintf("Checking repository %s (reading %.0f%% of the data)...", repo.Location(), readDataPercent))
+	a.emitEvent("app:check:status", "Running")
+
+	progressCb := func(progress backend.CheckProgress) {
+		a.checkMutex.Lock()
+		if a.checkState != nil {
+			a.checkState.Progress = progress
+			a.checkState.LastUpdateTime = time.Now()
+		}
+		a.checkMutex.Unlock()
+		a.emitEvent("app:check:progress", progress)
+	}
+
+	report, err := repo.Check(ctx, backend.CheckOptions{ReadDataPercent: readDataPercent}, progressCb)
+
+	a.checkMutex.Lock()
+	defer a.checkMutex.Unlock()
+	a.checkCancel = nil
+	if a.checkState == nil {
+		return
+	}
+	a.checkState.LastUpdateTime = time.Now()
+	switch {
+	case ctx.Err() != nil:
+		a.checkState.Status = "stopped"
+	case err != nil:
+		a.checkState.Status = "failed"
+		a.checkState.Error = err.Error()
+		a.emitEvent("app:log", fmt.Sprintf("Check failed: %v", err))
+		a.emitEvent("app:check:status", "Failed")
+	default:
+		a.checkState.Status = "completed"
+		a.checkState.Report = report
+		a.emitEvent("app:log", fmt.Sprintf("Check completed: %d snapshots, %d objects read, %d broken snapshots, %d missing, %d corrupt, %d orphaned objects",
+			report.Snapshots, report.ReadObjects, len(report.BrokenSnapshots), len(report.MissingObjects), len(report.CorruptObjects), len(report.OrphanedObjects)))
+		if report.OK() {
+			a.emitEvent("app:check:status", "Completed")
+		} else {
+			a.emitEvent("app:check:status", "Problems found")
+		}
+	}
+}
+
+// StopCheck cancels the running repository check
+func (a *App) StopCheck() error {
+	a.checkMutex.Lock()
+	defer a.checkMutex.Unlock()
+
+	if a.checkState == nil || a.checkState.Status != "running" || a.checkCancel == nil {
+		return fmt.Errorf("no check in progress")
+	}
+	a.checkCancel()
+	a.emitEvent("app:log", "Check stopped by user")
+	a.emitEvent("app:check:status", "Stopped")
+	return nil
+}
+
+// GetCheckState returns the state of the current or last repository check
+func (a *App) GetCheckState() *CheckState {
+	a.checkMutex.RLock()
+	defer a.checkMutex.RUnlock()
+
+	if a.checkState == nil {
+		return nil
+	}
+	state := *a.checkState
+	return &state
+}
+
+// StartCopy copies the snapshots selected by filter from the repository at sourcePath to
+// the one at destinationPath in the background, e.g. from the primary drive to an offsite
+// one. Only objects missing at the destination are transferred and every object is
+// verified on the way. The destination gets a new repository if it doesn't have one yet.
+// Progress is reported with app:copy:progress events and the result is available from
+// GetCopyState.
+func (a *App) StartCopy(sourcePath string, destinationPath string, filter backend.SnapshotFilter) error {
+	a.copyMutex.Lock()
+	defer a.copyMutex.Unlock()
+
+	if a.copyState != nil && a.copyState.Status == "running" {
+		return fmt.Errorf("a copy from %s is already running", a.copyState.SourcePath)
+	}
+	src, err := a.openRepository(sourcePath)
+	if err != nil {
+		return err
+	}
+	dst, err := backend.OpenRepositoryForWrite(destinationPath, a.savedStorageConfig(destinationPath), a.repositoryPassphrase(destinationPath))
+	if err != nil {
+		src.Close()
+		return err
+	}
+	dst.OnMigrate(a.logMigration)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.copyCancel = cancel
+	a.copyState = &CopyState{
+		ID:              fmt.Sprintf("copy-%d", time.Now().Unix()),
+		Status:          "running",
+		SourcePath:      sourcePath,
+		DestinationPath: destinationPath,
+		Filter:          filter,
+		StartTime:       time.Now(),
+		LastUpdateTime:  time.Now(),
+	}
+
+	go a.runCopy(ctx, src, dst, filter)
+	return nil
+}
+
+// runCopy executes a snapshot copy started by StartCopy
+func (a *App) runCopy(ctx context.Context, src, dst *backend.Repository, filter backend.SnapshotFilter) {
+	defer src.Close()
+	defer dst.Close()
+	a.emitEvent("app:log", fmt.Sprintf("Copying snapshots from %s to %s...", src.Location(), dst.Location()))
+	a.emitEvent("app:copy:status", "Running")
+
+	progressCb := func(progress backend.CopyProgress) {
+		a.copyMutex.Lock()
+		if a.copyState != nil {
+			a.copyState.Progress = progress
+			a.copyState.LastUpdateTime = time.Now()
+		}
+		a.copyMutex.Unlock()
+		a.emitEvent("app:copy:progress", progress)
+	}
+
+	stats, err := src.CopySnapshots(ctx, dst, filter, progressCb)
+
+	a.copyMutex.Lock()
+	defer a.copyMutex.Unlock()
+	a.copyCancel = nil
+	if a.copyState == nil {
+		return
+	}
+	a.copyState.LastUpdateTime = time.Now()
+	a.copyState.Stats = stats
+	switch {
+	case ctx.Err() != nil:
+		a.copyState.Status = "stopped"
+	case err != nil:
+		a.copyState.Status = "failed"
+		a.copyState.Error = err.Error()
+		a.emitEvent("app:log", fmt.Sprintf("Copy failed: %v", err))
+		a.emitEvent("app:copy:status", "Failed")
+	default:
+		a.copyState.Status = "completed"
+		a.emitEvent("app:log", fmt.Sprintf("Copy completed: %d of %d snapshots copied (%d already there), %d objects (%s) transferred",
+			stats.CopiedSnapshots, stats.Snapshots, stats.SkippedSnapshots, stats.CopiedObjects, formatBytes(stats.CopiedBytes)))
+		a.emitEvent("app:copy:status", "Completed")
+	}
+}
+
+// StopCopy cancels the running snapshot copy. Snapshots copied so far are kept.
+func (a *App) StopCopy() error {
+	a.copyMutex.Lock()
+	defer a.copyMutex.Unlock()
+
+	if a.copyState == nil || a.copyState.Status != "running" || a.copyCancel == nil {
+		return fmt.Errorf("no copy in progress")
+	}
+	a.copyCancel()
+	a.emitEvent("app:log", "Copy stopped by user")
+	a.emitEvent("app:copy:status", "Stopped")
+	return nil
+}
+
+// GetCopyState returns the state of the current or last snapshot copy
+func (a *App) GetCopyState() *CopyState {
+	a.copyMutex.RLock()
+	defer a.copyMutex.RUnlock()
+
+	if a.copyState == nil {
+		return nil
+	}
+	state := *a.copyState
+	return &state
+}
+
 // saveBackupState saves the current backup state to disk (thread-safe)
 func (a *App) saveBackupState() error {
 	a.backupMutex.RLock()
@@ -831,7 +1603,7 @@ func (a *App) saveBackupStateLocked() error {
 	
 	// Create a copy to avoid long blocking operations if we were doing more complex things
 	// But since we are already locked, we just marshal directly
-	stateFile := filepath.Join(a.backupState.Config.DestinationPath, ".backup_state.json")
+	stateFile := filepath.Join(localStateDir(a.backupState.Config.DestinationPath), ".backup_state.json")
 	
 	data, err := json.MarshalIndent(a.backupState, "", "  ")
 	if err != nil {
@@ -843,7 +1615,7 @@ func (a *App) saveBackupStateLocked() error {
 
 // loadBackupState loads backup state from disk
 func (a *App) loadBackupState(destinationPath string) (*BackupState, error) {
-	stateFile := filepath.Join(destinationPath, ".backup_state.json")
+	stateFile := filepath.Join(localStateDir(destinationPath), ".backup_state.json")
 	data, err := os.ReadFile(stateFile)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -1060,8 +1832,13 @@ func (a *App) RestartBackup(config *BackupConfig) error {
 	return nil
 }
 
-// StartDeployment starts a smart deployment operation
-func (a *App) StartDeployment(snapshotPath string, targetPath string, casBaseDir string, ignorePatterns []string) {
+// StartDeployment starts a smart deployment of a snapshot of the repository at casBaseDir,
+// chosen from ListSnapshots. An empty passphrase uses the one already set for the repository, if any.
+func (a *App) StartDeployment(snapshotID string, targetPath string, casBaseDir string, ignorePatterns []string, passphrase string) {
+	if passphrase != "" {
+		a.SetRepositoryPassphrase(casBaseDir, passphrase)
+	}
+
 	a.deploymentMutex.Lock()
 	defer a.deploymentMutex.Unlock()
 	
@@ -1076,12 +1853,14 @@ func (a *App) StartDeployment(snapshotPath string, targetPath string, casBaseDir
 	
 	// Create deployment configuration
 	config := backend.DeploymentConfig{
-		SnapshotPath:     snapshotPath,
+		SnapshotID:       snapshotID,
 		TargetPath:       targetPath,
 		CASBaseDir:       casBaseDir,
 		PreserveModTimes: true,
 		UseHardLinks:     false,
 		IgnorePatterns:   ignorePatterns,
+		Passphrase:       a.repositoryPassphrase(casBaseDir),
+		Storage:          a.savedStorageConfig(casBaseDir),
 	}
 	
 	// Initialize deployment state
@@ -1193,48 +1972,6 @@ func (a *App) GetDeploymentState() *DeploymentState {
 	return &stateCopy
 }
 
-// SelectSnapshotFile opens a file dialog to select a snapshot file
-func (a *App) SelectSnapshotFile() (string, error) {
-	// Check if we're in runtime context
-	if a.ctx == nil {
-		return "", fmt.Errorf("runtime context not available")
-	}
-	
-	defaultLocation, err := os.UserHomeDir()
-	if err != nil {
-		defaultLocation = ""
-	}
-	
-	filePath, err := wailsruntime.OpenFileDialog(a.ctx, wailsruntime.OpenDialogOptions{
-		Title: "Select Snapshot File",
-		DefaultDirectory: defaultLocation,
-		Filters: []wailsruntime.FileFilter{
-			{
-				DisplayName: "Snapshot Files",
-				Pattern:     "*.snapshot",
-			},
-			{
-				DisplayName: "JSON Files",
-				Pattern:     "*.json",
-			},
-			{
-				DisplayName: "All Files",
-				Pattern:     "*",
-			},
-		},
-	})
-	
-	if err != nil {
-		return "", err
-	}
-	
-	if filePath == "" {
-		return "", fmt.Errorf("no file selected")
-	}
-	
-	return filePath, nil
-}
-
 // SelectDeployTargetDirectory opens a directory dialog to select deployment target
 func (a *App) SelectDeployTargetDirectory() (string, error) {
 	// Check if we're in runtime context
@@ -0,0 +1,265 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// In append-only mode a repository refuses to delete or overwrite its config, keys,
+// objects, packs, parity and snapshots, so a compromised machine that runs backups can
+// add new data but can't destroy the existing backups. Removing a snapshot only records
+// a tombstone, which is applied by a maintenance operation that must be authorised with
+// the maintenance key handed out when append-only mode was turned on. The key is never
+// stored in the repository, only its hash.
+//
+// The checks are made by the storage the repository writes through, so they cover every
+// write path. Index, object index and prune mark files can only be added, like the data
+// they describe; lock files stay writable since locks must be released. A new object index
+// file could still list objects that don't exist, which would make backups skip storing
+// them, so in append-only mode the loose objects are taken from a listing of objects/
+// instead, and the object index is rebuilt when the mode is turned off.
+
+// ErrAppendOnly is returned for deletes and overwrites refused in append-only mode.
+var ErrAppendOnly = errors.New("repository is append-only")
+
+// ErrInvalidMaintenanceKey is returned when a maintenance key doesn't match the repository.
+var ErrInvalidMaintenanceKey = errors.New("invalid maintenance key")
+
+// appendOnlyProtected reports whether files of a type can't be deleted or overwritten in
+// append-only mode.
+func appendOnlyProtected(t FileType) bool {
+	switch t {
+	case ConfigFile, KeyFile, ObjectFile, PackFile, IndexFile, ObjectIndexFile, MarkFile, ParityFile, SnapshotFile, TombstoneFile:
+		return true
+	}
+	return false
+}
+
+// appendOnlyStorage wraps the storage of an append-only repository and refuses deletes
+// and overwrites of protected files unless maintenance has been authorised.
+type appendOnlyStorage struct {
+	Storage
+	maintenance atomic.Bool
+}
+
+func (s *appendOnlyStorage) Save(ctx context.Context, h Handle, rd io.Reader) error {
+	if appendOnlyProtected(h.Type) && !s.maintenance.Load() {
+		if _, err := s.Storage.Stat(ctx, h); err == nil {
+			return fmt.Errorf("refusing to overwrite %s: %w", h, ErrAppendOnly)
+		} else if !isNotExist(err) {
+			return err
+		}
+	}
+	return s.Storage.Save(ctx, h, rd)
+}
+
+func (s *appendOnlyStorage) Remove(ctx context.Context, h Handle) error {
+	if appendOnlyProtected(h.Type) && !s.maintenance.Load() {
+		return fmt.Errorf("refusing to remove %s: %w", h, ErrAppendOnly)
+	}
+	return s.Storage.Remove(ctx, h)
+}
+
+// AppendOnly reports whether deletes and overwrites are currently refused: the repository
+// is in append-only mode and maintenance hasn't been authorised.
+func (r *Repository) AppendOnly() bool {
+	s, ok := r.storage.(*appendOnlyStorage)
+	return ok && !s.maintenance.Load()
+}
+
+// applyAppendOnly wraps the storage if the config turns on append-only mode.
+func (r *Repository) applyAppendOnly() {
+	if _, ok := r.storage.(*appendOnlyStorage); !ok && r.config.AppendOnly {
+		r.storage = &appendOnlyStorage{Storage: r.storage}
+	}
+}
+
+// maintenanceKeyHash returns the hash of a maintenance key that is kept in the config.
+func maintenanceKeyHash(key string) string {
+	sum := sha256.Sum256([]byte("bbackup maintenance key\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnableAppendOnly turns on append-only mode and returns the maintenance key, which is
+// needed to apply tombstones, prune or leave append-only mode. It should be kept away
+// from the machines that write backups; it can't be recovered from the repository.
+func (r *Repository) EnableAppendOnly() (string, error) {
+	if r.config.AppendOnly {
+		return "", fmt.Errorf("repository %s is already append-only", r.Location())
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate maintenance key: %w", err)
+	}
+	key := hex.EncodeToString(buf)
+
+	config := r.config
+	config.AppendOnly = true
+	config.MaintenanceKeyHash = maintenanceKeyHash(key)
+	r.config = config
+	if err := r.SaveConfig(); err != nil {
+		r.config.AppendOnly = false
+		r.config.MaintenanceKeyHash = ""
+		return "", err
+	}
+	r.applyAppendOnly()
+	return key, nil
+}
+
+// AuthorizeMaintenance checks the maintenance key of an append-only repository and, if it
+// matches, allows deletes and overwrites through this Repository until it is closed.
+func (r *Repository) AuthorizeMaintenance(key string) error {
+	s, ok := r.storage.(*appendOnlyStorage)
+	if !ok {
+		return fmt.Errorf("repository %s is not append-only", r.Location())
+	}
+	if subtle.ConstantTimeCompare([]byte(maintenanceKeyHash(key)), []byte(r.config.MaintenanceKeyHash)) != 1 {
+		return ErrInvalidMaintenanceKey
+	}
+	s.maintenance.Store(true)
+	return nil
+}
+
+// DisableAppendOnly leaves append-only mode and rebuilds the object index, which wasn't
+// trusted while it was on. Maintenance must have been authorised.
+func (r *Repository) DisableAppendOnly() error {
+	s, ok := r.storage.(*appendOnlyStorage)
+	if !ok {
+		return fmt.Errorf("repository %s is not append-only", r.Location())
+	}
+	if !s.maintenance.Load() {
+		return fmt.Errorf("leaving append-only mode needs the maintenance key: %w", ErrAppendOnly)
+	}
+	config := r.config
+	config.AppendOnly = false
+	config.MaintenanceKeyHash = ""
+	old := r.config
+	r.config = config
+	if err := r.SaveConfig(); err != nil {
+		r.config = old
+		return err
+	}
+	r.storage = s.Storage
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.rebuildObjectIndex(context.Background()); err != nil {
+		return fmt.Errorf("failed to rebuild object index: %w", err)
+	}
+	return nil
+}
+
+// Tombstone records a request to remove a snapshot from an append-only repository.
+type Tombstone struct {
+	Snapshot  string    `json:"snapshot"`
+	Requested time.Time `json:"requested"`
+	Hostname  string    `json:"hostname"`
+}
+
+// RemoveSnapshot deletes a snapshot. In append-only mode the snapshot is kept and a
+// tombstone is recorded instead, which ApplyTombstones applies once maintenance is
+// authorised; tombstoned reports whether that happened. The objects of a removed
+// snapshot are freed by a later prune.
+func (r *Repository) RemoveSnapshot(ctx context.Context, id string) (tombstoned bool, err error) {
+	h := Handle{Type: SnapshotFile, Name: id}
+	if _, err := r.storage.Stat(ctx, h); err != nil {
+		return false, fmt.Errorf("failed to find snapshot %s: %w", id, err)
+	}
+
+	if !r.AppendOnly() {
+		if err := r.storage.Remove(ctx, h); err != nil {
+			return false, fmt.Errorf("failed to remove snapshot %s: %w", id, err)
+		}
+		if err := r.storage.Remove(ctx, Handle{Type: TombstoneFile, Name: id}); err != nil && !isNotExist(err) {
+			return false, fmt.Errorf("failed to remove tombstone of snapshot %s: %w", id, err)
+		}
+		return false, nil
+	}
+
+	th := Handle{Type: TombstoneFile, Name: id}
+	if _, err := r.storage.Stat(ctx, th); err == nil {
+		return true, nil
+	}
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(Tombstone{Snapshot: id, Requested: time.Now(), Hostname: hostname})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal tombstone: %w", err)
+	}
+	if r.key != nil {
+		if data, err = r.key.sealBlob(data, []byte(id)); err != nil {
+			return false, fmt.Errorf("failed to encrypt tombstone: %w", err)
+		}
+	}
+	if err := r.storage.Save(ctx, th, bytes.NewReader(data)); err != nil {
+		return false, fmt.Errorf("failed to write tombstone of snapshot %s: %w", id, err)
+	}
+	return true, nil
+}
+
+// ListTombstones returns the snapshot removals waiting to be applied.
+func (r *Repository) ListTombstones(ctx context.Context) ([]Tombstone, error) {
+	names, err := r.listFiles(ctx, TombstoneFile)
+	if err != nil {
+		return nil, err
+	}
+	tombstones := make([]Tombstone, 0, len(names))
+	for _, name := range names {
+		data, err := loadAll(ctx, r.storage, Handle{Type: TombstoneFile, Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tombstone %s: %w", name, err)
+		}
+		if isEncryptedBlob(data) {
+			if r.key == nil {
+				return nil, ErrPassphraseRequired
+			}
+			if data, err = r.key.openBlob(data, []byte(name)); err != nil {
+				return nil, fmt.Errorf("tombstone %s: %w", name, err)
+			}
+		}
+		var tombstone Tombstone
+		if err := json.Unmarshal(data, &tombstone); err != nil {
+			return nil, fmt.Errorf("failed to parse tombstone %s: %w", name, err)
+		}
+		tombstone.Snapshot = name
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, nil
+}
+
+// ApplyTombstones removes the snapshots that have tombstones, and the tombstones. In
+// append-only mode maintenance must have been authorised first.
+func (r *Repository) ApplyTombstones(ctx context.Context) (int, error) {
+	if r.AppendOnly() {
+		return 0, fmt.Errorf("applying tombstones needs the maintenance key: %w", ErrAppendOnly)
+	}
+	tombstones, err := r.ListTombstones(ctx)
+	if err != nil {
+		return 0, err
+	}
+	lock, err := r.acquireWriteLock(ctx, true, "apply-tombstones")
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	for i, tombstone := range tombstones {
+		if err := r.storage.Remove(ctx, Handle{Type: SnapshotFile, Name: tombstone.Snapshot}); err != nil && !isNotExist(err) {
+			return i, fmt.Errorf("failed to remove snapshot %s: %w", tombstone.Snapshot, err)
+		}
+		if err := r.storage.Remove(ctx, Handle{Type: TombstoneFile, Name: tombstone.Snapshot}); err != nil && !isNotExist(err) {
+			return i, fmt.Errorf("failed to remove tombstone of snapshot %s: %w", tombstone.Snapshot, err)
+		}
+	}
+	return len(tombstones), nil
+}
@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAppendOnly checks that an append-only repository refuses deletes and overwrites,
+// records snapshot removals as tombstones and only applies them with the maintenance key
+func TestAppendOnly(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	id := repo.objectID(data)
+	if _, err := repo.storeObject(ctx, id, data); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+	for _, snapshotID := range []string{"20250101000000", "20250102000000"} {
+		if err := repo.SaveSnapshot(&Snapshot{ID: snapshotID, Timestamp: time.Now(), Files: map[string]*FileEntry{}}); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+	key, err := repo.EnableAppendOnly()
+	if err != nil {
+		t.Fatalf("Failed to enable append-only mode: %v", err)
+	}
+	repo.Close()
+
+	// A reopened repository stays append-only
+	repo, err = OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	if !repo.AppendOnly() {
+		t.Fatalf("Expected the reopened repository to be append-only")
+	}
+	object := Handle{Type: ObjectFile, Name: id}
+	if err := repo.storage.Remove(ctx, object); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected removing an object to be refused, got %v", err)
+	}
+	if err := repo.storage.Save(ctx, object, strings.NewReader("garbage")); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected overwriting an object to be refused, got %v", err)
+	}
+	if err := repo.SaveSnapshot(&Snapshot{ID: "20250101000000", Timestamp: time.Now()}); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected overwriting a snapshot to be refused, got %v", err)
+	}
+	if err := repo.SetCompressionLevel(1); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected changing the config to be refused, got %v", err)
+	}
+	if _, err := repo.Prune(ctx, PruneOptions{}); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected prune to be refused, got %v", err)
+	}
+
+	// New data can still be added, and an object the object index doesn't know about is kept
+	repo.looseObjects = nil
+	if written, err := repo.storeObject(ctx, id, data); err != nil || written != 0 {
+		t.Errorf("Expected the existing object to be kept, got %d bytes written (err=%v)", written, err)
+	}
+	if err := repo.SaveSnapshot(&Snapshot{ID: "20250103000000", Timestamp: time.Now()}); err != nil {
+		t.Errorf("Failed to save a new snapshot: %v", err)
+	}
+
+	// Index files can only be added, and an object index listing a missing object is ignored
+	for _, fileType := range []FileType{IndexFile, ObjectIndexFile, MarkFile} {
+		if err := repo.storage.Remove(ctx, Handle{Type: fileType, Name: "any"}); !errors.Is(err, ErrAppendOnly) {
+			t.Errorf("Expected removing a file of %s to be refused, got %v", fileType, err)
+		}
+	}
+	forged := strings.Repeat("ab", 32)
+	if err := repo.writeObjectIndexFile(ctx, []string{forged}); err != nil {
+		t.Fatalf("Failed to write object index file: %v", err)
+	}
+	hasForged := func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		repo.looseObjects = nil
+		exists, err := repo.hasObject(ctx, forged)
+		if err != nil {
+			t.Fatalf("Failed to check object: %v", err)
+		}
+		return exists
+	}
+	if hasForged() {
+		t.Errorf("Expected the forged object index entry not to be trusted")
+	}
+
+	// Removing a snapshot only records a tombstone
+	tombstoned, err := repo.RemoveSnapshot(ctx, "20250101000000")
+	if err != nil || !tombstoned {
+		t.Fatalf("Expected a tombstone, got %v (err=%v)", tombstoned, err)
+	}
+	if _, err := repo.LoadSnapshot("20250101000000"); err != nil {
+		t.Errorf("Expected the tombstoned snapshot to be kept: %v", err)
+	}
+	tombstones, err := repo.ListTombstones(ctx)
+	if err != nil || len(tombstones) != 1 || tombstones[0].Snapshot != "20250101000000" {
+		t.Fatalf("Unexpected tombstones %+v (err=%v)", tombstones, err)
+	}
+	if _, err := repo.ApplyTombstones(ctx); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected applying tombstones without the maintenance key to be refused, got %v", err)
+	}
+	if err := repo.AuthorizeMaintenance("not the key"); !errors.Is(err, ErrInvalidMaintenanceKey) {
+		t.Errorf("Expected a wrong maintenance key to be rejected, got %v", err)
+	}
+
+	// With the maintenance key the tombstones are applied
+	if err := repo.AuthorizeMaintenance(key); err != nil {
+		t.Fatalf("Failed to authorise maintenance: %v", err)
+	}
+	if applied, err := repo.ApplyTombstones(ctx); err != nil || applied != 1 {
+		t.Fatalf("Expected one tombstone to be applied, got %d (err=%v)", applied, err)
+	}
+	ids, err := repo.listFiles(ctx, SnapshotFile)
+	if err != nil || len(ids) != 2 {
+		t.Errorf("Expected two snapshots to be left, got %v (err=%v)", ids, err)
+	}
+	if tombstones, _ := repo.ListTombstones(ctx); len(tombstones) != 0 {
+		t.Errorf("Expected the tombstone to be removed, got %+v", tombstones)
+	}
+
+	if err := repo.DisableAppendOnly(); err != nil {
+		t.Fatalf("Failed to leave append-only mode: %v", err)
+	}
+	repo.Close()
+	repo, err = OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	if repo.AppendOnly() {
+		t.Errorf("Expected append-only mode to be off")
+	}
+	if hasForged() {
+		t.Errorf("Expected the object index to be rebuilt when leaving append-only mode")
+	}
+	if tombstoned, err := repo.RemoveSnapshot(ctx, "20250102000000"); err != nil || tombstoned {
+		t.Errorf("Expected the snapshot to be removed directly, got %v (err=%v)", tombstoned, err)
+	}
+}
+
+// TestAppendOnlySettings checks that the settings of an append-only repository are refused
+// before anything is changed, and can be changed with the maintenance key
+func TestAppendOnlySettings(t *testing.T) {
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	key, err := repo.EnableAppendOnly()
+	if err != nil {
+		t.Fatalf("Failed to enable append-only mode: %v", err)
+	}
+	before := repo.Config()
+	for name, set := range map[string]func() error{
+		"compression level": func() error { return repo.SetCompressionLevel(1) },
+		"parity":            func() error { return repo.SetParity(ParityConfig{DataShards: 10, ParityShards: 2}) },
+		"quota":             func() error { return repo.SetQuota(QuotaConfig{MaxBytes: 1 << 30}) },
+		"maximum file size": func() error { return repo.SetMaxFileSize(1 << 30) },
+		"encryption":        func() error { return repo.InitEncryption("secret") },
+	} {
+		if err := set(); !errors.Is(err, ErrAppendOnly) || !strings.Contains(err.Error(), "maintenance key") {
+			t.Errorf("Expected changing the %s to need the maintenance key, got %v", name, err)
+		}
+	}
+	after := repo.Config()
+	if after.CompressionLevel != before.CompressionLevel || after.Parity != before.Parity ||
+		after.Quota != before.Quota || after.MaxFileSize != before.MaxFileSize || after.Encrypted {
+		t.Errorf("Expected the settings to be left as they were, got %+v", after)
+	}
+
+	if err := repo.AuthorizeMaintenance(key); err != nil {
+		t.Fatalf("Failed to authorise maintenance: %v", err)
+	}
+	if err := repo.SetCompressionLevel(1); err != nil || repo.Config().CompressionLevel != 1 {
+		t.Errorf("Expected the compression level to be changed with the maintenance key, got %d (err=%v)", repo.Config().CompressionLevel, err)
+	}
+	if err := repo.SetMaxFileSize(1 << 30); err != nil {
+		t.Errorf("Expected the maximum file size to be changed with the maintenance key, got %v", err)
+	}
+	if _, ok := repo.storage.(*appendOnlyStorage); !ok || !repo.Config().AppendOnly {
+		t.Errorf("Expected the repository to stay append-only")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -19,8 +20,11 @@ type BackupProgress struct {
 	CurrentFile      string `json:"currentFile"`
 	BytesTransferred int64  `json:"bytesTransferred"`
 	TotalBytes       int64  `json:"totalBytes"`
-	Status           string `json:"status"` // e.g., "Scanning", "Hashing", "Storing", "Completed", "Failed"
+	LogicalBytes     int64  `json:"logicalBytes"`    // Uncompressed size of newly stored objects
+	CompressedBytes  int64  `json:"compressedBytes"` // Size of newly stored objects on disk
+	Status           string `json:"status"`          // e.g., "Scanning", "Hashing", "Storing", "Completed", "Failed"
 	Error            string `json:"error"`
+	Warning          string `json:"warning,omitempty"` // e.g. the repository is close to its quota
 }
 
 // ProgressCallback is a function type for reporting backup progress.
@@ -141,6 +145,71 @@ func RunBackup(ctx context.Context, casBaseDir string, sourcePaths []string, ign
 
 // RunBackupWithBatchConfig orchestrates the entire backup process with custom batch configuration.
 func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePaths []string, ignorePatterns []string, tracker FileTracker, progressCallback ProgressCallback, config BatchConfig) error {
+	return RunBackupWithOptions(ctx, casBaseDir, sourcePaths, ignorePatterns, tracker, progressCallback, BackupOptions{Batch: config})
+}
+
+// BackupOptions holds optional settings for a backup run.
+type BackupOptions struct {
+	Passphrase string        // Unlocks an encrypted repository, or enables encryption for a new one
+	Batch      BatchConfig   // Snapshot batching and memory settings
+	Storage    StorageConfig // Remote storage for the repository; casBaseDir is used if none is set
+	OnMigrate  MigrationFunc // Told when the backup saves a repository opened in an older format
+	// HashAlgorithm is used if the backup creates the repository; HashSHA256 if empty.
+	// Existing repositories keep the algorithm they were created with.
+	HashAlgorithm string
+
+	// Recorded in the snapshot, to tell where it came from
+	ConfigID    string   // ID of the backup configuration being run
+	ConfigName  string   // Name of the backup configuration
+	Tags        []string // Free-form labels used to select snapshots
+	Description string   // Free-form note about the snapshot
+}
+
+// RunBackupWithOptions orchestrates the entire backup process with the given options.
+func RunBackupWithOptions(ctx context.Context, casBaseDir string, sourcePaths []string, ignorePatterns []string, tracker FileTracker, progressCallback ProgressCallback, options BackupOptions) error {
+	config := DefaultRepoConfig()
+	if options.HashAlgorithm != "" {
+		config.HashAlgorithm = options.HashAlgorithm
+	}
+	repo, err := openOrInitRepository(casBaseDir, options.Storage, config, options.Passphrase)
+	if err != nil {
+		if progressCallback != nil {
+			progressCallback(BackupProgress{
+				Status: "Failed",
+				Error:  fmt.Sprintf("Failed to open repository: %v", err),
+			})
+		}
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer repo.Close()
+	if options.OnMigrate != nil {
+		repo.OnMigrate(options.OnMigrate)
+	}
+
+	// Clean up after earlier runs that were killed while writing
+	if sweeper, ok := repo.baseStorage().(tempFileSweeper); ok {
+		if removed, err := sweeper.SweepTempFiles(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to remove orphaned temporary files: %v\n", err)
+		} else if removed > 0 && progressCallback != nil {
+			progressCallback(BackupProgress{
+				Status: fmt.Sprintf("Removed %d incomplete files left by an interrupted backup", removed),
+			})
+		}
+	}
+
+	return RunRepositoryBackupWithOptions(ctx, repo, sourcePaths, ignorePatterns, tracker, progressCallback, options)
+}
+
+// RunRepositoryBackup backs up the source paths into an open repository, whatever storage it is kept in.
+func RunRepositoryBackup(ctx context.Context, repo *Repository, sourcePaths []string, ignorePatterns []string, tracker FileTracker, progressCallback ProgressCallback, config BatchConfig) error {
+	return RunRepositoryBackupWithOptions(ctx, repo, sourcePaths, ignorePatterns, tracker, progressCallback, BackupOptions{Batch: config})
+}
+
+// RunRepositoryBackupWithOptions backs up the source paths into an open repository with the
+// given options. The repository settings in the options only apply when opening it.
+func RunRepositoryBackupWithOptions(ctx context.Context, repo *Repository, sourcePaths []string, ignorePatterns []string, tracker FileTracker, progressCallback ProgressCallback, options BackupOptions) error {
+	config := options.Batch
+	summary := SnapshotSummary{StartTime: time.Now()}
 	var currentProgress BackupProgress
 	updateProgress := func() {
 		if progressCallback != nil {
@@ -168,24 +237,95 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 	default:
 	}
 
+	lock, err := repo.acquireWriteLock(ctx, false, "backup")
+	if err != nil {
+		currentProgress.Status = "Failed"
+		currentProgress.Error = err.Error()
+		updateProgress()
+		return err
+	}
+	defer lock.Release()
+
+	// Objects stored before a cancellation or failure are kept for the next run
+	defer repo.Flush()
+
+	// Existence checks for every chunk are answered from memory from here on
+	currentProgress.Status = "Loading object index..."
+	updateProgress()
+	if err := repo.loadIndexes(ctx); err != nil {
+		currentProgress.Status = "Failed"
+		currentProgress.Error = fmt.Sprintf("Failed to load object index: %v", err)
+		updateProgress()
+		return fmt.Errorf("failed to load object index: %w", err)
+	}
+
+	// Never back up the repository into itself
+	var casBaseDir string
+	if local, ok := repo.baseStorage().(*LocalStorage); ok {
+		casBaseDir = local.Dir()
+	}
+
 	// 1. Load the latest snapshot
 	currentProgress.Status = "Loading previous snapshot..."
 	updateProgress()
 
-	fmt.Fprintf(os.Stderr, "DEBUG: About to load latest snapshot from %s\n", casBaseDir)
-	latestSnapshot, err := LoadLatestSnapshot(casBaseDir)
-	fmt.Fprintf(os.Stderr, "DEBUG: LoadLatestSnapshot returned: err=%v, snapshot=%p\n", err, latestSnapshot)
+	latestSnapshot, err := repo.findParent(ctx, sourcePaths)
 	if err != nil {
 		// If snapshot loading fails, log warning but continue with no previous snapshot
 		fmt.Fprintf(os.Stderr, "Warning: Failed to load latest snapshot, starting fresh backup: %v\n", err)
 		latestSnapshot = nil
 		currentProgress.Status = "Warning: Could not load previous snapshot, starting fresh"
 		updateProgress()
+	} else if latestSnapshot != nil && latestSnapshot.FileHashAlgorithm() != repo.config.HashAlgorithm {
+		// A snapshot copied from a repository with another hash can't lend its file hashes
+		warning := fmt.Sprintf("The previous snapshot uses %s file hashes, not %s, so all files are read again",
+			latestSnapshot.FileHashAlgorithm(), repo.config.HashAlgorithm)
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		summary.Warnings = append(summary.Warnings, warning)
+		latestSnapshot = nil
+		currentProgress.Warning = warning
+		updateProgress()
+	}
+	// Unchanged files take their entries from the previous snapshot, read one directory at a time
+	previous := repo.newSnapshotLookup(latestSnapshot)
+
+	// 2. Make sure the destination has room for the backup before anything is stored. That
+	// takes a scan of the sources ahead of the backup's own walk; see needsEstimate
+	if repo.needsEstimate(ctx) {
+		currentProgress.Status = "Estimating space needed..."
+		updateProgress()
+		estimate, err := repo.estimateBackup(ctx, sourcePaths, ignorePatterns, repo.newSnapshotLookup(latestSnapshot), tracker, casBaseDir)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				currentProgress.Status = "Cancelled"
+				currentProgress.Error = "Backup cancelled by user during space estimation"
+				updateProgress()
+				return ctx.Err()
+			}
+			currentProgress.Status = "Failed"
+			currentProgress.Error = fmt.Sprintf("Failed to estimate space needed: %v", err)
+			updateProgress()
+			return fmt.Errorf("failed to estimate space needed: %w", err)
+		}
+		currentProgress.TotalBytes = estimate.ChangedBytes
+		if err := repo.checkFreeSpace(ctx, estimate); err != nil {
+			currentProgress.Status = "Failed"
+			currentProgress.Error = err.Error()
+			updateProgress()
+			return err
+		}
+		if warning, err := repo.quotaWarning(ctx, estimate.ChangedBytes); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to check repository quota: %v\n", err)
+		} else if warning != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+			currentProgress.Warning = warning
+			updateProgress()
+		}
 	}
 
 	fmt.Fprintf(os.Stderr, "DEBUG: Creating streaming snapshot writer\n")
-	snapshotID := fmt.Sprintf("%d", time.Now().Unix())
-	snapshotWriter, err := NewStreamingSnapshotWriter(casBaseDir, snapshotID, sourcePaths)
+	snapshotID := NewSnapshotID(summary.StartTime)
+	snapshotWriter, err := repo.NewStreamingSnapshotWriter(snapshotID, sourcePaths)
 	if err != nil {
 		currentProgress.Status = "Failed"
 		currentProgress.Error = fmt.Sprintf("Failed to create snapshot writer: %v", err)
@@ -193,6 +333,16 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 		return fmt.Errorf("failed to create snapshot writer: %w", err)
 	}
 	defer snapshotWriter.Close()
+	header := snapshotWriter.Header()
+	header.Hostname, _ = os.Hostname()
+	header.Username = currentUsername()
+	header.ConfigID = options.ConfigID
+	header.ConfigName = options.ConfigName
+	header.Tags = options.Tags
+	header.Description = options.Description
+	if latestSnapshot != nil {
+		header.Parent = latestSnapshot.ID
+	}
 	fmt.Fprintf(os.Stderr, "DEBUG: Streaming snapshot writer created, about to start file processing\n")
 
 	fileCount := 0
@@ -264,6 +414,7 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 
 			if err != nil {
 				// Log error but attempt to continue for other files if possible
+				summary.Errors++
 				currentProgress.Status = "Scanning (with errors)"
 				currentProgress.Error = fmt.Sprintf("Error accessing %s: %v", path, err)
 				updateProgress()
@@ -295,15 +446,40 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 			// Exclude the backup destination directory itself
 			// This check assumes casBaseDir is an absolute path.
 			// It's crucial that casBaseDir is passed as an absolute path from the frontend.
-			if strings.HasPrefix(path, casBaseDir) {
+			if casBaseDir != "" && strings.HasPrefix(path, casBaseDir) {
 				if d.IsDir() {
 					return filepath.SkipDir
 				}
 				return nil
 			}
 
-			if d.IsDir() {
-				return nil // Skip directories after ignore checks
+			if path == absSourcePath && d.IsDir() {
+				// The source directory is the root of its tree; only its metadata is kept
+				rootInfo, err := d.Info()
+				if err != nil {
+					summary.Errors++
+					currentProgress.Status = "Scanning (with errors)"
+					currentProgress.Error = fmt.Sprintf("Error reading %s: %v", path, err)
+					updateProgress()
+					return nil
+				}
+				rootEntry := &FileEntry{Type: NodeDir, Mode: rootInfo.Mode(), ModTime: rootInfo.ModTime()}
+				if err := snapshotWriter.SetSourceDir(rootEntry); err != nil {
+					return fmt.Errorf("failed to record source directory %s: %w", path, err)
+				}
+				return nil
+			}
+			nodeType := NodeFile
+			switch {
+			case d.IsDir():
+				nodeType = NodeDir
+			case d.Type()&fs.ModeSymlink != 0:
+				nodeType = NodeSymlink // Stored as a link, never followed
+			case !d.Type().IsRegular():
+				// Named pipes, sockets and devices have no content to back up
+				fmt.Fprintf(os.Stderr, "Warning: Skipping %s, which is not a regular file (%s)\n", path, d.Type())
+				summary.Skipped++
+				return nil
 			}
 
 			// Get relative path from the source root
@@ -325,6 +501,27 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 				return fmt.Errorf("failed to get file info for %s: %w", path, err)
 			}
 
+			// Directories and symlinks only keep their metadata and link target
+			if nodeType != NodeFile {
+				entry := &FileEntry{Path: relPath, Type: nodeType, Mode: fileInfo.Mode(), ModTime: fileInfo.ModTime()}
+				if nodeType == NodeSymlink {
+					if entry.LinkTarget, err = os.Readlink(path); err != nil {
+						summary.Errors++
+						currentProgress.Status = "Scanning (with errors)"
+						currentProgress.Error = fmt.Sprintf("Error reading link %s: %v", path, err)
+						updateProgress()
+						return nil
+					}
+				}
+				if err := snapshotWriter.AddFile(entry); err != nil {
+					currentProgress.Status = "✗ Failed"
+					currentProgress.Error = fmt.Sprintf("Failed to add %s to snapshot: %v", relPath, err)
+					updateProgress()
+					return fmt.Errorf("failed to add %s to snapshot: %w", relPath, err)
+				}
+				return nil
+			}
+
 			fileCount++
 			currentProgress.TotalFiles = fileCount // Update total files found so far
 			currentProgress.FilesProcessed++
@@ -341,31 +538,40 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 			}
 
 			// Compare with latest snapshot - rsync-like optimization
-			var fileHash string
 			var fileChanged bool
 
+			prevEntry, err := previous.lookup(ctx, sourcePath, relPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to look up %s in the previous snapshot: %v\n", relPath, err)
+			}
 			if latestSnapshot != nil {
-				if prevEntry, ok := latestSnapshot.Files[relPath]; ok {
+				if prevEntry != nil {
 					// Quick check: size and mtime match means file is unchanged
 					if prevEntry.Size == currentFileEntry.Size &&
 						prevEntry.ModTime.Equal(currentFileEntry.ModTime) {
-						fileHash = prevEntry.Hash
+						currentFileEntry.Hash = prevEntry.Hash
+						currentFileEntry.Chunks = prevEntry.Chunks
+						summary.FilesUnchanged++
 					} else {
 						fileChanged = true
+						summary.FilesChanged++
 					}
 				} else {
 					fileChanged = true // New file
+					summary.FilesNew++
 				}
 			} else {
 				fileChanged = true // First backup
+				summary.FilesNew++
 			}
+			summary.TotalBytes += currentFileEntry.Size
 
 			if fileChanged {
 				currentProgress.Status = "↻ " + filepath.Base(path) // Changed file indicator
 				updateProgress()
 
 
-				hash, err := StoreFileContentWithContext(ctx, casBaseDir, path)
+				stored, err := repo.StoreFile(ctx, path)
 				if err != nil {
 					if errors.Is(err, context.Canceled) {
 						currentProgress.Status = "Cancelled"
@@ -378,14 +584,16 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 					updateProgress()
 					return fmt.Errorf("failed to store content for %s: %w", path, err)
 				}
-				fileHash = hash
+				currentFileEntry.Hash = stored.Hash
+				currentFileEntry.Chunks = stored.Chunks
+				currentProgress.LogicalBytes += stored.NewBytes
+				currentProgress.CompressedBytes += stored.StoredBytes
 
 			} else {
 				currentProgress.Status = "= " + filepath.Base(path) // Unchanged file indicator
 				currentProgress.FilesProcessed-- // Don't count as processed for progress
 				updateProgress()
 			}
-			currentFileEntry.Hash = fileHash
 
 			// Add to streaming snapshot writer with batch processing
 			if err := snapshotWriter.AddFile(currentFileEntry); err != nil {
@@ -412,7 +620,7 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 				}
 
 				fmt.Fprintf(os.Stderr, "DEBUG: Flushing batch (count: %d, time: %v)\n", batchCount, timeSinceFlush)
-				if err := snapshotWriter.writer.Flush(); err != nil {
+				if err := snapshotWriter.Flush(); err != nil {
 					currentProgress.Status = "✗ Failed"
 					currentProgress.Error = fmt.Sprintf("Failed to flush snapshot writer: %v", err)
 					updateProgress()
@@ -444,18 +652,24 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 
 			return nil
 		})
-			if err != nil {
-				if errors.Is(err, context.Canceled) { // Check if the error was due to context cancellation
-					currentProgress.Status = "Cancelled"
-					currentProgress.Error = "Backup cancelled by user"
-					updateProgress()
-					return err // Propagate cancellation error
-				}
-				currentProgress.Status = "Failed"
+		if err != nil {
+			if errors.Is(err, context.Canceled) { // Check if the error was due to context cancellation
+				currentProgress.Status = "Cancelled"
+				currentProgress.Error = "Backup cancelled by user"
+				updateProgress()
+				return err // Propagate cancellation error
+			}
+			currentProgress.Status = "Failed"
 			currentProgress.Error = fmt.Sprintf("Error walking source path %s: %v", sourcePath, err)
 			updateProgress()
 			return fmt.Errorf("error walking source path %s: %w", sourcePath, err)
 		}
+		if err := snapshotWriter.EndSource(); err != nil {
+			currentProgress.Status = "Failed"
+			currentProgress.Error = fmt.Sprintf("Failed to write snapshot tree of %s: %v", sourcePath, err)
+			updateProgress()
+			return fmt.Errorf("failed to write snapshot tree of %s: %w", sourcePath, err)
+		}
 	}
 
 	// Check for context cancellation before final operations
@@ -483,7 +697,7 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 			// Continue
 		}
 
-		if err := snapshotWriter.writer.Flush(); err != nil {
+		if err := snapshotWriter.Flush(); err != nil {
 			currentProgress.Status = "Failed"
 			currentProgress.Error = fmt.Sprintf("Failed to flush final batch: %v", err)
 			updateProgress()
@@ -505,7 +719,18 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 		// Continue
 	}
 
+	// Write out the open pack file before the snapshot that references its objects
+	if err := repo.Flush(); err != nil {
+		currentProgress.Status = "Failed"
+		currentProgress.Error = fmt.Sprintf("Failed to write pack files: %v", err)
+		updateProgress()
+		return fmt.Errorf("failed to write pack files: %w", err)
+	}
+
 	// Close the streaming snapshot writer (this finalizes the snapshot)
+	summary.BytesAdded = currentProgress.LogicalBytes
+	summary.EndTime = time.Now()
+	header.Summary = &summary
 	if err := snapshotWriter.Close(); err != nil {
 		currentProgress.Status = "Failed"
 		currentProgress.Error = fmt.Sprintf("Failed to close snapshot writer: %v", err)
@@ -513,8 +738,23 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 		return fmt.Errorf("failed to close snapshot writer: %w", err)
 	}
 
+	// Keep the repository within its quota; removing snapshots needs the backup lock released
+	if repo.config.Quota.MaxBytes > 0 {
+		lock.Release()
+		currentProgress.Status = "Checking repository quota..."
+		updateProgress()
+		warning, err := repo.enforceQuota(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to enforce repository quota: %v\n", err)
+			warning = fmt.Sprintf("Failed to enforce repository quota: %v", err)
+		}
+		if warning != "" {
+			currentProgress.Warning = warning
+		}
+	}
+
 	// Load the final snapshot to get statistics (optional, for logging only)
-	_, err = LoadLatestSnapshot(casBaseDir)
+	_, err = repo.LoadLatestSnapshot()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Warning: Failed to load final snapshot for stats: %v\n", err)
 	}
@@ -522,8 +762,9 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 	totalFiles := fileCount
 	changedFiles := currentProgress.FilesProcessed // Approximate since we're streaming
 
-	currentProgress.Status = fmt.Sprintf("✓ Completed: %d files, %d processed, %.2f MB transferred",
-		totalFiles, changedFiles, float64(currentProgress.BytesTransferred)/1024/1024)
+	currentProgress.Status = fmt.Sprintf("✓ Completed: %d files, %d processed, %.2f MB transferred, %.2f MB new data stored as %.2f MB",
+		totalFiles, changedFiles, float64(currentProgress.BytesTransferred)/1024/1024,
+		float64(currentProgress.LogicalBytes)/1024/1024, float64(currentProgress.CompressedBytes)/1024/1024)
 	updateProgress()
 
 	// Final memory cleanup
@@ -531,3 +772,14 @@ func RunBackupWithBatchConfig(ctx context.Context, casBaseDir string, sourcePath
 	fmt.Fprintf(os.Stderr, "DEBUG: Backup completed successfully\n")
 	return nil
 }
+
+// currentUsername returns the name of the user running the backup, or "" if it is unknown.
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
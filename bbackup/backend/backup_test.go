@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSnapshotMetadata checks that a backup records where it came from, its parent and a
+// summary of what it did, and that the snapshot listing returns them
+func TestSnapshotMetadata(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	sourceDir := t.TempDir()
+	modTime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, content := range map[string]string{"same": "same", "changed": "changed", "new": "new"} {
+		path := filepath.Join(sourceDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+
+	// The previous snapshot has "same" as it is now and an older "changed"
+	stored, err := repo.StoreFile(ctx, filepath.Join(sourceDir, "same"))
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	writer, err := repo.NewStreamingSnapshotWriter("20250101000000", []string{sourceDir})
+	if err != nil {
+		t.Fatalf("Failed to create snapshot writer: %v", err)
+	}
+	for _, entry := range []*FileEntry{
+		{Path: "changed", Hash: stored.Hash, Chunks: stored.Chunks, Size: 3, Mode: 0644, ModTime: modTime},
+		{Path: "same", Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size, Mode: 0644, ModTime: modTime},
+	} {
+		if err := writer.AddFile(entry); err != nil {
+			t.Fatalf("Failed to add %s: %v", entry.Path, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close snapshot writer: %v", err)
+	}
+
+	start := time.Now()
+	options := BackupOptions{
+		Batch:       DefaultBatchConfig(),
+		ConfigID:    "backup_1",
+		ConfigName:  "Documents",
+		Tags:        []string{"daily"},
+		Description: "before the upgrade",
+	}
+	if err := RunRepositoryBackupWithOptions(ctx, repo, []string{sourceDir}, nil, nil, nil, options); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	snapshots, err := repo.ListSnapshots(ctx)
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("Expected two snapshots, got %d (err=%v)", len(snapshots), err)
+	}
+	if snapshots[0].ID != "20250101000000" || snapshots[0].Summary != nil {
+		t.Errorf("Expected the written snapshot first, without a summary, got %+v", snapshots[0])
+	}
+	s := snapshots[1]
+	hostname, _ := os.Hostname()
+	if s.Hostname != hostname || s.Username == "" || s.ConfigID != "backup_1" || s.ConfigName != "Documents" ||
+		len(s.Tags) != 1 || s.Tags[0] != "daily" || s.Description != "before the upgrade" || s.Parent != "20250101000000" {
+		t.Errorf("Unexpected snapshot metadata %+v", s)
+	}
+	if s.Summary == nil {
+		t.Fatalf("Expected a summary")
+	}
+	summary := *s.Summary
+	if summary.FilesNew != 1 || summary.FilesChanged != 1 || summary.FilesUnchanged != 1 || summary.Errors != 0 {
+		t.Errorf("Unexpected file counts %+v", summary)
+	}
+	if summary.TotalBytes != int64(len("same")+len("changed")+len("new")) || summary.BytesAdded != int64(len("changed")+len("new")) {
+		t.Errorf("Unexpected byte counts %+v", summary)
+	}
+	if summary.StartTime.Before(start) || summary.EndTime.Before(summary.StartTime) || summary.EndTime.After(time.Now()) {
+		t.Errorf("Unexpected run times %+v", summary)
+	}
+	if s.Files != nil {
+		t.Errorf("Expected the listing not to read the files")
+	}
+}
@@ -1,13 +1,15 @@
 package backend
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // getObjectPath returns the full path for an object given its hash.
@@ -21,97 +23,204 @@ func getObjectPath(casBaseDir, hash string) string {
 	return filepath.Join(casBaseDir, "objects", hash[0:2], hash[2:4], hash)
 }
 
-// CalculateFileHash reads a file from the given path and returns its SHA-256 hash.
-func CalculateFileHash(filePath string) (string, error) {
-	return CalculateFileHashWithContext(context.Background(), filePath)
-}
-
-// CalculateFileHashWithContext reads a file from the given path and returns its SHA-256 hash, with context cancellation support.
-func CalculateFileHashWithContext(ctx context.Context, filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	
-	// Use a context-aware copier that checks for cancellation
-	if _, err := copyWithContext(ctx, hash, file); err != nil {
-		return "", fmt.Errorf("failed to calculate hash for file %s: %w", filePath, err)
-	}
-
-	return hex.EncodeToString(hash.Sum(nil)), nil
+// StoredFile describes the content of a file after it has been stored in the CAS.
+type StoredFile struct {
+	Hash        string   // Hash of the whole file content, with the repository's algorithm
+	Chunks      []string // Ordered hashes of the chunk objects that make up the file
+	Size        int64    // Number of bytes read from the file
+	NewBytes    int64    // Plaintext bytes of chunks that were not in the store yet
+	StoredBytes int64    // Bytes written to the object store for those chunks, after compression
 }
 
 // StoreFileContent stores the content of a file from the given filePath into the CAS system.
-// It calculates the hash of the file and stores it if it doesn't already exist.
-// Returns the hash of the stored content and an error if any.
+// The file is split into content-defined chunks and every chunk that doesn't already exist is stored.
+// Returns the whole-file hash and the ordered chunk list, and an error if any.
 // casBaseDir is the root directory where the CAS structure (e.g., "objects") will be created.
-func StoreFileContent(casBaseDir string, filePath string) (string, error) {
+func StoreFileContent(casBaseDir string, filePath string) (*StoredFile, error) {
 	return StoreFileContentWithContext(context.Background(), casBaseDir, filePath)
 }
 
 // StoreFileContentWithContext stores the content of a file from the given filePath into the CAS system with context cancellation support.
-func StoreFileContentWithContext(ctx context.Context, casBaseDir string, filePath string) (string, error) {
+// It opens the repository and takes a lock for the one file; to store many files, open the
+// repository once and use Repository.StoreFile under a single lock.
+func StoreFileContentWithContext(ctx context.Context, casBaseDir string, filePath string) (*StoredFile, error) {
+	repo, err := openRepositoryForWrite(casBaseDir, StorageConfig{}, "")
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	lock, err := repo.acquireWriteLock(ctx, false, "store")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	stored, err := repo.StoreFile(ctx, filePath)
+	if err != nil {
+		repo.Flush()
+		return nil, err
+	}
+	if err := repo.Flush(); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// StoreFile splits the file at filePath into chunks using the repository's chunker
+// settings and stores every chunk that doesn't already exist.
+func (r *Repository) StoreFile(ctx context.Context, filePath string) (*StoredFile, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
+		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
 	defer file.Close()
 
-	hash := sha256.New()
-	if _, err := copyWithContext(ctx, hash, file); err != nil {
-		return "", fmt.Errorf("failed to calculate hash for file %s: %w", filePath, err)
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
 	}
-	fileHash := hex.EncodeToString(hash.Sum(nil))
+	return r.storeContent(ctx, file, info.Size(), filePath)
+}
 
-	// Check for context cancellation before creating directories
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	default:
+// storeContent chunks and stores the size bytes of file content read from rd.
+// filePath is only used in error messages.
+func (r *Repository) storeContent(ctx context.Context, rd io.Reader, size int64, filePath string) (*StoredFile, error) {
+	chunkerConfig := r.config.Chunker
+	fileHasher, err := r.newHasher()
+	if err != nil {
+		return nil, err
 	}
+	stored := &StoredFile{}
+	storeChunk := func(data []byte) error {
+		fileHasher.Write(data)
+		stored.Size += int64(len(data))
 
-	objectPath := getObjectPath(casBaseDir, fileHash)
-
-	// Create parent directories if they don't exist
-	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
-		return "", fmt.Errorf("failed to create parent directories for object %s: %w", objectPath, err)
+		hash := r.objectID(data)
+		written, err := r.storeObject(ctx, hash, data)
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			stored.NewBytes += int64(len(data))
+			stored.StoredBytes += written
+		}
+		stored.Chunks = append(stored.Chunks, hash)
+		return nil
 	}
 
-	// Check if object already exists
-	if _, err := os.Stat(objectPath); err == nil {
-		// Object already exists, no need to copy
-		return fileHash, nil
-	} else if !os.IsNotExist(err) {
-		return "", fmt.Errorf("failed to check existence of object %s: %w", objectPath, err)
+	// Small files always form a single chunk, so skip the chunker and its large buffer
+	if size <= int64(chunkerConfig.MinSize) {
+		data, err := io.ReadAll(&contextReader{ctx: ctx, r: rd})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+		if len(data) > 0 {
+			if err := storeChunk(data); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		chunker, err := NewChunker(&contextReader{ctx: ctx, r: rd}, chunkerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create chunker: %w", err)
+		}
+		defer chunker.Release()
+
+		for {
+			chunk, err := chunker.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+			}
+			if err := storeChunk(chunk); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// Check for context cancellation before copying
+	stored.Hash = hex.EncodeToString(fileHasher.Sum(nil))
+	return stored, nil
+}
+
+// storeObject writes data to the object store under hash unless the object already exists.
+// Objects smaller than packObjectThreshold after encoding are added to a pack file,
+// larger ones are stored as loose files.
+// It returns the number of bytes written, which is 0 when the object was already present.
+func (r *Repository) storeObject(ctx context.Context, hash string, data []byte) (int64, error) {
+	// Check for context cancellation before creating directories
 	select {
 	case <-ctx.Done():
-		return "", ctx.Err()
+		return 0, ctx.Err()
 	default:
 	}
 
-	// Object does not exist, so copy the file content
-	// Re-open the file or seek to the beginning if it was already read
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return "", fmt.Errorf("failed to seek file %s to start: %w", filePath, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := Handle{Type: ObjectFile, Name: hash}
+
+	// Check if object already exists, either packed or loose. Both indexes are kept in
+	// memory, so this doesn't touch the storage.
+	if packed, err := r.hasPackedObject(ctx, hash); err != nil {
+		return 0, err
+	} else if packed {
+		return 0, nil
+	}
+	if loose, err := r.hasLooseObject(ctx, hash); err != nil {
+		return 0, err
+	} else if loose {
+		// Object already exists, no need to copy
+		return 0, nil
 	}
 
-	destinationFile, err := os.Create(objectPath)
+	encoded, err := encodeObject(data, r.config.CompressionLevel)
 	if err != nil {
-		return "", fmt.Errorf("failed to create object file %s: %w", objectPath, err)
+		return 0, fmt.Errorf("failed to encode object %s: %w", hash, err)
+	}
+	if r.key != nil {
+		encoded, err = r.key.sealBlob(encoded, []byte(hash))
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt object %s: %w", hash, err)
+		}
 	}
-	defer destinationFile.Close()
 
-	if _, err := copyWithContext(ctx, destinationFile, file); err != nil {
-		return "", fmt.Errorf("failed to copy content to object file %s: %w", objectPath, err)
+	if len(encoded) < packObjectThreshold {
+		if err := r.addToPack(ctx, hash, encoded); err != nil {
+			return 0, err
+		}
+		return int64(len(encoded)), nil
+	}
+
+	// The storage guarantees that an interrupted write never leaves an object under its final name
+	if err := r.storage.Save(ctx, h, bytes.NewReader(encoded)); errors.Is(err, ErrAppendOnly) {
+		// The object index missed an object an append-only repository won't let us replace
+		r.addLooseObject(hash)
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	r.addLooseObject(hash)
+	if err := r.saveParity(ctx, h, bytes.NewReader(encoded), int64(len(encoded))); err != nil {
+		return 0, err
 	}
 
-	return fileHash, nil
+	return int64(len(encoded)), nil
+}
+
+// contextReader wraps a reader and fails reads once the context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	select {
+	case <-cr.ctx.Done():
+		return 0, cr.ctx.Err()
+	default:
+	}
+	return cr.r.Read(p)
 }
 
 // copyWithContext copies data from src to dst while checking for context cancellation.
@@ -163,12 +272,128 @@ func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64,
 }
 
 // RetrieveObject reads the content of an object given its hash from the CAS system.
-// It returns an io.ReadCloser for the object's content.
+// It returns an io.ReadCloser for the object's plaintext content, decompressing it if needed.
 func RetrieveObject(casBaseDir, hash string) (io.ReadCloser, error) {
-	objectPath := getObjectPath(casBaseDir, hash)
-	file, err := os.Open(objectPath)
+	repo, err := OpenRepository(casBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	content, err := repo.RetrieveObject(hash)
+	if err != nil {
+		repo.Close()
+		return nil, err
+	}
+	return &repoReader{ReadCloser: content, repo: repo}, nil
+}
+
+// RetrieveObject reads the plaintext content of an object from the repository,
+// decrypting and decompressing it if needed. Loose objects are tried first, then packs.
+func (r *Repository) RetrieveObject(hash string) (io.ReadCloser, error) {
+	content, err := r.openLooseObject(context.Background(), hash)
+	if isNotExist(err) {
+		content, err = r.openPackedObject(hash)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve object %s: %w", hash, err)
 	}
-	return file, nil
+	return content, nil
+}
+
+// openPackedObject returns a reader over the plaintext content of an object stored in a pack.
+func (r *Repository) openPackedObject(hash string) (io.ReadCloser, error) {
+	raw, err := r.readPackedObject(context.Background(), hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeStoredObject(raw, hash, r.key, r.config.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// RetrieveFile returns a reader over the full content of a snapshot file entry.
+func RetrieveFile(casBaseDir string, entry *FileEntry) (io.ReadCloser, error) {
+	repo, err := OpenRepository(casBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	content, err := repo.RetrieveFile(entry)
+	if err != nil {
+		repo.Close()
+		return nil, err
+	}
+	return &repoReader{ReadCloser: content, repo: repo}, nil
+}
+
+// repoReader is a reader over content of a repository that was opened only to read it,
+// and closes the repository along with the reader.
+type repoReader struct {
+	io.ReadCloser
+	repo *Repository
+}
+
+func (rr *repoReader) Close() error {
+	err := rr.ReadCloser.Close()
+	if closeErr := rr.repo.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RetrieveFile returns a reader over the full content of a snapshot file entry.
+// Chunked entries are reassembled from their chunk objects in order; entries written
+// before chunking was introduced are read from the single object named by their hash.
+func (r *Repository) RetrieveFile(entry *FileEntry) (io.ReadCloser, error) {
+	if len(entry.Chunks) == 0 {
+		if entry.Size == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return r.RetrieveObject(entry.Hash)
+	}
+	return &chunkReader{repo: r, chunks: entry.Chunks}, nil
+}
+
+// chunkReader reads a sequence of chunk objects as one continuous stream,
+// opening each object only when the previous one has been consumed.
+type chunkReader struct {
+	repo    *Repository
+	chunks  []string
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := cr.repo.RetrieveObject(cr.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.current = rc
+			cr.chunks = cr.chunks[1:]
+		}
+
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.current != nil {
+		err := cr.current.Close()
+		cr.current = nil
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,401 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// smallChunkerConfig keeps test data small while still producing many chunks
+func smallChunkerConfig() ChunkerConfig {
+	return ChunkerConfig{MinSize: 2 * 1024, AvgSize: 8 * 1024, MaxSize: 64 * 1024}
+}
+
+func chunkHashes(t *testing.T, data []byte, cfg ChunkerConfig) []string {
+	t.Helper()
+	chunker, err := NewChunker(bytes.NewReader(data), cfg)
+	if err != nil {
+		t.Fatalf("Failed to create chunker: %v", err)
+	}
+	defer chunker.Release()
+
+	var hashes []string
+	total := 0
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Chunker failed: %v", err)
+		}
+		if len(chunk) > cfg.MaxSize {
+			t.Fatalf("Chunk of %d bytes exceeds max size %d", len(chunk), cfg.MaxSize)
+		}
+		total += len(chunk)
+		sum := sha256.Sum256(chunk)
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	if total != len(data) {
+		t.Fatalf("Chunks cover %d bytes, expected %d", total, len(data))
+	}
+	return hashes
+}
+
+// TestChunkerInsertionStability checks that a small insertion only changes nearby chunks
+func TestChunkerInsertionStability(t *testing.T) {
+	cfg := smallChunkerConfig()
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	modified := append([]byte{}, data[:300000]...)
+	modified = append(modified, []byte("inserted bytes")...)
+	modified = append(modified, data[300000:]...)
+
+	original := chunkHashes(t, data, cfg)
+	changed := chunkHashes(t, modified, cfg)
+
+	known := make(map[string]bool)
+	for _, h := range original {
+		known[h] = true
+	}
+	shared := 0
+	for _, h := range changed {
+		if known[h] {
+			shared++
+		}
+	}
+
+	t.Logf("%d chunks originally, %d after insertion, %d shared", len(original), len(changed), shared)
+	if shared < len(original)-3 {
+		t.Errorf("Expected all but a few chunks to be shared, got %d of %d", shared, len(original))
+	}
+}
+
+// TestStoreAndRetrieveFile round-trips chunked and legacy whole-file entries
+func TestStoreAndRetrieveFile(t *testing.T) {
+	tempDir := t.TempDir()
+	casDir := filepath.Join(tempDir, "cas")
+
+	data := make([]byte, 300*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	srcPath := filepath.Join(tempDir, "data.bin")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	repo, err := InitRepositoryWithConfig(casDir, StorageConfig{}, "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	repo.config.Chunker = smallChunkerConfig()
+
+	stored, err := repo.StoreFile(context.Background(), srcPath)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	if len(stored.Chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(stored.Chunks))
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush repository: %v", err)
+	}
+
+	entry := &FileEntry{Path: "data.bin", Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size}
+	assertFileContent(t, casDir, entry, data)
+
+	// A legacy entry references a single whole-file object by its hash
+	legacy := []byte("legacy whole-file object")
+	sum := sha256.Sum256(legacy)
+	legacyHash := hex.EncodeToString(sum[:])
+	legacyPath := getObjectPath(casDir, legacyHash)
+	os.MkdirAll(filepath.Dir(legacyPath), 0755)
+	if err := os.WriteFile(legacyPath, legacy, 0644); err != nil {
+		t.Fatalf("Failed to write legacy object: %v", err)
+	}
+	assertFileContent(t, casDir, &FileEntry{Path: "legacy.txt", Hash: legacyHash, Size: int64(len(legacy))}, legacy)
+}
+
+func assertFileContent(t *testing.T, casDir string, entry *FileEntry, expected []byte) {
+	t.Helper()
+	rc, err := RetrieveFile(casDir, entry)
+	if err != nil {
+		t.Fatalf("Failed to retrieve %s: %v", entry.Path, err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", entry.Path, err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Content mismatch for %s: got %d bytes, expected %d", entry.Path, len(got), len(expected))
+	}
+}
+
+// TestObjectCompression checks that compressible chunks shrink, incompressible ones are stored raw,
+// and both decode to the original content
+func TestObjectCompression(t *testing.T) {
+	compressible := bytes.Repeat([]byte("log line: backup completed successfully\n"), 4096)
+	random := make([]byte, 128*1024)
+	rand.New(rand.NewSource(3)).Read(random)
+
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"compressible", compressible, true},
+		{"random", random, false},
+	} {
+		encoded, err := encodeObject(tc.data, DefaultCompressionLevel)
+		if err != nil {
+			t.Fatalf("%s: failed to encode: %v", tc.name, err)
+		}
+		if got := encoded[4] == compressionZstd; got != tc.compressed {
+			t.Errorf("%s: compressed=%v, expected %v", tc.name, got, tc.compressed)
+		}
+
+		decoded, err := decodeObject(encoded, sha256Hex(tc.data), sha256Hex)
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", tc.name, err)
+		}
+		if !bytes.Equal(decoded, tc.data) {
+			t.Errorf("%s: decoded content differs from original", tc.name)
+		}
+		t.Logf("%s: %d bytes stored as %d", tc.name, len(tc.data), len(encoded))
+	}
+}
+
+// TestEncryptedRepository checks that an encrypted repository round-trips files and snapshots,
+// hides content hashes in object names, rejects a wrong passphrase and skips key files with
+// excessive scrypt parameters
+func TestEncryptedRepository(t *testing.T) {
+	tempDir := t.TempDir()
+	casDir := filepath.Join(tempDir, "cas")
+
+	data := bytes.Repeat([]byte("secret content\n"), 1000)
+	srcPath := filepath.Join(tempDir, "secret.txt")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	repo, err := openRepositoryForWrite(casDir, StorageConfig{}, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to create encrypted repository: %v", err)
+	}
+	stored, err := repo.StoreFile(context.Background(), srcPath)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	if len(stored.Chunks) != 1 || stored.Chunks[0] == stored.Hash {
+		t.Fatalf("Expected a single chunk named by a keyed hash, got %v", stored.Chunks)
+	}
+
+	entry := &FileEntry{Path: "secret.txt", Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size}
+	if err := repo.SaveSnapshot(&Snapshot{ID: "20250101120000", Files: map[string]*FileEntry{entry.Path: entry}}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	raw, err := os.ReadFile(snapshotFilePath(casDir, "20250101120000"))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot file: %v", err)
+	}
+	if bytes.Contains(raw, []byte("secret.txt")) {
+		t.Fatalf("Snapshot file contains plaintext paths")
+	}
+
+	if _, err := OpenRepository(casDir); !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatalf("Expected ErrPassphraseRequired, got %v", err)
+	}
+	if _, err := OpenRepositoryWithPassphrase(casDir, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush repository: %v", err)
+	}
+
+	// Deriving this key would need a terabyte of memory
+	forged, _ := json.Marshal(&keyFile{KDF: "scrypt", N: 1 << 30, R: 8, P: 1, Salt: make([]byte, 32)})
+	if err := NewLocalStorage(casDir).Save(context.Background(), Handle{Type: KeyFile, Name: "00000000"}, bytes.NewReader(forged)); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	reopened, err := OpenRepositoryWithPassphrase(casDir, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	snapshot, err := reopened.LoadLatestSnapshot()
+	if err != nil || snapshot == nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	rc, err := reopened.RetrieveFile(snapshot.Files["secret.txt"])
+	if err != nil {
+		t.Fatalf("Failed to retrieve file: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Retrieved content differs from original (err=%v)", err)
+	}
+}
+
+// TestPackFiles checks that small objects end up in pack files, are readable through the index
+// and stay readable after the index is deleted and rebuilt from the packs
+func TestPackFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	casDir := filepath.Join(tempDir, "cas")
+
+	repo, err := InitRepositoryWithConfig(casDir, StorageConfig{}, "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	entries := make(map[*FileEntry][]byte)
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("small file %d\n", i))
+		srcPath := filepath.Join(tempDir, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(srcPath, data, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		stored, err := repo.StoreFile(context.Background(), srcPath)
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		entries[&FileEntry{Path: srcPath, Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size}] = data
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush repository: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(casDir, "objects")); !os.IsNotExist(err) {
+		t.Errorf("Expected no loose objects, got err=%v", err)
+	}
+	packs, err := repo.listFiles(context.Background(), PackFile)
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("Expected one pack file, got %v (err=%v)", packs, err)
+	}
+
+	for entry, data := range entries {
+		assertFileContent(t, casDir, entry, data)
+	}
+
+	if err := os.RemoveAll(filepath.Join(casDir, string(IndexFile))); err != nil {
+		t.Fatalf("Failed to remove index: %v", err)
+	}
+	rebuilt, err := OpenRepository(casDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	if err := rebuilt.RebuildIndex(); err != nil {
+		t.Fatalf("Failed to rebuild index: %v", err)
+	}
+	for entry, data := range entries {
+		assertFileContent(t, casDir, entry, data)
+	}
+}
+
+// TestUnindexedPack checks that a pack whose index file was never written, as after a crash,
+// is found from its header on the next open and indexed again
+func TestUnindexedPack(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	store := func(name string) string {
+		data := []byte("content of object " + name)
+		id := repo.objectID(data)
+		if _, err := repo.storeObject(ctx, id, data); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		if err := repo.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+		return id
+	}
+	first := store("first")
+	before, _ := repo.listFiles(ctx, IndexFile)
+	second := store("second")
+	after, _ := repo.listFiles(ctx, IndexFile)
+	for _, name := range after {
+		if !containsString(before, name) {
+			storage.Remove(ctx, Handle{Type: IndexFile, Name: name})
+		}
+	}
+
+	reopened, err := OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	for _, id := range []string{first, second} {
+		rc, err := reopened.RetrieveObject(id)
+		if err != nil {
+			t.Errorf("Expected object %s to be readable: %v", id, err)
+			continue
+		}
+		rc.Close()
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Failed to close repository: %v", err)
+	}
+	if names, _ := repo.listFiles(ctx, IndexFile); len(names) != len(before)+1 {
+		t.Errorf("Expected the pack to be indexed again, got index files %v", names)
+	}
+}
+
+// TestInterruptedObjectWrite checks that failed writes leave nothing under the object name
+// and that orphaned temporary files are swept
+func TestInterruptedObjectWrite(t *testing.T) {
+	casDir := t.TempDir()
+	id := sha256Hex([]byte("content"))
+	objectPath := getObjectPath(casDir, id)
+
+	storage := NewLocalStorage(casDir)
+	failing := io.MultiReader(bytes.NewReader([]byte("cont")), iotest.ErrReader(errors.New("disk unplugged")))
+	if err := storage.Save(context.Background(), Handle{Type: ObjectFile, Name: id}, failing); err == nil {
+		t.Fatalf("Expected write error")
+	}
+	if _, err := os.Stat(objectPath); !os.IsNotExist(err) {
+		t.Fatalf("Object exists after a failed write (err=%v)", err)
+	}
+
+	orphan := objectPath + ".123.tmp"
+	fresh := objectPath + ".456.tmp"
+	for _, path := range []string{orphan, fresh} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatalf("Failed to write temp file: %v", err)
+		}
+	}
+	old := time.Now().Add(-2 * tempFileMaxAge)
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatalf("Failed to age temp file: %v", err)
+	}
+
+	removed, err := SweepTempFiles(casDir)
+	if err != nil {
+		t.Fatalf("Failed to sweep temp files: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 removed file, got %d", removed)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Orphaned temp file was not removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("Recent temp file was removed: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Snapshots are named by the UTC time their backup started and a random suffix, such as
+// 20250101120000-3fa9c2d1, so backups starting in the same second never collide and the
+// names still sort by time. Older snapshots are named by the time alone, 20250101120000,
+// or by Unix seconds, 1735732800. The catalog accepts all of them: it orders snapshots by
+// the timestamp they record and only falls back to the time in the name without one.
+
+// snapshotIDTimeFormat is the time part of snapshot IDs.
+const snapshotIDTimeFormat = "20060102150405"
+
+// NewSnapshotID returns a unique ID for a snapshot taken at t.
+func NewSnapshotID(t time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		// The nanoseconds still tell apart backups started in the same second
+		return fmt.Sprintf("%s-%08x", t.UTC().Format(snapshotIDTimeFormat), uint32(t.UnixNano()))
+	}
+	return t.UTC().Format(snapshotIDTimeFormat) + "-" + hex.EncodeToString(suffix)
+}
+
+// snapshotIDTime returns the time in a snapshot ID of any of the naming styles.
+func snapshotIDTime(id string) (time.Time, bool) {
+	if len(id) >= len(snapshotIDTimeFormat) && (len(id) == len(snapshotIDTimeFormat) || id[len(snapshotIDTimeFormat)] == '-') {
+		if t, err := time.Parse(snapshotIDTimeFormat, id[:len(snapshotIDTimeFormat)]); err == nil {
+			return t, true
+		}
+	}
+	if seconds, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// snapshotTime returns when a snapshot was taken.
+func snapshotTime(s *Snapshot) time.Time {
+	if !s.Timestamp.IsZero() {
+		return s.Timestamp
+	}
+	t, _ := snapshotIDTime(s.ID)
+	return t
+}
+
+// SnapshotQuery selects snapshots by where they came from. Empty fields match any snapshot.
+type SnapshotQuery struct {
+	Hostname string `json:"hostname"`
+	ConfigID string `json:"config_id"`
+	Tag      string `json:"tag"`
+}
+
+// Matches reports whether a snapshot is selected by the query.
+func (q SnapshotQuery) Matches(s *Snapshot) bool {
+	if q.Hostname != "" && s.Hostname != q.Hostname {
+		return false
+	}
+	if q.ConfigID != "" && s.ConfigID != q.ConfigID {
+		return false
+	}
+	return q.Tag == "" || containsString(s.Tags, q.Tag)
+}
+
+// ListSnapshots returns the snapshots of the repository, oldest first. Only their headers
+// are read, so their Files are never set. Snapshots that can't be read, such as a partial
+// upload, are skipped with a warning rather than hiding all the others.
+func (r *Repository) ListSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	ids, err := r.listFiles(ctx, SnapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(ids))
+	for _, id := range ids {
+		snapshot, err := r.GetSnapshot(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			fmt.Fprintf(os.Stderr, "Warning: Skipping unreadable snapshot %s: %v\n", id, err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		ti, tj := snapshotTime(snapshots[i]), snapshotTime(snapshots[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return snapshots[i].ID < snapshots[j].ID
+	})
+	return snapshots, nil
+}
+
+// GetSnapshot returns a snapshot of the repository by its ID. Only its header is read, so
+// its Files are never set; the error wraps fs.ErrNotExist if there is no such snapshot.
+func (r *Repository) GetSnapshot(ctx context.Context, snapshotID string) (*Snapshot, error) {
+	reader, err := r.OpenSnapshot(ctx, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+	snapshot := reader.Snapshot()
+	snapshot.Files = nil
+	if snapshot.ID == "" {
+		snapshot.ID = snapshotID
+	}
+	return snapshot, nil
+}
+
+// FindLatest returns the newest snapshot the query selects, without its files, or nil if
+// it selects none.
+func (r *Repository) FindLatest(ctx context.Context, query SnapshotQuery) (*Snapshot, error) {
+	return r.findLatest(ctx, query.Matches)
+}
+
+func (r *Repository) findLatest(ctx context.Context, match func(*Snapshot) bool) (*Snapshot, error) {
+	snapshots, err := r.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if match(snapshots[i]) {
+			return snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// findParent returns the snapshot a backup of the source paths can take unchanged files
+// from, with its files loaded: the newest one made on this host, or before hosts were
+// recorded, that shares a source path with the backup. Returns nil, nil if there is none.
+func (r *Repository) findParent(ctx context.Context, sourcePaths []string) (*Snapshot, error) {
+	hostname, _ := os.Hostname()
+	latest, err := r.findLatest(ctx, func(s *Snapshot) bool {
+		if s.Hostname != "" && s.Hostname != hostname {
+			return false
+		}
+		for _, source := range s.Source {
+			if containsString(sourcePaths, source) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	snapshot, err := r.LoadSnapshot(latest.ID)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.ID == "" {
+		snapshot.ID = latest.ID
+	}
+	return snapshot, nil
+}
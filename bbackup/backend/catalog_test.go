@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSnapshotCatalog checks that snapshot IDs don't collide, that the catalog orders and
+// selects snapshots of every naming style, and that backups find their parent snapshot
+func TestSnapshotCatalog(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewSnapshotID(now)
+		if seen[id] {
+			t.Fatalf("Snapshot ID %s was generated twice", id)
+		}
+		seen[id] = true
+		if at, ok := snapshotIDTime(id); !ok || !at.Equal(now) {
+			t.Fatalf("Expected the time of %s to be %s, got %s", id, now, at)
+		}
+	}
+	for id, want := range map[string]time.Time{
+		"20250101120000": time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+		"1735732800":     time.Unix(1735732800, 0).UTC(),
+	} {
+		if at, ok := snapshotIDTime(id); !ok || !at.Equal(want) {
+			t.Errorf("Expected the time of %s to be %s, got %s", id, want, at)
+		}
+	}
+	if _, ok := snapshotIDTime("latest"); ok {
+		t.Errorf("Expected no time in an unrelated name")
+	}
+
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	// Old snapshots named by Unix seconds and by time, some without a timestamp
+	for _, s := range []*Snapshot{
+		{ID: "1735732800", Hostname: "laptop", Tags: []string{"daily"}},
+		{ID: "20250102120000", Timestamp: time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), ConfigID: "docs"},
+		{ID: "1735560000"},
+		{Timestamp: now, Hostname: "server", ConfigID: "docs", Tags: []string{"daily", "db"}},
+	} {
+		if err := repo.SaveSnapshot(s); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+	snapshots, err := repo.ListSnapshots(ctx)
+	if err != nil || len(snapshots) != 4 {
+		t.Fatalf("Expected four snapshots, got %d (err=%v)", len(snapshots), err)
+	}
+	var ids []string
+	for _, s := range snapshots {
+		ids = append(ids, s.ID)
+	}
+	if !strings.HasPrefix(ids[3], "20250301120000-") || strings.Join(ids[:3], " ") != "1735560000 1735732800 20250102120000" {
+		t.Errorf("Unexpected snapshot order %v", ids)
+	}
+
+	for _, test := range []struct {
+		query SnapshotQuery
+		want  string
+	}{
+		{SnapshotQuery{}, ids[3]},
+		{SnapshotQuery{Hostname: "laptop"}, "1735732800"},
+		{SnapshotQuery{ConfigID: "docs"}, ids[3]},
+		{SnapshotQuery{ConfigID: "docs", Hostname: "laptop"}, ""},
+		{SnapshotQuery{Tag: "daily", Hostname: "laptop"}, "1735732800"},
+		{SnapshotQuery{Tag: "weekly"}, ""},
+	} {
+		latest, err := repo.FindLatest(ctx, test.query)
+		if err != nil {
+			t.Fatalf("Failed to find latest snapshot: %v", err)
+		}
+		got := ""
+		if latest != nil {
+			got = latest.ID
+		}
+		if got != test.want {
+			t.Errorf("Expected %q for %+v, got %q", test.want, test.query, got)
+		}
+	}
+	if s, err := repo.GetSnapshot(ctx, "20250102120000"); err != nil || s.ConfigID != "docs" {
+		t.Errorf("Expected to get snapshot 20250102120000, got %+v (err=%v)", s, err)
+	}
+	if _, err := repo.GetSnapshot(ctx, "20250102120001"); !isNotExist(err) {
+		t.Errorf("Expected a missing snapshot to be reported as not existing, got %v", err)
+	}
+
+	// Backups started in the same second get their own snapshots, and the second one takes
+	// every file over from the first
+	sourceDir := t.TempDir()
+	for i, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(strings.Repeat(name, i+1)), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	// A newer snapshot of the same sources from another machine is not a parent
+	if err := repo.SaveSnapshot(&Snapshot{Timestamp: time.Now().Add(time.Hour), Source: []string{sourceDir}, Hostname: "elsewhere"}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	var backups []*Snapshot
+	for i := 0; i < 2; i++ {
+		if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+		hostname, _ := os.Hostname()
+		latest, err := repo.FindLatest(ctx, SnapshotQuery{Hostname: hostname})
+		if err != nil || latest == nil {
+			t.Fatalf("Expected to find the backup, got %v", err)
+		}
+		backups = append(backups, latest)
+	}
+	if backups[0].ID == backups[1].ID {
+		t.Fatalf("Expected two snapshots, got %s twice", backups[0].ID)
+	}
+	if backups[0].Parent != "" || backups[1].Parent != backups[0].ID {
+		t.Errorf("Expected the second backup to have the first as parent, got %q and %q", backups[0].Parent, backups[1].Parent)
+	}
+	if summary := backups[1].Summary; summary.FilesUnchanged != 3 || summary.FilesNew != 0 || summary.BytesAdded != 0 {
+		t.Errorf("Expected the second backup to take all files over, got %+v", summary)
+	}
+}
+
+// TestUnreadableSnapshot checks that a truncated snapshot file is skipped by the catalog, so
+// backups still find their parent among the readable snapshots
+func TestUnreadableSnapshot(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "a"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	truncated := Handle{Type: SnapshotFile, Name: NewSnapshotID(time.Now().Add(time.Hour))}
+	if err := storage.Save(ctx, truncated, strings.NewReader(`{"id":"`)); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	snapshots, err := repo.ListSnapshots(ctx)
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("Expected the readable snapshot only, got %v (err=%v)", snapshots, err)
+	}
+	if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+	latest, err := repo.FindLatest(ctx, SnapshotQuery{})
+	if err != nil || latest == nil {
+		t.Fatalf("Expected to find the second backup, got %v", err)
+	}
+	if latest.Parent != snapshots[0].ID || latest.Summary.FilesUnchanged != 1 {
+		t.Errorf("Expected the second backup to build on the first, got parent %q and %+v", latest.Parent, latest.Summary)
+	}
+}
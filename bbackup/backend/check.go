@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// CheckOptions controls a repository check.
+type CheckOptions struct {
+	// ReadDataPercent is the share of stored objects, from 0 to 100, whose content is read
+	// back and verified against its ID to detect bitrot. 0 only checks that objects exist.
+	ReadDataPercent float64
+}
+
+// CheckProgress reports the progress of a repository check.
+type CheckProgress struct {
+	Phase       string `json:"phase"`       // "snapshots", "objects" or "data"
+	Done        int    `json:"done"`        // Items finished in the current phase
+	Total       int    `json:"total"`       // Items in the current phase
+	CurrentItem string `json:"currentItem"` // Snapshot or object being checked
+	Issues      int    `json:"issues"`      // Problems found so far
+}
+
+// CheckIssue describes a problem found by a repository check.
+type CheckIssue struct {
+	ID       string `json:"id"`                 // Object or snapshot ID
+	Snapshot string `json:"snapshot,omitempty"` // A snapshot that references the object
+	Path     string `json:"path,omitempty"`     // A file in that snapshot that uses the object
+	Error    string `json:"error,omitempty"`    // What is wrong with it
+}
+
+// CheckReport is the result of a repository check.
+type CheckReport struct {
+	Snapshots         int          `json:"snapshots"`          // Snapshots read
+	StoredObjects     int          `json:"stored_objects"`     // Objects found loose or in packs
+	ReferencedObjects int          `json:"referenced_objects"` // Objects referenced by snapshots
+	ReadObjects       int          `json:"read_objects"`       // Objects whose content was verified
+	BrokenSnapshots   []CheckIssue `json:"broken_snapshots"`   // Snapshots that can't be read
+	MissingObjects    []CheckIssue `json:"missing_objects"`    // Referenced objects that don't exist
+	CorruptObjects    []CheckIssue `json:"corrupt_objects"`    // Objects whose content doesn't match their ID
+	OrphanedObjects   []CheckIssue `json:"orphaned_objects"`   // Stored objects no snapshot references
+}
+
+// OK reports whether the check found no broken snapshots, missing or corrupt objects.
+// Orphaned objects are not errors; they are removed by Prune.
+func (c *CheckReport) OK() bool {
+	return len(c.BrokenSnapshots) == 0 && len(c.MissingObjects) == 0 && len(c.CorruptObjects) == 0
+}
+
+func (c *CheckReport) issues() int {
+	return len(c.BrokenSnapshots) + len(c.MissingObjects) + len(c.CorruptObjects)
+}
+
+// objectRef records where an object is first used, for reporting.
+type objectRef struct {
+	snapshot string
+	path     string
+}
+
+// Check verifies that every snapshot can be read and that every object it references
+// exists, and reads back the content of a share of the stored objects (see CheckOptions)
+// to detect corruption. The progress callback may be nil. An error is only returned if
+// the check itself can't run; problems with the repository are listed in the report.
+func (r *Repository) Check(ctx context.Context, opts CheckOptions, progress func(CheckProgress)) (*CheckReport, error) {
+	if opts.ReadDataPercent < 0 || opts.ReadDataPercent > 100 {
+		return nil, fmt.Errorf("read data percentage %v out of range (0-100)", opts.ReadDataPercent)
+	}
+	if progress == nil {
+		progress = func(CheckProgress) {}
+	}
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	lock, err := r.AcquireLock(ctx, false, "check")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	report := &CheckReport{}
+
+	// Snapshots and the objects they reference
+	ids, err := r.listFiles(ctx, SnapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	report.Snapshots = len(ids)
+	referenced := make(map[string]objectRef)
+	// Trees shared by several snapshots are only walked once
+	walker := &treeWalker{visited: make(map[string]bool)}
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(CheckProgress{Phase: "snapshots", Done: i, Total: len(ids), CurrentItem: id, Issues: report.issues()})
+		snapshot, err := r.LoadSnapshot(id)
+		if err != nil {
+			report.BrokenSnapshots = append(report.BrokenSnapshots, CheckIssue{ID: id, Error: err.Error()})
+			continue
+		}
+		walker.tree = func(tree, dir string) error {
+			if _, ok := referenced[tree]; !ok {
+				referenced[tree] = objectRef{snapshot: id, path: dir + "/"}
+			}
+			return nil
+		}
+		walker.file = func(entry *FileEntry) error {
+			for _, object := range entryObjects(entry) {
+				if _, ok := referenced[object]; !ok {
+					referenced[object] = objectRef{snapshot: id, path: entry.Path}
+				}
+			}
+			return nil
+		}
+		// A tree that can't be read breaks the snapshot; the files found so far are still checked
+		if err := r.walkSnapshot(ctx, snapshot, walker); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			report.BrokenSnapshots = append(report.BrokenSnapshots, CheckIssue{ID: id, Error: err.Error()})
+		}
+	}
+	report.ReferencedObjects = len(referenced)
+
+	// Stored objects: loose files and packed objects whose pack exists
+	stored, err := r.storedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.StoredObjects = len(stored)
+
+	refIDs := make([]string, 0, len(referenced))
+	for id := range referenced {
+		refIDs = append(refIDs, id)
+	}
+	sort.Strings(refIDs)
+	for i, id := range refIDs {
+		if i%1000 == 0 {
+			progress(CheckProgress{Phase: "objects", Done: i, Total: len(refIDs), CurrentItem: id, Issues: report.issues()})
+		}
+		if !stored[id] {
+			ref := referenced[id]
+			report.MissingObjects = append(report.MissingObjects, CheckIssue{ID: id, Snapshot: ref.snapshot, Path: ref.path, Error: "object not found"})
+		}
+	}
+
+	storedIDs := make([]string, 0, len(stored))
+	for id := range stored {
+		storedIDs = append(storedIDs, id)
+		if _, ok := referenced[id]; !ok {
+			report.OrphanedObjects = append(report.OrphanedObjects, CheckIssue{ID: id})
+		}
+	}
+	sort.Strings(storedIDs)
+	sort.Slice(report.OrphanedObjects, func(i, j int) bool { return report.OrphanedObjects[i].ID < report.OrphanedObjects[j].ID })
+
+	// Content of the selected share of objects
+	var toRead []string
+	for _, id := range storedIDs {
+		if opts.ReadDataPercent >= 100 || rand.Float64()*100 < opts.ReadDataPercent {
+			toRead = append(toRead, id)
+		}
+	}
+	for i, id := range toRead {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(CheckProgress{Phase: "data", Done: i, Total: len(toRead), CurrentItem: id, Issues: report.issues()})
+		if err := r.verifyObject(id); err != nil {
+			ref := referenced[id]
+			report.CorruptObjects = append(report.CorruptObjects, CheckIssue{ID: id, Snapshot: ref.snapshot, Path: ref.path, Error: err.Error()})
+		}
+		report.ReadObjects++
+	}
+	progress(CheckProgress{Phase: "data", Done: len(toRead), Total: len(toRead), Issues: report.issues()})
+
+	return report, nil
+}
+
+// storedObjects returns the IDs of all loose objects and of all packed objects whose
+// pack file exists.
+func (r *Repository) storedObjects(ctx context.Context) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	err := r.storage.List(ctx, ObjectFile, func(info StorageFileInfo) error {
+		stored[info.Name] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	packs := make(map[string]bool)
+	err = r.storage.List(ctx, PackFile, func(info StorageFileInfo) error {
+		packs[info.Name] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index = make(map[string]blobLocation)
+	r.indexLoaded = false
+	if err := r.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	for id, loc := range r.index {
+		if packs[loc.pack] {
+			stored[id] = true
+		}
+	}
+	return stored, nil
+}
+
+// verifyObject reads an object and checks that its content matches its ID.
+func (r *Repository) verifyObject(id string) error {
+	rc, err := r.RetrieveObject(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// Objects written before encryption may be whole files, so they are hashed as a stream
+	if r.key == nil {
+		hasher, err := r.newHasher()
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(hasher, rc); err != nil {
+			return fmt.Errorf("failed to read object %s: %w", id, err)
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != id {
+			return fmt.Errorf("object %s is corrupt: content hash mismatch", id)
+		}
+		return nil
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("failed to read object %s: %w", id, err)
+	}
+	if r.objectID(data) != id {
+		return fmt.Errorf("object %s is corrupt: content hash mismatch", id)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestCheck damages a repository in every way the check reports and verifies that each
+// problem is found, and that content is only verified when data reading is requested
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	store := func(data []byte) string {
+		id := repo.objectID(data)
+		if _, err := repo.storeObject(ctx, id, data); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		return id
+	}
+	large := func(seed int64) []byte {
+		data := make([]byte, 2*1024*1024)
+		rand.New(rand.NewSource(seed)).Read(data)
+		return data
+	}
+	good := store([]byte("good small object"))
+	rotten := store([]byte("small object that will rot"))
+	missing := store(large(1))
+	corrupt := store(large(2))
+	orphan := store([]byte("nobody uses this"))
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	snapshot := &Snapshot{ID: "20250101000000", Files: map[string]*FileEntry{
+		"a.txt": {Path: "a.txt", Chunks: []string{good, rotten}, Size: 1},
+		"b.bin": {Path: "b.bin", Chunks: []string{missing, corrupt}, Size: 1},
+	}}
+	if err := repo.SaveSnapshot(snapshot); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+
+	clean, err := repo.Check(ctx, CheckOptions{ReadDataPercent: 100}, nil)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !clean.OK() || clean.ReadObjects != 5 || len(clean.OrphanedObjects) != 1 || clean.OrphanedObjects[0].ID != orphan {
+		t.Fatalf("Unexpected report for an intact repository: %+v", clean)
+	}
+
+	// Damage the repository
+	if err := storage.Remove(ctx, Handle{Type: ObjectFile, Name: missing}); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+	damaged := large(2)
+	damaged[0] ^= 0xff
+	encoded, _ := encodeObject(damaged, repo.Config().CompressionLevel)
+	if err := storage.Save(ctx, Handle{Type: ObjectFile, Name: corrupt}, bytes.NewReader(encoded)); err != nil {
+		t.Fatalf("Failed to overwrite object: %v", err)
+	}
+	repo.mu.Lock()
+	loc := repo.index[rotten]
+	repo.mu.Unlock()
+	pack, _ := loadAll(ctx, storage, Handle{Type: PackFile, Name: loc.pack})
+	pack[loc.offset+loc.length-1] ^= 0xff
+	if err := storage.Save(ctx, Handle{Type: PackFile, Name: loc.pack}, bytes.NewReader(pack)); err != nil {
+		t.Fatalf("Failed to overwrite pack: %v", err)
+	}
+	if err := storage.Save(ctx, Handle{Type: SnapshotFile, Name: "20250102000000"}, strings.NewReader("{not json")); err != nil {
+		t.Fatalf("Failed to write broken snapshot: %v", err)
+	}
+
+	var phases []string
+	report, err := repo.Check(ctx, CheckOptions{ReadDataPercent: 100}, func(p CheckProgress) {
+		if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+			phases = append(phases, p.Phase)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if report.OK() {
+		t.Fatalf("Expected problems to be reported")
+	}
+	if strings.Join(phases, ",") != "snapshots,objects,data" {
+		t.Errorf("Unexpected progress phases %v", phases)
+	}
+	if len(report.BrokenSnapshots) != 1 || report.BrokenSnapshots[0].ID != "20250102000000" {
+		t.Errorf("Expected one broken snapshot, got %+v", report.BrokenSnapshots)
+	}
+	if len(report.MissingObjects) != 1 || report.MissingObjects[0].ID != missing || report.MissingObjects[0].Path != "b.bin" {
+		t.Errorf("Expected %s to be reported missing, got %+v", missing, report.MissingObjects)
+	}
+	corruptIDs := map[string]bool{}
+	for _, issue := range report.CorruptObjects {
+		corruptIDs[issue.ID] = true
+	}
+	if len(corruptIDs) != 2 || !corruptIDs[corrupt] || !corruptIDs[rotten] {
+		t.Errorf("Expected %s and %s to be reported corrupt, got %+v", corrupt, rotten, report.CorruptObjects)
+	}
+
+	// Without reading data only missing objects and broken snapshots are found
+	quick, err := repo.Check(ctx, CheckOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if quick.ReadObjects != 0 || len(quick.CorruptObjects) != 0 || len(quick.MissingObjects) != 1 {
+		t.Errorf("Unexpected report without data reading: %+v", quick)
+	}
+	if _, err := repo.Check(ctx, CheckOptions{ReadDataPercent: 150}, nil); err == nil {
+		t.Errorf("Expected an out of range percentage to be rejected")
+	}
+}
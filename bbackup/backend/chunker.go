@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// ChunkerConfig defines the size bounds used by the content-defined chunker.
+// AvgSize must be a power of two; MinSize and MaxSize bound every chunk except the last one of a file.
+type ChunkerConfig struct {
+	MinSize int `json:"min_size"`
+	AvgSize int `json:"avg_size"`
+	MaxSize int `json:"max_size"`
+}
+
+// DefaultChunkerConfig returns the chunk sizes used for new backups (512 KiB / 1 MiB / 8 MiB).
+func DefaultChunkerConfig() ChunkerConfig {
+	return ChunkerConfig{
+		MinSize: 512 * 1024,
+		AvgSize: 1024 * 1024,
+		MaxSize: 8 * 1024 * 1024,
+	}
+}
+
+// Validate checks that the chunk sizes are usable.
+func (c ChunkerConfig) Validate() error {
+	if c.MinSize <= 0 || c.AvgSize <= 0 || c.MaxSize <= 0 {
+		return fmt.Errorf("chunk sizes must be positive (min=%d avg=%d max=%d)", c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	if c.AvgSize&(c.AvgSize-1) != 0 {
+		return fmt.Errorf("average chunk size %d is not a power of two", c.AvgSize)
+	}
+	if !(c.MinSize < c.AvgSize && c.AvgSize < c.MaxSize) {
+		return fmt.Errorf("chunk sizes must satisfy min < avg < max (min=%d avg=%d max=%d)", c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	return nil
+}
+
+// gearTable holds the random values used by the rolling gear hash.
+// It is generated from a fixed seed because chunk boundaries must never change between versions.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x62626163_6b757030) // "bbackup0"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// errChunkerReleased is returned by Next after Release has been called.
+var errChunkerReleased = errors.New("chunker already released")
+
+// chunkBufferPool recycles the large read buffers used by Chunker.
+var chunkBufferPool sync.Pool
+
+// Chunker splits a stream into content-defined chunks using the FastCDC algorithm
+// with normalized chunking, so that an insertion only changes the chunks around it.
+type Chunker struct {
+	rd      io.Reader
+	cfg     ChunkerConfig
+	maskS   uint64 // stricter mask used before the average size is reached
+	maskL   uint64 // looser mask used after the average size is reached
+	buf     []byte
+	start   int
+	end     int
+	eof     bool
+	pooled  bool
+	lastErr error
+}
+
+// NewChunker creates a chunker reading from rd.
+func NewChunker(rd io.Reader, cfg ChunkerConfig) (*Chunker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	avgBits := bits.TrailingZeros(uint(cfg.AvgSize))
+	c := &Chunker{
+		rd:    rd,
+		cfg:   cfg,
+		maskS: topBitsMask(avgBits + 1),
+		maskL: topBitsMask(avgBits - 1),
+	}
+
+	if buf, ok := chunkBufferPool.Get().([]byte); ok && len(buf) == cfg.MaxSize {
+		c.buf = buf
+	} else {
+		c.buf = make([]byte, cfg.MaxSize)
+	}
+	c.pooled = true
+	return c, nil
+}
+
+// topBitsMask returns a mask with the n most significant bits set.
+// The gear hash shifts left, so the high bits depend on the widest window of input.
+func topBitsMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - uint(n))
+}
+
+// Next returns the next chunk. The returned slice is only valid until the next call.
+// It returns io.EOF once the input is exhausted.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.lastErr != nil {
+		return nil, c.lastErr
+	}
+
+	if err := c.fill(); err != nil {
+		c.lastErr = err
+		return nil, err
+	}
+
+	available := c.end - c.start
+	if available == 0 {
+		c.lastErr = io.EOF
+		return nil, io.EOF
+	}
+
+	cut := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
+
+// Release returns the chunker's buffer to the pool. The chunker must not be used afterwards.
+func (c *Chunker) Release() {
+	if c.pooled && c.buf != nil {
+		chunkBufferPool.Put(c.buf)
+	}
+	c.buf = nil
+	c.pooled = false
+	c.lastErr = errChunkerReleased
+}
+
+// fill tops the buffer up so that at least MaxSize bytes are available, unless the input ended.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.cfg.MaxSize {
+		return nil
+	}
+
+	// Move the remaining bytes to the front of the buffer
+	if c.start > 0 {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+	}
+
+	for c.end < len(c.buf) {
+		n, err := c.rd.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutPoint returns the length of the next chunk at the start of data.
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.cfg.MinSize {
+		return n
+	}
+	if n > c.cfg.MaxSize {
+		n = c.cfg.MaxSize
+	}
+	normal := c.cfg.AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.cfg.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
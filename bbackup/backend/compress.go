@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Objects written since compression was introduced start with a small header:
+//
+//	[0:4] objectMagic
+//	[4]   compression method (compressionNone or compressionZstd)
+//
+// followed by the (possibly compressed) content. Objects without the magic are
+// legacy raw copies and are returned as-is.
+var objectMagic = []byte{0x89, 'B', 'B', 'O'}
+
+const (
+	objectHeaderSize = 5
+
+	compressionNone byte = 0
+	compressionZstd byte = 1
+
+	// DefaultCompressionLevel is the zstd level used for new repositories.
+	DefaultCompressionLevel = 3
+
+	// compressionSampleSize is the size of each sample used to detect incompressible data
+	compressionSampleSize = 16 * 1024
+	// incompressibleRatio is the compressed/plain ratio above which data is stored uncompressed
+	incompressibleRatio = 0.95
+)
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+
+	zstdEncodersMu sync.Mutex
+	zstdEncoders   = make(map[zstd.EncoderLevel]*zstd.Encoder)
+)
+
+// getZstdDecoder returns the shared decoder. DecodeAll is safe for concurrent use.
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdDecoder, zstdDecoderErr
+}
+
+// getZstdEncoder returns a shared encoder for the given zstd level. EncodeAll is safe for concurrent use.
+func getZstdEncoder(level int) (*zstd.Encoder, error) {
+	encoderLevel := zstd.EncoderLevelFromZstd(level)
+
+	zstdEncodersMu.Lock()
+	defer zstdEncodersMu.Unlock()
+
+	if enc, ok := zstdEncoders[encoderLevel]; ok {
+		return enc, nil
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	zstdEncoders[encoderLevel] = enc
+	return enc, nil
+}
+
+// encodeObject returns the on-disk representation of data: the object header followed
+// by the zstd-compressed content, or the raw content when compression is disabled
+// (level <= 0) or the data doesn't compress.
+func encodeObject(data []byte, level int) ([]byte, error) {
+	if level > 0 && looksCompressible(data, level) {
+		enc, err := getZstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, objectHeaderSize, objectHeaderSize+len(data)/2)
+		copy(out, objectMagic)
+		out[4] = compressionZstd
+		out = enc.EncodeAll(data, out)
+		if len(out) < objectHeaderSize+len(data) {
+			return out, nil
+		}
+	}
+
+	out := make([]byte, objectHeaderSize+len(data))
+	copy(out, objectMagic)
+	out[4] = compressionNone
+	copy(out[objectHeaderSize:], data)
+	return out, nil
+}
+
+// looksCompressible compresses a few samples from the start, middle and end of data
+// to avoid spending time on already-compressed content such as media and archives.
+func looksCompressible(data []byte, level int) bool {
+	if len(data) <= 3*compressionSampleSize {
+		return true
+	}
+
+	enc, err := getZstdEncoder(level)
+	if err != nil {
+		return false
+	}
+
+	sample := make([]byte, 0, 3*compressionSampleSize)
+	middle := len(data)/2 - compressionSampleSize/2
+	sample = append(sample, data[:compressionSampleSize]...)
+	sample = append(sample, data[middle:middle+compressionSampleSize]...)
+	sample = append(sample, data[len(data)-compressionSampleSize:]...)
+
+	compressed := enc.EncodeAll(sample, make([]byte, 0, len(sample)))
+	return float64(len(compressed)) < float64(len(sample))*incompressibleRatio
+}
+
+// hasObjectHeader reports whether raw starts with the object header.
+func hasObjectHeader(raw []byte) bool {
+	return len(raw) >= objectHeaderSize && bytes.Equal(raw[:len(objectMagic)], objectMagic)
+}
+
+// decodeObject returns the plaintext content of an object read from disk and checks it against hash.
+// idOf computes the name an object with the given content must have.
+func decodeObject(raw []byte, hash string, idOf func([]byte) string) ([]byte, error) {
+	if !hasObjectHeader(raw) {
+		return raw, nil
+	}
+
+	var data []byte
+	switch raw[4] {
+	case compressionNone:
+		data = raw[objectHeaderSize:]
+	case compressionZstd:
+		dec, err := getZstdDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		data, err = dec.DecodeAll(raw[objectHeaderSize:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress object %s: %w", hash, err)
+		}
+	default:
+		return nil, fmt.Errorf("object %s uses unknown compression method %d", hash, raw[4])
+	}
+
+	if idOf(data) != hash {
+		return nil, fmt.Errorf("object %s is corrupt: content hash mismatch", hash)
+	}
+	return data, nil
+}
+
+// openLooseObject opens a loose object and returns a reader over its plaintext content.
+// Objects with a header are read and decoded in memory (they are at most one chunk in size);
+// legacy raw objects, which may be whole large files, are streamed directly.
+func (r *Repository) openLooseObject(ctx context.Context, hash string) (io.ReadCloser, error) {
+	rd, err := r.storage.Load(ctx, Handle{Type: ObjectFile, Name: hash}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(rd)
+	header, err := buffered.Peek(objectHeaderSize)
+	if err != nil && err != io.EOF {
+		rd.Close()
+		return nil, err
+	}
+	if !hasObjectHeader(header) && !isEncryptedBlob(header) {
+		if r.key != nil {
+			rd.Close()
+			return nil, fmt.Errorf("object %s is not encrypted in an encrypted repository", hash)
+		}
+		return &readCloser{Reader: buffered, Closer: rd}, nil
+	}
+
+	defer rd.Close()
+	raw, err := io.ReadAll(buffered)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeStoredObject(raw, hash, r.key, r.config.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// decodeStoredObject decrypts (if needed) and decodes an object as stored on disk,
+// either as a loose file or inside a pack, and returns its plaintext content.
+// algorithm is the repository's hash algorithm.
+func decodeStoredObject(raw []byte, hash string, key *MasterKey, algorithm string) ([]byte, error) {
+	var err error
+	idOf := func(data []byte) string { return hashBytes(algorithm, data) }
+	if isEncryptedBlob(raw) {
+		if key == nil {
+			return nil, ErrPassphraseRequired
+		}
+		raw, err = key.openBlob(raw, []byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("object %s: %w", hash, err)
+		}
+		idOf = func(data []byte) string { return key.objectID(algorithm, data) }
+	} else if key != nil {
+		return nil, fmt.Errorf("object %s is not encrypted in an encrypted repository", hash)
+	}
+
+	return decodeObject(raw, hash, idOf)
+}
+
+// sha256Hex returns the hex-encoded SHA-256 hash of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,364 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// SnapshotFilter selects snapshots. A snapshot matches if it matches every criterion that
+// is set; the zero filter matches all snapshots.
+type SnapshotFilter struct {
+	IDs    []string  `json:"ids"`    // Snapshot IDs, any of which matches
+	Tags   []string  `json:"tags"`   // Tags, any of which matches
+	After  time.Time `json:"after"`  // Only snapshots taken at or after this time
+	Before time.Time `json:"before"` // Only snapshots taken before this time
+}
+
+// Match reports whether the snapshot is selected by the filter.
+func (f SnapshotFilter) Match(snapshot *Snapshot) bool {
+	if len(f.IDs) > 0 && !containsString(f.IDs, snapshot.ID) {
+		return false
+	}
+	if len(f.Tags) > 0 {
+		tagged := false
+		for _, tag := range snapshot.Tags {
+			if containsString(f.Tags, tag) {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+	if !f.After.IsZero() && snapshot.Timestamp.Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !snapshot.Timestamp.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyProgress reports the progress of a snapshot copy.
+type CopyProgress struct {
+	Snapshot       string `json:"snapshot"`        // Snapshot being copied
+	SnapshotsDone  int    `json:"snapshots_done"`  // Selected snapshots finished
+	SnapshotsTotal int    `json:"snapshots_total"` // Snapshots selected by the filter
+	CopiedObjects  int    `json:"copied_objects"`  // Objects written to the destination so far
+	CopiedBytes    int64  `json:"copied_bytes"`    // Plaintext bytes of those objects
+}
+
+// CopyStats reports the outcome of a snapshot copy.
+type CopyStats struct {
+	Snapshots        int   `json:"snapshots"`         // Snapshots selected by the filter
+	CopiedSnapshots  int   `json:"copied_snapshots"`  // Snapshots written to the destination
+	SkippedSnapshots int   `json:"skipped_snapshots"` // Selected snapshots the destination already had
+	CopiedObjects    int   `json:"copied_objects"`    // Objects missing at the destination that were copied
+	CopiedBytes      int64 `json:"copied_bytes"`      // Plaintext bytes of the copied objects
+	ExistingObjects  int   `json:"existing_objects"`  // Objects the destination already had
+}
+
+// snapshotCopier copies the objects of snapshots from one repository to another.
+type snapshotCopier struct {
+	src, dst *Repository
+	// sameIDs is set when both repositories derive the same object ID from the same
+	// content (same hash algorithm and key), so objects can be looked up at the
+	// destination without reading them
+	sameIDs bool
+	ids     map[string]string // Destination IDs of source objects, when sameIDs is false
+	trees   map[string]string // Destination IDs of the source trees copied so far
+	stats   *CopyStats
+	entries int    // Files copied, for progress reports
+	report  func() // Reports progress
+}
+
+// CopySnapshots copies the snapshots selected by filter, and every object they use that the
+// destination doesn't have yet, from this repository to dst. Snapshots keep their IDs and
+// the ones dst already has are skipped. Every object read is verified against its ID, and
+// the copy fails on the first corrupt object. Objects are stored with the destination's
+// compression and encryption; when the repositories name objects differently (different
+// keys or only one encrypted) the copied snapshots are rewritten with the new names.
+// The progress callback may be nil.
+func (r *Repository) CopySnapshots(ctx context.Context, dst *Repository, filter SnapshotFilter, progress func(CopyProgress)) (*CopyStats, error) {
+	if progress == nil {
+		progress = func(CopyProgress) {}
+	}
+	if r.config.ID != "" && r.config.ID == dst.config.ID {
+		return nil, fmt.Errorf("%s and %s are the same repository", r.Location(), dst.Location())
+	}
+	srcLock, err := r.AcquireLock(ctx, false, "copy")
+	if err != nil {
+		return nil, err
+	}
+	defer srcLock.Release()
+	dstLock, err := dst.acquireWriteLock(ctx, false, "copy")
+	if err != nil {
+		return nil, err
+	}
+	defer dstLock.Release()
+
+	// Objects stored before a cancellation or failure are kept for the next run
+	defer dst.Flush()
+	if err := dst.loadIndexes(ctx); err != nil {
+		return nil, err
+	}
+
+	ids, err := r.listFiles(ctx, SnapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	var selected []string
+	for _, id := range ids {
+		snapshot, err := r.LoadSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.ID == "" {
+			snapshot.ID = id
+		}
+		if filter.Match(snapshot) {
+			selected = append(selected, id)
+		}
+	}
+
+	sameKeys := (r.key == nil && dst.key == nil) || (r.key != nil && dst.key != nil && bytes.Equal(r.key.MAC, dst.key.MAC))
+	c := &snapshotCopier{
+		src:     r,
+		dst:     dst,
+		sameIDs: sameKeys && r.config.HashAlgorithm == dst.config.HashAlgorithm,
+		ids:     make(map[string]string),
+		trees:   make(map[string]string),
+		stats:   &CopyStats{Snapshots: len(selected)},
+	}
+	for i, id := range selected {
+		report := func() {
+			progress(CopyProgress{Snapshot: id, SnapshotsDone: i, SnapshotsTotal: len(selected), CopiedObjects: c.stats.CopiedObjects, CopiedBytes: c.stats.CopiedBytes})
+		}
+		report()
+		c.report = report
+
+		if _, err := dst.storage.Stat(ctx, Handle{Type: SnapshotFile, Name: id}); err == nil {
+			c.stats.SkippedSnapshots++
+			continue
+		} else if !isNotExist(err) {
+			return c.stats, fmt.Errorf("failed to check snapshot %s at %s: %w", id, dst.Location(), err)
+		}
+
+		snapshot, err := r.LoadSnapshot(id)
+		if err != nil {
+			return c.stats, err
+		}
+		snapshot.ID = id
+		// File hashes are copied as they are, so they keep the source's algorithm
+		snapshot.HashAlgorithm = snapshot.FileHashAlgorithm()
+		for _, entry := range snapshot.Files {
+			if err := ctx.Err(); err != nil {
+				return c.stats, err
+			}
+			if err := c.copyEntry(ctx, entry, snapshot.HashAlgorithm); err != nil {
+				return c.stats, fmt.Errorf("failed to copy %s of snapshot %s: %w", entry.Path, id, err)
+			}
+			if c.entries++; c.entries%100 == 0 {
+				report()
+			}
+		}
+		for i, root := range snapshot.Roots {
+			newRoot, err := c.copyTree(ctx, root, "", snapshot.HashAlgorithm)
+			if err != nil {
+				return c.stats, fmt.Errorf("failed to copy snapshot %s: %w", id, err)
+			}
+			snapshot.Roots[i] = newRoot
+		}
+
+		// The snapshot is only saved once all its objects are in the destination storage
+		if err := dst.Flush(); err != nil {
+			return c.stats, err
+		}
+		if err := dst.SaveSnapshot(snapshot); err != nil {
+			return c.stats, err
+		}
+		c.stats.CopiedSnapshots++
+	}
+	progress(CopyProgress{SnapshotsDone: len(selected), SnapshotsTotal: len(selected), CopiedObjects: c.stats.CopiedObjects, CopiedBytes: c.stats.CopiedBytes})
+
+	return c.stats, nil
+}
+
+// copyTree copies a tree and everything in it, subtrees before the trees that reference
+// them, and returns its ID at the destination. A tree the destination already has under
+// the same ID is skipped along with its content.
+func (c *snapshotCopier) copyTree(ctx context.Context, id, dir, hashAlgorithm string) (string, error) {
+	if newID, ok := c.trees[id]; ok {
+		return newID, nil
+	}
+	if c.sameIDs {
+		c.dst.mu.Lock()
+		exists, err := c.dst.hasObject(ctx, id)
+		c.dst.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			c.stats.ExistingObjects++
+			c.trees[id] = id
+			return id, nil
+		}
+	}
+
+	tree, err := c.src.LoadTree(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("failed to read tree of /%s: %w", dir, err)
+	}
+	for i := range tree.Nodes {
+		node := &tree.Nodes[i]
+		p := path.Join(dir, node.Name)
+		if node.Type == NodeDir {
+			if node.Subtree, err = c.copyTree(ctx, node.Subtree, p, hashAlgorithm); err != nil {
+				return "", err
+			}
+			continue
+		}
+		entry := node.entry(p)
+		if err := c.copyEntry(ctx, entry, hashAlgorithm); err != nil {
+			return "", fmt.Errorf("failed to copy %s: %w", p, err)
+		}
+		node.Chunks = entry.Chunks
+		if c.entries++; c.entries%100 == 0 && c.report != nil {
+			c.report()
+		}
+	}
+	newID, err := c.dst.saveTree(ctx, tree)
+	if err != nil {
+		return "", err
+	}
+	c.trees[id] = newID
+	return newID, nil
+}
+
+// copyEntry copies the objects of a file entry, updating its chunk list if they are
+// named differently at the destination. hashAlgorithm is the one of the entry's file hash.
+func (c *snapshotCopier) copyEntry(ctx context.Context, entry *FileEntry, hashAlgorithm string) error {
+	if entry.NodeType() != NodeFile {
+		return nil
+	}
+	if len(entry.Chunks) == 0 {
+		if entry.Size == 0 {
+			return nil
+		}
+		return c.copyWholeFileObject(ctx, entry, hashAlgorithm)
+	}
+	for i, id := range entry.Chunks {
+		newID, err := c.copyObject(ctx, id)
+		if err != nil {
+			return err
+		}
+		entry.Chunks[i] = newID
+	}
+	return nil
+}
+
+// copyObject copies a chunk object unless the destination has it, and returns its ID at
+// the destination.
+func (c *snapshotCopier) copyObject(ctx context.Context, id string) (string, error) {
+	if c.sameIDs {
+		c.dst.mu.Lock()
+		exists, err := c.dst.hasObject(ctx, id)
+		c.dst.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			c.stats.ExistingObjects++
+			return id, nil
+		}
+	} else if newID, ok := c.ids[id]; ok {
+		c.stats.ExistingObjects++
+		return newID, nil
+	}
+
+	rc, err := c.src.RetrieveObject(id)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(&contextReader{ctx: ctx, r: rc})
+	rc.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to read object %s: %w", id, err)
+	}
+	if c.src.objectID(data) != id {
+		return "", fmt.Errorf("object %s is corrupt: content hash mismatch", id)
+	}
+
+	newID := c.dst.objectID(data)
+	written, err := c.dst.storeObject(ctx, newID, data)
+	if err != nil {
+		return "", err
+	}
+	if written > 0 {
+		c.stats.CopiedObjects++
+		c.stats.CopiedBytes += int64(len(data))
+	} else {
+		c.stats.ExistingObjects++
+	}
+	if !c.sameIDs {
+		c.ids[id] = newID
+	}
+	return newID, nil
+}
+
+// copyWholeFileObject copies the content of an entry written before chunking, which is a
+// single object named by the file hash. Unless the destination has that object under the
+// same name, the content is chunked with the destination's settings.
+func (c *snapshotCopier) copyWholeFileObject(ctx context.Context, entry *FileEntry, hashAlgorithm string) error {
+	if c.sameIDs {
+		c.dst.mu.Lock()
+		exists, err := c.dst.hasObject(ctx, entry.Hash)
+		c.dst.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if exists {
+			c.stats.ExistingObjects++
+			return nil
+		}
+	}
+
+	rc, err := c.src.RetrieveObject(entry.Hash)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// The destination hashes the content with its own algorithm, so verify it separately
+	hasher, err := newHasher(hashAlgorithm)
+	if err != nil {
+		return err
+	}
+	stored, err := c.dst.storeContent(ctx, io.TeeReader(rc, hasher), entry.Size, entry.Path)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != entry.Hash {
+		return fmt.Errorf("object %s is corrupt: content hash mismatch", entry.Hash)
+	}
+	c.stats.CopiedObjects++
+	c.stats.CopiedBytes += stored.NewBytes
+	entry.Chunks = stored.Chunks
+	return nil
+}
@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCopySnapshots checks that selected snapshots are copied with only the objects missing
+// at the destination, that objects are renamed for an encrypted destination and that
+// corrupt objects stop the copy
+func TestCopySnapshots(t *testing.T) {
+	ctx := context.Background()
+	src, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	tempDir := t.TempDir()
+	contents := make(map[string][]byte)
+	store := func(name string, size int) *FileEntry {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		stored, err := src.StoreFile(ctx, path)
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		contents[name] = data
+		return &FileEntry{Path: name, Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size}
+	}
+	shared := store("shared", 3*1024*1024)
+	daily := store("daily", 1000)
+	weekly := store("weekly", 2000)
+	if err := src.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, s := range []*Snapshot{
+		{ID: "20250101000000", Timestamp: base, Tags: []string{"daily"}, Files: map[string]*FileEntry{"shared": shared, "daily": daily}},
+		{ID: "20250108000000", Timestamp: base.Add(7 * 24 * time.Hour), Tags: []string{"weekly"}, Files: map[string]*FileEntry{"shared": shared, "weekly": weekly}},
+	} {
+		if err := src.SaveSnapshot(s); err != nil {
+			t.Fatalf("Failed to save snapshot %d: %v", i, err)
+		}
+	}
+
+	verify := func(dst *Repository, id string, names ...string) {
+		snapshot, err := dst.LoadSnapshot(id)
+		if err != nil {
+			t.Fatalf("Failed to load copied snapshot %s: %v", id, err)
+		}
+		for _, name := range names {
+			rc, err := dst.RetrieveFile(snapshot.Files[name])
+			if err != nil {
+				t.Fatalf("Failed to retrieve %s: %v", name, err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(data, contents[name]) {
+				t.Errorf("Copied content of %s differs (err=%v)", name, err)
+			}
+		}
+	}
+
+	// Only the tagged snapshot, then the other one without the objects the first brought along
+	dst, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init destination: %v", err)
+	}
+	stats, err := src.CopySnapshots(ctx, dst, SnapshotFilter{Tags: []string{"daily"}}, nil)
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Snapshots != 1 || stats.CopiedSnapshots != 1 || stats.CopiedObjects != len(shared.Chunks)+1 {
+		t.Errorf("Unexpected stats for the tagged copy: %+v", stats)
+	}
+	verify(dst, "20250101000000", "shared", "daily")
+	stats, err = src.CopySnapshots(ctx, dst, SnapshotFilter{After: base.Add(time.Hour)}, nil)
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.CopiedSnapshots != 1 || stats.CopiedObjects != 1 || stats.ExistingObjects != len(shared.Chunks) {
+		t.Errorf("Expected only the new object to be copied, got %+v", stats)
+	}
+	verify(dst, "20250108000000", "shared", "weekly")
+	stats, err = src.CopySnapshots(ctx, dst, SnapshotFilter{}, nil)
+	if err != nil || stats.SkippedSnapshots != 2 || stats.CopiedObjects != 0 {
+		t.Errorf("Expected both snapshots to be skipped, got %+v (err=%v)", stats, err)
+	}
+
+	// An encrypted destination names objects differently
+	encrypted, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "secret")
+	if err != nil {
+		t.Fatalf("Failed to init encrypted destination: %v", err)
+	}
+	if _, err := src.CopySnapshots(ctx, encrypted, SnapshotFilter{IDs: []string{"20250108000000"}}, nil); err != nil {
+		t.Fatalf("Copy to encrypted repository failed: %v", err)
+	}
+	verify(encrypted, "20250108000000", "shared", "weekly")
+	if snapshot, _ := encrypted.LoadSnapshot("20250108000000"); snapshot.Files["weekly"].Chunks[0] == weekly.Chunks[0] {
+		t.Errorf("Expected the chunks to be renamed for the encrypted repository")
+	}
+
+	// A corrupt object fails the copy and its snapshot isn't written
+	bad := []byte("not the content the ID was derived from")
+	corruptID := strings.Repeat("ab", 32)
+	if _, err := src.storeObject(ctx, corruptID, bad); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+	if err := src.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if err := src.SaveSnapshot(&Snapshot{ID: "20250115000000", Timestamp: base.Add(14 * 24 * time.Hour), Files: map[string]*FileEntry{"bad": {Path: "bad", Chunks: []string{corruptID}, Size: int64(len(bad))}}}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	if _, err := src.CopySnapshots(ctx, dst, SnapshotFilter{}, nil); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Expected the corrupt object to fail the copy, got %v", err)
+	}
+	if _, err := dst.LoadSnapshot("20250115000000"); err == nil {
+		t.Errorf("Expected the snapshot with the corrupt object not to be copied")
+	}
+
+	if _, err := src.CopySnapshots(ctx, src, SnapshotFilter{}, nil); err == nil {
+		t.Errorf("Expected copying a repository into itself to fail")
+	}
+}
@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"lukechampine.com/blake3"
+)
+
+// Encrypted objects and snapshot manifests start with encryptedMagic, followed by a
+// random XChaCha20-Poly1305 nonce and the sealed content. For objects the sealed
+// content is the normal object encoding (header + possibly compressed data).
+var encryptedMagic = []byte{0x89, 'B', 'B', 'E'}
+
+const (
+	masterKeySize = 32
+
+	// scrypt parameters for deriving the key-encryption key from a passphrase
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// Limits on the scrypt parameters of key files, so a tampered key file can't make
+	// unlocking take gigabytes of memory or hours of CPU
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+var (
+	// ErrPassphraseRequired is returned when an encrypted repository is opened without a passphrase.
+	ErrPassphraseRequired = errors.New("repository is encrypted: passphrase required")
+	// ErrWrongPassphrase is returned when no key file can be unlocked with the given passphrase.
+	ErrWrongPassphrase = errors.New("wrong passphrase for repository")
+)
+
+// MasterKey holds the random keys that protect a repository's content.
+type MasterKey struct {
+	Encrypt []byte `json:"encrypt"` // XChaCha20-Poly1305 key for objects and snapshots
+	MAC     []byte `json:"mac"`     // HMAC-SHA256 key used to derive object names
+}
+
+// keyFile is the on-disk form of a master key wrapped with a passphrase-derived key.
+type keyFile struct {
+	Created  time.Time `json:"created"`
+	Hostname string    `json:"hostname"`
+	KDF      string    `json:"kdf"`
+	N        int       `json:"n"`
+	R        int       `json:"r"`
+	P        int       `json:"p"`
+	Salt     []byte    `json:"salt"`
+	Data     []byte    `json:"data"` // nonce || sealed MasterKey JSON
+}
+
+// newMasterKey generates a random master key.
+func newMasterKey() (*MasterKey, error) {
+	key := &MasterKey{
+		Encrypt: make([]byte, masterKeySize),
+		MAC:     make([]byte, masterKeySize),
+	}
+	if _, err := rand.Read(key.Encrypt); err != nil {
+		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	if _, err := rand.Read(key.MAC); err != nil {
+		return nil, fmt.Errorf("failed to generate MAC key: %w", err)
+	}
+	return key, nil
+}
+
+// deriveKey derives the key-encryption key for a key file from the passphrase.
+func (kf *keyFile) deriveKey(passphrase string) ([]byte, error) {
+	if kf.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function %q", kf.KDF)
+	}
+	if kf.N > maxScryptN || kf.R > maxScryptR || kf.P > maxScryptP {
+		return nil, fmt.Errorf("scrypt parameters N=%d, r=%d, p=%d exceed the limits N=%d, r=%d, p=%d",
+			kf.N, kf.R, kf.P, maxScryptN, maxScryptR, maxScryptP)
+	}
+	return scrypt.Key([]byte(passphrase), kf.Salt, kf.N, kf.R, kf.P, chacha20poly1305.KeySize)
+}
+
+// writeKeyFile wraps the master key with the passphrase and stores it as a new key file.
+func writeKeyFile(ctx context.Context, storage Storage, key *MasterKey, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("passphrase must not be empty")
+	}
+
+	hostname, _ := os.Hostname()
+	kf := &keyFile{
+		Created:  time.Now(),
+		Hostname: hostname,
+		KDF:      "scrypt",
+		N:        scryptN,
+		R:        scryptR,
+		P:        scryptP,
+		Salt:     make([]byte, 32),
+	}
+	if _, err := rand.Read(kf.Salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	kek, err := kf.deriveKey(passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to derive key from passphrase: %w", err)
+	}
+	plain, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal master key: %w", err)
+	}
+	kf.Data, err = seal(kek, plain, nil)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal key file: %w", err)
+	}
+
+	id, err := randomName()
+	if err != nil {
+		return err
+	}
+	if err := storage.Save(ctx, Handle{Type: KeyFile, Name: id}, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// listKeyFiles returns the names of all key files in the repository.
+func listKeyFiles(ctx context.Context, storage Storage) ([]string, error) {
+	var names []string
+	err := storage.List(ctx, KeyFile, func(info StorageFileInfo) error {
+		names = append(names, info.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list key files: %w", err)
+	}
+	return names, nil
+}
+
+// unlockMasterKey tries every key file with the passphrase and returns the first master key it can open.
+func unlockMasterKey(ctx context.Context, storage Storage, passphrase string) (*MasterKey, error) {
+	names, err := listKeyFiles(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no key files found in %s", storage.Location())
+	}
+
+	for _, path := range names {
+		data, err := loadAll(ctx, storage, Handle{Type: KeyFile, Name: path})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file %s: %w", path, err)
+		}
+		var kf keyFile
+		if err := json.Unmarshal(data, &kf); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Skipping invalid key file %s: %v\n", path, err)
+			continue
+		}
+		kek, err := kf.deriveKey(passphrase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Skipping key file %s: %v\n", path, err)
+			continue
+		}
+		plain, err := open(kek, kf.Data, nil)
+		if err != nil {
+			continue // Not this key file
+		}
+		var key MasterKey
+		if err := json.Unmarshal(plain, &key); err != nil {
+			return nil, fmt.Errorf("failed to parse master key from %s: %w", path, err)
+		}
+		if len(key.Encrypt) != masterKeySize || len(key.MAC) != masterKeySize {
+			return nil, fmt.Errorf("master key in %s has invalid length", path)
+		}
+		return &key, nil
+	}
+	return nil, ErrWrongPassphrase
+}
+
+// seal encrypts plain with XChaCha20-Poly1305 and returns nonce || ciphertext.
+func seal(key, plain, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(out, out, plain, additionalData), nil
+}
+
+// open decrypts data produced by seal.
+func open(key, data, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// isEncryptedBlob reports whether data starts with the encryption magic.
+func isEncryptedBlob(data []byte) bool {
+	return len(data) >= len(encryptedMagic) && bytes.Equal(data[:len(encryptedMagic)], encryptedMagic)
+}
+
+// sealBlob encrypts data with the master key. additionalData binds the ciphertext to its name.
+func (k *MasterKey) sealBlob(data, additionalData []byte) ([]byte, error) {
+	sealed, err := seal(k.Encrypt, data, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, encryptedMagic...), sealed...), nil
+}
+
+// openBlob decrypts data produced by sealBlob.
+func (k *MasterKey) openBlob(data, additionalData []byte) ([]byte, error) {
+	if !isEncryptedBlob(data) {
+		return nil, errors.New("data is not encrypted")
+	}
+	plain, err := open(k.Encrypt, data[len(encryptedMagic):], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed (data corrupt or tampered): %w", err)
+	}
+	return plain, nil
+}
+
+// objectID returns the keyed name of an object with the given plaintext content:
+// HMAC-SHA256, or keyed BLAKE3 in BLAKE3 repositories.
+func (k *MasterKey) objectID(algorithm string, data []byte) string {
+	var mac hash.Hash
+	if algorithm == HashBLAKE3 {
+		mac = blake3.New(32, k.MAC)
+	} else {
+		mac = hmac.New(sha256.New, k.MAC)
+	}
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -2,11 +2,12 @@ package backend
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -24,54 +25,123 @@ type DeploymentProgress struct {
 
 // DeploymentConfig holds configuration for deployment operations
 type DeploymentConfig struct {
-	SnapshotPath     string `yaml:"snapshotPath"`
-	TargetPath       string `yaml:"targetPath"`
-	CASBaseDir       string `yaml:"casBaseDir"`
-	PreserveModTimes bool   `yaml:"preserveModTimes"`
-	UseHardLinks     bool   `yaml:"useHardLinks"`
-	IgnorePatterns   []string `yaml:"ignorePatterns"`
+	SnapshotID       string        `yaml:"snapshotID"`   // Snapshot of the repository to deploy; SnapshotPath is used if empty
+	SnapshotPath     string        `yaml:"snapshotPath"` // Snapshot file to deploy, named by its snapshot ID
+	TargetPath       string        `yaml:"targetPath"`
+	CASBaseDir       string        `yaml:"casBaseDir"`
+	PreserveModTimes bool          `yaml:"preserveModTimes"`
+	UseHardLinks     bool          `yaml:"useHardLinks"` // Ignored; files are always copied out of the repository
+	IgnorePatterns   []string      `yaml:"ignorePatterns"`
+	Passphrase       string        `json:"-" yaml:"-"`             // Passphrase for encrypted repositories; never persisted
+	Storage          StorageConfig `json:"storage" yaml:"storage"` // Remote storage of the repository; CASBaseDir is used if none is set
 }
 
 // SmartDeploy performs intelligent deployment with file comparison
 func SmartDeploy(ctx context.Context, config DeploymentConfig, progressCallback func(DeploymentProgress)) error {
+	repo, err := OpenRepositoryWithConfig(config.CASBaseDir, config.Storage, config.Passphrase)
+	if err != nil {
+		progressCallback(DeploymentProgress{
+			Status: "Failed",
+			Error:  fmt.Sprintf("Failed to open repository: %v", err),
+		})
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer repo.Close()
+
+	return DeployFromRepository(ctx, repo, config, progressCallback)
+}
+
+// DeployFromRepository deploys a snapshot of an open repository, whatever storage it is kept in.
+// config.CASBaseDir and config.Passphrase are not used; the repository is already open.
+func DeployFromRepository(ctx context.Context, repo *Repository, config DeploymentConfig, progressCallback func(DeploymentProgress)) error {
 	// Initialize progress
 	progress := DeploymentProgress{
 		Status: "Initializing...",
 	}
 	progressCallback(progress)
 
-	// Load the snapshot
-	snapshot, err := LoadSnapshotFromFile(config.SnapshotPath)
+	lock, err := repo.AcquireLock(ctx, false, "restore")
+	if err != nil {
+		progress.Status = "Failed"
+		progress.Error = err.Error()
+		progressCallback(progress)
+		return err
+	}
+	defer lock.Release()
+
+	// Open the snapshot by its ID, or by the ID in the name of the snapshot file; a
+	// snapshot file that isn't stored in the repository is read directly
+	snapshotID := config.SnapshotID
+	if snapshotID == "" {
+		snapshotID = strings.TrimSuffix(filepath.Base(config.SnapshotPath), ".json")
+	}
+	openSnapshot := func() (*SnapshotReader, error) {
+		reader, err := repo.OpenSnapshot(ctx, snapshotID)
+		if isNotExist(err) && config.SnapshotID == "" {
+			reader, err = repo.OpenSnapshotFile(ctx, config.SnapshotPath)
+		}
+		return reader, err
+	}
+	reader, err := openSnapshot()
 	if err != nil {
 		progress.Status = "Failed"
 		progress.Error = fmt.Sprintf("Failed to load snapshot: %v", err)
 		progressCallback(progress)
 		return fmt.Errorf("failed to load snapshot: %w", err)
 	}
+	snapshot := reader.Snapshot()
 
 	progress.Status = "Planning deployment..."
 	progressCallback(progress)
 
-	// First pass: count files and plan deployment
+	// First pass: count files and plan deployment. The snapshot is read twice
+	// instead of holding the file list in memory.
 	totalFiles := 0
-	filesToProcess := make(map[string]*FileEntry)
-
-	for relPath, fileEntry := range snapshot.Files {
-		// Skip files matching ignore patterns
-		if shouldIgnorePath(relPath, config.IgnorePatterns) {
-			continue
+	err = reader.Each(func(fileEntry *FileEntry) error {
+		// Skip directories and files matching ignore patterns
+		if fileEntry.NodeType() != NodeDir && !shouldIgnorePath(fileEntry.Path, config.IgnorePatterns) {
+			totalFiles++
 		}
-
-		totalFiles++
-		filesToProcess[relPath] = fileEntry
+		return nil
+	})
+	if err == nil {
+		reader, err = openSnapshot()
+	}
+	if err != nil {
+		progress.Status = "Failed"
+		progress.Error = fmt.Sprintf("Failed to read snapshot: %v", err)
+		progressCallback(progress)
+		return fmt.Errorf("failed to read snapshot: %w", err)
 	}
 
 	progress.TotalFiles = totalFiles
 	progress.Status = "Deploying files..."
 	progressCallback(progress)
 
-	// Process each file
-	for relPath, fileEntry := range filesToProcess {
+	// Process each file; directories come before their content
+	dirs := &deployedDirs{targetPath: config.TargetPath, preserveModTimes: config.PreserveModTimes}
+	// All sources deploy into the target directory, which takes the metadata of the first
+	// source directory that has any
+	for _, sourceDir := range snapshot.SourceDirs {
+		if sourceDir == nil {
+			continue
+		}
+		root := *sourceDir
+		root.Path = ""
+		if err := dirs.enter(&root); err != nil {
+			progress.Status = "Failed"
+			progress.Error = fmt.Sprintf("Failed to create %s: %v", config.TargetPath, err)
+			progressCallback(progress)
+			return fmt.Errorf("failed to create %s: %w", config.TargetPath, err)
+		}
+		break
+	}
+	err = reader.Each(func(fileEntry *FileEntry) error {
+		relPath := fileEntry.Path
+		if shouldIgnorePath(relPath, config.IgnorePatterns) {
+			return nil
+		}
+
 		select {
 		case <-ctx.Done():
 			progress.Status = "Cancelled"
@@ -82,13 +152,47 @@ func SmartDeploy(ctx context.Context, config DeploymentConfig, progressCallback
 			// Continue
 		}
 
+		if err := dirs.leave(relPath); err != nil {
+			progress.Status = "Failed"
+			progress.Error = err.Error()
+			progressCallback(progress)
+			return err
+		}
+		targetPath := filepath.Join(config.TargetPath, relPath)
+		if fileEntry.NodeType() == NodeDir {
+			if err := dirs.enter(fileEntry); err != nil {
+				progress.Status = "Failed"
+				progress.Error = fmt.Sprintf("Failed to create directory %s: %v", relPath, err)
+				progressCallback(progress)
+				return fmt.Errorf("failed to create directory %s: %w", relPath, err)
+			}
+			return nil
+		}
+
 		progress.CurrentFile = relPath
 		progress.FilesProcessed++
-		
-		targetPath := filepath.Join(config.TargetPath, relPath)
+
+		if fileEntry.NodeType() == NodeSymlink {
+			created, err := deploySymlink(targetPath, fileEntry)
+			if err != nil {
+				progress.Status = "Failed"
+				progress.Error = fmt.Sprintf("Failed to create symlink %s: %v", relPath, err)
+				progressCallback(progress)
+				return fmt.Errorf("failed to create symlink %s: %w", relPath, err)
+			}
+			if created {
+				progress.FilesCopied++
+				progress.Status = "→ " + filepath.Base(relPath)
+			} else {
+				progress.FilesSkipped++
+				progress.Status = "= " + filepath.Base(relPath)
+			}
+			progressCallback(progress)
+			return nil
+		}
 
 		// Check if deployment is needed
-		needsCopy, err := needsFileCopy(ctx, config.CASBaseDir, targetPath, fileEntry)
+		needsCopy, err := needsFileCopy(ctx, snapshot.FileHashAlgorithm(), targetPath, fileEntry)
 		if err != nil {
 			progress.Status = "Failed"
 			progress.Error = fmt.Sprintf("Error checking %s: %v", relPath, err)
@@ -101,7 +205,7 @@ func SmartDeploy(ctx context.Context, config DeploymentConfig, progressCallback
 			progress.FilesSkipped++
 			progress.Status = "= " + filepath.Base(relPath) // Skipped indicator
 			progressCallback(progress)
-			continue
+			return nil
 		}
 
 		// Ensure target directory exists
@@ -116,7 +220,7 @@ func SmartDeploy(ctx context.Context, config DeploymentConfig, progressCallback
 		progress.Status = "→ " + filepath.Base(relPath) // Copy indicator
 		progressCallback(progress)
 
-		bytesCopied, err := deployFile(ctx, config, targetPath, fileEntry)
+		bytesCopied, err := deployFile(ctx, repo, config, targetPath, fileEntry)
 		if err != nil {
 			if err == context.Canceled {
 				progress.Status = "Cancelled"
@@ -133,6 +237,30 @@ func SmartDeploy(ctx context.Context, config DeploymentConfig, progressCallback
 		progress.FilesCopied++
 		progress.BytesCopied += bytesCopied
 		progressCallback(progress)
+		return nil
+	})
+	if err == nil {
+		if err = dirs.leave(""); err != nil {
+			progress.Status = "Failed"
+			progress.Error = err.Error()
+			progressCallback(progress)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			if progress.Status != "Cancelled" {
+				progress.Status = "Cancelled"
+				progress.Error = "Deployment cancelled by user"
+				progressCallback(progress)
+			}
+			return ctx.Err()
+		}
+		if progress.Status != "Failed" {
+			progress.Status = "Failed"
+			progress.Error = fmt.Sprintf("Failed to read snapshot: %v", err)
+			progressCallback(progress)
+		}
+		return err
 	}
 
 	// Check for context cancellation before final operations
@@ -159,15 +287,18 @@ func SmartDeploy(ctx context.Context, config DeploymentConfig, progressCallback
 }
 
 // needsFileCopy determines if a file needs to be copied based on content comparison
-func needsFileCopy(ctx context.Context, casBaseDir, targetPath string, fileEntry *FileEntry) (bool, error) {
+func needsFileCopy(ctx context.Context, hashAlgorithm, targetPath string, fileEntry *FileEntry) (bool, error) {
 	// Check if target file exists
-	targetInfo, err := os.Stat(targetPath)
+	targetInfo, err := os.Lstat(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return true, nil // File doesn't exist, needs copy
 		}
 		return false, err
 	}
+	if !targetInfo.Mode().IsRegular() {
+		return true, nil // A symlink or directory is in the way
+	}
 
 	// Quick size check first
 	if targetInfo.Size() != fileEntry.Size {
@@ -180,7 +311,7 @@ func needsFileCopy(ctx context.Context, casBaseDir, targetPath string, fileEntry
 	}
 
 	// Compare file hashes
-	targetHash, err := computeFileHash(ctx, targetPath)
+	targetHash, err := HashFile(ctx, hashAlgorithm, targetPath)
 	if err != nil {
 		return false, fmt.Errorf("failed to compute target file hash: %w", err)
 	}
@@ -191,77 +322,90 @@ func needsFileCopy(ctx context.Context, casBaseDir, targetPath string, fileEntry
 	return targetHash != sourceHash, nil
 }
 
-// computeFileHash calculates SHA256 hash of a file
-func computeFileHash(ctx context.Context, filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
 
-	hasher := sha256.New()
-	buf := make([]byte, 32*1024) // 32KB buffer
+// deployedDirs are the directories on the path of the entry being deployed, outermost
+// first. Their mode and modification time are only set once their content is in place:
+// creating files changes the modification time of a directory, and a read-only directory
+// couldn't take them.
+type deployedDirs struct {
+	targetPath       string
+	preserveModTimes bool
+	open             []*FileEntry
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return "", ctx.Err()
-		default:
-			// Continue
+// enter creates a directory, replacing a file or symlink in its place, and keeps it open.
+func (d *deployedDirs) enter(entry *FileEntry) error {
+	targetPath := filepath.Join(d.targetPath, entry.Path)
+	if info, err := os.Lstat(targetPath); err == nil && !info.IsDir() {
+		if err := os.Remove(targetPath); err != nil {
+			return err
 		}
+	}
+	if err := os.MkdirAll(targetPath, 0755); err != nil {
+		return err
+	}
+	d.open = append(d.open, entry)
+	return nil
+}
 
-		n, err := file.Read(buf)
-		if n > 0 {
-			if _, err := hasher.Write(buf[:n]); err != nil {
-				return "", err
-			}
+// leave finishes the open directories relPath is not in; "" finishes all of them. The
+// target directory itself is open with an empty path.
+func (d *deployedDirs) leave(relPath string) error {
+	for len(d.open) > 0 {
+		top := d.open[len(d.open)-1]
+		if relPath != "" && (top.Path == "" || strings.HasPrefix(relPath, top.Path+"/")) {
+			return nil
 		}
-		if err == io.EOF {
-			break
+		d.open = d.open[:len(d.open)-1]
+		targetPath := filepath.Join(d.targetPath, top.Path)
+		// Directories of snapshots from before they were recorded have no mode
+		if top.Mode != 0 {
+			if err := os.Chmod(targetPath, top.Mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+				return fmt.Errorf("failed to set mode of %s: %w", top.Path, err)
+			}
 		}
-		if err != nil {
-			return "", err
+		if d.preserveModTimes && !top.ModTime.IsZero() {
+			if err := setFileModTime(targetPath, top.ModTime); err != nil {
+				return fmt.Errorf("failed to preserve modification time of %s: %w", top.Path, err)
+			}
 		}
 	}
-
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	return nil
 }
 
-// deployFile copies a single file using the optimal method
-func deployFile(ctx context.Context, config DeploymentConfig, targetPath string, fileEntry *FileEntry) (int64, error) {
-	// Get source file from CAS
-	sourcePath := filepath.Join(config.CASBaseDir, fileEntry.Hash[:2], fileEntry.Hash)
-
-	// If hard links are enabled and file sizes match, try to create a hard link
-	if config.UseHardLinks {
-		sourceInfo, err := os.Stat(sourcePath)
-		if err == nil && sourceInfo.Size() == fileEntry.Size {
-			// Remove target if it exists
-			os.Remove(targetPath)
-			
-			if err := os.Link(sourcePath, targetPath); err == nil {
-				// Hard link successful
-				if config.PreserveModTimes {
-					setFileModTime(targetPath, fileEntry.ModTime)
-				}
-				return fileEntry.Size, nil
-			}
-			// If hard link fails, fall back to copy
-		}
+// deploySymlink creates a symlink, replacing whatever is in its place, unless there already
+// is one with the same target. It reports whether it created the link. The modification
+// time of the link itself is not restored.
+func deploySymlink(targetPath string, fileEntry *FileEntry) (bool, error) {
+	if current, err := os.Readlink(targetPath); err == nil && current == fileEntry.LinkTarget {
+		return false, nil
 	}
-
-	// Fall back to regular copy
-	return copyFilePreservingAttributes(ctx, sourcePath, targetPath, fileEntry, config.PreserveModTimes)
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return false, err
+	}
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Symlink(fileEntry.LinkTarget, targetPath); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// copyFilePreservingAttributes copies a file while preserving attributes
-func copyFilePreservingAttributes(ctx context.Context, src, dst string, fileEntry *FileEntry, preserveModTime bool) (int64, error) {
-	srcFile, err := os.Open(src)
+// deployFile writes a single file, reassembling its content from the repository. Repository
+// objects are always copied, never linked, so changes to deployed files can't reach them.
+func deployFile(ctx context.Context, repo *Repository, config DeploymentConfig, targetPath string, fileEntry *FileEntry) (int64, error) {
+	content, err := repo.RetrieveFile(fileEntry)
 	if err != nil {
 		return 0, err
 	}
-	defer srcFile.Close()
+	defer content.Close()
 
+	return copyFilePreservingAttributes(ctx, content, targetPath, fileEntry, config.PreserveModTimes)
+}
+
+// copyFilePreservingAttributes copies content into a file while preserving attributes
+func copyFilePreservingAttributes(ctx context.Context, src io.Reader, dst string, fileEntry *FileEntry, preserveModTime bool) (int64, error) {
 	// Remove destination if it exists
 	os.Remove(dst)
 
@@ -283,7 +427,7 @@ func copyFilePreservingAttributes(ctx context.Context, src, dst string, fileEntr
 			// Continue
 		}
 
-		nr, err := srcFile.Read(buf)
+		nr, err := src.Read(buf)
 		if nr > 0 {
 			nw, err := dstFile.Write(buf[:nr])
 			if nw > 0 {
@@ -304,6 +448,13 @@ func copyFilePreservingAttributes(ctx context.Context, src, dst string, fileEntr
 		}
 	}
 
+	// Files of snapshots from before modes were recorded keep the default mode
+	if fileEntry.Mode != 0 {
+		if err := os.Chmod(dst, fileEntry.Mode.Perm()); err != nil {
+			return bytesCopied, fmt.Errorf("failed to set mode: %w", err)
+		}
+	}
+
 	// Preserve modification time if requested
 	if preserveModTime {
 		if err := setFileModTime(dst, fileEntry.ModTime); err != nil {
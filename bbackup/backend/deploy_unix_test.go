@@ -0,0 +1,155 @@
+//go:build !windows
+
+package backend
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestNodeTypes checks that backups keep directories, empty ones included, with their mode and
+// modification time, store symlinks without following them and skip named pipes, and that
+// a deployment recreates all of them
+func TestNodeTypes(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(sourceDir, "readonly"), 0755)
+		os.Chmod(filepath.Join(targetDir, "readonly"), 0755)
+	})
+	docsTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	emptyTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	rootTime := time.Date(2022, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	for _, dir := range []string{"docs", "empty", "readonly"} {
+		if err := os.Mkdir(filepath.Join(sourceDir, dir), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	for name, content := range map[string]string{"docs/a.txt": "hello", "readonly/f.txt": "locked"} {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	for name, target := range map[string]string{"link": "docs/a.txt", "dangling": "missing", "linkdir": "docs"} {
+		if err := os.Symlink(target, filepath.Join(sourceDir, name)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(sourceDir, "pipe"), 0644); err != nil {
+		t.Fatalf("Failed to create named pipe: %v", err)
+	}
+	for dir, mode := range map[string]fs.FileMode{"": 0750, "docs": 0750, "docs/a.txt": 0755, "empty": 0700, "readonly": 0555} {
+		if err := os.Chmod(filepath.Join(sourceDir, dir), mode); err != nil {
+			t.Fatalf("Failed to set mode: %v", err)
+		}
+	}
+	os.Chtimes(filepath.Join(sourceDir, "docs"), docsTime, docsTime)
+	os.Chtimes(filepath.Join(sourceDir, "empty"), emptyTime, emptyTime)
+	os.Chtimes(sourceDir, rootTime, rootTime)
+
+	if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	snapshot, err := repo.FindLatest(ctx, SnapshotQuery{})
+	if err != nil || snapshot == nil {
+		t.Fatalf("Expected to find the backup, got %v", err)
+	}
+	if summary := snapshot.Summary; summary.Skipped != 1 || summary.Errors != 0 || summary.FilesNew != 2 {
+		t.Errorf("Expected the pipe to be skipped and two files stored, got %+v", summary)
+	}
+	nodes, err := repo.ListSnapshotDir(ctx, snapshot, 0, "")
+	if err != nil {
+		t.Fatalf("Failed to list snapshot: %v", err)
+	}
+	var listed []string
+	for _, node := range nodes {
+		listed = append(listed, node.Name+":"+node.Type)
+	}
+	if got := strings.Join(listed, " "); got != "dangling:symlink docs:dir empty:dir link:symlink linkdir:symlink readonly:dir" {
+		t.Errorf("Unexpected snapshot root %s", got)
+	}
+
+	// Things of other types in the way are replaced
+	if err := os.WriteFile(filepath.Join(targetDir, "link"), []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(targetDir, "empty"), []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	var last DeploymentProgress
+	config := DeploymentConfig{SnapshotID: snapshot.ID, TargetPath: targetDir, PreserveModTimes: true}
+	if err := DeployFromRepository(ctx, repo, config, func(p DeploymentProgress) { last = p }); err != nil {
+		t.Fatalf("Deploy failed: %v", err)
+	}
+	if last.TotalFiles != 5 || last.FilesCopied != 5 {
+		t.Errorf("Expected two files and three symlinks deployed, got %+v", last)
+	}
+	for dir, want := range map[string]struct {
+		mode    fs.FileMode
+		modTime time.Time
+	}{"": {0750, rootTime}, "docs": {0750, docsTime}, "empty": {0700, emptyTime}, "readonly": {0555, time.Time{}}} {
+		info, err := os.Lstat(filepath.Join(targetDir, dir))
+		if err != nil || !info.IsDir() || info.Mode().Perm() != want.mode {
+			t.Errorf("Expected %s to be a directory with mode %v, got %v (err=%v)", dir, want.mode, info, err)
+			continue
+		}
+		if !want.modTime.IsZero() && !info.ModTime().Equal(want.modTime) {
+			t.Errorf("Expected %s to be modified at %s, got %s", dir, want.modTime, info.ModTime())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(targetDir, "docs/a.txt")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected docs/a.txt to keep its mode 0755, got %v (err=%v)", info, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(targetDir, "readonly/f.txt")); err != nil || string(data) != "locked" {
+		t.Errorf("Expected the file in the read-only directory, got %q (err=%v)", data, err)
+	}
+	for name, want := range map[string]string{"link": "docs/a.txt", "dangling": "missing", "linkdir": "docs"} {
+		if target, err := os.Readlink(filepath.Join(targetDir, name)); err != nil || target != want {
+			t.Errorf("Expected %s to link to %s, got %q (err=%v)", name, want, target, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "pipe")); !os.IsNotExist(err) {
+		t.Errorf("Expected the named pipe not to be deployed, got %v", err)
+	}
+
+	// Deploying again finds everything in place
+	if err := DeployFromRepository(ctx, repo, config, func(p DeploymentProgress) { last = p }); err != nil {
+		t.Fatalf("Second deploy failed: %v", err)
+	}
+	if last.FilesCopied != 0 || last.FilesSkipped != 5 {
+		t.Errorf("Expected nothing to be deployed again, got %+v", last)
+	}
+
+	// A symlink pointing elsewhere is a modified entry
+	os.Remove(filepath.Join(sourceDir, "link"))
+	if err := os.Symlink("readonly/f.txt", filepath.Join(sourceDir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+	latest, err := repo.FindLatest(ctx, SnapshotQuery{})
+	if err != nil {
+		t.Fatalf("Failed to find the second backup: %v", err)
+	}
+	var changes []string
+	err = repo.DiffSnapshots(ctx, snapshot, latest, func(change SnapshotChange) error {
+		changes = append(changes, change.Change+" "+change.Path)
+		return nil
+	})
+	if err != nil || strings.Join(changes, ", ") != "modified link" {
+		t.Errorf("Unexpected changes %v (err=%v)", changes, err)
+	}
+}
@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"lukechampine.com/blake3"
+)
+
+// Content hash algorithms. The content hash names objects and packs and identifies whole
+// files in snapshots. It is chosen when a repository is initialized and recorded in its
+// config and in every snapshot, so files can be compared with snapshot entries without
+// opening the repository.
+const (
+	HashSHA256 = "sha256" // The default
+	HashBLAKE3 = "blake3" // Several times faster than SHA-256
+)
+
+// ValidHashAlgorithm reports whether algorithm names a supported content hash.
+func ValidHashAlgorithm(algorithm string) bool {
+	return algorithm == HashSHA256 || algorithm == HashBLAKE3
+}
+
+// newHasher returns a hash of the given algorithm; "" means SHA-256, which repositories and
+// snapshots used before the algorithm was recorded.
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "", HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+}
+
+// hashBytes returns the hex-encoded hash of data.
+func hashBytes(algorithm string, data []byte) string {
+	if algorithm == HashBLAKE3 {
+		sum := blake3.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	return sha256Hex(data)
+}
+
+// HashReader returns the hex-encoded hash of everything read from rd, stopping early if
+// the context is cancelled.
+func HashReader(ctx context.Context, algorithm string, rd io.Reader) (string, error) {
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := copyWithContext(ctx, hasher, rd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HashFile returns the hex-encoded hash of the file at filePath.
+func HashFile(ctx context.Context, algorithm string, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	sum, err := HashReader(ctx, algorithm, file)
+	if err != nil {
+		return "", fmt.Errorf("failed to calculate hash for file %s: %w", filePath, err)
+	}
+	return sum, nil
+}
+
+// hashAlgorithmOrDefault returns algorithm, or SHA-256 for configs and snapshots written
+// before the algorithm was recorded.
+func hashAlgorithmOrDefault(algorithm string) string {
+	if algorithm == "" {
+		return HashSHA256
+	}
+	return algorithm
+}
+
+// newHasher returns a hash of the repository's algorithm.
+func (r *Repository) newHasher() (hash.Hash, error) {
+	return newHasher(r.config.HashAlgorithm)
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBLAKE3Repository checks that a BLAKE3 repository names objects and hashes files with
+// BLAKE3, records it in its snapshots, and that check, restore, deploy and copy to a SHA-256
+// repository all follow the recorded algorithm
+func TestBLAKE3Repository(t *testing.T) {
+	ctx := context.Background()
+	sourceDir := t.TempDir()
+	contents := map[string][]byte{"small": make([]byte, 1000), "large": make([]byte, 3*1024*1024)}
+	for name, data := range contents {
+		rand.New(rand.NewSource(int64(len(data)))).Read(data)
+		if err := os.WriteFile(filepath.Join(sourceDir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	for _, passphrase := range []string{"", "correct horse"} {
+		config := DefaultRepoConfig()
+		config.HashAlgorithm = HashBLAKE3
+		repo, err := InitRepository(NewMemoryStorage(), config, passphrase)
+		if err != nil {
+			t.Fatalf("Failed to init repository: %v", err)
+		}
+		if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+		ids, err := repo.listFiles(ctx, SnapshotFile)
+		if err != nil || len(ids) != 1 {
+			t.Fatalf("Expected one snapshot, got %v (err=%v)", ids, err)
+		}
+		snapshot, err := repo.LoadSnapshot(ids[0])
+		if err != nil {
+			t.Fatalf("Failed to load snapshot: %v", err)
+		}
+		if snapshot.HashAlgorithm != HashBLAKE3 {
+			t.Errorf("Expected the snapshot to record %s, got %q", HashBLAKE3, snapshot.HashAlgorithm)
+		}
+
+		for name, data := range contents {
+			path := filepath.Join(sourceDir, name)
+			entry, err := repo.SnapshotFile(ctx, snapshot, name)
+			if err != nil {
+				t.Fatalf("Expected %s in the snapshot: %v", name, err)
+			}
+			if want, _ := HashFile(ctx, HashBLAKE3, path); entry.Hash != want {
+				t.Errorf("Expected the BLAKE3 hash %s for %s, got %s", want, name, entry.Hash)
+			}
+			if sha, _ := HashFile(ctx, HashSHA256, path); entry.Hash == sha {
+				t.Errorf("Expected %s not to be hashed with SHA-256", name)
+			}
+			rc, err := repo.RetrieveFile(entry)
+			if err != nil {
+				t.Fatalf("Failed to retrieve %s: %v", name, err)
+			}
+			restored, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(restored, data) {
+				t.Errorf("Restored content of %s differs (err=%v)", name, err)
+			}
+			if needsCopy, err := needsFileCopy(ctx, snapshot.FileHashAlgorithm(), path, entry); err != nil || needsCopy {
+				t.Errorf("Expected deploy to find %s up to date, got %v (err=%v)", name, needsCopy, err)
+			}
+		}
+
+		report, err := repo.Check(ctx, CheckOptions{ReadDataPercent: 100}, nil)
+		if err != nil || !report.OK() {
+			t.Errorf("Expected the check to pass, got %+v (err=%v)", report, err)
+		}
+		if passphrase != "" {
+			continue
+		}
+
+		// Copied to a SHA-256 repository, objects are renamed but file hashes are kept
+		dst, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+		if err != nil {
+			t.Fatalf("Failed to init destination: %v", err)
+		}
+		if _, err := repo.CopySnapshots(ctx, dst, SnapshotFilter{}, nil); err != nil {
+			t.Fatalf("Failed to copy snapshots: %v", err)
+		}
+		copied, err := dst.LoadSnapshot(ids[0])
+		if err != nil {
+			t.Fatalf("Failed to load copied snapshot: %v", err)
+		}
+		if copied.HashAlgorithm != HashBLAKE3 {
+			t.Errorf("Expected the copied snapshot to keep %s file hashes, got %q", HashBLAKE3, copied.HashAlgorithm)
+		}
+		large, err := dst.SnapshotFile(ctx, copied, "large")
+		if err != nil {
+			t.Fatalf("Expected large in the copied snapshot: %v", err)
+		}
+		original, _ := repo.SnapshotFile(ctx, snapshot, "large")
+		if large.Hash != original.Hash || large.Chunks[0] == original.Chunks[0] {
+			t.Errorf("Expected the same file hash under new object names, got %+v", large)
+		}
+		if report, err := dst.Check(ctx, CheckOptions{ReadDataPercent: 100}, nil); err != nil || !report.OK() {
+			t.Errorf("Expected the destination check to pass, got %+v (err=%v)", report, err)
+		}
+
+		// A backup into the copy can't take file hashes from the copied snapshot, and says so
+		if err := RunRepositoryBackup(ctx, dst, []string{sourceDir}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+			t.Fatalf("Backup into the destination failed: %v", err)
+		}
+		latest, err := dst.FindLatest(ctx, SnapshotQuery{})
+		if err != nil || latest == nil {
+			t.Fatalf("Expected to find the backup, got %v", err)
+		}
+		if summary := latest.Summary; summary.FilesUnchanged != 0 || len(summary.Warnings) != 1 || !strings.Contains(summary.Warnings[0], HashBLAKE3) {
+			t.Errorf("Expected all files read again with a warning, got %+v", summary)
+		}
+	}
+
+	config := DefaultRepoConfig()
+	config.HashAlgorithm = "md5"
+	if _, err := InitRepository(NewMemoryStorage(), config, ""); err == nil {
+		t.Errorf("Expected an unsupported hash algorithm to be refused")
+	}
+	// A repository whose config names an unknown algorithm fails to store instead of crashing
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	repo.config.HashAlgorithm = "md5"
+	if _, err := repo.StoreFile(ctx, filepath.Join(sourceDir, "small")); err == nil {
+		t.Errorf("Expected storing with an unsupported hash algorithm to fail")
+	}
+}
@@ -0,0 +1,305 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Repository locks keep processes that write to the same repository from getting in each
+// other's way. Backups, restores and checks take shared locks, which any number of
+// processes can hold at once; prune and index repair take an exclusive lock, which
+// requires that no other lock is held.
+//
+// A lock is a file of type LockFile that records who holds it. The holder rewrites it
+// every lockRefreshInterval; a lock that hasn't been refreshed for lockStaleTimeout, or
+// whose process is known to be gone, is stale and is ignored and can be removed.
+
+var (
+	// lockRefreshInterval is how often a held lock is refreshed.
+	lockRefreshInterval = 5 * time.Minute
+	// lockStaleTimeout is the age after which a lock that wasn't refreshed is considered stale.
+	lockStaleTimeout = 30 * time.Minute
+)
+
+// ErrRepositoryLocked is matched (with errors.Is) by the error returned when a lock can't be
+// acquired because another process holds a conflicting lock.
+var ErrRepositoryLocked = errors.New("repository is locked")
+
+// LockInfo describes a lock and the process that holds it.
+type LockInfo struct {
+	Name      string    `json:"-"`         // Name of the lock file
+	Exclusive bool      `json:"exclusive"` // Exclusive locks can't be held together with any other lock
+	Operation string    `json:"operation"` // What the holder is doing, for messages
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Created   time.Time `json:"created"`
+	Refreshed time.Time `json:"refreshed"`
+}
+
+// Stale reports whether the lock was left behind by a process that is gone: it hasn't been
+// refreshed for longer than the stale timeout, or it was taken on this host by a process
+// that no longer exists.
+func (l LockInfo) Stale() bool {
+	if time.Since(l.Refreshed) > lockStaleTimeout {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname == l.Hostname {
+		return !processExists(l.PID)
+	}
+	return false
+}
+
+func (l LockInfo) String() string {
+	if l.Hostname == "" {
+		return fmt.Sprintf("lock %s that can't be read, last written %s", l.Name, l.Refreshed.Format(time.RFC3339))
+	}
+	kind := "shared"
+	if l.Exclusive {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%s lock for %s held by PID %d on %s since %s", kind, l.Operation, l.PID, l.Hostname, l.Created.Format(time.RFC3339))
+}
+
+// LockedError is returned when a lock conflicts with a lock held by another process.
+type LockedError struct {
+	Location string
+	Holder   LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("repository %s is locked: %s", e.Location, e.Holder)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrRepositoryLocked
+}
+
+// Lock is a lock held on a repository by this process.
+type Lock struct {
+	repo *Repository
+	info LockInfo
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// AcquireLock takes a shared or exclusive lock on the repository for the named operation.
+// The lock is refreshed in the background until it is released. It fails with an error
+// matching ErrRepositoryLocked if another process holds a conflicting lock that isn't stale.
+func (r *Repository) AcquireLock(ctx context.Context, exclusive bool, operation string) (*Lock, error) {
+	if err := r.checkLockConflicts(ctx, exclusive, ""); err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	name, err := randomName()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	lock := &Lock{
+		repo: r,
+		info: LockInfo{
+			Name:      name,
+			Exclusive: exclusive,
+			Operation: operation,
+			Hostname:  hostname,
+			PID:       os.Getpid(),
+			Created:   now,
+			Refreshed: now,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := r.saveLock(ctx, lock.info); err != nil {
+		return nil, err
+	}
+
+	// Another process may have written a conflicting lock while ours was being written
+	if err := r.checkLockConflicts(ctx, exclusive, name); err != nil {
+		r.storage.Remove(ctx, Handle{Type: LockFile, Name: name})
+		return nil, err
+	}
+
+	go lock.refresh()
+	return lock, nil
+}
+
+// acquireWriteLock is AcquireLock for operations that write to the repository. Once the lock
+// is held, it saves the config of a repository opened in an older format, see Migrate.
+func (r *Repository) acquireWriteLock(ctx context.Context, exclusive bool, operation string) (*Lock, error) {
+	lock, err := r.AcquireLock(ctx, exclusive, operation)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Migrate(); err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Info returns the description of the lock.
+func (l *Lock) Info() LockInfo {
+	return l.info
+}
+
+// Release stops refreshing the lock and removes its lock file. It is safe to call more than once
+// and on a nil lock.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		if removeErr := l.repo.storage.Remove(context.Background(), Handle{Type: LockFile, Name: l.info.Name}); removeErr != nil && !isNotExist(removeErr) {
+			err = fmt.Errorf("failed to remove lock %s: %w", l.info.Name, removeErr)
+		}
+	})
+	return err
+}
+
+// refresh rewrites the lock file periodically so other processes don't consider it stale.
+func (l *Lock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	info := l.info
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			info.Refreshed = time.Now()
+			if err := l.repo.saveLock(context.Background(), info); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to refresh lock on %s: %v\n", l.repo.Location(), err)
+			}
+		}
+	}
+}
+
+// checkLockConflicts returns a LockedError if a lock other than own that isn't stale
+// conflicts with a new shared or exclusive lock. A lock file that can't be read, being
+// written or from a process with another key, is taken for an exclusive lock until it is
+// stale by its modification time.
+func (r *Repository) checkLockConflicts(ctx context.Context, exclusive bool, own string) error {
+	locks, unreadable, err := r.listLocks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range append(locks, unreadable...) {
+		if info.Name == own || info.Stale() {
+			continue
+		}
+		if exclusive || info.Exclusive {
+			return &LockedError{Location: r.Location(), Holder: info}
+		}
+	}
+	return nil
+}
+
+// ListLocks returns all locks in the repository, including stale ones. Lock files that
+// can't be read are skipped with a warning.
+func (r *Repository) ListLocks(ctx context.Context) ([]LockInfo, error) {
+	locks, unreadable, err := r.listLocks(ctx)
+	for _, info := range unreadable {
+		fmt.Fprintf(os.Stderr, "Warning: Skipping unreadable lock %s\n", info.Name)
+	}
+	return locks, err
+}
+
+// listLocks returns the locks in the repository, and the lock files that can't be read as
+// exclusive locks with only their name and modification time set. Lock files removed while
+// listing are left out.
+func (r *Repository) listLocks(ctx context.Context) (locks, unreadable []LockInfo, err error) {
+	var files []StorageFileInfo
+	err = r.storage.List(ctx, LockFile, func(info StorageFileInfo) error {
+		files = append(files, info)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list %s: %w", LockFile, err)
+	}
+	for _, file := range files {
+		info, err := r.loadLock(ctx, file.Name)
+		if isNotExist(err) {
+			continue
+		} else if err != nil {
+			unreadable = append(unreadable, LockInfo{Name: file.Name, Exclusive: true, Refreshed: file.ModTime})
+			continue
+		}
+		locks = append(locks, info)
+	}
+	return locks, unreadable, nil
+}
+
+// RemoveLocks removes the stale locks from the repository, or all locks if all is set,
+// and returns the number of locks removed. It is meant for cleaning up after processes
+// that crashed; removing the lock of a running process lets others interfere with it.
+func (r *Repository) RemoveLocks(ctx context.Context, all bool) (int, error) {
+	locks, err := r.ListLocks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, info := range locks {
+		if !all && !info.Stale() {
+			continue
+		}
+		if err := r.storage.Remove(ctx, Handle{Type: LockFile, Name: info.Name}); err != nil && !isNotExist(err) {
+			return removed, fmt.Errorf("failed to remove lock %s: %w", info.Name, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// loadLock reads and decrypts a lock file.
+func (r *Repository) loadLock(ctx context.Context, name string) (LockInfo, error) {
+	var info LockInfo
+	data, err := loadAll(ctx, r.storage, Handle{Type: LockFile, Name: name})
+	if err != nil {
+		return info, err
+	}
+	if isEncryptedBlob(data) {
+		if r.key == nil {
+			return info, ErrPassphraseRequired
+		}
+		if data, err = r.key.openBlob(data, []byte(name)); err != nil {
+			return info, fmt.Errorf("lock %s: %w", name, err)
+		}
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("failed to parse lock %s: %w", name, err)
+	}
+	info.Name = name
+	return info, nil
+}
+
+// saveLock writes a lock file, encrypted in encrypted repositories.
+func (r *Repository) saveLock(ctx context.Context, info LockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock: %w", err)
+	}
+	if r.key != nil {
+		if data, err = r.key.sealBlob(data, []byte(info.Name)); err != nil {
+			return fmt.Errorf("failed to encrypt lock: %w", err)
+		}
+	}
+	if err := r.storage.Save(ctx, Handle{Type: LockFile, Name: info.Name}, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write lock: %w", err)
+	}
+	return nil
+}
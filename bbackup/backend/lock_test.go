@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRepositoryLocks checks that shared locks coexist, that exclusive locks conflict with
+// every other lock and that held locks are refreshed
+func TestRepositoryLocks(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	first, err := repo.AcquireLock(ctx, false, "backup")
+	if err != nil {
+		t.Fatalf("Failed to acquire shared lock: %v", err)
+	}
+	second, err := repo.AcquireLock(ctx, false, "restore")
+	if err != nil {
+		t.Fatalf("Failed to acquire a second shared lock: %v", err)
+	}
+	if _, err := repo.AcquireLock(ctx, true, "prune"); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Expected an exclusive lock to conflict with shared locks, got %v", err)
+	}
+	if _, err := repo.Prune(ctx, PruneOptions{}); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Expected prune to be refused during a backup, got %v", err)
+	}
+	first.Release()
+	second.Release()
+	second.Release()
+
+	exclusive, err := repo.AcquireLock(ctx, true, "prune")
+	if err != nil {
+		t.Fatalf("Failed to acquire exclusive lock after release: %v", err)
+	}
+	var locked *LockedError
+	if _, err := repo.AcquireLock(ctx, false, "backup"); !errors.As(err, &locked) || !locked.Holder.Exclusive || locked.Holder.PID != os.Getpid() {
+		t.Errorf("Expected a shared lock to conflict with the exclusive lock, got %v", err)
+	}
+	exclusive.Release()
+	if locks, _ := repo.ListLocks(ctx); len(locks) != 0 {
+		t.Errorf("Expected no locks after release, got %v", locks)
+	}
+
+	oldInterval := lockRefreshInterval
+	lockRefreshInterval = 10 * time.Millisecond
+	defer func() { lockRefreshInterval = oldInterval }()
+	refreshed, err := repo.AcquireLock(ctx, false, "backup")
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	defer refreshed.Release()
+	time.Sleep(50 * time.Millisecond)
+	info, err := repo.loadLock(ctx, refreshed.Info().Name)
+	if err != nil {
+		t.Fatalf("Failed to load lock: %v", err)
+	}
+	if !info.Refreshed.After(info.Created) {
+		t.Errorf("Expected the lock to be refreshed, got created %v refreshed %v", info.Created, info.Refreshed)
+	}
+}
+
+// TestStaleLocks checks that locks of crashed processes don't block others and can be removed
+func TestStaleLocks(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	hostname, _ := os.Hostname()
+
+	// A process on this host that has exited
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run helper process: %v", err)
+	}
+	now := time.Now()
+	stale := []LockInfo{
+		{Name: "crashed", Exclusive: true, Operation: "prune", Hostname: hostname, PID: cmd.Process.Pid, Created: now, Refreshed: now},
+		{Name: "abandoned", Exclusive: true, Operation: "prune", Hostname: "elsewhere", PID: 1, Created: now.Add(-time.Hour), Refreshed: now.Add(-time.Hour)},
+	}
+	live := LockInfo{Name: "running", Operation: "backup", Hostname: "elsewhere", PID: 1, Created: now, Refreshed: now}
+	for _, info := range append(stale, live) {
+		if err := repo.saveLock(ctx, info); err != nil {
+			t.Fatalf("Failed to write lock: %v", err)
+		}
+	}
+	for _, info := range stale {
+		if !info.Stale() {
+			t.Errorf("Expected lock %s to be stale", info.Name)
+		}
+	}
+	if live.Stale() {
+		t.Errorf("Expected a recently refreshed lock of another host to be live")
+	}
+
+	lock, err := repo.AcquireLock(ctx, false, "backup")
+	if err != nil {
+		t.Fatalf("Expected stale exclusive locks to be ignored, got %v", err)
+	}
+	lock.Release()
+
+	removed, err := repo.RemoveLocks(ctx, false)
+	if err != nil || removed != 2 {
+		t.Fatalf("Expected two stale locks to be removed, got %d (err=%v)", removed, err)
+	}
+	if _, err := repo.AcquireLock(ctx, true, "prune"); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Expected the live lock to be kept, got %v", err)
+	}
+	removed, err = repo.RemoveLocks(ctx, true)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected the remaining lock to be removed, got %d (err=%v)", removed, err)
+	}
+	lock, err = repo.AcquireLock(ctx, true, "prune")
+	if err != nil {
+		t.Fatalf("Failed to acquire exclusive lock after unlock: %v", err)
+	}
+	lock.Release()
+}
+
+// TestUnreadableLock checks that a lock file that can't be read blocks other locks until it
+// is stale by its modification time, and is left out of the listing
+func TestUnreadableLock(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalStorage(t.TempDir())
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	partial := Handle{Type: LockFile, Name: "partial"}
+	if err := storage.Save(ctx, partial, strings.NewReader(`{"exclusive":`)); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+
+	for _, exclusive := range []bool{true, false} {
+		var locked *LockedError
+		if _, err := repo.AcquireLock(ctx, exclusive, "prune"); !errors.As(err, &locked) || locked.Holder.Name != "partial" {
+			t.Errorf("Expected the unreadable lock to conflict, got %v", err)
+		}
+	}
+	if locks, err := repo.ListLocks(ctx); err != nil || len(locks) != 0 {
+		t.Errorf("Expected the unreadable lock not to be listed, got %v (err=%v)", locks, err)
+	}
+
+	old := time.Now().Add(-2 * lockStaleTimeout)
+	if err := os.Chtimes(storage.Path(partial), old, old); err != nil {
+		t.Fatalf("Failed to age lock: %v", err)
+	}
+	lock, err := repo.AcquireLock(ctx, true, "prune")
+	if err != nil {
+		t.Fatalf("Expected a stale unreadable lock to be ignored, got %v", err)
+	}
+	lock.Release()
+}
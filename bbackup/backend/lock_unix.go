@@ -0,0 +1,19 @@
+//go:build !windows
+
+package backend
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processExists reports whether a process with the given PID is running on this host.
+func processExists(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package backend
+
+import "os"
+
+// processExists reports whether a process with the given PID is running on this host.
+// On Windows, finding a process opens a handle to it, which fails if it has exited.
+func processExists(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	proc.Release()
+	return true
+}
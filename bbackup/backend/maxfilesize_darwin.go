@@ -0,0 +1,25 @@
+//go:build darwin
+
+package backend
+
+import "syscall"
+
+// filesystemMaxFileSize returns the largest file the filesystem holding dir can store, or 0
+// if its limit is too large to matter.
+func filesystemMaxFileSize(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if string(name) == "msdos" {
+		return fat32MaxFileSize, nil
+	}
+	return 0, nil
+}
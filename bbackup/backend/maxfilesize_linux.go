@@ -0,0 +1,21 @@
+//go:build linux
+
+package backend
+
+import "syscall"
+
+// msdosSuperMagic is the filesystem type of FAT filesystems in statfs
+const msdosSuperMagic = 0x4d44
+
+// filesystemMaxFileSize returns the largest file the filesystem holding dir can store, or 0
+// if its limit is too large to matter.
+func filesystemMaxFileSize(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	if st.Type == msdosSuperMagic {
+		return fat32MaxFileSize, nil
+	}
+	return 0, nil
+}
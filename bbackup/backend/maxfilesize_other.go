@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package backend
+
+// filesystemMaxFileSize returns 0: the filesystem type isn't detected on this platform, so
+// only a configured maximum file size applies.
+func filesystemMaxFileSize(dir string) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package backend
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// filesystemMaxFileSize returns the largest file the volume holding dir can store, or 0
+// if its limit is too large to matter.
+func filesystemMaxFileSize(dir string) (int64, error) {
+	root := filepath.VolumeName(dir) + `\`
+	p, err := windows.UTF16PtrFromString(root)
+	if err != nil {
+		return 0, err
+	}
+	name := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumeInformation(p, nil, 0, nil, nil, nil, &name[0], uint32(len(name))); err != nil {
+		return 0, err
+	}
+	switch windows.UTF16ToString(name) {
+	case "FAT32":
+		return fat32MaxFileSize, nil
+	case "FAT":
+		return 2*1024*1024*1024 - 1, nil
+	}
+	return 0, nil
+}
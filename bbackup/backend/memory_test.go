@@ -3,9 +3,11 @@ package backend
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -155,13 +157,17 @@ func TestMemoryEfficientBackup(t *testing.T) {
 			}
 			
 			// Verify snapshot can be loaded
-			snapshot, err := LoadLatestSnapshot(backupDir)
+			repo, err := OpenRepository(backupDir)
+			if err != nil {
+				t.Fatalf("Failed to open repository: %v", err)
+			}
+			snapshot, err := repo.LoadLatestSnapshot()
 			if err != nil {
 				t.Fatalf("Failed to load latest snapshot: %v", err)
 			}
 			
 			expectedFiles := numFiles
-			actualFiles := len(snapshot.Files)
+			actualFiles := countSnapshotFiles(t, repo, snapshot)
 			if actualFiles < expectedFiles*90/100 { // Allow 10% tolerance
 				t.Errorf("Expected at least %d files in snapshot, got %d", expectedFiles, actualFiles)
 			}
@@ -182,9 +188,8 @@ func TestStreamingSnapshotWriter(t *testing.T) {
 	casDir := filepath.Join(tempDir, "cas")
 	os.MkdirAll(casDir, 0755)
 	
-	// Create streaming snapshot writer with timestamp ID to match LoadLatestSnapshot expectations
-	// LoadLatestSnapshot expects a timestamp format like "20250101120000"
-	snapshotID := time.Now().Format("20060102150405")
+	// Create streaming snapshot writer
+	snapshotID := NewSnapshotID(time.Now())
 	writer, err := NewStreamingSnapshotWriter(casDir, snapshotID, []string{"/test/source"})
 	if err != nil {
 		t.Fatalf("Failed to create streaming snapshot writer: %v", err)
@@ -219,20 +224,234 @@ func TestStreamingSnapshotWriter(t *testing.T) {
 	}
 	
 	// Verify snapshot was created and can be loaded
-	snapshot, err := LoadLatestSnapshot(casDir)
+	repo, err := OpenRepository(casDir)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	snapshot, err := repo.LoadLatestSnapshot()
 	if err != nil {
 		t.Fatalf("Failed to load created snapshot: %v", err)
 	}
 	
-	if len(snapshot.Files) != numFiles {
-		t.Errorf("Expected %d files in snapshot, got %d", numFiles, len(snapshot.Files))
+	files := countSnapshotFiles(t, repo, snapshot)
+	if files != numFiles {
+		t.Errorf("Expected %d files in snapshot, got %d", numFiles, files)
 	}
 	
 	if snapshot.ID != snapshotID {
 		t.Errorf("Expected snapshot ID '%s', got '%s'", snapshotID, snapshot.ID)
 	}
 	
-	t.Logf("Successfully created and loaded snapshot with %d files", len(snapshot.Files))
+	t.Logf("Successfully created and loaded snapshot with %d files", files)
+}
+
+// countSnapshotFiles returns the number of files in a snapshot
+func countSnapshotFiles(t *testing.T, repo *Repository, snapshot *Snapshot) int {
+	files := 0
+	err := repo.WalkSnapshot(context.Background(), snapshot, func(entry *FileEntry) error {
+		if entry.NodeType() == NodeFile {
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	return files
+}
+
+// liveHeap returns the heap still in use after a garbage collection
+func liveHeap() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// TestSnapshotMemoryIsFlat writes and reads back snapshots of 10k files and of a much larger
+// count, and checks that the live heap doesn't grow with the number of files. The larger
+// count is 200k by default; set BBACKUP_SNAPSHOT_FILES=10000000 to check 10M files.
+func TestSnapshotMemoryIsFlat(t *testing.T) {
+	counts := []int{10000, 200000}
+	if n, err := strconv.Atoi(os.Getenv("BBACKUP_SNAPSHOT_FILES")); err == nil && n > counts[0] {
+		counts[1] = n
+	}
+	if testing.Short() {
+		counts = counts[:1]
+	}
+
+	// run writes and reads back a snapshot of numFiles files and returns how much the
+	// live heap grew meanwhile
+	run := func(numFiles int) uint64 {
+		casDir := t.TempDir()
+		snapshotID := "20250101120000"
+		before := liveHeap()
+		peak := before
+		sample := func(i int) {
+			if i%(numFiles/20) == 0 {
+				if heap := liveHeap(); heap > peak {
+					peak = heap
+				}
+			}
+		}
+
+		writer, err := NewStreamingSnapshotWriter(casDir, snapshotID, []string{"/test/source"})
+		if err != nil {
+			t.Fatalf("Failed to create streaming snapshot writer: %v", err)
+		}
+		modTime := time.Now()
+		for i := 0; i < numFiles; i++ {
+			entry := &FileEntry{
+				Path:    fmt.Sprintf("dir%05d/file%d.txt", i/1000, i),
+				Hash:    fmt.Sprintf("%064x", i),
+				Size:    int64(i),
+				ModTime: modTime,
+			}
+			if err := writer.AddFile(entry); err != nil {
+				t.Fatalf("Failed to add file entry %d: %v", i, err)
+			}
+			sample(i)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close streaming snapshot writer: %v", err)
+		}
+
+		repo, err := OpenRepository(casDir)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		reader, err := repo.OpenSnapshot(context.Background(), snapshotID)
+		if err != nil {
+			t.Fatalf("Failed to open snapshot: %v", err)
+		}
+		read := 0
+		err = reader.Each(func(entry *FileEntry) error {
+			sample(read)
+			if entry.NodeType() == NodeFile {
+				read++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to read snapshot: %v", err)
+		}
+		if read != numFiles {
+			t.Errorf("Expected %d files in snapshot, got %d", numFiles, read)
+		}
+		return peak - before
+	}
+
+	// The first snapshot also sets up the shared zstd encoder and decoder, which stay allocated
+	run(1000)
+	var baseline uint64
+	for _, numFiles := range counts {
+		growth := run(numFiles)
+		t.Logf("%d files: live heap grew by %.2f MB", numFiles, float64(growth)/1024/1024)
+		if baseline == 0 {
+			baseline = growth
+		} else if growth > baseline+8*1024*1024 {
+			t.Errorf("Memory grew with the number of files: %.2f MB for %d files, %.2f MB for %d",
+				float64(growth)/1024/1024, numFiles, float64(baseline)/1024/1024, counts[0])
+		}
+	}
+}
+
+// samplingWriter calls sample with the number of writes so far before each write
+type samplingWriter struct {
+	w      io.Writer
+	writes int
+	sample func(i int)
+}
+
+func (sw *samplingWriter) Write(p []byte) (int, error) {
+	sw.sample(sw.writes)
+	sw.writes++
+	return sw.w.Write(p)
+}
+
+// TestSnapshotStreamMemoryIsFlat does the same for snapshot files with a file list, which
+// encodeSnapshot writes one entry per line and SnapshotReader reads back a line at a time.
+// The entries being written are in memory already, so only the growth on top of them counts.
+func TestSnapshotStreamMemoryIsFlat(t *testing.T) {
+	counts := []int{20000, 200000}
+	if testing.Short() {
+		counts = counts[:1]
+	}
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	// run writes and reads back a snapshot file of numFiles files and returns how much
+	// the live heap grew meanwhile
+	run := func(numFiles int) uint64 {
+		snapshotPath := filepath.Join(t.TempDir(), "20250101120000.json")
+		snapshot := &Snapshot{
+			ID:        "20250101120000",
+			Timestamp: time.Now(),
+			Source:    []string{"/test/source"},
+			Files:     make(map[string]*FileEntry, numFiles),
+		}
+		for i := 0; i < numFiles; i++ {
+			p := fmt.Sprintf("dir%05d/file%d.txt", i/1000, i)
+			snapshot.Files[p] = &FileEntry{Hash: fmt.Sprintf("%064x", i), Size: int64(i), Mode: 0644, ModTime: snapshot.Timestamp}
+		}
+		before := liveHeap()
+		peak := before
+		sample := func(i int) {
+			if i%(numFiles/20) == 0 {
+				if heap := liveHeap(); heap > peak {
+					peak = heap
+				}
+			}
+		}
+
+		file, err := os.Create(snapshotPath)
+		if err != nil {
+			t.Fatalf("Failed to create snapshot file: %v", err)
+		}
+		if err := encodeSnapshot(&samplingWriter{w: file, sample: sample}, snapshot); err != nil {
+			t.Fatalf("Failed to write snapshot: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to write snapshot: %v", err)
+		}
+		writeGrowth := peak - before
+
+		snapshot = nil
+		before = liveHeap()
+		peak = before
+		reader, err := repo.OpenSnapshotFile(context.Background(), snapshotPath)
+		if err != nil {
+			t.Fatalf("Failed to open snapshot: %v", err)
+		}
+		defer reader.Close()
+		read := 0
+		err = reader.Each(func(entry *FileEntry) error {
+			sample(read)
+			read++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to read snapshot: %v", err)
+		}
+		if read != numFiles {
+			t.Errorf("Expected %d files in snapshot, got %d", numFiles, read)
+		}
+		return max(writeGrowth, peak-before)
+	}
+
+	run(1000)
+	growth := make([]uint64, len(counts))
+	for i, numFiles := range counts {
+		growth[i] = run(numFiles)
+		t.Logf("%d files: live heap grew by %.2f MB", numFiles, float64(growth[i])/1024/1024)
+	}
+	// Sorting the paths of the entries to write takes a string header per file
+	if len(counts) > 1 && growth[1] > growth[0]+8*1024*1024 {
+		t.Errorf("Memory grew with the number of files: %.2f MB for %d files, %.2f MB for %d",
+			float64(growth[1])/1024/1024, counts[1], float64(growth[0])/1024/1024, counts[0])
+	}
 }
 
 // TestMemoryStats tests the memory statistics functionality
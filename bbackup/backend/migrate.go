@@ -0,0 +1,87 @@
+package backend
+
+import "fmt"
+
+// repoMigration upgrades a repository from one format version to the next.
+type repoMigration struct {
+	from        int
+	description string
+	run         func(r *Repository) error
+}
+
+// repoMigrations lists the upgrade steps in order. Each step leaves the repository in the
+// format of version from+1. The steps only change the config in memory, so a repository
+// can be read in an older format without writing to it; the config file is rewritten by
+// Migrate, and an interrupted migration is simply run again.
+var repoMigrations = []repoMigration{
+	{from: 0, description: "assign a repository ID and record the hash algorithm", run: migrateV0},
+}
+
+// upgrade brings the config of the repository to RepoFormatVersion in memory. Migrate saves it.
+func (r *Repository) upgrade() error {
+	from := r.config.Version
+	for _, m := range repoMigrations {
+		if m.from != r.config.Version {
+			continue
+		}
+		if err := m.run(r); err != nil {
+			return fmt.Errorf("failed to migrate repository %s from format version %d: %w", r.Location(), m.from, err)
+		}
+		r.config.Version = m.from + 1
+	}
+	if r.config.Version != RepoFormatVersion {
+		return fmt.Errorf("no migration path for repository %s from format version %d", r.Location(), from)
+	}
+	r.migratedFrom = &from
+	return nil
+}
+
+// MigrationFunc is told that the config of a repository opened in an older format was saved
+// in the current one, with the format versions before and after.
+type MigrationFunc func(r *Repository, from, to int)
+
+// OnMigrate sets the function Migrate reports a saved migration to.
+func (r *Repository) OnMigrate(fn MigrationFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onMigrate = fn
+}
+
+// Migrate saves the config of a repository that was opened in an older format and upgraded
+// in memory, and reports it to the function set with OnMigrate. It does nothing for
+// repositories already in the current format. Operations that write to the repository call
+// it when they take their lock.
+func (r *Repository) Migrate() error {
+	r.mu.Lock()
+	if r.migratedFrom == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	if err := r.SaveConfig(); err != nil {
+		r.mu.Unlock()
+		return fmt.Errorf("failed to save migrated repository config: %w", err)
+	}
+	from, onMigrate := *r.migratedFrom, r.onMigrate
+	r.migratedFrom = nil
+	r.mu.Unlock()
+
+	if onMigrate != nil {
+		onMigrate(r, from, RepoFormatVersion)
+	}
+	return nil
+}
+
+// migrateV0 upgrades a repository written before the format was versioned. Its file
+// layout, chunking and compression settings are kept as they are; objects were always
+// named by SHA-256 (or its HMAC in encrypted repositories), which the config now records.
+func migrateV0(r *Repository) error {
+	if r.config.ID == "" {
+		id, err := randomName()
+		if err != nil {
+			return err
+		}
+		r.config.ID = id
+	}
+	r.config.HashAlgorithm = HashSHA256
+	return nil
+}
@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Loose objects are tracked in object index files so a backup can tell whether an object
+// exists from memory instead of checking the storage for every chunk, which on USB disks
+// and network shares often takes longer than hashing the data.
+//
+// Every process that stores loose objects writes their IDs to a new object index file when
+// it flushes, after the objects themselves are saved. An interrupted backup can therefore
+// only leave objects out of the index, which costs a second write of the same content
+// later but never loses data. Prune writes the index without the objects it deletes before
+// deleting them. The set is exact rather than a bloom filter, since a false positive would
+// skip storing an object.
+//
+// When the index is loaded it is checked against a listing of objects/, a single request
+// instead of one per chunk. Objects deleted behind the index's back, by hand, by a prune
+// interrupted on another machine or by a repair, would otherwise make backups skip storing
+// their content again; any difference between the two makes the index stale, and it is
+// rebuilt from the listing, as it is when there is no object index file yet. Append-only
+// repositories don't use the index files at all, see appendonly.go.
+
+// objectIndexFile is the on-disk form of an object index file.
+type objectIndexFile struct {
+	Objects []string `json:"objects"`
+}
+
+// objectSet is a set of object IDs. Hex IDs are kept in binary form to halve the memory use.
+type objectSet map[string]struct{}
+
+func objectSetKey(id string) string {
+	if raw, err := hex.DecodeString(id); err == nil {
+		return string(raw)
+	}
+	return id
+}
+
+func (s objectSet) add(id string) {
+	s[objectSetKey(id)] = struct{}{}
+}
+
+func (s objectSet) has(id string) bool {
+	_, ok := s[objectSetKey(id)]
+	return ok
+}
+
+// loadIndexes loads the pack index and the object index into memory, so that checking
+// whether an object exists doesn't touch the storage. Backups call it when they start;
+// otherwise both are loaded on first use.
+func (r *Repository) loadIndexes(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.loadIndex(ctx); err != nil {
+		return err
+	}
+	return r.loadObjectIndex(ctx)
+}
+
+// hasLooseObject reports whether a loose object exists according to the object index.
+// The caller must hold r.mu.
+func (r *Repository) hasLooseObject(ctx context.Context, id string) (bool, error) {
+	if err := r.loadObjectIndex(ctx); err != nil {
+		return false, err
+	}
+	return r.looseObjects.has(id), nil
+}
+
+// hasObject reports whether an object is stored in the repository, packed or loose,
+// according to the in-memory indexes. The caller must hold r.mu.
+func (r *Repository) hasObject(ctx context.Context, id string) (bool, error) {
+	if packed, err := r.hasPackedObject(ctx, id); err != nil || packed {
+		return packed, err
+	}
+	return r.hasLooseObject(ctx, id)
+}
+
+// addLooseObject records a loose object that has been saved to the storage.
+// The caller must hold r.mu.
+func (r *Repository) addLooseObject(id string) {
+	r.looseObjects.add(id)
+	r.unsavedLoose = append(r.unsavedLoose, id)
+}
+
+// loadObjectIndex reads all object index files into memory the first time it is called,
+// rebuilding the index if it is missing or stale. The caller must hold r.mu.
+func (r *Repository) loadObjectIndex(ctx context.Context) error {
+	if r.looseObjects != nil {
+		return nil
+	}
+	if r.config.AppendOnly {
+		ids, err := r.listFiles(ctx, ObjectFile)
+		if err != nil {
+			return err
+		}
+		r.looseObjects = make(objectSet, len(ids))
+		for _, id := range ids {
+			r.looseObjects.add(id)
+		}
+		return nil
+	}
+
+	names, err := r.listFiles(ctx, ObjectIndexFile)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return r.rebuildObjectIndex(ctx)
+	}
+
+	objects := make(objectSet)
+	for _, name := range names {
+		idx, err := r.readObjectIndexFile(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, id := range idx.Objects {
+			objects.add(id)
+		}
+	}
+
+	// The listing matches the index if it has as many objects, all of them indexed
+	listed, unindexed := 0, 0
+	err = r.storage.List(ctx, ObjectFile, func(info StorageFileInfo) error {
+		listed++
+		if !objects.has(info.Name) {
+			unindexed++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", ObjectFile, err)
+	}
+	if missing := len(objects) - (listed - unindexed); missing > 0 || unindexed > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Object index of repository %s lists %d missing objects and misses %d, rebuilding it\n", r.Location(), missing, unindexed)
+		return r.rebuildObjectIndex(ctx)
+	}
+
+	r.looseObjects = objects
+	return nil
+}
+
+// rebuildObjectIndex recreates the object index from a listing of objects/ and replaces
+// the existing object index files with it. The caller must hold r.mu.
+func (r *Repository) rebuildObjectIndex(ctx context.Context) error {
+	ids, err := r.listFiles(ctx, ObjectFile)
+	if err != nil {
+		return err
+	}
+	return r.replaceObjectIndex(ctx, ids)
+}
+
+// replaceObjectIndex writes a single object index file listing ids and removes the older
+// ones. The caller must hold r.mu.
+func (r *Repository) replaceObjectIndex(ctx context.Context, ids []string) error {
+	oldNames, err := r.listFiles(ctx, ObjectIndexFile)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		if err := r.writeObjectIndexFile(ctx, ids); err != nil {
+			return err
+		}
+	}
+	for _, name := range oldNames {
+		if err := r.storage.Remove(ctx, Handle{Type: ObjectIndexFile, Name: name}); err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to remove old object index file %s: %w", name, err)
+		}
+	}
+
+	r.looseObjects = make(objectSet, len(ids))
+	for _, id := range ids {
+		r.looseObjects.add(id)
+	}
+	r.unsavedLoose = nil
+	return nil
+}
+
+// saveObjectIndex writes the loose objects stored since the last object index file to a
+// new object index file. The caller must hold r.mu.
+func (r *Repository) saveObjectIndex(ctx context.Context) error {
+	if len(r.unsavedLoose) == 0 {
+		return nil
+	}
+	if err := r.writeObjectIndexFile(ctx, r.unsavedLoose); err != nil {
+		return err
+	}
+	r.unsavedLoose = nil
+	return nil
+}
+
+// writeObjectIndexFile stores an object index file under a new random name.
+func (r *Repository) writeObjectIndexFile(ctx context.Context, ids []string) error {
+	name, err := randomName()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&objectIndexFile{Objects: ids})
+	if err != nil {
+		return fmt.Errorf("failed to marshal object index: %w", err)
+	}
+	if r.key != nil {
+		if data, err = r.key.sealBlob(data, []byte(name)); err != nil {
+			return fmt.Errorf("failed to encrypt object index: %w", err)
+		}
+	}
+
+	if err := r.storage.Save(ctx, Handle{Type: ObjectIndexFile, Name: name}, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write object index file: %w", err)
+	}
+	return nil
+}
+
+// readObjectIndexFile reads and decrypts an object index file.
+func (r *Repository) readObjectIndexFile(ctx context.Context, name string) (*objectIndexFile, error) {
+	data, err := loadAll(ctx, r.storage, Handle{Type: ObjectIndexFile, Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object index file %s: %w", name, err)
+	}
+	if isEncryptedBlob(data) {
+		if r.key == nil {
+			return nil, ErrPassphraseRequired
+		}
+		if data, err = r.key.openBlob(data, []byte(name)); err != nil {
+			return nil, fmt.Errorf("object index file %s: %w", name, err)
+		}
+	}
+	var idx objectIndexFile
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse object index file %s: %w", name, err)
+	}
+	return &idx, nil
+}
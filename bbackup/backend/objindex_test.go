@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// statCountingStorage counts the Stat calls made to the wrapped storage.
+type statCountingStorage struct {
+	Storage
+	stats atomic.Int64
+}
+
+func (s *statCountingStorage) Stat(ctx context.Context, h Handle) (StorageFileInfo, error) {
+	s.stats.Add(1)
+	return s.Storage.Stat(ctx, h)
+}
+
+// TestObjectIndex checks that existence checks of loose objects are answered from the
+// object index without touching the storage, and that a missing or stale index is rebuilt
+func TestObjectIndex(t *testing.T) {
+	ctx := context.Background()
+	storage := &statCountingStorage{Storage: NewMemoryStorage()}
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	var ids []string
+	var objects [][]byte
+	random := rand.New(rand.NewSource(5))
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 2*1024*1024)
+		random.Read(data)
+		id := repo.objectID(data)
+		if written, err := repo.storeObject(ctx, id, data); err != nil || written == 0 {
+			t.Fatalf("Failed to store loose object: written=%d err=%v", written, err)
+		}
+		ids = append(ids, id)
+		objects = append(objects, data)
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if found, _ := hasFiles(ctx, storage, ObjectIndexFile); !found {
+		t.Fatalf("Expected an object index file after flush")
+	}
+
+	// Storing existing objects again only reads the index when it is loaded
+	reopen := func() *Repository {
+		repo, err := OpenRepositoryWithStorage(storage, "")
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		if err := repo.loadIndexes(ctx); err != nil {
+			t.Fatalf("Failed to load indexes: %v", err)
+		}
+		return repo
+	}
+	repo = reopen()
+	before := storage.stats.Load()
+	for i, id := range ids {
+		if written, err := repo.storeObject(ctx, id, objects[i]); err != nil || written != 0 {
+			t.Errorf("Expected object %s to be found, written=%d err=%v", id, written, err)
+		}
+	}
+	if calls := storage.stats.Load() - before; calls != 0 {
+		t.Errorf("Expected no storage stats for existing objects, got %d", calls)
+	}
+
+	// A missing index is rebuilt from objects/
+	names, err := repo.listFiles(ctx, ObjectIndexFile)
+	if err != nil {
+		t.Fatalf("Failed to list object index files: %v", err)
+	}
+	for _, name := range names {
+		if err := storage.Remove(ctx, Handle{Type: ObjectIndexFile, Name: name}); err != nil {
+			t.Fatalf("Failed to remove object index file: %v", err)
+		}
+	}
+	repo = reopen()
+	for _, id := range ids {
+		if !repo.looseObjects.has(id) {
+			t.Errorf("Expected rebuilt object index to list %s", id)
+		}
+	}
+	if found, _ := hasFiles(ctx, storage, ObjectIndexFile); !found {
+		t.Errorf("Expected the rebuilt object index to be saved")
+	}
+
+	// Objects deleted behind the index's back make it stale, so they are stored again
+	for _, id := range ids[1:] {
+		if err := storage.Remove(ctx, Handle{Type: ObjectFile, Name: id}); err != nil {
+			t.Fatalf("Failed to remove object: %v", err)
+		}
+	}
+	repo = reopen()
+	if !repo.looseObjects.has(ids[0]) || repo.looseObjects.has(ids[1]) || repo.looseObjects.has(ids[2]) {
+		t.Errorf("Expected the stale object index to be rebuilt")
+	}
+	if written, err := repo.storeObject(ctx, ids[1], objects[1]); err != nil || written == 0 {
+		t.Errorf("Expected the deleted object to be stored again, written=%d err=%v", written, err)
+	}
+}
+
+// TestObjectIndexMissingObject checks that a single object deleted behind the index's back
+// among many is noticed, and that its content is stored again
+func TestObjectIndexMissingObject(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	var ids []string
+	var objects [][]byte
+	random := rand.New(rand.NewSource(7))
+	for i := 0; i < 64; i++ {
+		data := make([]byte, packObjectThreshold+1024)
+		random.Read(data)
+		id := repo.objectID(data)
+		if written, err := repo.storeObject(ctx, id, data); err != nil || written == 0 {
+			t.Fatalf("Failed to store loose object: written=%d err=%v", written, err)
+		}
+		ids = append(ids, id)
+		objects = append(objects, data)
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if err := storage.Remove(ctx, Handle{Type: ObjectFile, Name: ids[41]}); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+
+	repo, err = OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	for i, id := range ids {
+		written, err := repo.storeObject(ctx, id, objects[i])
+		if err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		if (i == 41) != (written > 0) {
+			t.Errorf("Object %d: expected only the deleted object to be stored again, written=%d", i, written)
+		}
+	}
+	if _, err := storage.Stat(ctx, Handle{Type: ObjectFile, Name: ids[41]}); err != nil {
+		t.Errorf("Expected the deleted object to be back: %v", err)
+	}
+}
@@ -0,0 +1,494 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Small objects are grouped into pack files instead of being stored as one file each,
+// which keeps the file count of a repository low on filesystems that handle many small
+// files poorly (exFAT, network shares).
+//
+// A pack file holds the stored objects back to back, followed by a header listing the
+// ID, offset and length of every object, the 4-byte little-endian header length and
+// packMagic. The header is encrypted in encrypted repositories. Pack files are named by
+// the SHA-256 of their content.
+//
+// Index files map object IDs to their pack location so objects can be found
+// without reading every pack header. They can always be rebuilt from the packs.
+var packMagic = []byte{0x89, 'B', 'B', 'P'}
+
+const (
+	// packObjectThreshold is the stored size below which objects go into packs;
+	// larger objects stay loose in objects/.
+	packObjectThreshold = 1024 * 1024
+	// packTargetSize is the size at which the open pack file is finished.
+	packTargetSize = 32 * 1024 * 1024
+	// indexBatchPacks is the number of finished packs collected before they are written to an index file.
+	indexBatchPacks = 64
+
+	packTrailerSize = 8 // header length + packMagic
+)
+
+// packedBlob describes an object stored inside a pack file.
+type packedBlob struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// indexPack lists the objects of one pack file in an index file.
+type indexPack struct {
+	ID    string       `json:"id"`
+	Blobs []packedBlob `json:"blobs"`
+}
+
+// indexFile is the on-disk form of an index file.
+type indexFile struct {
+	Packs []indexPack `json:"packs"`
+}
+
+// blobLocation is the position of an object inside a pack file.
+type blobLocation struct {
+	pack   string
+	offset int64
+	length int64
+}
+
+// packer collects small objects into a local temporary file until it is large enough
+// to be finished and saved to the repository storage.
+type packer struct {
+	file   *os.File
+	hasher hash.Hash
+	blobs  []packedBlob
+	byID   map[string]packedBlob
+	size   int64
+}
+
+// randomName returns a random hex string used to name key and index files and repositories.
+func randomName() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random name: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hasPackedObject reports whether an object is stored in a pack, including the open one.
+// The caller must hold r.mu.
+func (r *Repository) hasPackedObject(ctx context.Context, id string) (bool, error) {
+	if r.packer != nil {
+		if _, ok := r.packer.byID[id]; ok {
+			return true, nil
+		}
+	}
+	if err := r.loadIndex(ctx); err != nil {
+		return false, err
+	}
+	_, ok := r.index[id]
+	return ok, nil
+}
+
+// addToPack appends a stored object to the open pack, starting a new pack if needed.
+// The caller must hold r.mu.
+func (r *Repository) addToPack(ctx context.Context, id string, encoded []byte) error {
+	if r.packer == nil {
+		hasher, err := r.newHasher()
+		if err != nil {
+			return err
+		}
+		file, err := os.CreateTemp("", "bbackup-pack-*.tmp")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary pack file: %w", err)
+		}
+		r.packer = &packer{
+			file:   file,
+			hasher: hasher,
+			byID:   make(map[string]packedBlob),
+		}
+	}
+
+	p := r.packer
+	if _, err := p.file.Write(encoded); err != nil {
+		return fmt.Errorf("failed to write object %s to pack file %s: %w", id, p.file.Name(), err)
+	}
+	p.hasher.Write(encoded)
+	blob := packedBlob{ID: id, Offset: p.size, Length: int64(len(encoded))}
+	p.blobs = append(p.blobs, blob)
+	p.byID[id] = blob
+	p.size += blob.Length
+
+	if p.size >= packTargetSize {
+		return r.finishPack(ctx)
+	}
+	return nil
+}
+
+// finishPack appends the header to the open pack and saves it to the storage.
+// The caller must hold r.mu.
+func (r *Repository) finishPack(ctx context.Context) error {
+	p := r.packer
+	if p == nil {
+		return nil
+	}
+	r.packer = nil
+	defer func() {
+		p.file.Close()
+		os.Remove(p.file.Name())
+	}()
+
+	header, err := json.Marshal(p.blobs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pack header: %w", err)
+	}
+	if r.key != nil {
+		if header, err = r.key.sealBlob(header, nil); err != nil {
+			return fmt.Errorf("failed to encrypt pack header: %w", err)
+		}
+	}
+	trailer := make([]byte, packTrailerSize)
+	binary.LittleEndian.PutUint32(trailer, uint32(len(header)))
+	copy(trailer[4:], packMagic)
+
+	for _, part := range [][]byte{header, trailer} {
+		if _, err := p.file.Write(part); err != nil {
+			return fmt.Errorf("failed to write pack header to %s: %w", p.file.Name(), err)
+		}
+		p.hasher.Write(part)
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind pack file %s: %w", p.file.Name(), err)
+	}
+
+	packID := hex.EncodeToString(p.hasher.Sum(nil))
+	h := Handle{Type: PackFile, Name: packID}
+	if err := r.storage.Save(ctx, h, p.file); err != nil {
+		return fmt.Errorf("failed to save pack %s: %w", packID, err)
+	}
+	if r.config.Parity.Enabled() {
+		size, err := p.file.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = p.file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to rewind pack file %s: %w", p.file.Name(), err)
+		}
+		if err := r.saveParity(ctx, h, p.file, size); err != nil {
+			return err
+		}
+	}
+
+	for _, blob := range p.blobs {
+		r.index[blob.ID] = blobLocation{pack: packID, offset: blob.Offset, length: blob.Length}
+	}
+	r.unsavedPacks = append(r.unsavedPacks, indexPack{ID: packID, Blobs: p.blobs})
+	if len(r.unsavedPacks) >= indexBatchPacks {
+		return r.saveIndex(ctx)
+	}
+	return nil
+}
+
+// saveIndex writes the packs finished since the last index file to a new index file.
+// The caller must hold r.mu.
+func (r *Repository) saveIndex(ctx context.Context) error {
+	if len(r.unsavedPacks) == 0 {
+		return nil
+	}
+	if err := r.writeIndexFile(ctx, &indexFile{Packs: r.unsavedPacks}); err != nil {
+		return err
+	}
+	r.unsavedPacks = nil
+	return nil
+}
+
+// writeIndexFile stores an index file under a new random name.
+func (r *Repository) writeIndexFile(ctx context.Context, idx *indexFile) error {
+	name, err := randomName()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	if r.key != nil {
+		if data, err = r.key.sealBlob(data, []byte(name)); err != nil {
+			return fmt.Errorf("failed to encrypt index: %w", err)
+		}
+	}
+
+	if err := r.storage.Save(ctx, Handle{Type: IndexFile, Name: name}, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	return nil
+}
+
+// listFiles returns the names of all files of a type in the repository storage.
+func (r *Repository) listFiles(ctx context.Context, t FileType) ([]string, error) {
+	var names []string
+	err := r.storage.List(ctx, t, func(info StorageFileInfo) error {
+		names = append(names, info.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", t, err)
+	}
+	return names, nil
+}
+
+// loadIndex reads all index files into memory the first time it is called. Packs that no
+// index file covers, such as those of a backup killed before it saved its index, are read
+// from their headers and written with the next index file.
+// The caller must hold r.mu.
+func (r *Repository) loadIndex(ctx context.Context) error {
+	if r.indexLoaded {
+		return nil
+	}
+
+	names, err := r.listFiles(ctx, IndexFile)
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool)
+	for _, name := range names {
+		idx, err := r.readIndexFile(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, pack := range idx.Packs {
+			indexed[pack.ID] = true
+			for _, blob := range pack.Blobs {
+				r.index[blob.ID] = blobLocation{pack: pack.ID, offset: blob.Offset, length: blob.Length}
+			}
+		}
+	}
+
+	packs, err := r.listFiles(ctx, PackFile)
+	if err != nil {
+		return err
+	}
+	var unindexed []string
+	for _, packID := range packs {
+		if !indexed[packID] {
+			unindexed = append(unindexed, packID)
+		}
+	}
+	if len(unindexed) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d pack files of repository %s are missing from the index, adding them\n", len(unindexed), r.Location())
+	}
+	for _, packID := range unindexed {
+		blobs, err := r.readPackHeader(ctx, packID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Skipping unreadable pack %s: %v\n", packID, err)
+			continue
+		}
+		r.unsavedPacks = append(r.unsavedPacks, indexPack{ID: packID, Blobs: blobs})
+		for _, blob := range blobs {
+			r.index[blob.ID] = blobLocation{pack: packID, offset: blob.Offset, length: blob.Length}
+		}
+	}
+
+	r.indexLoaded = true
+	return nil
+}
+
+// readIndexFile reads and decrypts an index file.
+func (r *Repository) readIndexFile(ctx context.Context, name string) (*indexFile, error) {
+	data, err := loadAll(ctx, r.storage, Handle{Type: IndexFile, Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index file %s: %w", name, err)
+	}
+	if isEncryptedBlob(data) {
+		if r.key == nil {
+			return nil, ErrPassphraseRequired
+		}
+		if data, err = r.key.openBlob(data, []byte(name)); err != nil {
+			return nil, fmt.Errorf("index file %s: %w", name, err)
+		}
+	}
+	var idx indexFile
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse index file %s: %w", name, err)
+	}
+	return &idx, nil
+}
+
+// readPackHeader reads the list of objects stored in a pack file from its header.
+func (r *Repository) readPackHeader(ctx context.Context, packID string) ([]packedBlob, error) {
+	h := Handle{Type: PackFile, Name: packID}
+	info, err := r.storage.Stat(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size < packTrailerSize {
+		return nil, fmt.Errorf("pack file %s is too short", packID)
+	}
+
+	trailer, err := loadRange(ctx, r.storage, h, info.Size-packTrailerSize, packTrailerSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack trailer of %s: %w", packID, err)
+	}
+	if !bytes.Equal(trailer[4:], packMagic) {
+		return nil, fmt.Errorf("pack file %s has no valid trailer", packID)
+	}
+	headerLen := int64(binary.LittleEndian.Uint32(trailer))
+	if headerLen == 0 || headerLen > info.Size-packTrailerSize {
+		return nil, fmt.Errorf("pack file %s has an invalid header length", packID)
+	}
+
+	header, err := loadRange(ctx, r.storage, h, info.Size-packTrailerSize-headerLen, headerLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack header of %s: %w", packID, err)
+	}
+	if isEncryptedBlob(header) {
+		if r.key == nil {
+			return nil, ErrPassphraseRequired
+		}
+		if header, err = r.key.openBlob(header, nil); err != nil {
+			return nil, fmt.Errorf("pack header of %s: %w", packID, err)
+		}
+	}
+
+	var blobs []packedBlob
+	if err := json.Unmarshal(header, &blobs); err != nil {
+		return nil, fmt.Errorf("failed to parse pack header of %s: %w", packID, err)
+	}
+	return blobs, nil
+}
+
+// loadRange reads exactly length bytes of a storage file starting at offset.
+func loadRange(ctx context.Context, s Storage, h Handle, offset, length int64) ([]byte, error) {
+	rd, err := s.Load(ctx, h, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// RebuildIndex recreates the index by reading the headers of all pack files
+// and replaces the existing index files with the result. The object index is
+// rebuilt from the loose objects as well.
+func (r *Repository) RebuildIndex() error {
+	ctx := context.Background()
+	lock, err := r.acquireWriteLock(ctx, true, "rebuild-index")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.rebuildIndex(ctx); err != nil {
+		return err
+	}
+	return r.rebuildObjectIndex(ctx)
+}
+
+// rebuildIndex implements RebuildIndex. The caller must hold r.mu.
+func (r *Repository) rebuildIndex(ctx context.Context) error {
+	oldNames, err := r.listFiles(ctx, IndexFile)
+	if err != nil {
+		return err
+	}
+	packs, err := r.listFiles(ctx, PackFile)
+	if err != nil {
+		return err
+	}
+
+	idx := &indexFile{}
+	index := make(map[string]blobLocation)
+	for _, packID := range packs {
+		blobs, err := r.readPackHeader(ctx, packID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Skipping unreadable pack %s: %v\n", packID, err)
+			continue
+		}
+		idx.Packs = append(idx.Packs, indexPack{ID: packID, Blobs: blobs})
+		for _, blob := range blobs {
+			index[blob.ID] = blobLocation{pack: packID, offset: blob.Offset, length: blob.Length}
+		}
+	}
+
+	if len(idx.Packs) > 0 {
+		if err := r.writeIndexFile(ctx, idx); err != nil {
+			return err
+		}
+	}
+	for _, name := range oldNames {
+		if err := r.storage.Remove(ctx, Handle{Type: IndexFile, Name: name}); err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to remove old index file %s: %w", name, err)
+		}
+	}
+
+	r.index = index
+	r.unsavedPacks = nil
+	r.indexLoaded = true
+	return nil
+}
+
+// readPackedObject returns the stored bytes of an object from its pack file,
+// or from the pack that is still being written.
+func (r *Repository) readPackedObject(ctx context.Context, id string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.packer != nil {
+		if blob, ok := r.packer.byID[id]; ok {
+			raw := make([]byte, blob.Length)
+			if _, err := r.packer.file.ReadAt(raw, blob.Offset); err != nil {
+				return nil, fmt.Errorf("failed to read object %s from open pack: %w", id, err)
+			}
+			return raw, nil
+		}
+	}
+
+	if err := r.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	loc, ok := r.index[id]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", id, fs.ErrNotExist)
+	}
+
+	raw, err := loadRange(ctx, r.storage, Handle{Type: PackFile, Name: loc.pack}, loc.offset, loc.length)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read object %s from pack %s: %w", id, loc.pack, err)
+	}
+	return raw, nil
+}
+
+// Flush finishes the open pack file and writes any pending index and object index entries.
+// Objects stored since the last flush are only readable by other processes afterwards.
+func (r *Repository) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx := context.Background()
+	if err := r.finishPack(ctx); err != nil {
+		return err
+	}
+	if err := r.saveIndex(ctx); err != nil {
+		return err
+	}
+	return r.saveObjectIndex(ctx)
+}
@@ -0,0 +1,509 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Packs and loose objects can be protected with Reed-Solomon parity, so that damage from
+// bitrot can be repaired without a second copy of the repository.
+//
+// A protected file is split into blocks of parityBlockSize bytes, and every DataShards
+// consecutive blocks form a stripe with ParityShards parity blocks. The SHA-256 of every
+// block is recorded, so a damaged block can be found and treated as missing; a stripe can
+// be repaired as long as no more than ParityShards of its blocks are damaged. The last
+// stripe is padded with zeros.
+//
+// The parity of a file is kept in a file of type ParityFile named after it. It holds the
+// parity blocks of all stripes back to back, followed by a JSON header with the block
+// hashes, the 4-byte little-endian header length and parityMagic. Parity is computed
+// from the stored (compressed and encrypted) bytes, so it reveals nothing about the
+// content.
+var parityMagic = []byte{0x89, 'B', 'B', 'R'}
+
+// parityBlockSize is the size of the blocks a protected file is split into.
+const parityBlockSize = 64 * 1024
+
+// ParityConfig sets up Reed-Solomon parity for packs and loose objects.
+// Zero shards disable parity.
+type ParityConfig struct {
+	DataShards   int `json:"data_shards"`   // Blocks per stripe
+	ParityShards int `json:"parity_shards"` // Parity blocks per stripe; up to this many damaged blocks per stripe can be repaired
+}
+
+// DefaultParityConfig returns the parity settings suggested when parity is turned on:
+// 20% overhead, repairing up to 2 damaged blocks in every 640 KiB.
+func DefaultParityConfig() ParityConfig {
+	return ParityConfig{DataShards: 10, ParityShards: 2}
+}
+
+// Enabled reports whether parity is written.
+func (c ParityConfig) Enabled() bool {
+	return c.DataShards > 0 && c.ParityShards > 0
+}
+
+// Validate checks that the parity settings can be used.
+func (c ParityConfig) Validate() error {
+	if c.DataShards == 0 && c.ParityShards == 0 {
+		return nil
+	}
+	if c.DataShards <= 0 || c.ParityShards <= 0 {
+		return fmt.Errorf("parity shards must both be positive or both be zero (data=%d parity=%d)", c.DataShards, c.ParityShards)
+	}
+	if c.DataShards+c.ParityShards > 256 {
+		return fmt.Errorf("at most 256 shards per stripe are supported (data=%d parity=%d)", c.DataShards, c.ParityShards)
+	}
+	return nil
+}
+
+// parityHeader is the JSON header of a parity file.
+type parityHeader struct {
+	Size         int64    `json:"size"` // Size of the protected file
+	BlockSize    int      `json:"block_size"`
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+	Hashes       []string `json:"hashes"` // Data then parity block hashes, stripe by stripe
+}
+
+func (h *parityHeader) stripes() int64 {
+	stripeSize := int64(h.BlockSize) * int64(h.DataShards)
+	return (h.Size + stripeSize - 1) / stripeSize
+}
+
+// parityName returns the name of the parity file of a protected file.
+func parityName(h Handle) string {
+	return h.Name + "." + string(h.Type)
+}
+
+// parityTarget returns the file protected by the parity file with the given name.
+func parityTarget(name string) (Handle, bool) {
+	i := strings.LastIndex(name, ".")
+	if i <= 0 {
+		return Handle{}, false
+	}
+	t := FileType(name[i+1:])
+	if t != PackFile && t != ObjectFile {
+		return Handle{}, false
+	}
+	return Handle{Type: t, Name: name[:i]}, true
+}
+
+// SetParity changes the parity written for packs and loose objects from now on.
+// Existing files get parity from Repair; zero shards turn parity off.
+func (r *Repository) SetParity(parity ParityConfig) error {
+	if err := r.checkSettingsWritable(); err != nil {
+		return err
+	}
+	config := r.config
+	config.Parity = parity
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	r.config = config
+	return r.SaveConfig()
+}
+
+// saveParity writes the parity of a protected file of the given size, read from rd, if
+// parity is enabled.
+func (r *Repository) saveParity(ctx context.Context, h Handle, rd io.Reader, size int64) error {
+	if !r.config.Parity.Enabled() {
+		return nil
+	}
+	data, err := computeParity(rd, size, r.config.Parity)
+	if err != nil {
+		return fmt.Errorf("failed to compute parity of %s: %w", h, err)
+	}
+	if err := r.storage.Save(ctx, Handle{Type: ParityFile, Name: parityName(h)}, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write parity of %s: %w", h, err)
+	}
+	return nil
+}
+
+// removeWithParity removes a protected file and its parity file, if any.
+func (r *Repository) removeWithParity(ctx context.Context, h Handle) error {
+	if err := r.storage.Remove(ctx, h); err != nil && !isNotExist(err) {
+		return err
+	}
+	if err := r.storage.Remove(ctx, Handle{Type: ParityFile, Name: parityName(h)}); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// computeParity returns the content of the parity file for size bytes read from rd.
+func computeParity(rd io.Reader, size int64, config ParityConfig) ([]byte, error) {
+	enc, err := reedsolomon.New(config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	header := parityHeader{Size: size, BlockSize: parityBlockSize, DataShards: config.DataShards, ParityShards: config.ParityShards}
+	shards := newParityShards(&header)
+
+	var out bytes.Buffer
+	for stripe := int64(0); stripe < header.stripes(); stripe++ {
+		if err := readStripe(rd, &header, stripe, shards); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(shards); err != nil {
+			return nil, err
+		}
+		for i, shard := range shards {
+			header.Hashes = append(header.Hashes, sha256Hex(shard))
+			if i >= header.DataShards {
+				out.Write(shard)
+			}
+		}
+	}
+
+	encoded, err := json.Marshal(&header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal parity header: %w", err)
+	}
+	out.Write(encoded)
+	trailer := make([]byte, packTrailerSize)
+	binary.LittleEndian.PutUint32(trailer, uint32(len(encoded)))
+	copy(trailer[4:], parityMagic)
+	out.Write(trailer)
+	return out.Bytes(), nil
+}
+
+// newParityShards allocates the data and parity blocks of one stripe.
+func newParityShards(header *parityHeader) [][]byte {
+	shards := make([][]byte, header.DataShards+header.ParityShards)
+	for i := range shards {
+		shards[i] = make([]byte, header.BlockSize)
+	}
+	return shards
+}
+
+// readStripe reads the data blocks of a stripe from rd, padding the last one with zeros.
+func readStripe(rd io.Reader, header *parityHeader, stripe int64, shards [][]byte) error {
+	remaining := header.Size - stripe*int64(header.BlockSize)*int64(header.DataShards)
+	for i := 0; i < header.DataShards; i++ {
+		shard := shards[i][:header.BlockSize]
+		n := int64(header.BlockSize)
+		if remaining < n {
+			n = max(remaining, 0)
+		}
+		if _, err := io.ReadFull(rd, shard[:n]); err != nil {
+			return err
+		}
+		clear(shard[n:])
+		shards[i] = shard
+		remaining -= n
+	}
+	return nil
+}
+
+// parityData is a parsed parity file.
+type parityData struct {
+	header parityHeader
+	blocks []byte // Parity blocks of all stripes
+}
+
+// parityBlock returns parity block i of a stripe.
+func (p *parityData) parityBlock(stripe int64, i int) []byte {
+	offset := (stripe*int64(p.header.ParityShards) + int64(i)) * int64(p.header.BlockSize)
+	return p.blocks[offset : offset+int64(p.header.BlockSize)]
+}
+
+// loadParity reads the parity file of a protected file.
+func (r *Repository) loadParity(ctx context.Context, h Handle) (*parityData, error) {
+	data, err := loadAll(ctx, r.storage, Handle{Type: ParityFile, Name: parityName(h)})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < packTrailerSize || !bytes.Equal(data[len(data)-4:], parityMagic) {
+		return nil, fmt.Errorf("parity of %s has no valid trailer", h)
+	}
+	headerLen := int(binary.LittleEndian.Uint32(data[len(data)-packTrailerSize:]))
+	if headerLen == 0 || headerLen > len(data)-packTrailerSize {
+		return nil, fmt.Errorf("parity of %s has an invalid header length", h)
+	}
+	p := &parityData{blocks: data[:len(data)-packTrailerSize-headerLen]}
+	if err := json.Unmarshal(data[len(p.blocks):len(data)-packTrailerSize], &p.header); err != nil {
+		return nil, fmt.Errorf("failed to parse parity header of %s: %w", h, err)
+	}
+	header := &p.header
+	config := ParityConfig{DataShards: header.DataShards, ParityShards: header.ParityShards}
+	if header.BlockSize <= 0 || !config.Enabled() || config.Validate() != nil {
+		return nil, fmt.Errorf("parity of %s has invalid settings", h)
+	}
+	if int64(len(header.Hashes)) != header.stripes()*int64(header.DataShards+header.ParityShards) ||
+		int64(len(p.blocks)) != header.stripes()*int64(header.ParityShards)*int64(header.BlockSize) {
+		return nil, fmt.Errorf("parity of %s is truncated", h)
+	}
+	return p, nil
+}
+
+// repairStripes reads a protected file from rd, checks every block against the parity
+// hashes and reconstructs damaged blocks. If out is not nil, the repaired content is
+// written to it. It returns the number of damaged blocks; an error is returned if a stripe
+// has more damaged blocks than can be repaired.
+func repairStripes(rd io.Reader, parity *parityData, out io.Writer) (int, error) {
+	header := &parity.header
+	enc, err := reedsolomon.New(header.DataShards, header.ParityShards)
+	if err != nil {
+		return 0, err
+	}
+	shards := newParityShards(header)
+	perStripe := header.DataShards + header.ParityShards
+	damaged := 0
+	remaining := header.Size
+
+	for stripe := int64(0); stripe < header.stripes(); stripe++ {
+		if err := readStripe(rd, header, stripe, shards); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return damaged, fmt.Errorf("file is shorter than its parity (%d bytes)", header.Size)
+			}
+			return damaged, err
+		}
+		for i := 0; i < header.ParityShards; i++ {
+			shards[header.DataShards+i] = append(shards[header.DataShards+i][:0], parity.parityBlock(stripe, i)...)
+		}
+
+		bad := 0
+		hashes := header.Hashes[stripe*int64(perStripe) : (stripe+1)*int64(perStripe)]
+		for i, shard := range shards {
+			if sha256Hex(shard) != hashes[i] {
+				shards[i] = shard[:0]
+				bad++
+			}
+		}
+		if bad > 0 {
+			if bad > header.ParityShards {
+				return damaged + bad, fmt.Errorf("stripe %d has %d damaged blocks, more than the %d that can be repaired", stripe, bad, header.ParityShards)
+			}
+			if err := enc.Reconstruct(shards); err != nil {
+				return damaged + bad, fmt.Errorf("failed to reconstruct stripe %d: %w", stripe, err)
+			}
+			for i, shard := range shards {
+				if sha256Hex(shard) != hashes[i] {
+					return damaged + bad, fmt.Errorf("reconstructed block %d of stripe %d doesn't match its hash", i, stripe)
+				}
+			}
+			damaged += bad
+		}
+
+		if out != nil {
+			for i := 0; i < header.DataShards && remaining > 0; i++ {
+				n := min(int64(header.BlockSize), remaining)
+				if _, err := out.Write(shards[i][:n]); err != nil {
+					return damaged, err
+				}
+				remaining -= n
+			}
+		}
+	}
+	return damaged, nil
+}
+
+// RepairProgress reports the progress of a repair run.
+type RepairProgress struct {
+	Done        int    `json:"done"`        // Files checked
+	Total       int    `json:"total"`       // Packs and loose objects in the repository
+	CurrentItem string `json:"currentItem"` // File being checked
+	Repaired    int    `json:"repaired"`    // Files repaired so far
+}
+
+// RepairReport is the result of a repair run.
+type RepairReport struct {
+	CheckedFiles      int          `json:"checked_files"`      // Packs and loose objects read
+	DamagedBlocks     int          `json:"damaged_blocks"`     // Blocks found damaged in those files
+	RepairedFiles     []string     `json:"repaired_files"`     // Files rewritten from their parity
+	UnrepairableFiles []CheckIssue `json:"unrepairable_files"` // Damaged files that couldn't be repaired
+	AddedParity       int          `json:"added_parity"`       // Files that got parity after being verified
+	MissingParity     int          `json:"missing_parity"`     // Files without parity, while parity is turned off
+	RemovedParity     int          `json:"removed_parity"`     // Parity files whose file no longer exists
+}
+
+// Repair reads every pack and loose object and repairs damaged ones from their parity.
+// Files without parity are verified against their content hash and get parity if it is
+// turned on; parity files left behind by removed files are deleted. The progress callback
+// may be nil. An error is only returned if the repair itself can't run.
+// Append-only repositories can only be repaired once maintenance is authorised.
+func (r *Repository) Repair(ctx context.Context, progress func(RepairProgress)) (*RepairReport, error) {
+	if progress == nil {
+		progress = func(RepairProgress) {}
+	}
+	if r.AppendOnly() {
+		return nil, fmt.Errorf("repairing needs the maintenance key: %w", ErrAppendOnly)
+	}
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	lock, err := r.acquireWriteLock(ctx, true, "repair")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	report := &RepairReport{}
+
+	var files []Handle
+	for _, t := range []FileType{PackFile, ObjectFile} {
+		names, err := r.listFiles(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			files = append(files, Handle{Type: t, Name: name})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].String() < files[j].String() })
+	parityNames, err := r.listFiles(ctx, ParityFile)
+	if err != nil {
+		return nil, err
+	}
+	hasParity := make(map[string]bool, len(parityNames))
+	for _, name := range parityNames {
+		hasParity[name] = true
+	}
+
+	for i, h := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(RepairProgress{Done: i, Total: len(files), CurrentItem: h.String(), Repaired: len(report.RepairedFiles)})
+		report.CheckedFiles++
+
+		if !hasParity[parityName(h)] {
+			if err := r.addMissingParity(ctx, h, report); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		delete(hasParity, parityName(h))
+
+		damaged, err := r.repairFile(ctx, h)
+		report.DamagedBlocks += damaged
+		if err != nil {
+			report.UnrepairableFiles = append(report.UnrepairableFiles, CheckIssue{ID: h.String(), Error: err.Error()})
+		} else if damaged > 0 {
+			report.RepairedFiles = append(report.RepairedFiles, h.String())
+		}
+	}
+	progress(RepairProgress{Done: len(files), Total: len(files), Repaired: len(report.RepairedFiles)})
+
+	for name := range hasParity {
+		if _, ok := parityTarget(name); !ok {
+			continue
+		}
+		if err := r.storage.Remove(ctx, Handle{Type: ParityFile, Name: name}); err != nil && !isNotExist(err) {
+			return nil, fmt.Errorf("failed to remove parity file %s: %w", name, err)
+		}
+		report.RemovedParity++
+	}
+	return report, nil
+}
+
+// repairFile checks a file against its parity and rewrites it if it is damaged. It returns
+// the number of damaged blocks.
+func (r *Repository) repairFile(ctx context.Context, h Handle) (int, error) {
+	parity, err := r.loadParity(ctx, h)
+	if err != nil {
+		return 0, err
+	}
+	info, err := r.storage.Stat(ctx, h)
+	if err != nil {
+		return 0, err
+	}
+
+	check := func(out io.Writer) (int, error) {
+		rd, err := r.storage.Load(ctx, h, 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer rd.Close()
+		return repairStripes(rd, parity, out)
+	}
+	damaged, err := check(nil)
+	if err != nil || (damaged == 0 && info.Size == parity.header.Size) {
+		return damaged, err
+	}
+
+	// Damaged or with trailing garbage: rebuild it in a temporary file and replace it
+	tmp, err := os.CreateTemp("", "bbackup-repair-*.tmp")
+	if err != nil {
+		return damaged, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	if _, err := check(tmp); err != nil {
+		return damaged, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return damaged, err
+	}
+	if err := r.storage.Save(ctx, h, tmp); err != nil {
+		return damaged, fmt.Errorf("failed to rewrite %s: %w", h, err)
+	}
+	fmt.Fprintf(os.Stderr, "Repaired %d damaged blocks of %s\n", damaged, h)
+	return max(damaged, 1), nil
+}
+
+// addMissingParity verifies a file that has no parity and writes its parity if parity is
+// turned on.
+func (r *Repository) addMissingParity(ctx context.Context, h Handle, report *RepairReport) error {
+	if !r.config.Parity.Enabled() {
+		report.MissingParity++
+		return nil
+	}
+
+	var err error
+	if h.Type == PackFile {
+		err = r.verifyPack(ctx, h.Name)
+	} else {
+		err = r.verifyObject(h.Name)
+	}
+	if err != nil {
+		report.UnrepairableFiles = append(report.UnrepairableFiles, CheckIssue{ID: h.String(), Error: fmt.Sprintf("no parity and %v", err)})
+		return nil
+	}
+
+	info, err := r.storage.Stat(ctx, h)
+	if err != nil {
+		return err
+	}
+	rd, err := r.storage.Load(ctx, h, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if err := r.saveParity(ctx, h, rd, info.Size); err != nil {
+		return err
+	}
+	report.AddedParity++
+	return nil
+}
+
+// verifyPack checks that the content of a pack matches its ID.
+func (r *Repository) verifyPack(ctx context.Context, packID string) error {
+	rd, err := r.storage.Load(ctx, Handle{Type: PackFile, Name: packID}, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	hasher, err := r.newHasher()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, rd); err != nil {
+		return fmt.Errorf("failed to read pack %s: %w", packID, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != packID {
+		return fmt.Errorf("pack %s is corrupt: content hash mismatch", packID)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// TestParityRepair checks that damaged packs and loose objects are repaired from their
+// parity, that too much damage is reported and that missing parity is added
+func TestParityRepair(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	config := DefaultRepoConfig()
+	config.Parity = ParityConfig{DataShards: 4, ParityShards: 2}
+	repo, err := InitRepository(storage, config, "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	random := rand.New(rand.NewSource(7))
+	store := func(size int) (string, []byte) {
+		data := make([]byte, size)
+		random.Read(data)
+		id := repo.objectID(data)
+		if _, err := repo.storeObject(ctx, id, data); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		return id, data
+	}
+	looseID, looseData := store(2 * 1024 * 1024)
+	packedID, packedData := store(300 * 1024)
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	packs, err := repo.listFiles(ctx, PackFile)
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("Expected one pack, got %v (err=%v)", packs, err)
+	}
+	loose := Handle{Type: ObjectFile, Name: looseID}
+	pack := Handle{Type: PackFile, Name: packs[0]}
+	for _, h := range []Handle{loose, pack} {
+		if _, err := storage.Stat(ctx, Handle{Type: ParityFile, Name: parityName(h)}); err != nil {
+			t.Fatalf("Expected parity for %s: %v", h, err)
+		}
+	}
+
+	// Flip bytes in the stored files; blocks are 64 KiB and stripes hold 4 of them
+	corrupt := func(h Handle, offsets ...int) {
+		data, err := loadAll(ctx, storage, h)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", h, err)
+		}
+		for _, offset := range offsets {
+			data[offset] ^= 0xff
+		}
+		if err := storage.Save(ctx, h, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to write %s: %v", h, err)
+		}
+	}
+	verify := func(id string, expected []byte) {
+		rc, err := repo.RetrieveObject(id)
+		if err != nil {
+			t.Fatalf("Failed to retrieve %s: %v", id, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(data, expected) {
+			t.Errorf("Content of %s differs after repair (err=%v)", id, err)
+		}
+	}
+	corrupt(loose, 10, 70000, 600000)
+	corrupt(pack, 100)
+
+	report, err := repo.Repair(ctx, nil)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.RepairedFiles) != 2 || report.DamagedBlocks != 4 || len(report.UnrepairableFiles) != 0 {
+		t.Errorf("Unexpected repair report: %+v", report)
+	}
+	repo.index = make(map[string]blobLocation)
+	repo.indexLoaded = false
+	verify(looseID, looseData)
+	verify(packedID, packedData)
+
+	// Three damaged blocks in one stripe are more than two parity blocks can repair
+	corrupt(loose, 262144+10, 262144+65536+10, 262144+131072+10)
+	report, err = repo.Repair(ctx, nil)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.UnrepairableFiles) != 1 || report.UnrepairableFiles[0].ID != loose.String() || len(report.RepairedFiles) != 0 {
+		t.Errorf("Expected the loose object to be unrepairable, got %+v", report)
+	}
+	if err := storage.Remove(ctx, loose); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+
+	// Parity is added to files without it, and removed for files that are gone
+	if err := storage.Remove(ctx, Handle{Type: ParityFile, Name: parityName(pack)}); err != nil {
+		t.Fatalf("Failed to remove parity: %v", err)
+	}
+	report, err = repo.Repair(ctx, nil)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report.AddedParity != 1 || report.RemovedParity != 1 || report.CheckedFiles != 1 {
+		t.Errorf("Expected parity to be added to the pack and removed for the object, got %+v", report)
+	}
+	if err := repo.SetParity(ParityConfig{DataShards: 4}); err == nil {
+		t.Errorf("Expected parity without parity shards to be rejected")
+	}
+}
@@ -0,0 +1,408 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Pruning removes objects that no snapshot references any more. It works in two phases
+// so that a backup running at the same time cannot lose objects it has just written but
+// not yet recorded in a snapshot: a prune run only marks newly unreferenced objects, and
+// objects are deleted by a later run once they have stayed unreferenced for the grace
+// period. Objects that are referenced again in the meantime are unmarked.
+//
+// The marks are kept in a single file of type MarkFile. Loose objects are deleted
+// directly; packs whose objects are all deleted are removed, and packs that still hold
+// live objects are rewritten without the deleted ones. Packs that no index file lists, left
+// by a backup that saved its packs but not their index, are read from their headers and
+// pruned like the others; only packs whose header can't be read are marked and removed
+// as a whole.
+
+// DefaultPruneGracePeriod is how long an object must stay unreferenced before it is deleted.
+const DefaultPruneGracePeriod = 24 * time.Hour
+
+// markHandleName is the name of the file that holds the prune marks.
+const markHandleName = "prune"
+
+// PruneOptions controls a prune run.
+type PruneOptions struct {
+	DryRun      bool          // Only report what would be marked and deleted
+	GracePeriod time.Duration // Time an object must stay marked before it is deleted
+}
+
+// PruneStats reports the outcome of a prune run.
+type PruneStats struct {
+	Snapshots           int   `json:"snapshots"`            // Snapshots whose objects are kept
+	ReferencedObjects   int   `json:"referenced_objects"`   // Objects referenced by those snapshots
+	UnreferencedObjects int   `json:"unreferenced_objects"` // Objects no snapshot references, and unreadable unindexed packs
+	UnreferencedBytes   int64 `json:"unreferenced_bytes"`   // Stored size of those, reclaimable once their grace period is over
+	NewlyMarked         int   `json:"newly_marked"`         // Unreferenced objects marked by this run
+	PendingObjects      int   `json:"pending_objects"`      // Marked objects still within their grace period
+	DeletableObjects    int   `json:"deletable_objects"`    // Marked objects whose grace period is over
+	DeletableBytes      int64 `json:"deletable_bytes"`      // Stored size of the deletable objects
+	DeletedObjects      int   `json:"deleted_objects"`      // Objects deleted by this run (0 in a dry run)
+	DeletedBytes        int64 `json:"deleted_bytes"`        // Stored bytes freed by this run
+	RemovedPacks        int   `json:"removed_packs"`        // Packs deleted because nothing in them was kept
+	RepackedPacks       int   `json:"repacked_packs"`       // Packs rewritten without their deleted objects
+}
+
+// pruneMarks is the on-disk form of the prune marks: the time each unreferenced object
+// and unreadable unindexed pack was first found by a prune run.
+type pruneMarks struct {
+	Objects map[string]time.Time `json:"objects"`
+	Packs   map[string]time.Time `json:"packs"`
+}
+
+// Prune deletes objects that are no longer referenced by any snapshot, see the
+// description of the two-phase process above. A zero GracePeriod in opts uses
+// DefaultPruneGracePeriod. Append-only repositories can only be pruned once maintenance
+// is authorised, except for dry runs. A dry run only takes a shared lock and writes nothing.
+func (r *Repository) Prune(ctx context.Context, opts PruneOptions) (*PruneStats, error) {
+	if r.AppendOnly() && !opts.DryRun {
+		return nil, fmt.Errorf("pruning needs the maintenance key: %w", ErrAppendOnly)
+	}
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = DefaultPruneGracePeriod
+	}
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	var lock *Lock
+	var err error
+	if opts.DryRun {
+		lock, err = r.AcquireLock(ctx, false, "prune")
+	} else {
+		lock, err = r.acquireWriteLock(ctx, true, "prune")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	referenced, snapshots, err := r.referencedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := &PruneStats{Snapshots: snapshots, ReferencedObjects: len(referenced)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Start from what is in the storage now rather than from what this process has cached
+	r.index = make(map[string]blobLocation)
+	r.indexLoaded = false
+	if err := r.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	indexNames, err := r.listFiles(ctx, IndexFile)
+	if err != nil {
+		return nil, err
+	}
+	packs := make(map[string][]packedBlob)
+	for _, name := range indexNames {
+		idx, err := r.readIndexFile(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, pack := range idx.Packs {
+			packs[pack.ID] = pack.Blobs
+		}
+	}
+	// Packs no index file lists, as loadIndex read them from their headers
+	for _, pack := range r.unsavedPacks {
+		packs[pack.ID] = pack.Blobs
+	}
+
+	loose := make(map[string]int64)
+	err = r.storage.List(ctx, ObjectFile, func(info StorageFileInfo) error {
+		loose[info.Name] = info.Size
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	unindexed := make(map[string]int64)
+	err = r.storage.List(ctx, PackFile, func(info StorageFileInfo) error {
+		if _, ok := packs[info.Name]; !ok {
+			unindexed[info.Name] = info.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	// Sizes of all unreferenced objects, wherever they are stored
+	unreferenced := make(map[string]int64)
+	for id, size := range loose {
+		if !referenced[id] {
+			unreferenced[id] += size
+		}
+	}
+	for _, blobs := range packs {
+		for _, blob := range blobs {
+			if !referenced[blob.ID] {
+				unreferenced[blob.ID] += blob.Length
+			}
+		}
+	}
+
+	marks, err := r.loadPruneMarks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	newMarks := &pruneMarks{Objects: make(map[string]time.Time), Packs: make(map[string]time.Time)}
+	deletable := make(map[string]bool)
+	classify := func(marked map[string]time.Time, kept map[string]time.Time, id string, size int64) bool {
+		stats.UnreferencedObjects++
+		stats.UnreferencedBytes += size
+		markedAt, ok := marked[id]
+		if !ok {
+			stats.NewlyMarked++
+			kept[id] = now
+			return false
+		}
+		if now.Sub(markedAt) < opts.GracePeriod {
+			stats.PendingObjects++
+			kept[id] = markedAt
+			return false
+		}
+		stats.DeletableObjects++
+		stats.DeletableBytes += size
+		return true
+	}
+	for id, size := range unreferenced {
+		if classify(marks.Objects, newMarks.Objects, id, size) {
+			deletable[id] = true
+		}
+	}
+	var deletablePacks []string
+	for id, size := range unindexed {
+		if classify(marks.Packs, newMarks.Packs, id, size) {
+			deletablePacks = append(deletablePacks, id)
+		}
+	}
+
+	if opts.DryRun {
+		// Leave indexing the unindexed packs to a run that may write
+		r.index = make(map[string]blobLocation)
+		r.indexLoaded = false
+		r.unsavedPacks = nil
+		return stats, nil
+	}
+
+	if err := r.deleteObjects(ctx, stats, indexNames, packs, loose, deletable); err != nil {
+		return stats, err
+	}
+	for _, id := range deletablePacks {
+		if err := r.removeWithParity(ctx, Handle{Type: PackFile, Name: id}); err != nil {
+			return stats, fmt.Errorf("failed to remove unreadable pack %s: %w", id, err)
+		}
+		stats.DeletedObjects++
+		stats.DeletedBytes += unindexed[id]
+		stats.RemovedPacks++
+	}
+
+	if err := r.savePruneMarks(ctx, newMarks); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// referencedObjects returns the IDs of all objects referenced by the snapshots in the
+// repository, trees included, and the number of snapshots. A snapshot or tree that can't be
+// read fails the whole call, since its objects would otherwise be treated as unreferenced.
+func (r *Repository) referencedObjects(ctx context.Context) (map[string]bool, int, error) {
+	ids, err := r.listFiles(ctx, SnapshotFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	referenced := make(map[string]bool)
+	walker := &treeWalker{
+		visited: make(map[string]bool),
+		tree: func(id, dir string) error {
+			referenced[id] = true
+			return nil
+		},
+		file: func(entry *FileEntry) error {
+			for _, id := range entryObjects(entry) {
+				referenced[id] = true
+			}
+			return nil
+		},
+	}
+	for _, id := range ids {
+		snapshot, err := r.LoadSnapshot(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := r.walkSnapshot(ctx, snapshot, walker); err != nil {
+			return nil, 0, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+		}
+	}
+	return referenced, len(ids), nil
+}
+
+// deleteObjects removes the deletable loose objects, after dropping them from the object
+// index, and rewrites or removes the packs that hold deletable objects. New packs and a new index are written before the old index files
+// and packs are removed, so an interrupted run never loses a live object.
+// The caller must hold r.mu.
+func (r *Repository) deleteObjects(ctx context.Context, stats *PruneStats, indexNames []string, packs map[string][]packedBlob, loose map[string]int64, deletable map[string]bool) error {
+	// The object index must not list deleted objects, or backups would skip storing them
+	remaining := make([]string, 0, len(loose))
+	for id := range loose {
+		if !deletable[id] {
+			remaining = append(remaining, id)
+		}
+	}
+	if len(remaining) < len(loose) {
+		if err := r.replaceObjectIndex(ctx, remaining); err != nil {
+			return err
+		}
+	}
+	for id, size := range loose {
+		if !deletable[id] {
+			continue
+		}
+		if err := r.removeWithParity(ctx, Handle{Type: ObjectFile, Name: id}); err != nil {
+			return fmt.Errorf("failed to remove object %s: %w", id, err)
+		}
+		stats.DeletedObjects++
+		stats.DeletedBytes += size
+	}
+
+	// Packs loadIndex found without an index file are in packs as well, and go into the new
+	// index with the kept packs unless they are removed. Packs written while repacking are
+	// collected in r.unsavedPacks.
+	pending := r.unsavedPacks
+	r.unsavedPacks = nil
+	var obsolete []string
+	kept := make(map[string][]packedBlob)
+	for packID, blobs := range packs {
+		var keep []packedBlob
+		for _, blob := range blobs {
+			if !deletable[blob.ID] {
+				keep = append(keep, blob)
+			}
+		}
+		if len(keep) == len(blobs) {
+			kept[packID] = blobs
+			continue
+		}
+		obsolete = append(obsolete, packID)
+		for _, blob := range blobs {
+			if deletable[blob.ID] {
+				stats.DeletedObjects++
+				stats.DeletedBytes += blob.Length
+			}
+		}
+		if len(keep) == 0 {
+			stats.RemovedPacks++
+			continue
+		}
+
+		stats.RepackedPacks++
+		for _, blob := range keep {
+			raw, err := loadRange(ctx, r.storage, Handle{Type: PackFile, Name: packID}, blob.Offset, blob.Length)
+			if err != nil {
+				return fmt.Errorf("failed to read object %s from pack %s: %w", blob.ID, packID, err)
+			}
+			if err := r.addToPack(ctx, blob.ID, raw); err != nil {
+				return err
+			}
+		}
+	}
+	if len(obsolete) == 0 {
+		r.unsavedPacks = pending
+		return nil
+	}
+	if err := r.finishPack(ctx); err != nil {
+		return err
+	}
+
+	idx := &indexFile{Packs: r.unsavedPacks}
+	for packID, blobs := range kept {
+		idx.Packs = append(idx.Packs, indexPack{ID: packID, Blobs: blobs})
+	}
+	if len(idx.Packs) > 0 {
+		if err := r.writeIndexFile(ctx, idx); err != nil {
+			return err
+		}
+	}
+	r.unsavedPacks = nil
+	for _, name := range indexNames {
+		if err := r.storage.Remove(ctx, Handle{Type: IndexFile, Name: name}); err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to remove old index file %s: %w", name, err)
+		}
+	}
+	for _, packID := range obsolete {
+		if err := r.removeWithParity(ctx, Handle{Type: PackFile, Name: packID}); err != nil {
+			return fmt.Errorf("failed to remove pack %s: %w", packID, err)
+		}
+	}
+
+	r.index = make(map[string]blobLocation)
+	r.indexLoaded = false
+	return nil
+}
+
+// loadPruneMarks reads the prune marks, returning empty marks if there are none yet.
+func (r *Repository) loadPruneMarks(ctx context.Context) (*pruneMarks, error) {
+	marks := &pruneMarks{Objects: make(map[string]time.Time), Packs: make(map[string]time.Time)}
+	data, err := loadAll(ctx, r.storage, Handle{Type: MarkFile, Name: markHandleName})
+	if isNotExist(err) {
+		return marks, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read prune marks: %w", err)
+	}
+	if isEncryptedBlob(data) {
+		if r.key == nil {
+			return nil, ErrPassphraseRequired
+		}
+		if data, err = r.key.openBlob(data, []byte(markHandleName)); err != nil {
+			return nil, fmt.Errorf("prune marks: %w", err)
+		}
+	}
+	if err := json.Unmarshal(data, marks); err != nil {
+		// Losing the marks only delays deletion by one grace period
+		fmt.Fprintf(os.Stderr, "Warning: Ignoring unreadable prune marks in %s: %v\n", r.Location(), err)
+		return &pruneMarks{Objects: make(map[string]time.Time), Packs: make(map[string]time.Time)}, nil
+	}
+	if marks.Objects == nil {
+		marks.Objects = make(map[string]time.Time)
+	}
+	if marks.Packs == nil {
+		marks.Packs = make(map[string]time.Time)
+	}
+	return marks, nil
+}
+
+// savePruneMarks replaces the prune marks, removing the file when nothing is marked.
+func (r *Repository) savePruneMarks(ctx context.Context, marks *pruneMarks) error {
+	h := Handle{Type: MarkFile, Name: markHandleName}
+	if len(marks.Objects) == 0 && len(marks.Packs) == 0 {
+		if err := r.storage.Remove(ctx, h); err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to remove prune marks: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(marks)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prune marks: %w", err)
+	}
+	if r.key != nil {
+		if data, err = r.key.sealBlob(data, []byte(markHandleName)); err != nil {
+			return fmt.Errorf("failed to encrypt prune marks: %w", err)
+		}
+	}
+	if err := r.storage.Save(ctx, h, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write prune marks: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestPrune checks that unreferenced objects are only marked on the first run, deleted once
+// the grace period is over, and that packs holding live objects are rewritten without them
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	store := func(data []byte) string {
+		id := repo.objectID(data)
+		if _, err := repo.storeObject(ctx, id, data); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		return id
+	}
+	large := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(3)).Read(large)
+	kept := store([]byte("kept small object"))
+	dropped := store([]byte("dropped small object"))
+	droppedLarge := store(large)
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	snapshot := func(id string, chunks ...string) {
+		s := &Snapshot{ID: id, Files: map[string]*FileEntry{"f": {Path: "f", Chunks: chunks, Size: 1}}}
+		if err := repo.SaveSnapshot(s); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+	snapshot("20250101000000", kept)
+	snapshot("20250102000000", dropped, droppedLarge)
+	if err := storage.Remove(ctx, Handle{Type: SnapshotFile, Name: "20250102000000"}); err != nil {
+		t.Fatalf("Failed to remove snapshot: %v", err)
+	}
+
+	stats, err := repo.Prune(ctx, PruneOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if stats.Snapshots != 1 || stats.UnreferencedObjects != 2 || stats.UnreferencedBytes == 0 || stats.DeletedObjects != 0 {
+		t.Errorf("Unexpected dry run stats: %+v", stats)
+	}
+	if found, _ := hasFiles(ctx, storage, MarkFile); found {
+		t.Errorf("Dry run must not write prune marks")
+	}
+
+	// The first run only marks, a second run within the grace period keeps them pending
+	stats, err = repo.Prune(ctx, PruneOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if stats.NewlyMarked != 2 || stats.DeletedObjects != 0 {
+		t.Errorf("Expected two newly marked objects and no deletions, got %+v", stats)
+	}
+	stats, err = repo.Prune(ctx, PruneOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if stats.PendingObjects != 2 || stats.DeletedObjects != 0 {
+		t.Errorf("Expected two pending objects and no deletions, got %+v", stats)
+	}
+
+	stats, err = repo.Prune(ctx, PruneOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if stats.DeletedObjects != 2 || stats.RepackedPacks != 1 || stats.DeletedBytes != stats.DeletableBytes {
+		t.Errorf("Expected both objects deleted and one pack rewritten, got %+v", stats)
+	}
+	for _, id := range []string{dropped, droppedLarge} {
+		if _, err := repo.RetrieveObject(id); !isNotExist(err) {
+			t.Errorf("Expected object %s to be deleted, got %v", id, err)
+		}
+	}
+
+	reopened, err := OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	rc, err := reopened.RetrieveObject(kept)
+	if err != nil {
+		t.Fatalf("Kept object is gone after prune: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "kept small object" {
+		t.Errorf("Kept object has wrong content %q", data)
+	}
+	if found, _ := hasFiles(ctx, storage, MarkFile); found {
+		t.Errorf("Expected the prune marks to be removed once nothing is marked")
+	}
+}
+
+// TestPruneUnmarksReusedObjects checks that an object written by a backup that hasn't saved
+// its snapshot yet survives pruning when the snapshot appears within the grace period
+func TestPruneUnmarksReusedObjects(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	data := []byte("written by a backup in progress")
+	id := repo.objectID(data)
+	if _, err := repo.storeObject(ctx, id, data); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	stats, err := repo.Prune(ctx, PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if stats.NewlyMarked != 1 || stats.DeletedObjects != 0 {
+		t.Errorf("Expected the object to be marked only, got %+v", stats)
+	}
+
+	snapshot := &Snapshot{ID: "20250101000000", Files: map[string]*FileEntry{"f": {Path: "f", Chunks: []string{id}, Size: int64(len(data))}}}
+	if err := repo.SaveSnapshot(snapshot); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	stats, err = repo.Prune(ctx, PruneOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if stats.UnreferencedObjects != 0 || stats.DeletedObjects != 0 {
+		t.Errorf("Expected the referenced object to be kept, got %+v", stats)
+	}
+	if _, err := repo.RetrieveObject(id); err != nil {
+		t.Errorf("Object was deleted: %v", err)
+	}
+	if found, _ := hasFiles(ctx, storage, MarkFile); found {
+		t.Errorf("Expected the object to be unmarked")
+	}
+}
+
+// TestPruneUnindexedPack checks that a pack whose index file was never written is pruned
+// by its objects: referenced ones are kept, unreferenced ones are deleted, and no index
+// points at the removed pack afterwards. A dry run on it writes nothing.
+func TestPruneUnindexedPack(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	// One pack with a referenced and an unreferenced object, another with only an
+	// unreferenced one, and no index for either
+	store := func(data string) string {
+		id := repo.objectID([]byte(data))
+		if _, err := repo.storeObject(ctx, id, []byte(data)); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		return id
+	}
+	kept := store("referenced object in an unindexed pack")
+	dropped := store("unreferenced object next to it")
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	alone := store("unreferenced object alone in its pack")
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	snapshot := &Snapshot{ID: "20250101000000", Files: map[string]*FileEntry{"f": {Path: "f", Chunks: []string{kept}, Size: 1}}}
+	if err := repo.SaveSnapshot(snapshot); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	names, _ := repo.listFiles(ctx, IndexFile)
+	for _, name := range names {
+		storage.Remove(ctx, Handle{Type: IndexFile, Name: name})
+	}
+
+	dry, err := OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	stats, err := dry.Prune(ctx, PruneOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if stats.UnreferencedObjects != 2 {
+		t.Errorf("Expected the two unreferenced objects to be found, got %+v", stats)
+	}
+	if err := dry.Close(); err != nil {
+		t.Fatalf("Failed to close repository: %v", err)
+	}
+	if found, _ := hasFiles(ctx, storage, IndexFile); found {
+		t.Errorf("Expected the dry run not to write an index")
+	}
+
+	pruner, err := OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	if _, err := pruner.Prune(ctx, PruneOptions{}); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	stats, err = pruner.Prune(ctx, PruneOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if stats.DeletedObjects != 2 || stats.RemovedPacks != 1 || stats.RepackedPacks != 1 {
+		t.Errorf("Expected both objects deleted, one pack removed and one rewritten, got %+v", stats)
+	}
+	if err := pruner.Close(); err != nil {
+		t.Fatalf("Failed to close repository: %v", err)
+	}
+
+	reopened, err := OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	packs, _ := reopened.listFiles(ctx, PackFile)
+	names, _ = reopened.listFiles(ctx, IndexFile)
+	for _, name := range names {
+		idx, err := reopened.readIndexFile(ctx, name)
+		if err != nil {
+			t.Fatalf("Failed to read index: %v", err)
+		}
+		for _, pack := range idx.Packs {
+			if !containsString(packs, pack.ID) {
+				t.Errorf("Index %s lists the removed pack %s", name, pack.ID)
+			}
+		}
+	}
+	rc, err := reopened.RetrieveObject(kept)
+	if err != nil {
+		t.Fatalf("Referenced object is gone after prune: %v", err)
+	}
+	rc.Close()
+	for _, id := range []string{dropped, alone} {
+		if found, err := reopened.hasObject(ctx, id); err != nil || found {
+			t.Errorf("Expected object %s to be deleted, got %v (err=%v)", id, found, err)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// RepoFormatVersion is the repository format written by this version of the program.
+// Repositories from before versioning was introduced have no version in their config
+// (or no config at all) and are treated as version 0.
+const RepoFormatVersion = 1
+
+var (
+	// ErrRepositoryNotInitialized is returned when opening a location that holds no repository.
+	ErrRepositoryNotInitialized = errors.New("repository is not initialized")
+	// ErrUnsupportedRepositoryVersion is returned for repositories written by a newer program version.
+	ErrUnsupportedRepositoryVersion = errors.New("unsupported repository format version")
+)
+
+// RepoConfig holds the settings stored in a repository's config file.
+type RepoConfig struct {
+	Version          int           `json:"version"`           // Repository format version; 0 if the config predates versioning
+	ID               string        `json:"id"`                // Unique repository ID, assigned on init
+	HashAlgorithm    string        `json:"hash_algorithm"`    // Hash used to name objects and packs and to identify files; fixed at init
+	Chunker          ChunkerConfig `json:"chunker"`           // Content-defined chunk sizes
+	CompressionLevel int           `json:"compression_level"` // zstd level for new objects; 0 disables compression
+	Encrypted        bool          `json:"encrypted"`         // Objects and snapshots are encrypted with a key from keys/
+	Parity           ParityConfig  `json:"parity"`            // Reed-Solomon parity for packs and loose objects; off by default
+	Quota            QuotaConfig   `json:"quota"`             // Repository size limit checked by backups; off by default
+	MaxFileSize      int64         `json:"max_file_size"`     // Larger files are stored as segments; 0 for no limit beyond the filesystem's
+	// AppendOnly refuses deletes and overwrites unless authorised with the maintenance key
+	AppendOnly         bool   `json:"append_only"`
+	MaintenanceKeyHash string `json:"maintenance_key_hash,omitempty"` // Hash of the maintenance key, set with AppendOnly
+}
+
+// DefaultRepoConfig returns the settings used for new repositories and for
+// version 0 repositories without a config file.
+func DefaultRepoConfig() RepoConfig {
+	return RepoConfig{
+		HashAlgorithm:    HashSHA256,
+		Chunker:          DefaultChunkerConfig(),
+		CompressionLevel: DefaultCompressionLevel,
+	}
+}
+
+// Validate checks that the settings can be used with this version of the program.
+func (c RepoConfig) Validate() error {
+	if !ValidHashAlgorithm(c.HashAlgorithm) {
+		return fmt.Errorf("unsupported hash algorithm %q", c.HashAlgorithm)
+	}
+	if err := c.Chunker.Validate(); err != nil {
+		return fmt.Errorf("invalid chunker settings: %w", err)
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > 22 {
+		return fmt.Errorf("compression level %d out of range (0-22)", c.CompressionLevel)
+	}
+	if err := c.Parity.Validate(); err != nil {
+		return fmt.Errorf("invalid parity settings: %w", err)
+	}
+	if err := c.Quota.Validate(); err != nil {
+		return fmt.Errorf("invalid quota settings: %w", err)
+	}
+	if c.MaxFileSize != 0 && c.MaxFileSize < MinMaxFileSize {
+		return fmt.Errorf("maximum file size %d is below the minimum of %d bytes", c.MaxFileSize, MinMaxFileSize)
+	}
+	if c.AppendOnly && c.MaintenanceKeyHash == "" {
+		return errors.New("append-only mode needs a maintenance key")
+	}
+	return nil
+}
+
+// Repository is an open backup destination together with its settings.
+type Repository struct {
+	storage Storage
+	config  RepoConfig
+	key     *MasterKey // nil for unencrypted repositories
+
+	migratedFrom *int          // Format version the repository was opened in, until Migrate saves the upgrade
+	onMigrate    MigrationFunc // Told when Migrate saves the upgrade, if set
+
+	mu           sync.Mutex
+	index        map[string]blobLocation // Packed objects by ID, loaded on first use
+	indexLoaded  bool
+	packer       *packer     // Pack file currently being written, if any
+	unsavedPacks []indexPack // Finished packs not yet written to an index file
+	looseObjects objectSet   // Loose objects by ID, loaded on first use
+	unsavedLoose []string    // Loose objects not yet written to an object index file
+}
+
+// repoConfigPath returns the path of the repository config file.
+func repoConfigPath(casBaseDir string) string {
+	return filepath.Join(casBaseDir, "config")
+}
+
+// OpenRepository opens the repository at casBaseDir, loading its config file if there is one.
+// Encrypted repositories must be opened with OpenRepositoryWithPassphrase.
+func OpenRepository(casBaseDir string) (*Repository, error) {
+	return OpenRepositoryWithPassphrase(casBaseDir, "")
+}
+
+// OpenRepositoryWithPassphrase opens the repository at casBaseDir and, if it is encrypted,
+// unlocks its master key with the passphrase.
+func OpenRepositoryWithPassphrase(casBaseDir, passphrase string) (*Repository, error) {
+	return OpenRepositoryWithConfig(casBaseDir, StorageConfig{}, passphrase)
+}
+
+// OpenRepositoryWithConfig opens the repository in the storage selected by storageConfig
+// (see OpenStorageWithConfig) and, if it is encrypted, unlocks its master key with the passphrase.
+func OpenRepositoryWithConfig(casBaseDir string, storageConfig StorageConfig, passphrase string) (*Repository, error) {
+	storage, err := OpenStorageWithConfig(casBaseDir, storageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	repo, err := OpenRepositoryWithStorage(storage, passphrase)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return repo, nil
+}
+
+// OpenRepositoryWithStorage opens the repository kept in storage and, if it is encrypted,
+// unlocks its master key with the passphrase. Repositories in an older format are upgraded
+// in memory, and only saved in the current one by Migrate; repositories from a newer program
+// version are refused.
+func OpenRepositoryWithStorage(storage Storage, passphrase string) (*Repository, error) {
+	ctx := context.Background()
+	location := storage.Location()
+	config := DefaultRepoConfig()
+
+	data, err := loadAll(ctx, storage, Handle{Type: ConfigFile, Name: configHandleName})
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse repository config in %s: %w", location, err)
+		}
+	} else if isNotExist(err) {
+		// Repositories written before the config file existed only have data
+		empty, err := isEmptyStorage(ctx, storage)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return nil, fmt.Errorf("%w: %s", ErrRepositoryNotInitialized, location)
+		}
+	} else {
+		return nil, fmt.Errorf("failed to read repository config in %s: %w", location, err)
+	}
+
+	if config.Version > RepoFormatVersion {
+		return nil, fmt.Errorf("%w: %s uses format version %d, this program supports up to %d",
+			ErrUnsupportedRepositoryVersion, location, config.Version, RepoFormatVersion)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid repository config in %s: %w", location, err)
+	}
+
+	repo := &Repository{
+		storage: storage,
+		config:  config,
+		index:   make(map[string]blobLocation),
+	}
+
+	if config.Encrypted {
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		key, err := unlockMasterKey(ctx, storage, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		repo.key = key
+	}
+
+	if repo.config.Version < RepoFormatVersion {
+		if err := repo.upgrade(); err != nil {
+			return nil, err
+		}
+	}
+	repo.applyMaxFileSize()
+	repo.applyAppendOnly()
+
+	return repo, nil
+}
+
+// InitRepository creates a new repository in storage with the given settings and writes
+// its config file. The repository gets a fresh ID and the current format version. If a
+// passphrase is given, the repository is encrypted with a newly generated master key.
+func InitRepository(storage Storage, config RepoConfig, passphrase string) (*Repository, error) {
+	ctx := context.Background()
+	location := storage.Location()
+
+	if _, err := storage.Stat(ctx, Handle{Type: ConfigFile, Name: configHandleName}); err == nil {
+		return nil, fmt.Errorf("repository %s is already initialized", location)
+	} else if !isNotExist(err) {
+		return nil, fmt.Errorf("failed to check for repository config in %s: %w", location, err)
+	}
+	empty, err := isEmptyStorage(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, fmt.Errorf("%s already contains backup data; open it to migrate it instead", location)
+	}
+	keys, err := listKeyFiles(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		return nil, fmt.Errorf("%s contains key files from an unfinished init; remove %s/ to start over", location, KeyFile)
+	}
+
+	if config.HashAlgorithm == "" {
+		config.HashAlgorithm = HashSHA256
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid repository settings: %w", err)
+	}
+	id, err := randomName()
+	if err != nil {
+		return nil, err
+	}
+	config.Version = RepoFormatVersion
+	config.ID = id
+	config.Encrypted = passphrase != ""
+
+	repo := &Repository{
+		storage: storage,
+		config:  config,
+		index:   make(map[string]blobLocation),
+	}
+	if passphrase != "" {
+		key, err := newMasterKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeKeyFile(ctx, storage, key, passphrase); err != nil {
+			return nil, err
+		}
+		repo.key = key
+	}
+
+	// The config is written last so an interrupted init doesn't leave a half-made repository
+	if err := repo.SaveConfig(); err != nil {
+		return nil, err
+	}
+	repo.applyMaxFileSize()
+	repo.applyAppendOnly()
+	return repo, nil
+}
+
+// InitRepositoryWithConfig creates a new repository in the storage selected by storageConfig
+// (see OpenStorageWithConfig) using the default settings.
+func InitRepositoryWithConfig(casBaseDir string, storageConfig StorageConfig, passphrase string) (*Repository, error) {
+	return InitRepositoryWithSettings(casBaseDir, storageConfig, DefaultRepoConfig(), passphrase)
+}
+
+// InitRepositoryWithSettings is InitRepositoryWithConfig with the given repository settings
+// instead of the defaults.
+func InitRepositoryWithSettings(casBaseDir string, storageConfig StorageConfig, config RepoConfig, passphrase string) (*Repository, error) {
+	storage, err := OpenStorageWithConfig(casBaseDir, storageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	repo, err := InitRepository(storage, config, passphrase)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return repo, nil
+}
+
+// OpenRepositoryForWrite opens the repository at casBaseDir, or in the remote storage
+// selected by storageConfig, to write to it the way a backup does: a location that doesn't
+// hold a repository yet gets one.
+func OpenRepositoryForWrite(casBaseDir string, storageConfig StorageConfig, passphrase string) (*Repository, error) {
+	return openRepositoryForWrite(casBaseDir, storageConfig, passphrase)
+}
+
+// openRepositoryForWrite opens the repository for a backup, initializing it if the location
+// doesn't hold one yet. A passphrase given for an unencrypted repository that doesn't hold
+// any data yet turns on encryption for it.
+func openRepositoryForWrite(casBaseDir string, storageConfig StorageConfig, passphrase string) (*Repository, error) {
+	return openOrInitRepository(casBaseDir, storageConfig, DefaultRepoConfig(), passphrase)
+}
+
+// openOrInitRepository is openRepositoryForWrite with the settings for a new repository.
+func openOrInitRepository(casBaseDir string, storageConfig StorageConfig, config RepoConfig, passphrase string) (*Repository, error) {
+	storage, err := OpenStorageWithConfig(casBaseDir, storageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	repo, err := OpenRepositoryWithStorage(storage, passphrase)
+	if errors.Is(err, ErrRepositoryNotInitialized) {
+		repo, err = InitRepository(storage, config, passphrase)
+	}
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if passphrase != "" && !repo.config.Encrypted {
+		if err := repo.InitEncryption(passphrase); err != nil {
+			repo.Close()
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// Close writes out pending pack and index data and releases the storage.
+func (r *Repository) Close() error {
+	err := r.Flush()
+	if closeErr := r.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// baseStorage returns the storage the repository is kept in, without the append-only checks
+// and file segmentation layered on it. It is only for asking the storage what it is and
+// what it can do; writes go through r.storage, or rawStorage where the layers are rebuilt.
+func (r *Repository) baseStorage() Storage {
+	storage := r.storage
+	if s, ok := storage.(*appendOnlyStorage); ok {
+		storage = s.Storage
+	}
+	if s, ok := storage.(*segmentedStorage); ok {
+		storage = s.Storage
+	}
+	return storage
+}
+
+// rawStorage returns the storage below the append-only checks and file segmentation for
+// direct use. In append-only mode maintenance must have been authorised first.
+func (r *Repository) rawStorage() (Storage, error) {
+	if r.AppendOnly() {
+		return nil, fmt.Errorf("bypassing the append-only checks needs the maintenance key: %w", ErrAppendOnly)
+	}
+	return r.baseStorage(), nil
+}
+
+// Location returns a human-readable description of where the repository is.
+func (r *Repository) Location() string {
+	return r.storage.Location()
+}
+
+// Config returns the repository settings.
+func (r *Repository) Config() RepoConfig {
+	return r.config
+}
+
+// SaveConfig writes the repository settings to the config file.
+func (r *Repository) SaveConfig() error {
+	data, err := json.MarshalIndent(r.config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository config: %w", err)
+	}
+
+	h := Handle{Type: ConfigFile, Name: configHandleName}
+	if err := r.storage.Save(context.Background(), h, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write repository config: %w", err)
+	}
+	return nil
+}
+
+// checkSettingsWritable fails if the settings of the repository can't be changed: the config
+// of an append-only repository can only be rewritten once maintenance is authorised.
+func (r *Repository) checkSettingsWritable() error {
+	if r.AppendOnly() {
+		return fmt.Errorf("changing the settings of repository %s needs the maintenance key: %w", r.Location(), ErrAppendOnly)
+	}
+	return nil
+}
+
+// SetCompressionLevel changes the zstd level used for objects written from now on.
+// Existing objects keep their compression; 0 disables compression.
+func (r *Repository) SetCompressionLevel(level int) error {
+	if err := r.checkSettingsWritable(); err != nil {
+		return err
+	}
+	config := r.config
+	config.CompressionLevel = level
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	r.config = config
+	return r.SaveConfig()
+}
+
+// Encrypted reports whether the repository content is encrypted.
+func (r *Repository) Encrypted() bool {
+	return r.key != nil
+}
+
+// InitEncryption turns on encryption for a repository that doesn't contain any objects or
+// snapshots yet. A random master key is generated and stored wrapped with the passphrase.
+func (r *Repository) InitEncryption(passphrase string) error {
+	if r.config.Encrypted {
+		return fmt.Errorf("repository %s is already encrypted", r.Location())
+	}
+	if err := r.checkSettingsWritable(); err != nil {
+		return err
+	}
+	empty, err := r.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("repository %s already contains unencrypted data; encryption can only be enabled for a new repository", r.Location())
+	}
+
+	key, err := newMasterKey()
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(context.Background(), r.storage, key, passphrase); err != nil {
+		return err
+	}
+
+	r.key = key
+	r.config.Encrypted = true
+	return r.SaveConfig()
+}
+
+// isEmpty reports whether the repository holds no objects and no snapshots.
+func (r *Repository) isEmpty() (bool, error) {
+	return isEmptyStorage(context.Background(), r.storage)
+}
+
+// isEmptyStorage reports whether storage holds no objects, packs or snapshots.
+func isEmptyStorage(ctx context.Context, storage Storage) (bool, error) {
+	for _, t := range []FileType{ObjectFile, PackFile, SnapshotFile} {
+		found, err := hasFiles(ctx, storage, t)
+		if err != nil {
+			return false, fmt.Errorf("failed to list %s: %w", t, err)
+		}
+		if found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// objectID returns the name under which an object with the given content is stored:
+// its hash, or a keyed hash in encrypted repositories so names don't reveal content hashes.
+func (r *Repository) objectID(data []byte) string {
+	if r.key != nil {
+		return r.key.objectID(r.config.HashAlgorithm, data)
+	}
+	return hashBytes(r.config.HashAlgorithm, data)
+}
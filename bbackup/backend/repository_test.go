@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestInitRepository checks that init writes a versioned config with a unique ID and that
+// locations without a repository are not opened silently
+func TestInitRepository(t *testing.T) {
+	storage := NewMemoryStorage()
+	if _, err := OpenRepositoryWithStorage(storage, ""); !errors.Is(err, ErrRepositoryNotInitialized) {
+		t.Fatalf("Expected ErrRepositoryNotInitialized for empty storage, got %v", err)
+	}
+
+	settings := DefaultRepoConfig()
+	settings.CompressionLevel = 7
+	repo, err := InitRepository(storage, settings, "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	config := repo.Config()
+	if config.Version != RepoFormatVersion || config.HashAlgorithm != HashSHA256 || len(config.ID) != 32 {
+		t.Errorf("Unexpected config after init: %+v", config)
+	}
+	if _, err := InitRepository(storage, settings, ""); err == nil {
+		t.Errorf("Expected a second init of the same repository to fail")
+	}
+
+	other, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init second repository: %v", err)
+	}
+	if other.Config().ID == config.ID {
+		t.Errorf("Expected repositories to get distinct IDs, both got %s", config.ID)
+	}
+
+	reopened, err := OpenRepositoryWithStorage(storage, "")
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	if reopened.Config() != config {
+		t.Errorf("Reopened config %+v differs from %+v", reopened.Config(), config)
+	}
+
+	bad := DefaultRepoConfig()
+	bad.HashAlgorithm = "md5"
+	if _, err := InitRepository(NewMemoryStorage(), bad, ""); err == nil {
+		t.Errorf("Expected init with an unknown hash algorithm to fail")
+	}
+}
+
+// TestRepositoryMigration checks that version 0 repositories, with or without a config file,
+// are upgraded on open, saved in the new format only once something is written, and that
+// repositories from a newer format are refused
+func TestRepositoryMigration(t *testing.T) {
+	ctx := context.Background()
+	configHandle := Handle{Type: ConfigFile, Name: configHandleName}
+
+	t.Run("no config", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+		if err != nil {
+			t.Fatalf("Failed to init repository: %v", err)
+		}
+		testBackupAndDeploy(t, repo)
+		if err := storage.Remove(ctx, configHandle); err != nil {
+			t.Fatalf("Failed to remove config: %v", err)
+		}
+
+		migrated, err := OpenRepositoryWithStorage(storage, "")
+		if err != nil {
+			t.Fatalf("Failed to open version 0 repository: %v", err)
+		}
+		if migrated.Config().Version != RepoFormatVersion || migrated.Config().ID == "" {
+			t.Errorf("Repository was not migrated: %+v", migrated.Config())
+		}
+		if ids, err := migrated.listFiles(ctx, SnapshotFile); err != nil || len(ids) != 1 {
+			t.Errorf("Expected the snapshot to survive migration, got %v (err=%v)", ids, err)
+		}
+		if _, err := storage.Stat(ctx, configHandle); !isNotExist(err) {
+			t.Errorf("Expected opening not to write a config file, got %v", err)
+		}
+		if err := RunRepositoryBackup(ctx, migrated, []string{t.TempDir()}, nil, nil, nil, DefaultBatchConfig()); err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+		if _, err := storage.Stat(ctx, configHandle); err != nil {
+			t.Errorf("Expected the backup to write a config file: %v", err)
+		}
+	})
+
+	t.Run("unversioned config", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		legacy := []byte(`{"chunker":{"min_size":262144,"avg_size":524288,"max_size":4194304},"compression_level":9,"encrypted":false}`)
+		if err := storage.Save(ctx, configHandle, bytes.NewReader(legacy)); err != nil {
+			t.Fatalf("Failed to write legacy config: %v", err)
+		}
+
+		repo, err := OpenRepositoryWithStorage(storage, "")
+		if err != nil {
+			t.Fatalf("Failed to open version 0 repository: %v", err)
+		}
+		config := repo.Config()
+		if config.Version != RepoFormatVersion || config.CompressionLevel != 9 || config.Chunker.AvgSize != 524288 {
+			t.Errorf("Migration did not keep the existing settings: %+v", config)
+		}
+		if after, _ := loadAll(ctx, storage, configHandle); !bytes.Equal(after, legacy) {
+			t.Errorf("Expected opening not to rewrite the config, got %s", after)
+		}
+		var migrations []string
+		repo.OnMigrate(func(r *Repository, from, to int) {
+			migrations = append(migrations, fmt.Sprintf("%d->%d", from, to))
+		})
+		for i := 0; i < 2; i++ {
+			if err := repo.Migrate(); err != nil {
+				t.Fatalf("Failed to migrate: %v", err)
+			}
+		}
+		if want := fmt.Sprintf("0->%d", RepoFormatVersion); strings.Join(migrations, " ") != want {
+			t.Errorf("Expected the migration to be reported once as %s, got %v", want, migrations)
+		}
+
+		reopened, err := OpenRepositoryWithStorage(storage, "")
+		if err != nil {
+			t.Fatalf("Failed to reopen migrated repository: %v", err)
+		}
+		if reopened.Config().ID != config.ID {
+			t.Errorf("Expected the ID to be kept after migration, got %s and %s", config.ID, reopened.Config().ID)
+		}
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		future := DefaultRepoConfig()
+		future.Version = RepoFormatVersion + 1
+		data, _ := json.Marshal(future)
+		if err := storage.Save(ctx, configHandle, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, err := OpenRepositoryWithStorage(storage, ""); !errors.Is(err, ErrUnsupportedRepositoryVersion) {
+			t.Errorf("Expected ErrUnsupportedRepositoryVersion, got %v", err)
+		}
+		after, _ := loadAll(ctx, storage, configHandle)
+		if !bytes.Equal(after, data) {
+			t.Errorf("Config of a newer repository was modified")
+		}
+	})
+}
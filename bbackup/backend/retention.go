@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy selects the snapshots to keep when old ones are removed. A snapshot is
+// kept if any rule selects it: KeepLast keeps the newest snapshots, and the other rules
+// keep the newest snapshot of each of that many most recent days, ISO weeks or months
+// that have snapshots. The zero policy keeps everything.
+type RetentionPolicy struct {
+	KeepLast    int `json:"keep_last"`
+	KeepDaily   int `json:"keep_daily"`
+	KeepWeekly  int `json:"keep_weekly"`
+	KeepMonthly int `json:"keep_monthly"`
+}
+
+// Empty reports whether the policy has no rules, in which case no snapshot is removed.
+func (p RetentionPolicy) Empty() bool {
+	return p == RetentionPolicy{}
+}
+
+// Validate checks that the policy is usable.
+func (p RetentionPolicy) Validate() error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 {
+		return errors.New("snapshot counts can't be negative")
+	}
+	return nil
+}
+
+// RetentionResult reports the outcome of applying a retention policy.
+type RetentionResult struct {
+	Kept       []string    `json:"kept"`            // Snapshots the policy keeps, newest first
+	Removed    []string    `json:"removed"`         // Snapshots removed (or that would be, in a dry run), newest first
+	Tombstoned bool        `json:"tombstoned"`      // The repository is append-only, so removals were recorded as tombstones
+	Prune      *PruneStats `json:"prune,omitempty"` // The prune run that followed the removals, if any
+}
+
+// ApplyRetention removes the snapshots the policy doesn't keep and then prunes the
+// repository, which marks their objects for deletion after the prune grace period. In an
+// append-only repository removals are recorded as tombstones and nothing is pruned. An
+// empty policy is refused rather than treated as "keep nothing".
+func (r *Repository) ApplyRetention(ctx context.Context, policy RetentionPolicy, dryRun bool) (*RetentionResult, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention policy: %w", err)
+	}
+	if policy.Empty() {
+		return nil, errors.New("retention policy keeps no snapshots")
+	}
+
+	lock, err := r.acquireWriteLock(ctx, true, "retention")
+	if err != nil {
+		return nil, err
+	}
+	result, err := r.removeExpiredSnapshots(ctx, policy, dryRun)
+	lock.Release()
+	if err != nil || len(result.Removed) == 0 || result.Tombstoned {
+		return result, err
+	}
+
+	// Prune takes its own exclusive lock
+	if result.Prune, err = r.Prune(ctx, PruneOptions{DryRun: dryRun}); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// removeExpiredSnapshots removes the snapshots the policy doesn't keep. The caller holds an
+// exclusive lock.
+func (r *Repository) removeExpiredSnapshots(ctx context.Context, policy RetentionPolicy, dryRun bool) (*RetentionResult, error) {
+	ids, err := r.listFiles(ctx, SnapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(ids))
+	for _, id := range ids {
+		snapshot, err := r.LoadSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &Snapshot{ID: id, Timestamp: snapshot.Timestamp})
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if !snapshots[i].Timestamp.Equal(snapshots[j].Timestamp) {
+			return snapshots[i].Timestamp.After(snapshots[j].Timestamp)
+		}
+		return snapshots[i].ID > snapshots[j].ID
+	})
+
+	keep := retainedSnapshots(snapshots, policy)
+	result := &RetentionResult{Tombstoned: r.AppendOnly()}
+	for _, snapshot := range snapshots {
+		if keep[snapshot.ID] {
+			result.Kept = append(result.Kept, snapshot.ID)
+			continue
+		}
+		result.Removed = append(result.Removed, snapshot.ID)
+		if dryRun {
+			continue
+		}
+		if _, err := r.RemoveSnapshot(ctx, snapshot.ID); err != nil {
+			return result, err
+		}
+		fmt.Fprintf(os.Stderr, "Removed snapshot %s taken %s\n", snapshot.ID, snapshot.Timestamp.Format(time.RFC3339))
+	}
+	return result, nil
+}
+
+// retainedSnapshots returns the IDs of the snapshots the policy keeps. The snapshots must be
+// sorted newest first.
+func retainedSnapshots(snapshots []*Snapshot, policy RetentionPolicy) map[string]bool {
+	keep := make(map[string]bool)
+	for i := 0; i < policy.KeepLast && i < len(snapshots); i++ {
+		keep[snapshots[i].ID] = true
+	}
+	rules := []struct {
+		count  int
+		bucket func(time.Time) string
+	}{
+		{policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for _, snapshot := range snapshots {
+			if len(seen) == rule.count {
+				break
+			}
+			bucket := rule.bucket(snapshot.Timestamp.Local())
+			if !seen[bucket] {
+				seen[bucket] = true
+				keep[snapshot.ID] = true
+			}
+		}
+	}
+	return keep
+}
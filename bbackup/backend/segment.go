@@ -0,0 +1,339 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Some destination filesystems can't hold large files; FAT32, common on USB sticks, fails
+// any write past 4 GiB. In a repository with a maximum file size, files larger than that
+// are stored as numbered segments of at most that size plus a small manifest, and are put
+// back together when read, so the repository code never sees them:
+//
+//	objects/ab/cd/abcd...ef.seg0000   first max-file-size bytes
+//	objects/ab/cd/abcd...ef.seg0001   ...
+//	objects/ab/cd/abcd...ef.segments  manifest, written last
+//
+// The manifest is written after all segments and removed before them, so a segmented file
+// appears and disappears as a whole. A plain file under the same name takes precedence.
+
+const (
+	segmentManifestSuffix = ".segments"
+	// MinMaxFileSize is the smallest maximum file size a repository can be set to
+	MinMaxFileSize = 1024 * 1024
+	// fat32MaxFileSize is the largest file FAT32 can hold
+	fat32MaxFileSize = 4*1024*1024*1024 - 1
+)
+
+// segmentNamePattern matches the names of segment files
+var segmentNamePattern = regexp.MustCompile(`\.seg[0-9]{4,}$`)
+
+func segmentName(name string, i int) string {
+	return fmt.Sprintf("%s.seg%04d", name, i)
+}
+
+// segmentManifest describes a file stored as segments.
+type segmentManifest struct {
+	Size        int64 `json:"size"`         // Total size of the file
+	SegmentSize int64 `json:"segment_size"` // Size of every segment but the last
+	Segments    int   `json:"segments"`
+}
+
+// maxFileSizeReporter is implemented by storages that can find out the largest file their
+// filesystem holds.
+type maxFileSizeReporter interface {
+	// MaxFileSize returns the largest file size, or 0 if there is no limit that matters.
+	MaxFileSize(ctx context.Context) (int64, error)
+}
+
+// segmentedStorage wraps a storage and stores files larger than maxSize as segments.
+type segmentedStorage struct {
+	Storage
+	maxSize int64
+}
+
+func (s *segmentedStorage) Save(ctx context.Context, h Handle, rd io.Reader) error {
+	size, rd, cleanup, err := readerSize(rd)
+	if err != nil {
+		return fmt.Errorf("failed to size %s: %w", h, err)
+	}
+	defer cleanup()
+	if size <= s.maxSize {
+		return s.Storage.Save(ctx, h, rd)
+	}
+
+	manifest := segmentManifest{Size: size, SegmentSize: s.maxSize, Segments: int((size + s.maxSize - 1) / s.maxSize)}
+	for i := 0; i < manifest.Segments; i++ {
+		segment := Handle{Type: h.Type, Name: segmentName(h.Name, i)}
+		if err := s.Storage.Save(ctx, segment, io.LimitReader(rd, s.maxSize)); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal segment manifest: %w", err)
+	}
+	if err := s.Storage.Save(ctx, Handle{Type: h.Type, Name: h.Name + segmentManifestSuffix}, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	// An older plain file would hide the segments
+	if err := s.Storage.Remove(ctx, h); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readerSize returns the number of bytes left in rd and a reader over them. Readers that
+// can't seek are spooled to a temporary file, which cleanup removes.
+func readerSize(rd io.Reader) (int64, io.Reader, func(), error) {
+	if seeker, ok := rd.(io.Seeker); ok {
+		pos, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if _, err := seeker.Seek(pos, io.SeekStart); err != nil {
+			return 0, nil, nil, err
+		}
+		return end - pos, rd, func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "bbackup-segment-*")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, rd)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return 0, nil, nil, err
+	}
+	return size, tmp, cleanup, nil
+}
+
+// loadManifest reads the segment manifest of a file.
+func (s *segmentedStorage) loadManifest(ctx context.Context, h Handle) (*segmentManifest, error) {
+	data, err := loadAll(ctx, s.Storage, Handle{Type: h.Type, Name: h.Name + segmentManifestSuffix})
+	if err != nil {
+		return nil, err
+	}
+	var manifest segmentManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse segment manifest of %s: %w", h, err)
+	}
+	if manifest.SegmentSize <= 0 || manifest.Segments <= 0 {
+		return nil, fmt.Errorf("invalid segment manifest of %s", h)
+	}
+	return &manifest, nil
+}
+
+func (s *segmentedStorage) Load(ctx context.Context, h Handle, offset, length int64) (io.ReadCloser, error) {
+	rc, err := s.Storage.Load(ctx, h, offset, length)
+	if !isNotExist(err) {
+		return rc, err
+	}
+	manifest, manifestErr := s.loadManifest(ctx, h)
+	if isNotExist(manifestErr) {
+		return nil, err
+	} else if manifestErr != nil {
+		return nil, manifestErr
+	}
+
+	end := manifest.Size
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	return &segmentReader{ctx: ctx, storage: s.Storage, h: h, manifest: manifest, pos: offset, end: end}, nil
+}
+
+// segmentReader reads a range of a segmented file, opening one segment at a time.
+type segmentReader struct {
+	ctx      context.Context
+	storage  Storage
+	h        Handle
+	manifest *segmentManifest
+	pos, end int64
+	current  io.ReadCloser
+	left     int64 // Bytes still expected from the current segment
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for r.pos < r.end {
+		if r.current == nil {
+			i := int(r.pos / r.manifest.SegmentSize)
+			start := r.pos - int64(i)*r.manifest.SegmentSize
+			length := r.manifest.SegmentSize - start
+			if remaining := r.end - r.pos; remaining < length {
+				length = remaining
+			}
+			rc, err := r.storage.Load(r.ctx, Handle{Type: r.h.Type, Name: segmentName(r.h.Name, i)}, start, length)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open segment %d of %s: %w", i, r.h, err)
+			}
+			r.current, r.left = rc, length
+		}
+		if int64(len(p)) > r.left {
+			p = p[:r.left]
+		}
+		n, err := r.current.Read(p)
+		r.pos += int64(n)
+		r.left -= int64(n)
+		if r.left == 0 || err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if r.left > 0 {
+				return n, fmt.Errorf("segment of %s is truncated: %w", r.h, io.ErrUnexpectedEOF)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *segmentReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+func (s *segmentedStorage) Stat(ctx context.Context, h Handle) (StorageFileInfo, error) {
+	info, err := s.Storage.Stat(ctx, h)
+	if !isNotExist(err) {
+		return info, err
+	}
+	manifestInfo, manifestErr := s.Storage.Stat(ctx, Handle{Type: h.Type, Name: h.Name + segmentManifestSuffix})
+	if isNotExist(manifestErr) {
+		return info, err
+	} else if manifestErr != nil {
+		return StorageFileInfo{}, manifestErr
+	}
+	manifest, err := s.loadManifest(ctx, h)
+	if err != nil {
+		return StorageFileInfo{}, err
+	}
+	return StorageFileInfo{Name: h.Name, Size: manifest.Size, ModTime: manifestInfo.ModTime}, nil
+}
+
+func (s *segmentedStorage) Remove(ctx context.Context, h Handle) error {
+	err := s.Storage.Remove(ctx, h)
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	manifest, manifestErr := s.loadManifest(ctx, h)
+	if isNotExist(manifestErr) {
+		return err
+	} else if manifestErr != nil {
+		return manifestErr
+	}
+	if err := s.Storage.Remove(ctx, Handle{Type: h.Type, Name: h.Name + segmentManifestSuffix}); err != nil {
+		return err
+	}
+	for i := 0; i < manifest.Segments; i++ {
+		if err := s.Storage.Remove(ctx, Handle{Type: h.Type, Name: segmentName(h.Name, i)}); err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List reports segmented files under their own name and size and skips the segments.
+// Segments without a manifest, left behind by an interrupted write, are never listed.
+func (s *segmentedStorage) List(ctx context.Context, t FileType, fn func(StorageFileInfo) error) error {
+	return s.Storage.List(ctx, t, func(info StorageFileInfo) error {
+		if segmentNamePattern.MatchString(info.Name) {
+			return nil
+		}
+		if name, ok := strings.CutSuffix(info.Name, segmentManifestSuffix); ok {
+			manifest, err := s.loadManifest(ctx, Handle{Type: t, Name: name})
+			if isNotExist(err) {
+				return nil // Removed while listing
+			} else if err != nil {
+				return err
+			}
+			return fn(StorageFileInfo{Name: name, Size: manifest.Size, ModTime: info.ModTime})
+		}
+		return fn(info)
+	})
+}
+
+// maxFileSize returns the largest file the repository writes to its storage: the configured
+// maximum or what the destination filesystem holds, whichever is smaller. 0 means no limit.
+func (r *Repository) maxFileSize() int64 {
+	limit := r.config.MaxFileSize
+	if reporter, ok := r.baseStorage().(maxFileSizeReporter); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		detected, err := reporter.MaxFileSize(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to detect the maximum file size of %s: %v\n", r.Location(), err)
+		} else if detected > 0 && (limit == 0 || detected < limit) {
+			limit = detected
+		}
+	}
+	return limit
+}
+
+// applyMaxFileSize wraps the storage so that files over the maximum file size are segmented.
+// It is called before applyAppendOnly, whose checks must see whole files.
+func (r *Repository) applyMaxFileSize() {
+	if _, ok := r.storage.(*segmentedStorage); ok {
+		return
+	}
+	if limit := r.maxFileSize(); limit > 0 {
+		r.storage = &segmentedStorage{Storage: r.storage, maxSize: limit}
+	}
+}
+
+// SetMaxFileSize changes the largest file the repository writes; 0 removes the configured
+// limit, leaving only the one detected from the filesystem. Files already stored are kept
+// as they are.
+func (r *Repository) SetMaxFileSize(size int64) error {
+	if err := r.checkSettingsWritable(); err != nil {
+		return err
+	}
+	config := r.config
+	config.MaxFileSize = size
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	old := r.config
+	r.config = config
+	if err := r.SaveConfig(); err != nil {
+		r.config = old
+		return err
+	}
+
+	// Rewrap the underlying storage with the new limit, keeping append-only checks outside
+	base, err := r.rawStorage()
+	if err != nil {
+		return err
+	}
+	aos, appendOnly := r.storage.(*appendOnlyStorage)
+	r.storage = base
+	r.applyMaxFileSize()
+	if appendOnly {
+		aos.Storage = r.storage
+		r.storage = aos
+	}
+	return nil
+}
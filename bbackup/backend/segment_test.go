@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSegmentedFiles checks that files over the maximum file size are stored as segments
+// that read back as one file, whole or in ranges, and are listed and removed as one file
+func TestSegmentedFiles(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	config := DefaultRepoConfig()
+	config.MaxFileSize = MinMaxFileSize
+	repo, err := InitRepository(storage, config, "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	data := make([]byte, 5*1024*1024/2)
+	rand.New(rand.NewSource(5)).Read(data)
+	path := filepath.Join(t.TempDir(), "video")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// One chunk of the whole file, larger than the maximum file size
+	repo.config.Chunker = ChunkerConfig{MinSize: 4 * 1024 * 1024, AvgSize: 8 * 1024 * 1024, MaxSize: 16 * 1024 * 1024}
+	stored, err := repo.StoreFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	if len(stored.Chunks) != 1 {
+		t.Fatalf("Expected one chunk, got %d", len(stored.Chunks))
+	}
+	id := stored.Chunks[0]
+	object := Handle{Type: ObjectFile, Name: id}
+	if _, err := storage.Stat(ctx, object); !isNotExist(err) {
+		t.Errorf("Expected no plain file for the object, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		info, err := storage.Stat(ctx, Handle{Type: ObjectFile, Name: segmentName(id, i)})
+		if err != nil || info.Size > MinMaxFileSize {
+			t.Errorf("Expected segment %d of at most %d bytes, got %+v (err=%v)", i, MinMaxFileSize, info, err)
+		}
+	}
+
+	rc, err := repo.RetrieveFile(&FileEntry{Path: "video", Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size})
+	if err != nil {
+		t.Fatalf("Failed to retrieve file: %v", err)
+	}
+	content, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(content, data) {
+		t.Errorf("Retrieved content differs (err=%v)", err)
+	}
+
+	// Ranges across segment boundaries, as packs are read
+	encoded, err := loadAll(ctx, repo.storage, object)
+	if err != nil {
+		t.Fatalf("Failed to load object: %v", err)
+	}
+	for _, r := range [][2]int64{{0, 10}, {MinMaxFileSize - 5, 10}, {MinMaxFileSize + 3, MinMaxFileSize + 1}, {2*MinMaxFileSize - 1, 0}} {
+		rc, err := repo.storage.Load(ctx, object, r[0], r[1])
+		if err != nil {
+			t.Fatalf("Failed to load range %v: %v", r, err)
+		}
+		part, err := io.ReadAll(rc)
+		rc.Close()
+		want := encoded[r[0]:]
+		if r[1] > 0 {
+			want = encoded[r[0] : r[0]+r[1]]
+		}
+		if err != nil || !bytes.Equal(part, want) {
+			t.Errorf("Range %v differs (err=%v)", r, err)
+		}
+	}
+
+	// Listed and sized as one file, and checked like any other object
+	var listed []StorageFileInfo
+	repo.storage.List(ctx, ObjectFile, func(info StorageFileInfo) error {
+		listed = append(listed, info)
+		return nil
+	})
+	if len(listed) != 1 || listed[0].Name != id || listed[0].Size != int64(len(encoded)) {
+		t.Errorf("Expected the object to be listed once with its full size, got %+v", listed)
+	}
+	if info, err := repo.storage.Stat(ctx, object); err != nil || info.Size != int64(len(encoded)) {
+		t.Errorf("Expected the full size from Stat, got %+v (err=%v)", info, err)
+	}
+	if err := repo.SaveSnapshot(&Snapshot{ID: "20250101000000", Timestamp: time.Now(), Files: map[string]*FileEntry{"video": {Path: "video", Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size}}}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	report, err := repo.Check(ctx, CheckOptions{ReadDataPercent: 100}, nil)
+	if err != nil || !report.OK() || report.ReadObjects != 1 {
+		t.Errorf("Expected the check to pass, got %+v (err=%v)", report, err)
+	}
+
+	// Readers that can't seek are spooled before they are split
+	spooled := Handle{Type: ObjectFile, Name: strings.Repeat("cd", 32)}
+	if err := repo.storage.Save(ctx, spooled, io.MultiReader(bytes.NewReader(data), bytes.NewReader(data))); err != nil {
+		t.Fatalf("Failed to save from a stream: %v", err)
+	}
+	if content, err := loadAll(ctx, repo.storage, spooled); err != nil || !bytes.Equal(content, append(append([]byte{}, data...), data...)) {
+		t.Errorf("Streamed content differs (err=%v)", err)
+	}
+
+	// A truncated segment is an error, not short content
+	segment := Handle{Type: ObjectFile, Name: segmentName(id, 1)}
+	full, _ := loadAll(ctx, storage, segment)
+	storage.Save(ctx, segment, bytes.NewReader(full[:100]))
+	if _, err := loadAll(ctx, repo.storage, object); err == nil {
+		t.Errorf("Expected a truncated segment to fail the read")
+	}
+
+	if err := repo.storage.Remove(ctx, object); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+	var left []string
+	storage.List(ctx, ObjectFile, func(info StorageFileInfo) error {
+		if strings.HasPrefix(info.Name, id) {
+			left = append(left, info.Name)
+		}
+		return nil
+	})
+	if len(left) != 0 {
+		t.Errorf("Expected the segments to be removed, got %v", left)
+	}
+
+	if err := repo.SetMaxFileSize(1000); err == nil {
+		t.Errorf("Expected a maximum file size below the minimum to be rejected")
+	}
+}
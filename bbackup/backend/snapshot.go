@@ -1,34 +1,73 @@
 package backend
 
 import (
-	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
-	"sort"
-	"strings"
 	"time"
 )
 
-// FileEntry represents a file in the snapshot, mapping its relative path to its CAS hash.
+// FileEntry represents a file, directory or symlink in the snapshot, mapping a file's relative
+// path to its CAS hash.
 type FileEntry struct {
-	Path string `json:"path"` // Relative path from the source root
-	Hash string `json:"hash"` // SHA-256 hash of the file content
-	Size int64  `json:"size"` // Size of the file in bytes
-	Mode fs.FileMode `json:"mode"` // File permissions and mode
-	ModTime time.Time `json:"mod_time"` // Last modification time
+	Path       string      `json:"path"`                  // Relative path from the source root
+	Hash       string      `json:"hash"`                  // SHA-256 hash of the whole file content
+	Chunks     []string    `json:"chunks,omitempty"`      // Ordered chunk object hashes; empty for entries stored as a single object named by Hash
+	Size       int64       `json:"size"`                  // Size of the file in bytes
+	Mode       fs.FileMode `json:"mode"`                  // File permissions and mode
+	ModTime    time.Time   `json:"mod_time"`              // Last modification time
+	Type       string      `json:"type,omitempty"`        // NodeDir or NodeSymlink; empty for a file
+	LinkTarget string      `json:"link_target,omitempty"` // Target of a symlink, as stored in the link
+}
+
+// NodeType returns the type of the entry, NodeFile, NodeDir or NodeSymlink.
+func (e *FileEntry) NodeType() string {
+	if e.Type == "" {
+		return NodeFile
+	}
+	return e.Type
 }
 
 // Snapshot represents a single point-in-time backup.
 type Snapshot struct {
-	ID        string                 `json:"id"`        // Unique ID for the snapshot (e.g., timestamp)
-	Timestamp time.Time              `json:"timestamp"` // When the snapshot was created
-	Source    []string               `json:"source"`    // Source directories that were backed up
-	Files     map[string]*FileEntry `json:"files"`     // Map of relative path to FileEntry
+	ID            string                `json:"id"`                       // Unique ID for the snapshot, see NewSnapshotID
+	Timestamp     time.Time             `json:"timestamp"`                // When the snapshot was created
+	Source        []string              `json:"source"`                   // Source directories that were backed up
+	Files         map[string]*FileEntry `json:"files,omitempty"`          // Map of relative path to FileEntry, in snapshots written before trees
+	Roots         []string              `json:"roots,omitempty"`          // Root tree ID of each source, in the order of Source
+	SourceDirs    []*FileEntry          `json:"source_dirs,omitempty"`    // Mode and modification time of each source directory, in the order of Source
+	Tags          []string              `json:"tags,omitempty"`           // Free-form labels used to select snapshots
+	HashAlgorithm string                `json:"hash_algorithm,omitempty"` // Hash of the file entries; empty means SHA-256
+	Hostname      string                `json:"hostname,omitempty"`       // Machine the backup ran on
+	Username      string                `json:"username,omitempty"`       // User the backup ran as
+	ConfigID      string                `json:"config_id,omitempty"`      // ID of the backup configuration that made the snapshot
+	ConfigName    string                `json:"config_name,omitempty"`    // Name of that backup configuration
+	Parent        string                `json:"parent,omitempty"`         // Snapshot the backup compared files with, if any
+	Description   string                `json:"description,omitempty"`    // Free-form note about the snapshot
+	Summary       *SnapshotSummary      `json:"summary,omitempty"`        // What the backup did; nil for snapshots not made by a backup
+}
+
+// SnapshotSummary records the backup run that made a snapshot.
+type SnapshotSummary struct {
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+	Errors         int       `json:"errors"`             // Files and directories that couldn't be read and were left out
+	FilesNew       int       `json:"files_new"`          // Files not in the parent snapshot
+	FilesChanged   int       `json:"files_changed"`      // Files whose size or modification time changed since the parent
+	FilesUnchanged int       `json:"files_unchanged"`    // Files taken over from the parent without reading them
+	Skipped        int       `json:"skipped"`            // Named pipes, sockets and devices, which are left out
+	TotalBytes     int64     `json:"total_bytes"`        // Size of all files in the snapshot
+	BytesAdded     int64     `json:"bytes_added"`        // New data stored in the repository, before compression
+	Warnings       []string  `json:"warnings,omitempty"` // Problems that didn't stop the backup
+}
+
+// FileHashAlgorithm returns the algorithm the file hashes of the snapshot were computed with.
+func (s *Snapshot) FileHashAlgorithm() string {
+	return hashAlgorithmOrDefault(s.HashAlgorithm)
 }
 
 // snapshotsDir returns the path to the directory where snapshots are stored.
@@ -44,268 +83,259 @@ func snapshotFilePath(casBaseDir, snapshotID string) string {
 // LoadLatestSnapshot finds and loads the most recent snapshot from the backup destination.
 // Returns nil, nil if no snapshots are found.
 func LoadLatestSnapshot(casBaseDir string) (*Snapshot, error) {
-	fmt.Fprintf(os.Stderr, "DEBUG: LoadLatestSnapshot started with casBaseDir=%s\n", casBaseDir)
-	snapDir := snapshotsDir(casBaseDir)
-	fmt.Fprintf(os.Stderr, "DEBUG: snapDir=%s\n", snapDir)
-	
-	// Check if directory exists before trying to read it
-	fmt.Fprintf(os.Stderr, "DEBUG: About to stat snapshots directory\n")
-	if stat, err := os.Stat(snapDir); os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "DEBUG: Snapshots directory does not exist, returning nil\n")
-		return nil, nil // No snapshots directory, so no snapshots
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to access snapshots directory %s: %w", snapDir, err)
-	} else if !stat.IsDir() {
-		return nil, fmt.Errorf("snapshots path %s exists but is not a directory", snapDir)
-	}
-	fmt.Fprintf(os.Stderr, "DEBUG: Snapshots directory exists and is valid\n")
-	
-	// Open directory with a file handle to ensure it's readable
-	fmt.Fprintf(os.Stderr, "DEBUG: About to open snapshots directory\n")
-	dir, err := os.Open(snapDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open snapshots directory %s: %w", snapDir, err)
-	}
-	defer dir.Close()
-	
-	// Read directory entries
-	fmt.Fprintf(os.Stderr, "DEBUG: About to read directory entries\n")
-	fileInfos, err := dir.Readdir(-1)
+	repo, err := OpenRepository(casBaseDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read snapshots directory entries %s: %w", snapDir, err)
+		return nil, err
 	}
-	fmt.Fprintf(os.Stderr, "DEBUG: Read %d directory entries\n", len(fileInfos))
-
-	var latestSnapshotID string
-	var latestTime time.Time
+	defer repo.Close()
+	return repo.LoadLatestSnapshot()
+}
 
-	var validEntries []fs.FileInfo
-	for _, info := range fileInfos {
-		if !strings.HasSuffix(info.Name(), ".json") {
-			continue
-		}
-		validEntries = append(validEntries, info)
+// LoadLatestSnapshot finds and loads the most recent snapshot in the repository, whatever
+// the naming style of its ID. Returns nil, nil if no snapshots are found.
+func (r *Repository) LoadLatestSnapshot() (*Snapshot, error) {
+	latest, err := r.FindLatest(context.Background(), SnapshotQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots in %s: %w", r.Location(), err)
 	}
-
-	// Sort entries to find the latest snapshot by name (assuming timestamp-based names)
-	sort.Slice(validEntries, func(i, j int) bool {
-		return validEntries[i].Name() > validEntries[j].Name() // Descending order
-	})
-
-	for _, info := range validEntries {
-		entryName := info.Name()
-		
-		id := strings.TrimSuffix(entryName, ".json")
-		t, err := time.Parse("20060102150405", id) // Expecting format YYYYMMDDhhmmss
-		if err != nil {
-			// Log error but continue to find valid snapshots
-			fmt.Fprintf(os.Stderr, "Warning: Invalid snapshot ID format '%s': %v\n", id, err)
-			continue
-		}
-
-		if latestTime.IsZero() || t.After(latestTime) {
-			latestTime = t
-			latestSnapshotID = id
-		}
+	if latest == nil {
+		return nil, nil
 	}
 
-	if latestSnapshotID == "" {
-		return nil, nil // No valid snapshots found
+	snapshot, err := r.LoadSnapshot(latest.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load latest snapshot: %w", err)
 	}
+	return snapshot, nil
+}
 
-	snapshot := &Snapshot{}
-	filePath := snapshotFilePath(casBaseDir, latestSnapshotID)
-	data, err := os.ReadFile(filePath)
+// LoadSnapshot loads a snapshot of the repository by its ID. Entries that follow the header
+// of its file are read into Files; OpenSnapshot reads them one at a time instead.
+func (r *Repository) LoadSnapshot(snapshotID string) (*Snapshot, error) {
+	reader, err := r.OpenSnapshot(context.Background(), snapshotID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read latest snapshot file %s: %w", filePath, err)
+		return nil, err
 	}
+	return reader.readAll()
+}
 
-	if err := json.Unmarshal(data, snapshot); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal latest snapshot %s: %w", filePath, err)
+// decodeSnapshotData decrypts the content of a snapshot file if the repository is encrypted.
+// The snapshot ID is authenticated along with the content.
+func (r *Repository) decodeSnapshotData(data []byte, snapshotID string) ([]byte, error) {
+	if !isEncryptedBlob(data) {
+		if r != nil && r.key != nil {
+			return nil, fmt.Errorf("snapshot %s is not encrypted but the repository is", snapshotID)
+		}
+		return data, nil
 	}
-
-	return snapshot, nil
+	if r == nil || r.key == nil {
+		return nil, ErrPassphraseRequired
+	}
+	return r.key.openBlob(data, []byte(snapshotID))
 }
 
 // LoadSnapshotFromFile loads a snapshot from a specific file path.
+// Snapshots of encrypted repositories must be loaded with Repository.LoadSnapshotFromFile.
 func LoadSnapshotFromFile(snapshotPath string) (*Snapshot, error) {
+	var repo *Repository
+	return repo.LoadSnapshotFromFile(snapshotPath)
+}
+
+// LoadSnapshotFromFile loads a snapshot of this repository from a specific local file path.
+func (r *Repository) LoadSnapshotFromFile(snapshotPath string) (*Snapshot, error) {
 	fmt.Fprintf(os.Stderr, "DEBUG: LoadSnapshotFromFile loading from %s\n", snapshotPath)
-	
-	data, err := os.ReadFile(snapshotPath)
+
+	reader, err := r.OpenSnapshotFile(context.Background(), snapshotPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read snapshot file %s: %w", snapshotPath, err)
+		return nil, err
 	}
-
-	var snapshot Snapshot
-	if err := json.Unmarshal(data, &snapshot); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal snapshot from %s: %w", snapshotPath, err)
+	snapshot, err := reader.readAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot file %s: %w", snapshotPath, err)
 	}
 
-	fmt.Fprintf(os.Stderr, "DEBUG: Loaded snapshot with %d files\n", len(snapshot.Files))
-	return &snapshot, nil
+	fmt.Fprintf(os.Stderr, "DEBUG: Loaded snapshot with %d files and %d trees\n", len(snapshot.Files), len(snapshot.Roots))
+	return snapshot, nil
 }
 
 // SaveSnapshot writes a new snapshot to the backup destination.
 func SaveSnapshot(casBaseDir string, snapshot *Snapshot) error {
-	if snapshot.ID == "" {
-		snapshot.ID = snapshot.Timestamp.Format("20060102150405")
+	repo, err := openRepositoryForWrite(casBaseDir, StorageConfig{}, "")
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	lock, err := repo.acquireWriteLock(context.Background(), false, "snapshot")
+	if err != nil {
+		return err
 	}
+	defer lock.Release()
+	return repo.SaveSnapshot(snapshot)
+}
 
-	snapDir := snapshotsDir(casBaseDir)
-	if err := os.MkdirAll(snapDir, 0755); err != nil {
-		return fmt.Errorf("failed to create snapshots directory %s: %w", snapDir, err)
+// SaveSnapshot writes a new snapshot to the repository.
+func (r *Repository) SaveSnapshot(snapshot *Snapshot) error {
+	if snapshot.ID == "" {
+		snapshot.ID = NewSnapshotID(snapshot.Timestamp)
+	}
+	if snapshot.HashAlgorithm == "" {
+		snapshot.HashAlgorithm = r.config.HashAlgorithm
 	}
 
-	filePath := snapshotFilePath(casBaseDir, snapshot.ID)
-	data, err := json.MarshalIndent(snapshot, "", "  ")
-	if err != nil {
+	var buf bytes.Buffer
+	if err := encodeSnapshot(&buf, snapshot); err != nil {
 		return fmt.Errorf("failed to marshal snapshot to JSON: %w", err)
 	}
-
-	// Write to a temporary file first, then rename for atomicity
-	tempFilePath := filePath + ".tmp"
-	if err := os.WriteFile(tempFilePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write snapshot to temporary file %s: %w", tempFilePath, err)
+	data := buf.Bytes()
+	var err error
+	if r.key != nil {
+		if data, err = r.key.sealBlob(data, []byte(snapshot.ID)); err != nil {
+			return fmt.Errorf("failed to encrypt snapshot: %w", err)
+		}
 	}
 
-	if err := os.Rename(tempFilePath, filePath); err != nil {
-		return fmt.Errorf("failed to rename temporary snapshot file %s to %s: %w", tempFilePath, filePath, err)
+	h := Handle{Type: SnapshotFile, Name: snapshot.ID}
+	if err := r.storage.Save(context.Background(), h, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
 	}
 
 	return nil
 }
 
-// StreamingSnapshotWriter allows writing snapshots incrementally without keeping everything in memory
+// StreamingSnapshotWriter allows writing snapshots incrementally without keeping everything in memory.
+// Files are added to the tree of the current source, whose directories are stored as
+// tree objects as soon as they are complete.
 type StreamingSnapshotWriter struct {
-	file      *os.File
-	writer    *bufio.Writer
-	encoder   *json.Encoder
-	header    Snapshot
-	filesLeft int
-	closed    bool
+	repo    *Repository
+	header  Snapshot
+	builder *treeBuilder // Tree of the source files are added to, Source[len(header.Roots)]
+	closed  bool
+	lock    *Lock // Shared lock held until Close, if the writer opened the repository itself and closes it too
 }
 
 // NewStreamingSnapshotWriter creates a new streaming snapshot writer
 func NewStreamingSnapshotWriter(casBaseDir, snapshotID string, sourcePaths []string) (*StreamingSnapshotWriter, error) {
-	snapDir := filepath.Join(casBaseDir, "snapshots")
-	if err := os.MkdirAll(snapDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create snapshots directory %s: %w", snapDir, err)
+	repo, err := openRepositoryForWrite(casBaseDir, StorageConfig{}, "")
+	if err != nil {
+		return nil, err
 	}
-
-	filePath := snapshotFilePath(casBaseDir, snapshotID)
-	tempFilePath := filePath + ".tmp"
-	
-	file, err := os.Create(tempFilePath)
+	lock, err := repo.acquireWriteLock(context.Background(), false, "snapshot")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temporary snapshot file %s: %w", tempFilePath, err)
+		repo.Close()
+		return nil, err
 	}
-
-	writer := bufio.NewWriter(file)
-	encoder := json.NewEncoder(writer)
-	
-	// Write opening of snapshot object
-	header := Snapshot{
-		ID:        snapshotID,
-		Timestamp: time.Now(),
-		Source:    sourcePaths,
-		Files:     make(map[string]*FileEntry), // Will be populated incrementally
+	writer, err := repo.NewStreamingSnapshotWriter(snapshotID, sourcePaths)
+	if err != nil {
+		lock.Release()
+		repo.Close()
+		return nil, err
 	}
+	writer.lock = lock // Released by Close
+	return writer, nil
+}
 
-	if err := encoder.Encode(header); err != nil {
-		file.Close()
-		os.Remove(tempFilePath)
-		return nil, fmt.Errorf("failed to write snapshot header: %w", err)
+// NewStreamingSnapshotWriter creates a streaming snapshot writer for this repository.
+// The snapshot is saved to the repository storage when the writer is closed.
+func (r *Repository) NewStreamingSnapshotWriter(snapshotID string, sourcePaths []string) (*StreamingSnapshotWriter, error) {
+	header := Snapshot{
+		ID:            snapshotID,
+		Timestamp:     time.Now(),
+		Source:        sourcePaths,
+		Roots:         make([]string, 0, len(sourcePaths)),
+		HashAlgorithm: r.config.HashAlgorithm,
 	}
-
 	return &StreamingSnapshotWriter{
-		file:    file,
-		writer:  writer,
-		encoder: encoder,
+		repo:    r,
 		header:  header,
-		closed:  false,
+		builder: newTreeBuilder(r.saveTree),
 	}, nil
 }
 
-// AddFile adds a file entry to the snapshot
+// Header returns the snapshot being written. Its metadata, such as tags and the summary,
+// can be set until the writer is closed.
+func (ssw *StreamingSnapshotWriter) Header() *Snapshot {
+	return &ssw.header
+}
+
+// AddFile adds a file, directory or symlink entry to the snapshot, in the current source.
+// The entries of a directory must be added together, as a walk of the source yields them;
+// the entry of a directory itself, if added, must come before them.
 func (ssw *StreamingSnapshotWriter) AddFile(entry *FileEntry) error {
 	if ssw.closed {
 		return fmt.Errorf("snapshot writer is closed")
 	}
-	
-	// Add to in-memory map for final count
-	ssw.header.Files[entry.Path] = entry
-	ssw.filesLeft++
-	
-	// Write file entry as a separate line for easy parsing
-	lineData, err := json.Marshal(entry)
-	if err != nil {
-		return fmt.Errorf("failed to marshal file entry: %w", err)
+	if len(ssw.header.Roots) >= len(ssw.header.Source) {
+		return fmt.Errorf("all %d sources of the snapshot are finished", len(ssw.header.Source))
+	}
+	if err := ssw.builder.add(context.Background(), entry); err != nil {
+		return fmt.Errorf("failed to add file entry: %w", err)
 	}
-	
-	if _, err := ssw.writer.Write(lineData); err != nil {
-		return fmt.Errorf("failed to write file entry: %w", err)
+	return nil
+}
+
+// SetSourceDir records the metadata of the directory of the current source, which a
+// deploy applies to its target directory.
+func (ssw *StreamingSnapshotWriter) SetSourceDir(entry *FileEntry) error {
+	if ssw.closed {
+		return fmt.Errorf("snapshot writer is closed")
 	}
-	if _, err := ssw.writer.WriteString("\n"); err != nil {
-		return fmt.Errorf("failed to write newline: %w", err)
+	if len(ssw.header.Roots) >= len(ssw.header.Source) {
+		return fmt.Errorf("all %d sources of the snapshot are finished", len(ssw.header.Source))
 	}
-	
+	if ssw.header.SourceDirs == nil {
+		ssw.header.SourceDirs = make([]*FileEntry, len(ssw.header.Source))
+	}
+	ssw.header.SourceDirs[len(ssw.header.Roots)] = entry
+	return nil
+}
+
+// EndSource finishes the tree of the current source; files added afterwards belong to the next source.
+func (ssw *StreamingSnapshotWriter) EndSource() error {
+	if ssw.closed {
+		return fmt.Errorf("snapshot writer is closed")
+	}
+	if len(ssw.header.Roots) >= len(ssw.header.Source) {
+		return fmt.Errorf("all %d sources of the snapshot are finished", len(ssw.header.Source))
+	}
+	root, err := ssw.builder.finish(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to finish tree of %s: %w", ssw.header.Source[len(ssw.header.Roots)], err)
+	}
+	ssw.header.Roots = append(ssw.header.Roots, root)
 	return nil
 }
 
-// Close finalizes the snapshot and closes the file
+// Flush writes the finished trees, and any other objects still held in the open pack, to
+// the repository storage.
+func (ssw *StreamingSnapshotWriter) Flush() error {
+	return ssw.repo.Flush()
+}
+
+// Close finishes the trees of the remaining sources and saves the snapshot
 func (ssw *StreamingSnapshotWriter) Close() error {
 	if ssw.closed {
 		return nil
 	}
-	
-	// Flush any remaining data
-	if err := ssw.writer.Flush(); err != nil {
-		ssw.file.Close()
-		return fmt.Errorf("failed to flush snapshot data: %w", err)
+	ssw.closed = true
+	if ssw.lock != nil {
+		defer ssw.repo.Close()
 	}
-	
-	// Rewrite with complete snapshot (rebuild the file properly)
-	finalData, err := json.MarshalIndent(ssw.header, "", "  ")
-	if err != nil {
-		ssw.file.Close()
-		return fmt.Errorf("failed to marshal final snapshot: %w", err)
-	}
-	
-	if _, err := ssw.file.Seek(0, io.SeekStart); err != nil {
-		ssw.file.Close()
-		return fmt.Errorf("failed to seek to start: %w", err)
-	}
-	
-	if err := ssw.file.Truncate(int64(len(finalData))); err != nil {
-		ssw.file.Close()
-		return fmt.Errorf("failed to truncate file: %w", err)
-	}
-	
-	if _, err := ssw.file.Write(finalData); err != nil {
-		ssw.file.Close()
-		return fmt.Errorf("failed to write final snapshot: %w", err)
-	}
-	
-	// Get current file path before closing
-	currentPath, err := filepath.Abs(ssw.file.Name())
-	if err != nil {
-		ssw.file.Close()
-		return fmt.Errorf("failed to get current file path: %w", err)
-	}
-	
-	if err := ssw.file.Close(); err != nil {
-		return fmt.Errorf("failed to close snapshot file: %w", err)
-	}
-	
-	// Rename from temporary to final name
-	if strings.HasSuffix(currentPath, ".tmp") {
-		finalPath := strings.TrimSuffix(currentPath, ".tmp")
-		if err := os.Rename(currentPath, finalPath); err != nil {
-			return fmt.Errorf("failed to rename snapshot file from %s to %s: %w", currentPath, finalPath, err)
+	defer ssw.lock.Release()
+
+	for len(ssw.header.Roots) < len(ssw.header.Source) {
+		root, err := ssw.builder.finish(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to finish tree of %s: %w", ssw.header.Source[len(ssw.header.Roots)], err)
 		}
+		ssw.header.Roots = append(ssw.header.Roots, root)
+	}
+	// The trees must be stored before the snapshot that references them
+	if err := ssw.repo.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot trees: %w", err)
+	}
+	if err := ssw.repo.SaveSnapshot(&ssw.header); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
 	}
-	
-	ssw.closed = true
 	return nil
 }
 
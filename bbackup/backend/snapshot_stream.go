@@ -0,0 +1,250 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A snapshot file is a header line, the snapshot without its files, followed by one file
+// entry per line sorted by path. Snapshots of backups keep their files in trees, so their
+// file is only the header; entries follow it in snapshots saved with a file list. Files
+// written before this format are a single JSON object with a "files" map, and are still read.
+//
+// SnapshotReader reads the files of a snapshot one at a time, from the lines of its file or
+// from its trees, so a snapshot is never held in memory whatever its number of files.
+// Encrypted snapshot files are sealed as a whole and are decrypted in memory; with trees
+// that is only the header.
+
+// encodeSnapshot writes a snapshot in the snapshot file format.
+func encodeSnapshot(w io.Writer, snapshot *Snapshot) error {
+	header := *snapshot
+	header.Files = nil
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	for _, p := range sortedFilePaths(snapshot.Files) {
+		entry := *snapshot.Files[p]
+		entry.Path = p
+		if err := enc.Encode(&entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotReader iterates over the entries of a snapshot, source by source in path order.
+// A directory comes before its content; directories of snapshots written before they had
+// entries of their own only come up in trees, and have no mode.
+type SnapshotReader struct {
+	ctx      context.Context
+	repo     *Repository
+	snapshot *Snapshot
+	entries  *json.Decoder // Entry lines following the header of the snapshot file
+	paths    []string      // Remaining paths of Snapshot.Files
+	roots    []string      // Root trees not read yet
+	stack    []treeCursor  // Open trees of the current root, outermost first
+	closer   io.Closer
+}
+
+// treeCursor is the position of a SnapshotReader in a tree.
+type treeCursor struct {
+	tree *Tree
+	dir  string
+	next int
+}
+
+// NewSnapshotReader returns a reader over the files of a loaded snapshot.
+func (r *Repository) NewSnapshotReader(ctx context.Context, snapshot *Snapshot) *SnapshotReader {
+	sr := &SnapshotReader{ctx: ctx, repo: r, snapshot: snapshot, roots: snapshot.Roots}
+	if len(snapshot.Roots) == 0 {
+		sr.paths = sortedFilePaths(snapshot.Files)
+	}
+	return sr
+}
+
+// OpenSnapshot opens a snapshot of the repository by its ID, reading only its header until
+// Next is called. The reader must be closed.
+func (r *Repository) OpenSnapshot(ctx context.Context, snapshotID string) (*SnapshotReader, error) {
+	rc, err := r.storage.Load(ctx, Handle{Type: SnapshotFile, Name: snapshotID}, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", snapshotID, err)
+	}
+	sr, err := r.openSnapshotStream(ctx, rc, snapshotID)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", snapshotID, err)
+	}
+	return sr, nil
+}
+
+// OpenSnapshotFile opens a snapshot of the repository from a local file path. The
+// reader must be closed.
+func (r *Repository) OpenSnapshotFile(ctx context.Context, snapshotPath string) (*SnapshotReader, error) {
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot file %s: %w", snapshotPath, err)
+	}
+	sr, err := r.openSnapshotStream(ctx, file, strings.TrimSuffix(filepath.Base(snapshotPath), ".json"))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read snapshot file %s: %w", snapshotPath, err)
+	}
+	return sr, nil
+}
+
+// openSnapshotStream decodes the header of a snapshot file; the rest is read by Next.
+func (r *Repository) openSnapshotStream(ctx context.Context, rc io.ReadCloser, snapshotID string) (*SnapshotReader, error) {
+	buffered := bufio.NewReader(rc)
+	var rd io.Reader = buffered
+	if magic, _ := buffered.Peek(len(encryptedMagic)); isEncryptedBlob(magic) {
+		data, err := io.ReadAll(buffered)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = r.decodeSnapshotData(data, snapshotID); err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(data)
+	} else if r != nil && r.key != nil {
+		return nil, fmt.Errorf("snapshot %s is not encrypted but the repository is", snapshotID)
+	}
+
+	dec := json.NewDecoder(rd)
+	snapshot := &Snapshot{}
+	if err := dec.Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot header: %w", err)
+	}
+	sr := r.NewSnapshotReader(ctx, snapshot)
+	if snapshot.Files == nil && dec.More() {
+		sr.entries = dec
+	}
+	sr.closer = rc
+	return sr, nil
+}
+
+// Snapshot returns the snapshot being read. Its Files are only set for snapshot files in
+// the format written before the file entries were streamed.
+func (sr *SnapshotReader) Snapshot() *Snapshot {
+	return sr.snapshot
+}
+
+// Next returns the next entry of the snapshot, or io.EOF after the last one. Entry paths
+// are relative to their source.
+func (sr *SnapshotReader) Next() (*FileEntry, error) {
+	if err := sr.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if sr.entries != nil {
+		if !sr.entries.More() {
+			return nil, io.EOF
+		}
+		entry := &FileEntry{}
+		if err := sr.entries.Decode(entry); err != nil {
+			return nil, fmt.Errorf("failed to read file entry of snapshot %s: %w", sr.snapshot.ID, err)
+		}
+		return entry, nil
+	}
+	if sr.paths != nil {
+		if len(sr.paths) == 0 {
+			return nil, io.EOF
+		}
+		entry := sr.snapshot.Files[sr.paths[0]]
+		sr.paths = sr.paths[1:]
+		return entry, nil
+	}
+
+	for {
+		if len(sr.stack) == 0 {
+			if len(sr.roots) == 0 {
+				return nil, io.EOF
+			}
+			if err := sr.push(sr.roots[0], ""); err != nil {
+				return nil, err
+			}
+			sr.roots = sr.roots[1:]
+			continue
+		}
+		top := &sr.stack[len(sr.stack)-1]
+		if top.next == len(top.tree.Nodes) {
+			sr.stack = sr.stack[:len(sr.stack)-1]
+			continue
+		}
+		node := &top.tree.Nodes[top.next]
+		top.next++
+		p := path.Join(top.dir, node.Name)
+		if node.Type == NodeDir {
+			if err := sr.push(node.Subtree, p); err != nil {
+				return nil, err
+			}
+		}
+		return node.entry(p), nil
+	}
+}
+
+// push opens the tree of a directory.
+func (sr *SnapshotReader) push(id, dir string) error {
+	if sr.repo == nil {
+		return fmt.Errorf("snapshot %s keeps its files in trees, which must be read from its repository", sr.snapshot.ID)
+	}
+	tree, err := sr.repo.LoadTree(sr.ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to read tree of /%s: %w", dir, err)
+	}
+	sr.stack = append(sr.stack, treeCursor{tree: tree, dir: dir})
+	return nil
+}
+
+// Each calls fn for every remaining entry of the snapshot and closes the reader.
+func (sr *SnapshotReader) Each(fn func(entry *FileEntry) error) error {
+	defer sr.Close()
+	for {
+		entry, err := sr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// Close releases the snapshot file.
+func (sr *SnapshotReader) Close() error {
+	if sr.closer == nil {
+		return nil
+	}
+	err := sr.closer.Close()
+	sr.closer = nil
+	return err
+}
+
+// readAll reads the remaining entries of the snapshot file into Snapshot.Files.
+func (sr *SnapshotReader) readAll() (*Snapshot, error) {
+	defer sr.Close()
+	if sr.entries == nil {
+		return sr.snapshot, nil
+	}
+	sr.snapshot.Files = make(map[string]*FileEntry)
+	for {
+		entry, err := sr.Next()
+		if err == io.EOF {
+			return sr.snapshot, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sr.snapshot.Files[entry.Path] = entry
+	}
+}
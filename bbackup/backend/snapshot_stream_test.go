@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSnapshotFileFormat checks that snapshots with a file list are written as a header line
+// followed by entries sorted by path, that they are read back one entry at a time, and that
+// snapshot files written as a single JSON object are still read
+func TestSnapshotFileFormat(t *testing.T) {
+	ctx := context.Background()
+	files := map[string]*FileEntry{
+		"b":   {Path: "b", Hash: "hb", Size: 2},
+		"a/x": {Path: "a/x", Hash: "hx", Size: 1},
+		"a.y": {Path: "a.y", Hash: "hy", Size: 3},
+	}
+	readAll := func(reader *SnapshotReader) []string {
+		var paths []string
+		if err := reader.Each(func(entry *FileEntry) error {
+			paths = append(paths, entry.Path)
+			return nil
+		}); err != nil {
+			t.Fatalf("Failed to read snapshot: %v", err)
+		}
+		return paths
+	}
+
+	for _, passphrase := range []string{"", "correct horse"} {
+		storage := NewMemoryStorage()
+		repo, err := InitRepository(storage, DefaultRepoConfig(), passphrase)
+		if err != nil {
+			t.Fatalf("Failed to init repository: %v", err)
+		}
+		if err := repo.SaveSnapshot(&Snapshot{ID: "20250101000000", Timestamp: time.Now(), Files: files}); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+		if passphrase == "" {
+			data, _ := loadAll(ctx, storage, Handle{Type: SnapshotFile, Name: "20250101000000"})
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != 4 || strings.Contains(lines[0], `"files"`) || !strings.Contains(lines[1], `"a.y"`) || !strings.Contains(lines[3], `"b"`) {
+				t.Errorf("Unexpected snapshot file:\n%s", data)
+			}
+		}
+
+		reader, err := repo.OpenSnapshot(ctx, "20250101000000")
+		if err != nil {
+			t.Fatalf("Failed to open snapshot: %v", err)
+		}
+		if reader.Snapshot().Files != nil {
+			t.Errorf("Expected the entries not to be read with the header")
+		}
+		if paths := readAll(reader); strings.Join(paths, " ") != "a.y a/x b" {
+			t.Errorf("Unexpected entries %v", paths)
+		}
+		snapshot, err := repo.LoadSnapshot("20250101000000")
+		if err != nil || len(snapshot.Files) != 3 || snapshot.Files["a/x"].Hash != "hx" {
+			t.Errorf("Expected LoadSnapshot to read all files, got %+v (err=%v)", snapshot, err)
+		}
+	}
+
+	// A snapshot file from before the entries were streamed
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	data, _ := json.MarshalIndent(&Snapshot{ID: "20240101000000", Files: files}, "", "  ")
+	if err := storage.Save(ctx, Handle{Type: SnapshotFile, Name: "20240101000000"}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	reader, err := repo.OpenSnapshot(ctx, "20240101000000")
+	if err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	if paths := readAll(reader); strings.Join(paths, " ") != "a.y a/x b" {
+		t.Errorf("Unexpected entries of the old snapshot %v", paths)
+	}
+
+	// A damaged entry fails the read instead of ending it
+	data = []byte(`{"id":"20230101000000"}` + "\n" + `{"path":"a","hash":"h"}` + "\n" + `{"path":`)
+	if err := storage.Save(ctx, Handle{Type: SnapshotFile, Name: "20230101000000"}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	if reader, err = repo.OpenSnapshot(ctx, "20230101000000"); err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	if entry, err := reader.Next(); err != nil || entry.Path != "a" {
+		t.Errorf("Expected the first entry, got %+v (err=%v)", entry, err)
+	}
+	if _, err := reader.Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected the damaged entry to fail, got %v", err)
+	}
+	reader.Close()
+}
@@ -0,0 +1,280 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInsufficientSpace is returned when a backup is stopped before storing anything because
+// the destination doesn't have room for it.
+var ErrInsufficientSpace = errors.New("not enough free space at the destination")
+
+const (
+	// spaceReserve is kept free on top of the estimated new data, for pack, index and
+	// temporary files
+	spaceReserve = 64 * 1024 * 1024
+	// snapshotEntryEstimate is the space a file takes in a snapshot, on average
+	snapshotEntryEstimate = 512
+)
+
+// BackupEstimate is what a backup is expected to add to the repository, found by scanning
+// the sources and comparing them with the previous snapshot before anything is stored.
+type BackupEstimate struct {
+	Files        int   `json:"files"`         // Files to back up
+	Bytes        int64 `json:"bytes"`         // Total size of those files
+	ChangedFiles int   `json:"changed_files"` // New files and files whose size or modification time changed
+	ChangedBytes int64 `json:"changed_bytes"` // Size of the changed files, which will be read and stored
+	// NeededBytes is the space the backup may take: the changed bytes as if none of them
+	// deduplicated or compressed, plus parity, the snapshot and a reserve
+	NeededBytes int64 `json:"needed_bytes"`
+}
+
+// estimateBackup scans the sources the way a backup does, skipping the same files, and
+// estimates the space the backup needs.
+func (r *Repository) estimateBackup(ctx context.Context, sourcePaths, ignorePatterns []string, previous *snapshotLookup, tracker FileTracker, casBaseDir string) (*BackupEstimate, error) {
+	estimate := &BackupEstimate{}
+	for _, sourcePath := range sourcePaths {
+		absSourcePath, err := filepath.Abs(sourcePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path for source %s: %w", sourcePath, err)
+		}
+		err = filepath.WalkDir(absSourcePath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // The backup reports unreadable paths
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if tracker != nil && tracker.IsProcessed(path) {
+				return nil
+			}
+			if shouldIgnore(path, d, ignorePatterns) || (casBaseDir != "" && strings.HasPrefix(path, casBaseDir)) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil // Only file content is stored
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			relPath, err := filepath.Rel(absSourcePath, path)
+			if err != nil {
+				return nil
+			}
+
+			estimate.Files++
+			estimate.Bytes += info.Size()
+			if prev, err := previous.lookup(ctx, sourcePath, filepath.ToSlash(relPath)); err == nil && prev != nil && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+				return nil
+			}
+			estimate.ChangedFiles++
+			estimate.ChangedBytes += info.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", sourcePath, err)
+		}
+	}
+
+	needed := estimate.ChangedBytes
+	if parity := r.config.Parity; parity.Enabled() {
+		needed += needed * int64(parity.ParityShards) / int64(parity.DataShards)
+	}
+	estimate.NeededBytes = needed + int64(estimate.Files)*snapshotEntryEstimate + spaceReserve
+	return estimate, nil
+}
+
+// needsEstimate reports whether a backup has to scan its sources before storing anything,
+// which it only does to check the free space of the destination and the quota.
+//
+// The scan walks the sources a second time. It doesn't read file contents and the backup's
+// own walk mostly finds the directories cached, but it is not free on large trees. Merging
+// the two walks would mean holding the whole file list in memory or storing objects before
+// knowing whether they fit, so the scan is skipped instead when neither check applies.
+func (r *Repository) needsEstimate(ctx context.Context) bool {
+	if r.config.Quota.MaxBytes > 0 {
+		return true
+	}
+	_, known, err := r.FreeSpace(ctx)
+	return known || err != nil // checkFreeSpace reports the error
+}
+
+// FreeSpace returns the bytes available for the repository in its storage. known is false
+// for storages that can't tell, such as S3.
+func (r *Repository) FreeSpace(ctx context.Context) (free int64, known bool, err error) {
+	reporter, ok := r.baseStorage().(freeSpaceReporter)
+	if !ok {
+		return 0, false, nil
+	}
+	free, err = reporter.FreeSpace(ctx)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to get free space of %s: %w", r.Location(), err)
+	}
+	return free, true, nil
+}
+
+// checkFreeSpace fails with ErrInsufficientSpace if the destination has less free space than
+// the backup may need.
+func (r *Repository) checkFreeSpace(ctx context.Context, estimate *BackupEstimate) error {
+	free, known, err := r.FreeSpace(ctx)
+	if err != nil || !known {
+		return err
+	}
+	if estimate.NeededBytes > free {
+		return fmt.Errorf("%w: the backup may need up to %.2f MB for %d new or changed files, but %s has only %.2f MB free",
+			ErrInsufficientSpace, float64(estimate.NeededBytes)/1024/1024, estimate.ChangedFiles, r.Location(), float64(free)/1024/1024)
+	}
+	return nil
+}
+
+// DefaultQuotaWarnPercent is the share of the quota above which backups warn, if the quota
+// doesn't set one.
+const DefaultQuotaWarnPercent = 90
+
+// QuotaConfig limits the size of a repository. Backups warn when the repository grows past
+// WarnPercent of MaxBytes. Once it is over MaxBytes, a backup applies the retention policy if
+// one is set, and only warns otherwise.
+type QuotaConfig struct {
+	MaxBytes    int64           `json:"max_bytes"`    // Repository size limit; 0 means no quota
+	WarnPercent int             `json:"warn_percent"` // 0 means DefaultQuotaWarnPercent
+	Retention   RetentionPolicy `json:"retention"`    // Applied when the quota is exceeded; empty to only warn
+}
+
+// Validate checks that the quota settings are usable.
+func (q QuotaConfig) Validate() error {
+	if q.MaxBytes < 0 {
+		return errors.New("quota can't be negative")
+	}
+	if q.WarnPercent < 0 || q.WarnPercent > 100 {
+		return fmt.Errorf("warning threshold %d%% out of range (0-100)", q.WarnPercent)
+	}
+	return q.Retention.Validate()
+}
+
+// QuotaStatus reports how much of its quota a repository uses.
+type QuotaStatus struct {
+	UsedBytes int64   `json:"used_bytes"` // Size of all files in the repository
+	MaxBytes  int64   `json:"max_bytes"`  // The quota; 0 if there is none
+	Percent   float64 `json:"percent"`    // UsedBytes as a percentage of MaxBytes
+	Warning   bool    `json:"warning"`    // Usage is above the warning threshold
+	Exceeded  bool    `json:"exceeded"`   // Usage is above the quota
+}
+
+// status compares a repository size with the quota.
+func (q QuotaConfig) status(used int64) *QuotaStatus {
+	status := &QuotaStatus{UsedBytes: used, MaxBytes: q.MaxBytes}
+	if q.MaxBytes == 0 {
+		return status
+	}
+	warnPercent := q.WarnPercent
+	if warnPercent == 0 {
+		warnPercent = DefaultQuotaWarnPercent
+	}
+	status.Percent = float64(used) * 100 / float64(q.MaxBytes)
+	status.Warning = status.Percent >= float64(warnPercent)
+	status.Exceeded = used > q.MaxBytes
+	return status
+}
+
+// SetQuota changes the repository quota; a zero MaxBytes removes it.
+func (r *Repository) SetQuota(quota QuotaConfig) error {
+	if err := r.checkSettingsWritable(); err != nil {
+		return err
+	}
+	config := r.config
+	config.Quota = quota
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	old := r.config
+	r.config = config
+	if err := r.SaveConfig(); err != nil {
+		r.config = old
+		return err
+	}
+	return nil
+}
+
+// QuotaStatus returns the repository's usage of its quota.
+func (r *Repository) QuotaStatus(ctx context.Context) (*QuotaStatus, error) {
+	used, err := r.repositorySize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.config.Quota.status(used), nil
+}
+
+// repositorySize returns the size of all files in the repository.
+func (r *Repository) repositorySize(ctx context.Context) (int64, error) {
+	var size int64
+	for _, t := range repositoryDirTypes {
+		err := r.storage.List(ctx, t, func(info StorageFileInfo) error {
+			size += info.Size
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to list %s: %w", t, err)
+		}
+	}
+	return size, nil
+}
+
+// quotaWarning returns a warning if adding newBytes may take the repository past the
+// warning threshold of its quota, and "" otherwise.
+func (r *Repository) quotaWarning(ctx context.Context, newBytes int64) (string, error) {
+	quota := r.config.Quota
+	if quota.MaxBytes == 0 {
+		return "", nil
+	}
+	used, err := r.repositorySize(ctx)
+	if err != nil {
+		return "", err
+	}
+	status := quota.status(used + newBytes)
+	if !status.Warning {
+		return "", nil
+	}
+	return fmt.Sprintf("Repository %s may grow to %.2f MB, %.0f%% of its %.2f MB quota",
+		r.Location(), float64(status.UsedBytes)/1024/1024, status.Percent, float64(quota.MaxBytes)/1024/1024), nil
+}
+
+// enforceQuota checks the repository size after a backup. Over the quota, the retention
+// policy of the quota is applied if it has one. It returns a warning if the repository is
+// still above the warning threshold, and "" otherwise.
+func (r *Repository) enforceQuota(ctx context.Context) (string, error) {
+	status, err := r.QuotaStatus(ctx)
+	if err != nil {
+		return "", err
+	}
+	quota := r.config.Quota
+	if status.Exceeded && !quota.Retention.Empty() {
+		result, err := r.ApplyRetention(ctx, quota.Retention, false)
+		if err != nil {
+			return "", fmt.Errorf("failed to apply retention policy: %w", err)
+		}
+		if len(result.Removed) > 0 {
+			// Pruned objects are only deleted after the grace period, so the size may not drop yet
+			return fmt.Sprintf("Repository %s is over its %.2f MB quota; removed %d old snapshots, their space is freed by a later prune",
+				r.Location(), float64(quota.MaxBytes)/1024/1024, len(result.Removed)), nil
+		}
+	}
+	switch {
+	case status.Exceeded:
+		return fmt.Sprintf("Repository %s uses %.2f MB, over its %.2f MB quota",
+			r.Location(), float64(status.UsedBytes)/1024/1024, float64(quota.MaxBytes)/1024/1024), nil
+	case status.Warning:
+		return fmt.Sprintf("Repository %s uses %.2f MB, %.0f%% of its %.2f MB quota",
+			r.Location(), float64(status.UsedBytes)/1024/1024, status.Percent, float64(quota.MaxBytes)/1024/1024), nil
+	}
+	return "", nil
+}
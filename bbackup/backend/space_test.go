@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeSpaceStorage reports a fixed amount of free space
+type freeSpaceStorage struct {
+	Storage
+	free int64
+}
+
+func (s *freeSpaceStorage) FreeSpace(ctx context.Context) (int64, error) {
+	return s.free, nil
+}
+
+// TestBackupSpacePreflight checks that a backup that doesn't fit stops before storing
+// anything, and that one that fits runs
+func TestBackupSpacePreflight(t *testing.T) {
+	ctx := context.Background()
+	sourceDir := t.TempDir()
+	for i, size := range []int{300 * 1024, 2 * 1024 * 1024} {
+		if err := os.WriteFile(filepath.Join(sourceDir, string(rune('a'+i))), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	storage := &freeSpaceStorage{Storage: NewMemoryStorage(), free: spaceReserve + 1024*1024}
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	var last BackupProgress
+	err = RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, func(p BackupProgress) { last = p }, DefaultBatchConfig())
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Expected the backup to stop for lack of space, got %v", err)
+	}
+	if last.Status != "Failed" || !strings.Contains(last.Error, "free") {
+		t.Errorf("Expected a failure explaining the free space, got %+v", last)
+	}
+	for _, fileType := range []FileType{ObjectFile, PackFile, SnapshotFile} {
+		if names, _ := repo.listFiles(ctx, fileType); len(names) != 0 {
+			t.Errorf("Expected no %s to be stored, got %v", fileType, names)
+		}
+	}
+
+	storage.free = spaceReserve + 10*1024*1024
+	if err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, nil, func(p BackupProgress) { last = p }, DefaultBatchConfig()); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if last.TotalBytes != 2*1024*1024+300*1024 {
+		t.Errorf("Expected the changed bytes to be reported as the total, got %d", last.TotalBytes)
+	}
+
+	// Without a free space figure or a quota there is nothing to check, and no scan
+	plain, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	estimated := false
+	err = RunRepositoryBackup(ctx, plain, []string{sourceDir}, nil, nil, func(p BackupProgress) {
+		estimated = estimated || strings.HasPrefix(p.Status, "Estimating")
+	}, DefaultBatchConfig())
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if estimated {
+		t.Errorf("Expected the backup not to scan its sources ahead")
+	}
+}
+
+// TestQuotaRetention checks that a repository over its quota warns, and applies the
+// retention policy when it has one
+func TestQuotaRetention(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 10; i++ {
+		id := base.AddDate(0, 0, i).Format("20060102150405")
+		if err := repo.SaveSnapshot(&Snapshot{ID: id, Timestamp: base.AddDate(0, 0, i), Files: map[string]*FileEntry{}}); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+	// A second snapshot on the last day, which daily retention doesn't keep
+	if err := repo.SaveSnapshot(&Snapshot{ID: "20250310110000", Timestamp: base.AddDate(0, 0, 9).Add(-time.Hour), Files: map[string]*FileEntry{}}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	used, err := repo.repositorySize(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get repository size: %v", err)
+	}
+
+	if err := repo.SetQuota(QuotaConfig{MaxBytes: used + used/20}); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if warning, err := repo.enforceQuota(ctx); err != nil || !strings.Contains(warning, "% of its") {
+		t.Errorf("Expected a warning near the quota, got %q (err=%v)", warning, err)
+	}
+	if err := repo.SetQuota(QuotaConfig{MaxBytes: used / 2}); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if warning, err := repo.enforceQuota(ctx); err != nil || !strings.Contains(warning, "over its") {
+		t.Errorf("Expected an over-quota warning, got %q (err=%v)", warning, err)
+	}
+
+	if err := repo.SetQuota(QuotaConfig{MaxBytes: used / 2, Retention: RetentionPolicy{KeepLast: 1, KeepDaily: 3}}); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if warning, err := repo.enforceQuota(ctx); err != nil || !strings.Contains(warning, "removed 8 old snapshots") {
+		t.Errorf("Expected old snapshots to be removed, got %q (err=%v)", warning, err)
+	}
+	ids, err := repo.listFiles(ctx, SnapshotFile)
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("Expected three snapshots to be kept, got %v (err=%v)", ids, err)
+	}
+	for _, id := range []string{"20250310120000", "20250309120000", "20250308120000"} {
+		if !containsString(ids, id) {
+			t.Errorf("Expected snapshot %s to be kept, got %v", id, ids)
+		}
+	}
+
+	if err := repo.SetQuota(QuotaConfig{MaxBytes: -1}); err == nil {
+		t.Errorf("Expected a negative quota to be rejected")
+	}
+	if _, err := repo.ApplyRetention(ctx, RetentionPolicy{}, false); err == nil {
+		t.Errorf("Expected an empty retention policy to be refused")
+	}
+}
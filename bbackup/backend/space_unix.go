@@ -0,0 +1,14 @@
+//go:build !windows
+
+package backend
+
+import "syscall"
+
+// diskFreeSpace returns the bytes available to this user on the filesystem holding dir.
+func diskFreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
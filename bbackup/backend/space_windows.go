@@ -0,0 +1,18 @@
+//go:build windows
+
+package backend
+
+import "golang.org/x/sys/windows"
+
+// diskFreeSpace returns the bytes available to this user on the volume holding dir.
+func diskFreeSpace(dir string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotStats reports how much space a snapshot takes. Logical sizes are file sizes as
+// they were backed up; stored sizes are the sizes of the objects in the repository, after
+// compression and encryption.
+type SnapshotStats struct {
+	ID             string    `json:"id"`
+	Timestamp      time.Time `json:"timestamp"`
+	Parent         string    `json:"parent,omitempty"` // Snapshot the backup compared files with, if it still exists
+	Files          int       `json:"files"`
+	LogicalBytes   int64     `json:"logical_bytes"`   // Total size of the files in the snapshot
+	StoredBytes    int64     `json:"stored_bytes"`    // Stored size of all objects the snapshot references
+	NewBytes       int64     `json:"new_bytes"`       // Stored size of the objects its parent doesn't reference
+	ExclusiveBytes int64     `json:"exclusive_bytes"` // Stored size of the objects no other snapshot references; what pruning it would free
+}
+
+// RepositoryStats reports the space used by a repository and its snapshots.
+type RepositoryStats struct {
+	Snapshots         []SnapshotStats `json:"snapshots"`           // Oldest first
+	TotalLogicalBytes int64           `json:"total_logical_bytes"` // Sum of the logical sizes of all snapshots
+	UniqueStoredBytes int64           `json:"unique_stored_bytes"` // Stored size of the objects referenced by any snapshot
+	DedupRatio        float64         `json:"dedup_ratio"`         // TotalLogicalBytes / UniqueStoredBytes, including compression
+	RepositoryBytes   int64           `json:"repository_bytes"`    // Size of all files in the repository, including unreferenced objects
+}
+
+// Stats computes the space statistics of the repository and each of its snapshots.
+// The parent of a snapshot is the one its backup compared files with. Snapshots that don't
+// record one, made before parents were, take the latest earlier snapshot with the same
+// source paths.
+func (r *Repository) Stats(ctx context.Context) (*RepositoryStats, error) {
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	lock, err := r.AcquireLock(ctx, false, "stats")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	stats := &RepositoryStats{}
+	sizes, err := r.objectSizes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stats.RepositoryBytes, err = r.repositorySize(ctx); err != nil {
+		return nil, err
+	}
+
+	snapshots, err := r.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(snapshots))
+	for _, header := range snapshots {
+		listed[header.ID] = true
+	}
+
+	// First pass: sizes, new bytes against the parent and how many snapshots use each object.
+	// Only the object sets of the latest snapshot of each source set are kept in memory, as
+	// the usual parents; other parents are read again.
+	refCount := make(map[string]int)
+	latestID := make(map[string]string)        // Latest snapshot by source set
+	latest := make(map[string]map[string]bool) // Objects of those snapshots by ID
+	for _, header := range snapshots {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		snapshot, err := r.LoadSnapshot(header.ID)
+		if err != nil {
+			return nil, err
+		}
+		s := SnapshotStats{ID: header.ID, Timestamp: snapshot.Timestamp}
+		objects, err := r.snapshotObjects(ctx, snapshot, func(entry *FileEntry) {
+			if entry.NodeType() == NodeFile {
+				s.Files++
+				s.LogicalBytes += entry.Size
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// A parent that was pruned since counts as none
+		key := sourceKey(snapshot.Source)
+		if snapshot.Parent == "" {
+			s.Parent = latestID[key] // Made before parents were recorded
+		} else if listed[snapshot.Parent] {
+			s.Parent = snapshot.Parent
+		}
+		parent, ok := latest[s.Parent]
+		if s.Parent != "" && !ok {
+			if parent, err = r.loadSnapshotObjects(ctx, s.Parent); err != nil {
+				return nil, err
+			}
+		}
+		for id := range objects {
+			s.StoredBytes += sizes[id]
+			if !parent[id] {
+				s.NewBytes += sizes[id]
+			}
+			refCount[id]++
+		}
+		delete(latest, latestID[key])
+		latest[header.ID] = objects
+		latestID[key] = header.ID
+		stats.TotalLogicalBytes += s.LogicalBytes
+		stats.Snapshots = append(stats.Snapshots, s)
+	}
+	for id := range refCount {
+		stats.UniqueStoredBytes += sizes[id]
+	}
+	if stats.UniqueStoredBytes > 0 {
+		stats.DedupRatio = float64(stats.TotalLogicalBytes) / float64(stats.UniqueStoredBytes)
+	}
+
+	// Second pass: objects used by a single snapshot
+	for i := range stats.Snapshots {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		snapshot, err := r.LoadSnapshot(stats.Snapshots[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := r.snapshotObjects(ctx, snapshot, nil)
+		if err != nil {
+			return nil, err
+		}
+		for id := range objects {
+			if refCount[id] == 1 {
+				stats.Snapshots[i].ExclusiveBytes += sizes[id]
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// loadSnapshotObjects returns the IDs of the objects the snapshot with the given ID references.
+func (r *Repository) loadSnapshotObjects(ctx context.Context, id string) (map[string]bool, error) {
+	snapshot, err := r.LoadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.snapshotObjects(ctx, snapshot, nil)
+}
+
+// snapshotObjects returns the IDs of the objects a snapshot references, its trees included,
+// and calls file, if set, for every file in it.
+func (r *Repository) snapshotObjects(ctx context.Context, snapshot *Snapshot, file func(entry *FileEntry)) (map[string]bool, error) {
+	objects := make(map[string]bool)
+	walker := &treeWalker{
+		tree: func(id, dir string) error {
+			objects[id] = true
+			return nil
+		},
+		file: func(entry *FileEntry) error {
+			if file != nil {
+				file(entry)
+			}
+			for _, id := range entryObjects(entry) {
+				objects[id] = true
+			}
+			return nil
+		},
+	}
+	if err := r.walkSnapshot(ctx, snapshot, walker); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", snapshot.ID, err)
+	}
+	return objects, nil
+}
+
+// entryObjects returns the IDs of the objects that hold the content of a file entry.
+func entryObjects(entry *FileEntry) []string {
+	if entry.NodeType() != NodeFile {
+		return nil
+	}
+	if len(entry.Chunks) == 0 {
+		if entry.Size == 0 {
+			return nil
+		}
+		return []string{entry.Hash}
+	}
+	return entry.Chunks
+}
+
+// sourceKey identifies the set of source paths of a snapshot, independent of their order.
+func sourceKey(sources []string) string {
+	sorted := append([]string(nil), sources...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, "\x00")
+}
+
+// objectSizes returns the stored size of every loose and packed object in the repository.
+func (r *Repository) objectSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	err := r.storage.List(ctx, ObjectFile, func(info StorageFileInfo) error {
+		sizes[info.Name] = info.Size
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index = make(map[string]blobLocation)
+	r.indexLoaded = false
+	if err := r.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	for id, loc := range r.index {
+		if _, ok := sizes[id]; !ok {
+			sizes[id] = loc.length
+		}
+	}
+	return sizes, nil
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestRepositoryStats checks the per-snapshot new and exclusive sizes and the repository
+// totals for snapshots that share objects, comparing with the recorded parent when there is one
+func TestRepositoryStats(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	ids := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "orphan"} {
+		data := []byte("content of object " + name + " with some padding to make it longer")
+		ids[name] = repo.objectID(data)
+		if _, err := repo.storeObject(ctx, ids[name], data); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	sizes, err := repo.objectSizes(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get object sizes: %v", err)
+	}
+	size := func(names ...string) int64 {
+		var total int64
+		for _, name := range names {
+			total += sizes[ids[name]]
+		}
+		return total
+	}
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	save := func(id string, offset int, source, parent string, objects ...string) {
+		files := make(map[string]*FileEntry)
+		for _, name := range objects {
+			files[name] = &FileEntry{Path: name, Chunks: []string{ids[name]}, Size: 1000}
+		}
+		snapshot := &Snapshot{ID: id, Timestamp: base.Add(time.Duration(offset) * time.Hour), Source: []string{source}, Parent: parent, Files: files}
+		if err := repo.SaveSnapshot(snapshot); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+	save("first", 0, "/home", "", "a", "b")
+	save("other", 1, "/work", "", "c", "d")
+	save("second", 2, "/home", "", "a", "c") // Without a recorded parent
+	save("third", 3, "/home", "other", "c", "d")
+	save("fourth", 4, "/tmp", "pruned", "d")
+
+	stats, err := repo.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	expected := []SnapshotStats{
+		{ID: "first", Files: 2, LogicalBytes: 2000, StoredBytes: size("a", "b"), NewBytes: size("a", "b"), ExclusiveBytes: size("b")},
+		{ID: "other", Files: 2, LogicalBytes: 2000, StoredBytes: size("c", "d"), NewBytes: size("c", "d"), ExclusiveBytes: 0},
+		{ID: "second", Parent: "first", Files: 2, LogicalBytes: 2000, StoredBytes: size("a", "c"), NewBytes: size("c"), ExclusiveBytes: 0},
+		{ID: "third", Parent: "other", Files: 2, LogicalBytes: 2000, StoredBytes: size("c", "d"), NewBytes: 0, ExclusiveBytes: 0},
+		{ID: "fourth", Files: 1, LogicalBytes: 1000, StoredBytes: size("d"), NewBytes: size("d"), ExclusiveBytes: 0},
+	}
+	if len(stats.Snapshots) != len(expected) {
+		t.Fatalf("Expected %d snapshots, got %+v", len(expected), stats.Snapshots)
+	}
+	for i, want := range expected {
+		got := stats.Snapshots[i]
+		got.Timestamp = time.Time{}
+		if got != want {
+			t.Errorf("Snapshot %d: got %+v, expected %+v", i, got, want)
+		}
+	}
+
+	if stats.TotalLogicalBytes != 9000 || stats.UniqueStoredBytes != size("a", "b", "c", "d") {
+		t.Errorf("Unexpected totals: %+v", stats)
+	}
+	if ratio := float64(9000) / float64(size("a", "b", "c", "d")); stats.DedupRatio != ratio {
+		t.Errorf("Expected dedup ratio %v, got %v", ratio, stats.DedupRatio)
+	}
+	if stats.RepositoryBytes <= stats.UniqueStoredBytes+size("orphan") {
+		t.Errorf("Expected the repository size to include packs, index and snapshots, got %d", stats.RepositoryBytes)
+	}
+}
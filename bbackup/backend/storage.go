@@ -0,0 +1,216 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// FileType identifies the kind of file a repository keeps in its storage.
+type FileType string
+
+const (
+	ConfigFile      FileType = "config"
+	KeyFile         FileType = "keys"
+	ObjectFile      FileType = "objects"
+	PackFile        FileType = "packs"
+	IndexFile       FileType = "index"
+	SnapshotFile    FileType = "snapshots"
+	LockFile        FileType = "locks"
+	MarkFile        FileType = "marks"
+	ObjectIndexFile FileType = "objindex"
+	ParityFile      FileType = "parity"
+	TombstoneFile   FileType = "tombstones"
+)
+
+// repositoryDirTypes lists the file types that are kept in a directory of their own.
+var repositoryDirTypes = []FileType{KeyFile, ObjectFile, PackFile, IndexFile, SnapshotFile, LockFile, MarkFile, ObjectIndexFile, ParityFile, TombstoneFile}
+
+// configHandleName is the name of the single file of type ConfigFile.
+const configHandleName = "config"
+
+// Handle names a file in a storage.
+type Handle struct {
+	Type FileType
+	Name string
+}
+
+func (h Handle) String() string {
+	return fmt.Sprintf("%s/%s", h.Type, h.Name)
+}
+
+// StorageFileInfo describes a file in a storage.
+type StorageFileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where a repository keeps its files: objects, packs, index files,
+// object index files, parity files, snapshots, snapshot tombstones, keys, locks, prune marks and its config. Implementations must be safe for concurrent use.
+//
+// Missing files are reported with errors that match fs.ErrNotExist (check with errors.Is).
+type Storage interface {
+	// Location returns a human-readable description of where the storage is, for messages.
+	Location() string
+
+	// Save stores the content of rd under h, replacing any existing file. A file is
+	// either stored completely or not at all, even if the write is interrupted.
+	Save(ctx context.Context, h Handle, rd io.Reader) error
+
+	// Load returns a reader over length bytes of the file starting at offset.
+	// A length of 0 reads to the end of the file.
+	Load(ctx context.Context, h Handle, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns information about a file.
+	Stat(ctx context.Context, h Handle) (StorageFileInfo, error)
+
+	// Remove deletes a file.
+	Remove(ctx context.Context, h Handle) error
+
+	// List calls fn for every file of the given type. Listing stops at the first error fn returns.
+	List(ctx context.Context, t FileType, fn func(StorageFileInfo) error) error
+
+	// Close releases any resources held by the storage.
+	Close() error
+}
+
+// repositoryFilePath returns the slash-separated path of a file relative to the root of a
+// repository kept as a directory tree, as local and SFTP storage do. Objects and packs are
+// spread over subdirectories named after the first characters of their IDs.
+func repositoryFilePath(h Handle) string {
+	switch h.Type {
+	case ConfigFile:
+		return configHandleName
+	case ObjectFile:
+		if len(h.Name) < 4 {
+			return path.Join(string(h.Type), h.Name)
+		}
+		return path.Join(string(h.Type), h.Name[0:2], h.Name[2:4], h.Name)
+	case PackFile, ParityFile:
+		if len(h.Name) < 2 {
+			return path.Join(string(h.Type), h.Name)
+		}
+		return path.Join(string(h.Type), h.Name[0:2], h.Name)
+	case SnapshotFile:
+		return path.Join(string(h.Type), h.Name+".json")
+	default:
+		return path.Join(string(h.Type), h.Name)
+	}
+}
+
+// repositoryFileName returns the name of a file found while walking the directory of a
+// file type in a repository directory tree. Temporary files and, for snapshots, files
+// without the .json extension are skipped.
+func repositoryFileName(t FileType, base string) (string, bool) {
+	if strings.HasSuffix(base, ".tmp") {
+		return "", false
+	}
+	if t == SnapshotFile {
+		if !strings.HasSuffix(base, ".json") {
+			return "", false
+		}
+		return strings.TrimSuffix(base, ".json"), true
+	}
+	return base, true
+}
+
+// listConfigFile implements List for ConfigFile in storages that keep the config as a
+// single file rather than in a directory.
+func listConfigFile(ctx context.Context, s Storage, fn func(StorageFileInfo) error) error {
+	info, err := s.Stat(ctx, Handle{Type: ConfigFile, Name: configHandleName})
+	if isNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fn(info)
+}
+
+// tempFileSweeper is implemented by storages that write through temporary files which
+// an interrupted process can leave behind.
+type tempFileSweeper interface {
+	SweepTempFiles() (int, error)
+}
+
+// freeSpaceReporter is implemented by storages that can tell how much space is left for
+// new files. Object stores without a fixed size, such as S3, don't implement it.
+type freeSpaceReporter interface {
+	FreeSpace(ctx context.Context) (int64, error)
+}
+
+// errFreeSpaceUnknown is returned by FreeSpace when the free space can't be found out.
+var errFreeSpaceUnknown = errors.New("free space is unknown")
+
+// errStopListing is returned from List callbacks to end a listing early.
+var errStopListing = errors.New("stop listing")
+
+// StorageConfig selects a remote storage for a repository. Without one, the repository
+// is kept where the destination it is opened with points: a local directory or an
+// sftp://user@host/path URL.
+type StorageConfig struct {
+	S3   *S3Config   `json:"s3,omitempty" yaml:"s3,omitempty"`
+	SFTP *SFTPConfig `json:"sftp,omitempty" yaml:"sftp,omitempty"`
+}
+
+// IsRemote reports whether the config selects a remote storage.
+func (c StorageConfig) IsRemote() bool {
+	return c.S3 != nil || c.SFTP != nil
+}
+
+// OpenStorage returns the storage for a backup destination: a local directory or an
+// sftp://user@host/path URL.
+func OpenStorage(location string) (Storage, error) {
+	return OpenStorageWithConfig(location, StorageConfig{})
+}
+
+// OpenStorageWithConfig returns the remote storage selected by config, or the storage for
+// the destination at location if there is none.
+func OpenStorageWithConfig(location string, config StorageConfig) (Storage, error) {
+	switch {
+	case config.S3 != nil:
+		return NewS3Storage(*config.S3)
+	case config.SFTP != nil:
+		return NewSFTPStorage(*config.SFTP)
+	case IsRemoteLocation(location):
+		sftpConfig, err := ParseSFTPURL(location)
+		if err != nil {
+			return nil, err
+		}
+		return NewSFTPStorage(sftpConfig)
+	}
+	return NewLocalStorage(location), nil
+}
+
+// loadAll reads a whole file from the storage.
+func loadAll(ctx context.Context, s Storage, h Handle) ([]byte, error) {
+	rd, err := s.Load(ctx, h, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// hasFiles reports whether the storage contains at least one file of the given type.
+func hasFiles(ctx context.Context, s Storage, t FileType) (bool, error) {
+	found := false
+	err := s.List(ctx, t, func(StorageFileInfo) error {
+		found = true
+		return errStopListing
+	})
+	if err != nil && !errors.Is(err, errStopListing) {
+		return false, err
+	}
+	return found, nil
+}
+
+// isNotExist reports whether err means that a storage file doesn't exist.
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
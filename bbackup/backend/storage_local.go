@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFileMaxAge is how long a temporary file must have been left untouched
+// before SweepTempFiles treats it as orphaned. Files of a running backup are
+// written to continuously, so they never get this old.
+const tempFileMaxAge = time.Hour
+
+// LocalStorage keeps repository files in a directory on a mounted filesystem:
+//
+//	config
+//	keys/<id>
+//	objects/ab/cd/abcdef...
+//	packs/ab/abcdef...
+//	index/<id>
+//	snapshots/<id>.json
+//	locks/<id>
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage returns a storage for the repository directory dir.
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+// Dir returns the repository directory.
+func (s *LocalStorage) Dir() string {
+	return s.dir
+}
+
+// Location returns the repository directory.
+func (s *LocalStorage) Location() string {
+	return s.dir
+}
+
+// Path returns the path of the file for a handle.
+func (s *LocalStorage) Path(h Handle) string {
+	return filepath.Join(s.dir, filepath.FromSlash(repositoryFilePath(h)))
+}
+
+// Save writes the file via a temporary file in the same directory, which is fsynced and
+// read back to check that what reached the disk is what was written before it is renamed
+// into place. An interrupted or corrupted write never leaves a file under its final name.
+func (s *LocalStorage) Save(ctx context.Context, h Handle, rd io.Reader) error {
+	path := s.Path(h)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	tempFile, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", path, err)
+	}
+	tempPath := tempFile.Name()
+	success := false
+	defer func() {
+		if !success {
+			tempFile.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	hasher := sha256.New()
+	if _, err := copyWithContext(ctx, io.MultiWriter(tempFile, hasher), rd); err != nil {
+		return fmt.Errorf("failed to write temporary file %s: %w", tempPath, err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file %s: %w", tempPath, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file %s: %w", tempPath, err)
+	}
+	perm := os.FileMode(0644)
+	if h.Type == KeyFile {
+		perm = 0600
+	}
+	if err := os.Chmod(tempPath, perm); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", tempPath, err)
+	}
+
+	if err := verifyFileHash(tempPath, hasher.Sum(nil)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tempPath, path, err)
+	}
+	success = true
+	syncDir(dir)
+	return nil
+}
+
+// verifyFileHash reads a written file back and checks it against the SHA-256 of the data that was written.
+func verifyFileHash(path string, expected []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to read back %s: %w", path, err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), expected) {
+		return fmt.Errorf("%s is corrupt after writing: content hash mismatch", path)
+	}
+	return nil
+}
+
+// syncDir flushes a directory entry change (such as a rename) to disk.
+// Errors are ignored because not every platform supports syncing directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Load opens the file and returns a reader over the requested range.
+func (s *LocalStorage) Load(ctx context.Context, h Handle, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.Path(h))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length > 0 {
+		return &readCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+	}
+	return file, nil
+}
+
+// readCloser combines a reader with the closer of the file it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Stat returns the size and modification time of the file.
+func (s *LocalStorage) Stat(ctx context.Context, h Handle) (StorageFileInfo, error) {
+	info, err := os.Stat(s.Path(h))
+	if err != nil {
+		return StorageFileInfo{}, err
+	}
+	return StorageFileInfo{Name: h.Name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Remove deletes the file.
+func (s *LocalStorage) Remove(ctx context.Context, h Handle) error {
+	return os.Remove(s.Path(h))
+}
+
+// List walks the directory for the file type, skipping temporary files.
+func (s *LocalStorage) List(ctx context.Context, t FileType, fn func(StorageFileInfo) error) error {
+	if t == ConfigFile {
+		return listConfigFile(ctx, s, fn)
+	}
+
+	root := filepath.Join(s.dir, string(t))
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			return nil
+		}
+
+		name, ok := repositoryFileName(t, d.Name())
+		if !ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil // Removed while listing
+		} else if err != nil {
+			return err
+		}
+		return fn(StorageFileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// Close does nothing for local storage.
+func (s *LocalStorage) Close() error {
+	return nil
+}
+
+// SweepTempFiles removes temporary files that interrupted writes left behind in the
+// repository at casBaseDir, such as partially written objects, packs and snapshots.
+// It returns the number of files removed.
+func SweepTempFiles(casBaseDir string) (int, error) {
+	return NewLocalStorage(casBaseDir).SweepTempFiles()
+}
+
+// FreeSpace returns the bytes available on the filesystem holding the repository directory.
+func (s *LocalStorage) FreeSpace(ctx context.Context) (int64, error) {
+	return diskFreeSpace(s.dir)
+}
+
+// MaxFileSize returns the largest file the filesystem holding the repository directory can
+// store, or 0 if it has no limit that matters. A directory that doesn't exist yet is looked
+// up on the filesystem of its closest existing parent.
+func (s *LocalStorage) MaxFileSize(ctx context.Context) (int64, error) {
+	dir := s.dir
+	for {
+		parent := filepath.Dir(dir)
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return filesystemMaxFileSize(dir)
+}
+
+// SweepTempFiles removes temporary files left behind by interrupted writes.
+// Files changed within tempFileMaxAge are kept since they may still be being written.
+func (s *LocalStorage) SweepTempFiles() (int, error) {
+	casBaseDir := filepath.Clean(s.dir)
+	cutoff := time.Now().Add(-tempFileMaxAge)
+	removed := 0
+
+	err := filepath.WalkDir(casBaseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == casBaseDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			// Only descend into repository directories, not into unrelated data next to them
+			if path != casBaseDir && filepath.Dir(path) == casBaseDir && !isRepositoryDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		if filepath.Dir(path) == casBaseDir && !strings.HasPrefix(d.Name(), configHandleName) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil // Possibly still being written
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove temporary file %s: %w", path, err)
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to sweep temporary files in %s: %w", casBaseDir, err)
+	}
+	return removed, nil
+}
+
+// isRepositoryDir reports whether name is one of the directories a repository creates.
+func isRepositoryDir(name string) bool {
+	for _, t := range repositoryDirTypes {
+		if FileType(name) == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps repository files in memory. It is meant for tests and
+// for staging data that never needs to outlive the process.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[Handle]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStorage returns an empty in-memory storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[Handle]memoryFile)}
+}
+
+// Location returns a fixed description of the in-memory storage.
+func (s *MemoryStorage) Location() string {
+	return "memory"
+}
+
+// Save reads rd completely before storing it, so an interrupted write stores nothing.
+func (s *MemoryStorage) Save(ctx context.Context, h Handle, rd io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := copyWithContext(ctx, &buf, rd); err != nil {
+		return fmt.Errorf("failed to save %s: %w", h, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[h] = memoryFile{data: buf.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+// Load returns a reader over a copy of the requested range.
+func (s *MemoryStorage) Load(ctx context.Context, h Handle, offset, length int64) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, ok := s.files[h]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", h, fs.ErrNotExist)
+	}
+	if offset > int64(len(file.data)) {
+		return nil, fmt.Errorf("%s: offset %d beyond end of file", h, offset)
+	}
+	data := file.data[offset:]
+	if length > 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(append([]byte(nil), data...))), nil
+}
+
+// Stat returns the size and modification time of a file.
+func (s *MemoryStorage) Stat(ctx context.Context, h Handle) (StorageFileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, ok := s.files[h]
+	if !ok {
+		return StorageFileInfo{}, fmt.Errorf("%s: %w", h, fs.ErrNotExist)
+	}
+	return StorageFileInfo{Name: h.Name, Size: int64(len(file.data)), ModTime: file.modTime}, nil
+}
+
+// Remove deletes a file.
+func (s *MemoryStorage) Remove(ctx context.Context, h Handle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[h]; !ok {
+		return fmt.Errorf("%s: %w", h, fs.ErrNotExist)
+	}
+	delete(s.files, h)
+	return nil
+}
+
+// List calls fn for the files of a type in name order. fn may modify the storage.
+func (s *MemoryStorage) List(ctx context.Context, t FileType, fn func(StorageFileInfo) error) error {
+	s.mu.RLock()
+	var infos []StorageFileInfo
+	for h, file := range s.files {
+		if h.Type == t {
+			infos = append(infos, StorageFileInfo{Name: h.Name, Size: int64(len(file.data)), ModTime: file.modTime})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing for in-memory storage.
+func (s *MemoryStorage) Close() error {
+	return nil
+}
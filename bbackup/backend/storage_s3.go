@@ -0,0 +1,527 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of the parts of a multipart upload. Data up to this
+	// size is uploaded with a single PUT.
+	s3PartSize = 16 * 1024 * 1024
+
+	// s3MaxRetries is how often a throttled or failed request is retried.
+	s3MaxRetries = 5
+
+	// s3RetryDelay is the delay before the first retry; it doubles with every attempt.
+	s3RetryDelay = 500 * time.Millisecond
+
+	s3DefaultRegion = "us-east-1"
+)
+
+// S3Config describes where a repository is kept on an S3-compatible service
+// such as AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint        string `json:"endpoint" yaml:"endpoint"` // e.g. "https://s3.eu-central-1.amazonaws.com" or "http://nas.local:9000"
+	Region          string `json:"region" yaml:"region"`     // Defaults to us-east-1, which MinIO accepts as well
+	Bucket          string `json:"bucket" yaml:"bucket"`
+	Prefix          string `json:"prefix" yaml:"prefix"` // Key prefix the repository is kept under, may be empty
+	AccessKeyID     string `json:"accessKeyId" yaml:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey" yaml:"secretAccessKey"`
+}
+
+// S3Storage keeps repository files as keys in an S3 bucket:
+//
+//	<prefix>/config
+//	<prefix>/keys/<id>
+//	<prefix>/objects/<id>
+//	<prefix>/packs/<id>
+//	<prefix>/index/<id>
+//	<prefix>/snapshots/<id>
+//	<prefix>/locks/<id>
+//
+// Requests use path-style URLs and are signed with AWS Signature Version 4.
+type S3Storage struct {
+	config     S3Config
+	endpoint   *url.URL
+	prefix     string
+	client     *http.Client
+	partSize   int64
+	maxRetries int
+	retryDelay time.Duration
+}
+
+// NewS3Storage returns a storage for the bucket and prefix in config. Missing credentials
+// are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket not set")
+	}
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("S3 endpoint not set")
+	}
+	endpoint := config.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", config.Endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: unsupported scheme %s", config.Endpoint, u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+	if config.AccessKeyID == "" && config.SecretAccessKey == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &S3Storage{
+		config:     config,
+		endpoint:   u,
+		prefix:     strings.Trim(config.Prefix, "/"),
+		client:     &http.Client{},
+		partSize:   s3PartSize,
+		maxRetries: s3MaxRetries,
+		retryDelay: s3RetryDelay,
+	}, nil
+}
+
+// Location returns the bucket and prefix as an s3: URL.
+func (s *S3Storage) Location() string {
+	return fmt.Sprintf("s3:%s/%s", s.endpoint.Host, path.Join(s.config.Bucket, s.prefix))
+}
+
+// key returns the object key for a handle.
+func (s *S3Storage) key(h Handle) string {
+	if h.Type == ConfigFile {
+		return path.Join(s.prefix, configHandleName)
+	}
+	return path.Join(s.prefix, string(h.Type), h.Name)
+}
+
+// Save uploads the file with a single PUT, or as a multipart upload if it is larger than
+// one part. S3 only makes an object visible once its upload is complete.
+func (s *S3Storage) Save(ctx context.Context, h Handle, rd io.Reader) error {
+	key := s.key(h)
+
+	var first bytes.Buffer
+	n, err := io.CopyN(&first, rd, s.partSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read data for %s: %w", h, err)
+	}
+	if n < s.partSize {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, nil, first.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", h, err)
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := s.multipartUpload(ctx, key, first.Bytes(), rd); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", h, err)
+	}
+	return nil
+}
+
+// multipartUpload uploads first followed by the rest of rd in parts. A failed upload is
+// aborted so that the bucket doesn't keep the parts that were already uploaded.
+func (s *S3Storage) multipartUpload(ctx context.Context, key string, first []byte, rd io.Reader) (err error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = decodeS3Response(resp, &initiated)
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	uploadID := initiated.UploadID
+
+	defer func() {
+		if err != nil {
+			// Use a fresh context: the upload may have failed because ctx was cancelled
+			if resp, abortErr := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr == nil {
+				resp.Body.Close()
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to abort multipart upload of %s: %v\n", key, abortErr)
+			}
+		}
+	}()
+
+	var complete s3CompleteMultipartUpload
+	part := first
+	for partNumber := 1; len(part) > 0; partNumber++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := s.do(ctx, http.MethodPut, key, query, nil, part)
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		var next bytes.Buffer
+		if _, err := io.CopyN(&next, rd, s.partSize); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+		part = next.Bytes()
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return fmt.Errorf("failed to encode multipart upload: %w", err)
+	}
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	// Completing can fail after the 200 status has been sent, so check for an error document
+	var result struct {
+		XMLName xml.Name
+		s3ErrorResponse
+	}
+	if err := decodeS3Response(resp, &result); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("failed to complete multipart upload: %w", &S3Error{StatusCode: http.StatusOK, Code: result.Code, Message: result.Message})
+	}
+	return nil
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Load downloads the requested range of the file.
+func (s *S3Storage) Load(ctx context.Context, h Handle, offset, length int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.key(h), nil, header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", h, err)
+	}
+	return resp.Body, nil
+}
+
+// Stat returns the size and modification time of the file.
+func (s *S3Storage) Stat(ctx context.Context, h Handle) (StorageFileInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.key(h), nil, nil, nil)
+	if err != nil {
+		return StorageFileInfo{}, fmt.Errorf("failed to stat %s: %w", h, err)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageFileInfo{Name: h.Name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// Remove deletes the file. S3 doesn't report whether the key existed, so removing
+// a missing file succeeds.
+func (s *S3Storage) Remove(ctx context.Context, h Handle) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.key(h), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", h, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List pages through the keys under the prefix of the file type.
+func (s *S3Storage) List(ctx context.Context, t FileType, fn func(StorageFileInfo) error) error {
+	if t == ConfigFile {
+		return listConfigFile(ctx, s, fn)
+	}
+
+	prefix := path.Join(s.prefix, string(t)) + "/"
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", t, err)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := decodeS3Response(resp, &result); err != nil {
+			return fmt.Errorf("failed to list %s: %w", t, err)
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			if err := fn(StorageFileInfo{Name: name, Size: object.Size, ModTime: object.LastModified}); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Close releases idle connections.
+func (s *S3Storage) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// S3Error is an error response from the S3 service.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("S3 request failed: %s: %s", e.Code, e.Message)
+}
+
+// Is makes missing keys match fs.ErrNotExist. A missing bucket doesn't, so that it
+// isn't mistaken for an empty repository.
+func (e *S3Error) Is(target error) bool {
+	if target != fs.ErrNotExist || e.Code == "NoSuchBucket" {
+		return false
+	}
+	return e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey"
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// retryable reports whether a request that failed with the error may succeed when retried.
+func (e *S3Error) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return e.Code == "SlowDown" || e.Code == "RequestTimeout"
+}
+
+// decodeS3Response reads an XML response body into v.
+func decodeS3Response(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse S3 response: %w", err)
+	}
+	return nil
+}
+
+// do sends a signed request for key, or for the bucket if key is empty, and returns the
+// response if it has a 2xx status. Throttled requests, server errors and network errors
+// are retried with exponential backoff, honouring Retry-After.
+func (s *S3Storage) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := s.send(ctx, method, key, query, header, body)
+		if err == nil {
+			return resp, nil
+		}
+
+		var s3err *S3Error
+		if ctx.Err() != nil || attempt >= s.maxRetries || (errors.As(err, &s3err) && !s3err.retryable()) {
+			return nil, err
+		}
+
+		wait := delay
+		if resp != nil {
+			if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// send performs a single request. On an error status it returns the (closed) response
+// together with an *S3Error.
+func (s *S3Storage) send(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.config.Bucket
+	u.RawPath = s.endpoint.EscapedPath() + "/" + s3Escape(s.config.Bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, true)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, u.RawPath, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	s3err := &S3Error{StatusCode: resp.StatusCode}
+	var errResp s3ErrorResponse
+	if xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&errResp) == nil {
+		s3err.Code = errResp.Code
+		s3err.Message = errResp.Message
+	}
+	return resp, s3err
+}
+
+// sign adds AWS Signature Version 4 headers to the request. Requests are sent
+// unsigned if no credentials are configured, for public or anonymous buckets.
+func (s *S3Storage) sign(req *http.Request, canonicalURI string, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.config.AccessKeyID == "" {
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes a query string the way Signature Version 4 expects it:
+// sorted by key with every value escaped.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters (and slashes if keepSlash is set).
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,541 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// sftpIdleTimeout is how long an SSH connection is kept open after the last storage
+	// using it has been closed, so that repositories opened one after another share it.
+	sftpIdleTimeout = time.Minute
+
+	sftpDialTimeout = 30 * time.Second
+
+	// sftpConcurrentRequests is the number of write and read requests kept in flight per
+	// file, which hides the round-trip time of the connection.
+	sftpConcurrentRequests = 64
+)
+
+// SFTPConfig describes where a repository is kept on a server reachable over SSH.
+type SFTPConfig struct {
+	Host           string `json:"host" yaml:"host"`
+	Port           int    `json:"port" yaml:"port"` // Defaults to 22
+	User           string `json:"user" yaml:"user"`
+	Path           string `json:"path" yaml:"path"`                     // Repository directory; relative paths start in the user's home directory
+	KeyFile        string `json:"keyFile" yaml:"keyFile"`               // Private key; defaults to ~/.ssh/id_ed25519, id_ecdsa and id_rsa
+	KnownHostsFile string `json:"knownHostsFile" yaml:"knownHostsFile"` // Defaults to ~/.ssh/known_hosts
+}
+
+// IsRemoteLocation reports whether a backup destination is a URL such as
+// sftp://user@host/path rather than a local directory.
+func IsRemoteLocation(location string) bool {
+	return strings.HasPrefix(location, "sftp://")
+}
+
+// ParseSFTPURL parses a destination of the form sftp://user@host[:port]/path. A path
+// starting with /~/ is relative to the user's home directory on the server.
+func ParseSFTPURL(location string) (SFTPConfig, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return SFTPConfig{}, fmt.Errorf("invalid SFTP destination %q: %w", location, err)
+	}
+	if u.Scheme != "sftp" || u.Hostname() == "" {
+		return SFTPConfig{}, fmt.Errorf("invalid SFTP destination %q: expected sftp://user@host/path", location)
+	}
+
+	config := SFTPConfig{
+		Host: u.Hostname(),
+		Path: u.Path,
+	}
+	if u.User != nil {
+		config.User = u.User.Username()
+	}
+	if port := u.Port(); port != "" {
+		config.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return SFTPConfig{}, fmt.Errorf("invalid port in SFTP destination %q: %w", location, err)
+		}
+	}
+	if config.Path == "/~" || strings.HasPrefix(config.Path, "/~/") {
+		config.Path = strings.TrimPrefix(strings.TrimPrefix(config.Path, "/~"), "/")
+	}
+	return config, nil
+}
+
+// SFTPStorage keeps repository files in a directory on an SFTP server, with the same
+// layout as LocalStorage. Storages for the same server and user share one SSH connection.
+// Writes and reads are pipelined, and the storage can be used from several goroutines at once.
+type SFTPStorage struct {
+	config SFTPConfig
+	root   string
+	conn   *sftpConnection
+
+	dirsMu sync.Mutex
+	dirs   map[string]bool // Directories known to exist
+}
+
+// NewSFTPStorage connects to the server in config, or reuses an open connection to it.
+// Servers are authenticated against the known_hosts file, users with the keys of a running
+// SSH agent (SSH_AUTH_SOCK) and the configured or default private key files.
+func NewSFTPStorage(config SFTPConfig) (*SFTPStorage, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("SFTP host not set")
+	}
+	if config.Port == 0 {
+		config.Port = 22
+	}
+	if config.User == "" {
+		config.User = os.Getenv("USER")
+	}
+
+	conn, err := acquireSFTPConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	root := config.Path
+	if root == "" {
+		root = "."
+	}
+	return &SFTPStorage{
+		config: config,
+		root:   path.Clean(root),
+		conn:   conn,
+		dirs:   make(map[string]bool),
+	}, nil
+}
+
+// Location returns the destination as an sftp:// URL.
+func (s *SFTPStorage) Location() string {
+	p := s.root
+	if !path.IsAbs(p) {
+		p = "/~/" + p
+	}
+	return fmt.Sprintf("sftp://%s@%s%s", s.config.User, net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port)), p)
+}
+
+func (s *SFTPStorage) path(h Handle) string {
+	return path.Join(s.root, repositoryFilePath(h))
+}
+
+// RootExists reports whether the repository directory exists on the server.
+func (s *SFTPStorage) RootExists() (bool, error) {
+	info, err := s.conn.client.Stat(s.root)
+	if isNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", s.Location(), err)
+	}
+	return info.IsDir(), nil
+}
+
+// mkdirAll creates a directory and its parents, remembering which ones exist to save round trips.
+func (s *SFTPStorage) mkdirAll(dir string) error {
+	s.dirsMu.Lock()
+	known := s.dirs[dir]
+	s.dirsMu.Unlock()
+	if known {
+		return nil
+	}
+
+	if err := s.conn.client.MkdirAll(dir); err != nil {
+		return err
+	}
+	s.dirsMu.Lock()
+	s.dirs[dir] = true
+	s.dirsMu.Unlock()
+	return nil
+}
+
+// Save writes the file to a temporary file next to it, checks its size and renames it into
+// place, so that an interrupted upload never leaves a file under its final name.
+func (s *SFTPStorage) Save(ctx context.Context, h Handle, rd io.Reader) error {
+	client := s.conn.client
+	p := s.path(h)
+	if err := s.mkdirAll(path.Dir(p)); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", h, err)
+	}
+
+	suffix, err := randomName()
+	if err != nil {
+		return err
+	}
+	tempPath := p + "." + suffix[:16] + ".tmp"
+	file, err := client.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", h, err)
+	}
+	success := false
+	defer func() {
+		if !success {
+			file.Close()
+			client.Remove(tempPath)
+		}
+	}()
+
+	written, err := file.ReadFrom(&contextReader{ctx: ctx, r: rd})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", h, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file for %s: %w", h, err)
+	}
+	if h.Type == KeyFile {
+		if err := client.Chmod(tempPath, 0600); err != nil {
+			return fmt.Errorf("failed to set permissions for %s: %w", h, err)
+		}
+	}
+	info, err := client.Stat(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to check upload of %s: %w", h, err)
+	}
+	if info.Size() != written {
+		return fmt.Errorf("upload of %s is incomplete: %d of %d bytes written", h, info.Size(), written)
+	}
+
+	if err := s.rename(tempPath, p); err != nil {
+		return fmt.Errorf("failed to rename temporary file for %s: %w", h, err)
+	}
+	success = true
+	return nil
+}
+
+// rename replaces newPath with oldPath, atomically if the server supports the POSIX
+// rename extension. Plain SFTP renames fail if the target exists.
+func (s *SFTPStorage) rename(oldPath, newPath string) error {
+	client := s.conn.client
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+	if err := client.Remove(newPath); err != nil && !isNotExist(err) {
+		return err
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+// Load opens the file and returns a reader over the requested range.
+func (s *SFTPStorage) Load(ctx context.Context, h Handle, offset, length int64) (io.ReadCloser, error) {
+	file, err := s.conn.client.Open(s.path(h))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length > 0 {
+		return &readCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+	}
+	return file, nil
+}
+
+// Stat returns the size and modification time of the file.
+func (s *SFTPStorage) Stat(ctx context.Context, h Handle) (StorageFileInfo, error) {
+	info, err := s.conn.client.Stat(s.path(h))
+	if err != nil {
+		return StorageFileInfo{}, err
+	}
+	return StorageFileInfo{Name: h.Name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Remove deletes the file.
+func (s *SFTPStorage) Remove(ctx context.Context, h Handle) error {
+	return s.conn.client.Remove(s.path(h))
+}
+
+// List walks the directory for the file type, skipping temporary files.
+func (s *SFTPStorage) List(ctx context.Context, t FileType, fn func(StorageFileInfo) error) error {
+	if t == ConfigFile {
+		return listConfigFile(ctx, s, fn)
+	}
+
+	root := path.Join(s.root, string(t))
+	walker := s.conn.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		name, ok := repositoryFileName(t, info.Name())
+		if !ok {
+			continue
+		}
+		if err := fn(StorageFileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FreeSpace returns the bytes available on the server's filesystem holding the repository.
+// It needs the statvfs extension, which OpenSSH servers provide.
+func (s *SFTPStorage) FreeSpace(ctx context.Context) (int64, error) {
+	client := s.conn.client
+	if _, ok := client.HasExtension("statvfs@openssh.com"); !ok {
+		return 0, errFreeSpaceUnknown
+	}
+	st, err := client.StatVFS(s.root)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Frsize * st.Bavail), nil
+}
+
+// SweepTempFiles removes temporary files left behind by interrupted uploads.
+// Files changed within tempFileMaxAge are kept since they may still be being written.
+func (s *SFTPStorage) SweepTempFiles() (int, error) {
+	client := s.conn.client
+	cutoff := time.Now().Add(-tempFileMaxAge)
+	removed := 0
+
+	for _, t := range repositoryDirTypes {
+		walker := client.Walk(path.Join(s.root, string(t)))
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if isNotExist(err) {
+					continue
+				}
+				return removed, fmt.Errorf("failed to sweep temporary files in %s: %w", s.Location(), err)
+			}
+			info := walker.Stat()
+			if info.IsDir() || !strings.HasSuffix(info.Name(), ".tmp") || info.ModTime().After(cutoff) {
+				continue
+			}
+			if err := client.Remove(walker.Path()); err != nil && !isNotExist(err) {
+				return removed, fmt.Errorf("failed to remove temporary file %s: %w", walker.Path(), err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Close releases the storage's use of the shared connection.
+func (s *SFTPStorage) Close() error {
+	if s.conn != nil {
+		releaseSFTPConnection(s.conn)
+		s.conn = nil
+	}
+	return nil
+}
+
+// sftpConnection is an SSH connection with an SFTP session, shared by the storages for
+// the same server, user and credentials.
+type sftpConnection struct {
+	key    string
+	ssh    *ssh.Client
+	client *sftp.Client
+	refs   int
+	idle   *time.Timer
+}
+
+var (
+	sftpConnectionsMu sync.Mutex
+	sftpConnections   = make(map[string]*sftpConnection)
+)
+
+// acquireSFTPConnection returns the open connection for config, or dials a new one.
+func acquireSFTPConnection(config SFTPConfig) (*sftpConnection, error) {
+	key := fmt.Sprintf("%s@%s:%d|%s|%s", config.User, config.Host, config.Port, config.KeyFile, config.KnownHostsFile)
+
+	sftpConnectionsMu.Lock()
+	defer sftpConnectionsMu.Unlock()
+
+	if conn, ok := sftpConnections[key]; ok {
+		if conn.idle != nil {
+			conn.idle.Stop()
+			conn.idle = nil
+		}
+		conn.refs++
+		return conn, nil
+	}
+
+	conn, err := dialSFTP(config)
+	if err != nil {
+		return nil, err
+	}
+	conn.key = key
+	conn.refs = 1
+	sftpConnections[key] = conn
+
+	// Forget the connection once it breaks, so that the next storage dials again
+	go func() {
+		conn.ssh.Wait()
+		sftpConnectionsMu.Lock()
+		if sftpConnections[key] == conn {
+			delete(sftpConnections, key)
+		}
+		sftpConnectionsMu.Unlock()
+	}()
+	return conn, nil
+}
+
+// releaseSFTPConnection drops a reference to conn and closes it once it has been idle for sftpIdleTimeout.
+func releaseSFTPConnection(conn *sftpConnection) {
+	sftpConnectionsMu.Lock()
+	defer sftpConnectionsMu.Unlock()
+
+	conn.refs--
+	if conn.refs > 0 {
+		return
+	}
+	conn.idle = time.AfterFunc(sftpIdleTimeout, func() {
+		sftpConnectionsMu.Lock()
+		defer sftpConnectionsMu.Unlock()
+		if conn.refs > 0 {
+			return
+		}
+		if sftpConnections[conn.key] == conn {
+			delete(sftpConnections, conn.key)
+		}
+		conn.client.Close()
+		conn.ssh.Close()
+	})
+}
+
+// dialSFTP opens an SSH connection and starts an SFTP session on it.
+func dialSFTP(config SFTPConfig) (*sftpConnection, error) {
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts file: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts from %s: %w", knownHostsFile, err)
+	}
+
+	auth, closeAgent, err := sftpAuthMethods(config)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("failed to connect to %s: host key is not in %s; connect once with ssh to add it: %w", addr, knownHostsFile, err)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	session, err := sftp.NewClient(client,
+		sftp.UseConcurrentWrites(true),
+		sftp.UseConcurrentReads(true),
+		sftp.MaxConcurrentRequestsPerFile(sftpConcurrentRequests),
+	)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", addr, err)
+	}
+	return &sftpConnection{ssh: client, client: session}, nil
+}
+
+// sftpAuthMethods returns the SSH agent's keys, if an agent is running, followed by the
+// keys from the configured or default key files. The returned function closes the
+// connection to the agent; it is only needed during the handshake.
+func sftpAuthMethods(config SFTPConfig) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAgent = func() { conn.Close() }
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to connect to SSH agent: %v\n", err)
+		}
+	}
+
+	keyFiles := []string{config.KeyFile}
+	if config.KeyFile == "" {
+		keyFiles = nil
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			if os.IsNotExist(err) && config.KeyFile == "" {
+				continue // Default key files are optional
+			}
+			closeAgent()
+			return nil, nil, fmt.Errorf("failed to read SSH key %s: %w", keyFile, err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			var passphraseErr *ssh.PassphraseMissingError
+			if errors.As(err, &passphraseErr) && config.KeyFile == "" {
+				continue // Protected default keys are expected to be loaded into the agent
+			}
+			closeAgent()
+			return nil, nil, fmt.Errorf("failed to parse SSH key %s: %w", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, fmt.Errorf("no SSH keys available: start an SSH agent or configure a key file")
+	}
+	return methods, closeAgent, nil
+}
+
+// CheckRemoteLocation connects to a remote destination such as sftp://user@host/path and
+// reports whether its directory exists.
+func CheckRemoteLocation(location string) (bool, error) {
+	config, err := ParseSFTPURL(location)
+	if err != nil {
+		return false, err
+	}
+	storage, err := NewSFTPStorage(config)
+	if err != nil {
+		return false, err
+	}
+	defer storage.Close()
+	return storage.RootExists()
+}
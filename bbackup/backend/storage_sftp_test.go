@@ -0,0 +1,253 @@
+package backend
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server that serves SFTP for a single user key
+type testSFTPServer struct {
+	addr        string
+	connections atomic.Int32
+}
+
+// startTestSFTPServer starts an SSH server that accepts the public key of user and
+// records its own host key in knownHostsFile
+func startTestSFTPServer(t *testing.T, user ssh.PublicKey, knownHostsFile string) *testSFTPServer {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("Failed to create host signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(user.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &testSFTPServer{addr: listener.Addr().String()}
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+			go serveTestSFTPConnection(conn, config)
+		}
+	}()
+	return server
+}
+
+func serveTestSFTPConnection(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(isSFTP, nil)
+				if !isSFTP {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				channel.Close()
+				return
+			}
+		}()
+	}
+}
+
+// newTestSSHKey generates a key pair and writes the private key to a file in dir
+func newTestSSHKey(t *testing.T, dir string) (ssh.Signer, ed25519.PrivateKey, string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return signer, priv, keyFile
+}
+
+// TestSFTPStorageBackupAndDeploy runs a backup over SFTP with key file authentication and
+// checks that the repository on the server has the local layout and that connections are reused
+func TestSFTPStorageBackupAndDeploy(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	sshDir := t.TempDir()
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	signer, _, keyFile := newTestSSHKey(t, sshDir)
+	knownHostsFile := filepath.Join(sshDir, "known_hosts")
+	server := startTestSFTPServer(t, signer.PublicKey(), knownHostsFile)
+
+	host, port, _ := net.SplitHostPort(server.addr)
+	config, err := ParseSFTPURL(fmt.Sprintf("sftp://tester@%s:%s%s", host, port, repoDir))
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	config.KeyFile = keyFile
+	config.KnownHostsFile = knownHostsFile
+
+	repo, err := InitRepositoryWithConfig("", StorageConfig{SFTP: &config}, "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	testBackupAndDeploy(t, repo)
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Failed to close repository: %v", err)
+	}
+
+	// The repository can be opened directly from the server's disk
+	found, err := hasFiles(context.Background(), NewLocalStorage(repoDir), PackFile)
+	if err != nil || !found {
+		t.Errorf("Expected pack files in %s (err=%v)", repoDir, err)
+	}
+	ids, err := (&Repository{storage: NewLocalStorage(repoDir)}).listFiles(context.Background(), SnapshotFile)
+	if err != nil || len(ids) != 1 {
+		t.Errorf("Expected one snapshot on disk, got %v (err=%v)", ids, err)
+	}
+
+	reopened, err := OpenRepositoryWithConfig("", StorageConfig{SFTP: &config}, "")
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	reopened.Close()
+	if n := server.connections.Load(); n != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", n)
+	}
+
+	wrongKey := config
+	_, _, wrongKey.KeyFile = newTestSSHKey(t, t.TempDir())
+	if _, err := NewSFTPStorage(wrongKey); err == nil {
+		t.Errorf("Expected authentication with an unknown key to fail")
+	}
+}
+
+// TestSFTPAgentAuthentication checks that keys are taken from the SSH agent and that
+// destinations given as URLs use the default known_hosts file
+func TestSFTPAgentAuthentication(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		t.Fatalf("Failed to create .ssh: %v", err)
+	}
+	signer, priv, keyFile := newTestSSHKey(t, t.TempDir())
+	os.Remove(keyFile) // Only the agent has the key
+	server := startTestSFTPServer(t, signer.PublicKey(), filepath.Join(sshDir, "known_hosts"))
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatalf("Failed to add key to agent: %v", err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen on agent socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	repoDir := t.TempDir()
+	location := fmt.Sprintf("sftp://agent-user@%s%s", server.addr, repoDir)
+	if ok, err := CheckRemoteLocation(location); err != nil || !ok {
+		t.Fatalf("Expected %s to be accessible, got %v (err=%v)", location, ok, err)
+	}
+	if ok, err := CheckRemoteLocation(location + "/missing"); err != nil || ok {
+		t.Errorf("Expected a missing directory to be reported, got %v (err=%v)", ok, err)
+	}
+
+	storage, err := OpenStorage(location)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+	if _, ok := storage.(*SFTPStorage); !ok {
+		t.Fatalf("Expected SFTP storage for %s, got %T", location, storage)
+	}
+	failing := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection lost")))
+	if err := storage.Save(context.Background(), Handle{Type: LockFile, Name: "test"}, failing); err == nil {
+		t.Fatalf("Expected a failing upload to return an error")
+	}
+	entries, err := os.ReadDir(filepath.Join(repoDir, string(LockFile)))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected no files after a failed upload, got %v (err=%v)", entries, err)
+	}
+}
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMemoryStorageBackupAndDeploy runs a backup into an in-memory repository and deploys it back
+func TestMemoryStorageBackupAndDeploy(t *testing.T) {
+	storage := NewMemoryStorage()
+	repo, err := InitRepository(storage, DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	defer repo.Close()
+
+	testBackupAndDeploy(t, repo)
+	if found, err := hasFiles(context.Background(), storage, PackFile); err != nil || !found {
+		t.Errorf("Expected pack files in memory storage (err=%v)", err)
+	}
+}
+
+// testBackupAndDeploy backs up a small tree into repo, deploys the snapshot to a new
+// directory and checks that the files come back unchanged
+func testBackupAndDeploy(t *testing.T, repo *Repository) {
+	t.Helper()
+	ctx := context.Background()
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	files := map[string][]byte{
+		"small.txt":      []byte("hello from a storage backend\n"),
+		"nested/big.bin": bytes.Repeat([]byte("0123456789abcdef"), 256*1024),
+	}
+	for name, data := range files {
+		path := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+	}
+
+	err := RunRepositoryBackup(ctx, repo, []string{sourceDir}, nil, NewMapFileTracker(nil), nil, DefaultBatchConfig())
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	ids, err := repo.listFiles(ctx, SnapshotFile)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("Expected one snapshot, got %v (err=%v)", ids, err)
+	}
+
+	config := DeploymentConfig{
+		SnapshotPath: ids[0] + ".json",
+		TargetPath:   targetDir,
+		UseHardLinks: true,
+	}
+	if err := DeployFromRepository(ctx, repo, config, func(DeploymentProgress) {}); err != nil {
+		t.Fatalf("Deploy failed: %v", err)
+	}
+
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(targetDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read deployed %s: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Content mismatch for %s: got %d bytes, expected %d", name, len(got), len(data))
+		}
+	}
+}
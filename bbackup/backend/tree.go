@@ -0,0 +1,638 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshots written by backups are trees: every directory is a tree object that lists its
+// files and the tree IDs of its subdirectories, and the snapshot only records the root tree
+// of each source. Trees are stored like any other object, named by the hash of their
+// content, so a directory that didn't change between backups is the same object in both
+// snapshots and is stored once. Walks that have seen a tree before can skip it.
+//
+// Older snapshots list all their files in Snapshot.Files. Every function here accepts both.
+
+// Node types in a tree.
+const (
+	NodeFile    = "file"
+	NodeDir     = "dir"
+	NodeSymlink = "symlink"
+)
+
+// Tree is a directory of a snapshot.
+type Tree struct {
+	Nodes []TreeNode `json:"nodes"` // Sorted by name
+}
+
+// TreeNode is a file, a symlink or a subdirectory in a tree.
+type TreeNode struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`              // NodeFile, NodeDir or NodeSymlink
+	Subtree    string      `json:"subtree,omitempty"` // Tree ID of a directory
+	Hash       string      `json:"hash,omitempty"`    // Hash of the whole file content
+	Chunks     []string    `json:"chunks,omitempty"`  // Ordered chunk object IDs of a file
+	Size       int64       `json:"size,omitempty"`
+	LinkTarget string      `json:"link_target,omitempty"` // Target of a symlink
+	Mode       fs.FileMode `json:"mode,omitempty"`
+	ModTime    time.Time   `json:"mod_time"`
+}
+
+// entry returns the entry of a node at the given path. Entries of files have no type.
+func (n *TreeNode) entry(p string) *FileEntry {
+	entry := &FileEntry{Path: p, Hash: n.Hash, Chunks: n.Chunks, Size: n.Size, Mode: n.Mode, ModTime: n.ModTime, LinkTarget: n.LinkTarget}
+	if n.Type != NodeFile {
+		entry.Type = n.Type
+	}
+	return entry
+}
+
+// find returns the node with the given name, or nil.
+func (t *Tree) find(name string) *TreeNode {
+	i := sort.Search(len(t.Nodes), func(i int) bool { return t.Nodes[i].Name >= name })
+	if i < len(t.Nodes) && t.Nodes[i].Name == name {
+		return &t.Nodes[i]
+	}
+	return nil
+}
+
+// saveTree stores a tree as an object and returns its ID.
+func (r *Repository) saveTree(ctx context.Context, tree *Tree) (string, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tree: %w", err)
+	}
+	id := r.objectID(data)
+	if _, err := r.storeObject(ctx, id, data); err != nil {
+		return "", fmt.Errorf("failed to store tree %s: %w", id, err)
+	}
+	return id, nil
+}
+
+// LoadTree reads a tree object.
+func (r *Repository) LoadTree(ctx context.Context, id string) (*Tree, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rc, err := r.RetrieveObject(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree %s: %w", id, err)
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse tree %s: %w", id, err)
+	}
+	return &tree, nil
+}
+
+// treeBuilder builds the trees of one source from file entries, storing each directory as
+// soon as all its entries are in. Only the directories on the path of the last entry are
+// kept in memory. Entries must come directory by directory, as a walk of the source yields
+// them or as sorted paths do; a directory that shows up again after it was finished is an
+// error. Directories are made up from the paths of their entries; an entry of the directory
+// itself gives it its mode and modification time, and keeps it in the tree when it's empty.
+type treeBuilder struct {
+	store func(ctx context.Context, tree *Tree) (string, error)
+	stack []*openTree // Open directories from the root down
+}
+
+// openTree is a directory whose entries are still being added.
+type openTree struct {
+	path  string // "" for the root
+	nodes []TreeNode
+	dirs  map[string]int // Nodes of subdirectories added by their entry but not stored yet
+}
+
+func newTreeBuilder(store func(ctx context.Context, tree *Tree) (string, error)) *treeBuilder {
+	return &treeBuilder{store: store, stack: []*openTree{{}}}
+}
+
+func (b *treeBuilder) top() *openTree {
+	return b.stack[len(b.stack)-1]
+}
+
+// add adds a file entry, whose path is relative to the source root.
+func (b *treeBuilder) add(ctx context.Context, entry *FileEntry) error {
+	p := entry.Path
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("invalid path %q in snapshot", p)
+	}
+	dir, name := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+
+	// Finish the directories the entry is not in
+	for top := b.top(); top.path != "" && dir != top.path && !strings.HasPrefix(dir, top.path+"/"); top = b.top() {
+		if err := b.closeTop(ctx); err != nil {
+			return err
+		}
+	}
+	// Open the directories down to the entry's
+	for top := b.top(); top.path != dir; top = b.top() {
+		rest := strings.TrimPrefix(strings.TrimPrefix(dir, top.path), "/")
+		next, _, _ := strings.Cut(rest, "/")
+		b.stack = append(b.stack, &openTree{path: path.Join(top.path, next)})
+	}
+
+	top := b.top()
+	node := TreeNode{Name: name, Type: entry.NodeType(), Mode: entry.Mode, ModTime: entry.ModTime}
+	switch node.Type {
+	case NodeFile:
+		node.Hash, node.Chunks, node.Size = entry.Hash, entry.Chunks, entry.Size
+	case NodeSymlink:
+		node.LinkTarget = entry.LinkTarget
+	case NodeDir:
+		// The subtree is set once the directory is finished
+		if _, ok := top.dirs[name]; ok {
+			return fmt.Errorf("%s is in the snapshot twice", p)
+		}
+		if top.dirs == nil {
+			top.dirs = make(map[string]int)
+		}
+		top.dirs[name] = len(top.nodes)
+	default:
+		return fmt.Errorf("%s has unknown type %q", p, node.Type)
+	}
+	top.nodes = append(top.nodes, node)
+	return nil
+}
+
+// closeTop stores the innermost open directory and adds it to its parent.
+func (b *treeBuilder) closeTop(ctx context.Context) error {
+	dir := b.top()
+	b.stack = b.stack[:len(b.stack)-1]
+	id, err := b.storeTree(ctx, dir)
+	if err != nil {
+		return err
+	}
+	parent := b.top()
+	name := path.Base(dir.path)
+	if i, ok := parent.dirs[name]; ok {
+		delete(parent.dirs, name)
+		parent.nodes[i].Subtree = id
+		return nil
+	}
+	parent.nodes = append(parent.nodes, TreeNode{Name: name, Type: NodeDir, Subtree: id})
+	return nil
+}
+
+func (b *treeBuilder) storeTree(ctx context.Context, dir *openTree) (string, error) {
+	nodes := dir.nodes
+	if nodes == nil {
+		nodes = []TreeNode{}
+	}
+	// Directories that got no entries are empty
+	for _, i := range dir.dirs {
+		id, err := b.store(ctx, &Tree{Nodes: []TreeNode{}})
+		if err != nil {
+			return "", err
+		}
+		nodes[i].Subtree = id
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	for i := 1; i < len(nodes); i++ {
+		if nodes[i].Name == nodes[i-1].Name {
+			return "", fmt.Errorf("%s is in the snapshot twice; entries of a directory must be added together", path.Join(dir.path, nodes[i].Name))
+		}
+	}
+	return b.store(ctx, &Tree{Nodes: nodes})
+}
+
+// finish stores the remaining directories and returns the ID of the root tree. The builder
+// can then be used for another source.
+func (b *treeBuilder) finish(ctx context.Context) (string, error) {
+	for len(b.stack) > 1 {
+		if err := b.closeTop(ctx); err != nil {
+			return "", err
+		}
+	}
+	id, err := b.storeTree(ctx, b.top())
+	if err != nil {
+		return "", err
+	}
+	b.stack = []*openTree{{}}
+	return id, nil
+}
+
+// treeWalker walks snapshot trees depth first, in name order.
+type treeWalker struct {
+	load func(ctx context.Context, id string) (*Tree, error)
+	// visited, if set, records the trees walked so far; they are skipped when seen again,
+	// so directories shared between snapshots are only read once
+	visited map[string]bool
+	tree    func(id, dir string) error   // Called before a tree is read; may be nil
+	file    func(entry *FileEntry) error // Called for every file and symlink; may be nil
+}
+
+func (w *treeWalker) walk(ctx context.Context, id, dir string) error {
+	if w.visited[id] {
+		return nil
+	}
+	if w.tree != nil {
+		if err := w.tree(id, dir); err != nil {
+			return err
+		}
+	}
+	tree, err := w.load(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to read tree of /%s: %w", dir, err)
+	}
+	for i := range tree.Nodes {
+		node := &tree.Nodes[i]
+		p := path.Join(dir, node.Name)
+		if node.Type == NodeDir {
+			if err := w.walk(ctx, node.Subtree, p); err != nil {
+				return err
+			}
+		} else if w.file != nil {
+			if err := w.file(node.entry(p)); err != nil {
+				return err
+			}
+		}
+	}
+	if w.visited != nil {
+		w.visited[id] = true
+	}
+	return nil
+}
+
+// walkSnapshot walks the files of a snapshot, and its trees if it has them, with w.
+func (r *Repository) walkSnapshot(ctx context.Context, snapshot *Snapshot, w *treeWalker) error {
+	if len(snapshot.Roots) == 0 {
+		for _, p := range sortedFilePaths(snapshot.Files) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if entry := snapshot.Files[p]; w.file != nil && entry.NodeType() != NodeDir {
+				if err := w.file(entry); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if w.load == nil {
+		w.load = r.LoadTree
+	}
+	for _, root := range snapshot.Roots {
+		if err := w.walk(ctx, root, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkSnapshot calls fn for every entry of a snapshot, source by source in path order, a
+// directory before its content. Entry paths are relative to their source.
+func (r *Repository) WalkSnapshot(ctx context.Context, snapshot *Snapshot, fn func(entry *FileEntry) error) error {
+	return r.NewSnapshotReader(ctx, snapshot).Each(fn)
+}
+
+func sortedFilePaths(files map[string]*FileEntry) []string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// snapshotRoots returns the root trees of a snapshot and a function that reads its trees.
+// A snapshot that lists its files is turned into a single tree in memory.
+func (r *Repository) snapshotRoots(ctx context.Context, snapshot *Snapshot) ([]string, func(context.Context, string) (*Tree, error), error) {
+	if len(snapshot.Roots) > 0 {
+		return snapshot.Roots, r.LoadTree, nil
+	}
+	trees := make(map[string]*Tree)
+	builder := newTreeBuilder(func(ctx context.Context, tree *Tree) (string, error) {
+		data, err := json.Marshal(tree)
+		if err != nil {
+			return "", err
+		}
+		id := sha256Hex(data)
+		trees[id] = tree
+		return id, nil
+	})
+	for _, p := range sortedFilePaths(snapshot.Files) {
+		entry := *snapshot.Files[p]
+		entry.Path = p
+		if err := builder.add(ctx, &entry); err != nil {
+			return nil, nil, err
+		}
+	}
+	root, err := builder.finish(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	load := func(ctx context.Context, id string) (*Tree, error) {
+		if tree, ok := trees[id]; ok {
+			return tree, nil
+		}
+		return nil, fmt.Errorf("tree %s: %w", id, fs.ErrNotExist)
+	}
+	return []string{root}, load, nil
+}
+
+// ListSnapshotDir returns the files and subdirectories of a directory of a snapshot, with
+// dir relative to the given source ("" for its root). Only the trees on the way are read.
+// A snapshot that lists its files has a single source holding all of them.
+func (r *Repository) ListSnapshotDir(ctx context.Context, snapshot *Snapshot, source int, dir string) ([]TreeNode, error) {
+	roots, load, err := r.snapshotRoots(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if source < 0 || source >= len(roots) {
+		return nil, fmt.Errorf("snapshot %s has no source %d", snapshot.ID, source)
+	}
+	tree, err := load(ctx, roots[source])
+	if err != nil {
+		return nil, err
+	}
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	if dir != "" {
+		for _, name := range strings.Split(dir, "/") {
+			node := tree.find(name)
+			if node == nil || node.Type != NodeDir {
+				return nil, fmt.Errorf("%s is not a directory in snapshot %s: %w", dir, snapshot.ID, fs.ErrNotExist)
+			}
+			if tree, err = load(ctx, node.Subtree); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tree.Nodes, nil
+}
+
+// SnapshotFile returns the entry of a file of a snapshot by its path relative to its
+// source, looking in every source. It returns an error wrapping fs.ErrNotExist if there
+// is no such file.
+func (r *Repository) SnapshotFile(ctx context.Context, snapshot *Snapshot, p string) (*FileEntry, error) {
+	if len(snapshot.Roots) == 0 {
+		if entry, ok := snapshot.Files[p]; ok {
+			return entry, nil
+		}
+		return nil, fmt.Errorf("%s is not in snapshot %s: %w", p, snapshot.ID, fs.ErrNotExist)
+	}
+	lookup := r.newSnapshotLookup(snapshot)
+	for _, source := range snapshot.Source {
+		entry, err := lookup.lookup(ctx, source, p)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+	}
+	return nil, fmt.Errorf("%s is not in snapshot %s: %w", p, snapshot.ID, fs.ErrNotExist)
+}
+
+// maxCachedTrees bounds the trees a snapshotLookup keeps.
+const maxCachedTrees = 256
+
+// snapshotLookup finds files of a snapshot by source and path, reading only the trees on
+// the way. Lookups in walk order mostly hit the directory found last.
+type snapshotLookup struct {
+	repo     *Repository
+	snapshot *Snapshot
+	roots    map[string]string // Root tree by source path
+	trees    map[string]*Tree  // Recently read trees by ID
+	dirKey   string            // Source and directory of dir
+	dir      *Tree             // Nil if the directory isn't in the snapshot
+}
+
+// newSnapshotLookup returns a lookup in snapshot, which may be nil to find nothing.
+func (r *Repository) newSnapshotLookup(snapshot *Snapshot) *snapshotLookup {
+	l := &snapshotLookup{repo: r, snapshot: snapshot, roots: make(map[string]string), trees: make(map[string]*Tree)}
+	if snapshot != nil {
+		for i, root := range snapshot.Roots {
+			if i < len(snapshot.Source) {
+				l.roots[snapshot.Source[i]] = root
+			}
+		}
+	}
+	return l
+}
+
+// lookup returns the entry of the file at relPath in the given source, or nil if there
+// is none.
+func (l *snapshotLookup) lookup(ctx context.Context, source, relPath string) (*FileEntry, error) {
+	if l.snapshot == nil {
+		return nil, nil
+	}
+	if len(l.snapshot.Roots) == 0 {
+		if entry := l.snapshot.Files[relPath]; entry != nil && entry.NodeType() == NodeFile {
+			return entry, nil
+		}
+		return nil, nil
+	}
+	root, ok := l.roots[source]
+	if !ok {
+		return nil, nil
+	}
+
+	dir, name := path.Split(relPath)
+	dir = strings.TrimSuffix(dir, "/")
+	if key := source + "\x00" + dir; key != l.dirKey {
+		tree, err := l.resolve(ctx, root, dir)
+		if err != nil {
+			return nil, err
+		}
+		l.dirKey, l.dir = key, tree
+	}
+	if l.dir == nil {
+		return nil, nil
+	}
+	node := l.dir.find(name)
+	if node == nil || node.Type != NodeFile {
+		return nil, nil
+	}
+	return node.entry(relPath), nil
+}
+
+// resolve returns the tree of dir under root, or nil if it isn't a directory there.
+func (l *snapshotLookup) resolve(ctx context.Context, root, dir string) (*Tree, error) {
+	tree, err := l.load(ctx, root)
+	if err != nil || dir == "" {
+		return tree, err
+	}
+	for _, name := range strings.Split(dir, "/") {
+		node := tree.find(name)
+		if node == nil || node.Type != NodeDir {
+			return nil, nil
+		}
+		if tree, err = l.load(ctx, node.Subtree); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+func (l *snapshotLookup) load(ctx context.Context, id string) (*Tree, error) {
+	if tree, ok := l.trees[id]; ok {
+		return tree, nil
+	}
+	tree, err := l.repo.LoadTree(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trees) >= maxCachedTrees {
+		l.trees = make(map[string]*Tree)
+	}
+	l.trees[id] = tree
+	return tree, nil
+}
+
+// Kinds of SnapshotChange.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified" // Content changed
+	ChangeMetadata = "metadata" // Only the mode or modification time changed
+)
+
+// SnapshotChange is a file or symlink that differs between two snapshots.
+type SnapshotChange struct {
+	Source int        `json:"source"` // Index of the source the file is in
+	Path   string     `json:"path"`   // Path relative to the source
+	Change string     `json:"change"` // ChangeAdded, ChangeRemoved, ChangeModified or ChangeMetadata
+	Old    *FileEntry `json:"old,omitempty"`
+	New    *FileEntry `json:"new,omitempty"`
+}
+
+// DiffSnapshots calls fn for every file or symlink that was added, removed or changed from
+// old to new, comparing the sources in order. Directories with the same tree in both
+// snapshots are skipped without reading them.
+func (r *Repository) DiffSnapshots(ctx context.Context, old, new *Snapshot, fn func(SnapshotChange) error) error {
+	oldRoots, oldLoad, err := r.snapshotRoots(ctx, old)
+	if err != nil {
+		return err
+	}
+	newRoots, newLoad, err := r.snapshotRoots(ctx, new)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(oldRoots) || i < len(newRoots); i++ {
+		d := &treeDiff{oldLoad: oldLoad, newLoad: newLoad, source: i, fn: fn}
+		var oldRoot, newRoot string
+		if i < len(oldRoots) {
+			oldRoot = oldRoots[i]
+		}
+		if i < len(newRoots) {
+			newRoot = newRoots[i]
+		}
+		if err := d.diff(ctx, oldRoot, newRoot, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeDiff compares the trees of two snapshots.
+type treeDiff struct {
+	oldLoad, newLoad func(context.Context, string) (*Tree, error)
+	source           int
+	fn               func(SnapshotChange) error
+}
+
+// diff compares two trees; an empty ID stands for a missing directory.
+func (d *treeDiff) diff(ctx context.Context, oldID, newID, dir string) error {
+	if oldID == newID {
+		return nil
+	}
+	oldTree, newTree := &Tree{}, &Tree{}
+	var err error
+	if oldID != "" {
+		if oldTree, err = d.oldLoad(ctx, oldID); err != nil {
+			return err
+		}
+	}
+	if newID != "" {
+		if newTree, err = d.newLoad(ctx, newID); err != nil {
+			return err
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(oldTree.Nodes) || j < len(newTree.Nodes) {
+		var o, n *TreeNode
+		switch {
+		case j == len(newTree.Nodes) || (i < len(oldTree.Nodes) && oldTree.Nodes[i].Name < newTree.Nodes[j].Name):
+			o = &oldTree.Nodes[i]
+			i++
+		case i == len(oldTree.Nodes) || newTree.Nodes[j].Name < oldTree.Nodes[i].Name:
+			n = &newTree.Nodes[j]
+			j++
+		default:
+			o, n = &oldTree.Nodes[i], &newTree.Nodes[j]
+			i++
+			j++
+		}
+		if err := d.diffNodes(ctx, o, n, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffNodes compares two nodes of the same name; either may be nil.
+func (d *treeDiff) diffNodes(ctx context.Context, o, n *TreeNode, dir string) error {
+	var p string
+	if o != nil {
+		p = path.Join(dir, o.Name)
+	} else {
+		p = path.Join(dir, n.Name)
+	}
+	if o != nil && n != nil && o.Type == NodeDir && n.Type == NodeDir {
+		return d.diff(ctx, o.Subtree, n.Subtree, p)
+	}
+	if o != nil && n != nil && o.Type == n.Type && o.Type != NodeDir {
+		change := ""
+		if o.Hash != n.Hash || o.Size != n.Size || o.LinkTarget != n.LinkTarget {
+			change = ChangeModified
+		} else if o.Mode != n.Mode || !o.ModTime.Equal(n.ModTime) {
+			change = ChangeMetadata
+		}
+		if change == "" {
+			return nil
+		}
+		return d.fn(SnapshotChange{Source: d.source, Path: p, Change: change, Old: o.entry(p), New: n.entry(p)})
+	}
+	// Added, removed, or replaced by a node of another type
+	if o != nil {
+		if err := d.report(ctx, o, p, ChangeRemoved, d.oldLoad); err != nil {
+			return err
+		}
+	}
+	if n != nil {
+		if err := d.report(ctx, n, p, ChangeAdded, d.newLoad); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report reports a node and, for a directory, every file in it as added or removed.
+func (d *treeDiff) report(ctx context.Context, node *TreeNode, p, change string, load func(context.Context, string) (*Tree, error)) error {
+	emit := func(entry *FileEntry) error {
+		c := SnapshotChange{Source: d.source, Path: entry.Path, Change: change}
+		if change == ChangeAdded {
+			c.New = entry
+		} else {
+			c.Old = entry
+		}
+		return d.fn(c)
+	}
+	if node.Type != NodeDir {
+		return emit(node.entry(p))
+	}
+	w := &treeWalker{load: load, file: emit}
+	return w.walk(ctx, node.Subtree, p)
+}
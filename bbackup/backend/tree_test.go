@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTreeSnapshots checks that snapshots are stored as trees that share unchanged
+// directories, and that they can be browsed, diffed, looked up, checked, pruned and copied
+func TestTreeSnapshots(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "")
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	sourceDir := t.TempDir()
+	modTime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	backup := func(id string, files map[string]string) *Snapshot {
+		writer, err := repo.NewStreamingSnapshotWriter(id, []string{sourceDir})
+		if err != nil {
+			t.Fatalf("Failed to create snapshot writer: %v", err)
+		}
+		paths := make([]string, 0, len(files))
+		for p := range files {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, []byte(files[p]), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			stored, err := repo.StoreFile(ctx, path)
+			if err != nil {
+				t.Fatalf("Failed to store %s: %v", p, err)
+			}
+			if err := writer.AddFile(&FileEntry{Path: p, Hash: stored.Hash, Chunks: stored.Chunks, Size: stored.Size, Mode: 0644, ModTime: modTime}); err != nil {
+				t.Fatalf("Failed to add %s: %v", p, err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close snapshot writer: %v", err)
+		}
+		snapshot, err := repo.LoadSnapshot(id)
+		if err != nil {
+			t.Fatalf("Failed to load snapshot %s: %v", id, err)
+		}
+		return snapshot
+	}
+
+	first := backup("20250101000000", map[string]string{"a/x.txt": "x1", "a/y.txt": "y", "b/c/z.txt": "z", "top.txt": "top"})
+	second := backup("20250102000000", map[string]string{"a/x.txt": "x2", "a/y.txt": "y", "b/c/z.txt": "z", "d/e.txt": "e"})
+	if len(first.Roots) != 1 || len(first.Files) != 0 {
+		t.Fatalf("Expected one root tree and no file list, got %+v", first)
+	}
+
+	root, err := repo.ListSnapshotDir(ctx, first, 0, "")
+	if err != nil {
+		t.Fatalf("Failed to list root: %v", err)
+	}
+	var names []string
+	for _, node := range root {
+		names = append(names, node.Name+":"+node.Type)
+	}
+	if strings.Join(names, " ") != "a:dir b:dir top.txt:file" {
+		t.Errorf("Unexpected root listing %v", names)
+	}
+	if nodes, err := repo.ListSnapshotDir(ctx, first, 0, "b/c"); err != nil || len(nodes) != 1 || nodes[0].Name != "z.txt" {
+		t.Errorf("Unexpected listing of b/c: %+v (err=%v)", nodes, err)
+	}
+	if _, err := repo.ListSnapshotDir(ctx, first, 0, "top.txt"); !isNotExist(err) {
+		t.Errorf("Expected listing a file to fail, got %v", err)
+	}
+
+	// The unchanged directory is the same tree in both snapshots
+	subtree := func(snapshot *Snapshot, name string) string {
+		nodes, err := repo.ListSnapshotDir(ctx, snapshot, 0, "")
+		if err != nil {
+			t.Fatalf("Failed to list root: %v", err)
+		}
+		for _, node := range nodes {
+			if node.Name == name {
+				return node.Subtree
+			}
+		}
+		return ""
+	}
+	if b := subtree(first, "b"); b == "" || b != subtree(second, "b") {
+		t.Errorf("Expected b to be shared, got %q and %q", b, subtree(second, "b"))
+	}
+	if subtree(first, "a") == subtree(second, "a") {
+		t.Errorf("Expected a to differ")
+	}
+
+	var changes []string
+	err = repo.DiffSnapshots(ctx, first, second, func(change SnapshotChange) error {
+		changes = append(changes, change.Change+" "+change.Path)
+		return nil
+	})
+	if err != nil || strings.Join(changes, ", ") != "modified a/x.txt, added d/e.txt, removed top.txt" {
+		t.Errorf("Unexpected diff %v (err=%v)", changes, err)
+	}
+
+	entry, err := repo.SnapshotFile(ctx, second, "a/x.txt")
+	if err != nil {
+		t.Fatalf("Failed to find a/x.txt: %v", err)
+	}
+	rc, err := repo.RetrieveFile(entry)
+	if err != nil {
+		t.Fatalf("Failed to retrieve a/x.txt: %v", err)
+	}
+	content, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(content) != "x2" {
+		t.Errorf("Expected the second version of a/x.txt, got %q", content)
+	}
+	lookup := repo.newSnapshotLookup(first)
+	if entry, err := lookup.lookup(ctx, sourceDir, "b/c/z.txt"); err != nil || entry == nil || entry.Size != 1 {
+		t.Errorf("Expected to find b/c/z.txt, got %+v (err=%v)", entry, err)
+	}
+	for _, p := range []string{"b/c/missing", "b/c", "b/c/z.txt/x"} {
+		if entry, err := lookup.lookup(ctx, sourceDir, p); err != nil || entry != nil {
+			t.Errorf("Expected no entry for %s, got %+v (err=%v)", p, entry, err)
+		}
+	}
+	if entry, _ := lookup.lookup(ctx, "/elsewhere", "top.txt"); entry != nil {
+		t.Errorf("Expected no entry in another source, got %+v", entry)
+	}
+
+	report, err := repo.Check(ctx, CheckOptions{ReadDataPercent: 100}, nil)
+	if err != nil || !report.OK() || len(report.OrphanedObjects) != 0 {
+		t.Errorf("Expected the check to pass with no orphans, got %+v (err=%v)", report, err)
+	}
+
+	// Without the first snapshot, its own trees are no longer referenced but shared ones are
+	if err := repo.storage.Remove(ctx, Handle{Type: SnapshotFile, Name: first.ID}); err != nil {
+		t.Fatalf("Failed to remove snapshot: %v", err)
+	}
+	referenced, _, err := repo.referencedObjects(ctx)
+	if err != nil {
+		t.Fatalf("Failed to find referenced objects: %v", err)
+	}
+	if referenced[first.Roots[0]] || referenced[subtree(first, "a")] || !referenced[subtree(first, "b")] || !referenced[second.Roots[0]] {
+		t.Errorf("Unexpected referenced trees")
+	}
+
+	// Copied to an encrypted repository, trees are renamed along with the objects
+	dst, err := InitRepository(NewMemoryStorage(), DefaultRepoConfig(), "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to init destination: %v", err)
+	}
+	if _, err := repo.CopySnapshots(ctx, dst, SnapshotFilter{}, nil); err != nil {
+		t.Fatalf("Failed to copy snapshots: %v", err)
+	}
+	copied, err := dst.LoadSnapshot(second.ID)
+	if err != nil {
+		t.Fatalf("Failed to load copied snapshot: %v", err)
+	}
+	if copied.Roots[0] == second.Roots[0] {
+		t.Errorf("Expected the copied root tree to be renamed")
+	}
+	entry, err = dst.SnapshotFile(ctx, copied, "b/c/z.txt")
+	if err != nil {
+		t.Fatalf("Failed to find b/c/z.txt in the copy: %v", err)
+	}
+	if rc, err = dst.RetrieveFile(entry); err != nil {
+		t.Fatalf("Failed to retrieve copied file: %v", err)
+	}
+	content, _ = io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(content, []byte("z")) {
+		t.Errorf("Copied content differs: %q", content)
+	}
+	if report, err := dst.Check(ctx, CheckOptions{ReadDataPercent: 100}, nil); err != nil || !report.OK() {
+		t.Errorf("Expected the destination check to pass, got %+v (err=%v)", report, err)
+	}
+
+	// A directory must not come back after it was finished
+	writer, err := repo.NewStreamingSnapshotWriter("20250103000000", []string{sourceDir})
+	if err != nil {
+		t.Fatalf("Failed to create snapshot writer: %v", err)
+	}
+	for _, p := range []string{"a/1", "b/1", "a/2"} {
+		if err := writer.AddFile(&FileEntry{Path: p, Hash: "h", Chunks: []string{"h"}, Size: 1}); err != nil {
+			t.Fatalf("Failed to add %s: %v", p, err)
+		}
+	}
+	if err := writer.Close(); err == nil {
+		t.Errorf("Expected entries of a directory added apart to be refused")
+	}
+}
@@ -2,6 +2,7 @@ import React, { useState, useEffect, useRef } from 'react';
 
 import { EventsOn, EventsOff } from '../wailsjs/runtime';
 import * as App from '../wailsjs/go/main/App'; // Import all functions from App namespace
+import { backend, main } from '../wailsjs/go/models';
 
 // Define the shape of the BackupProgress object
 interface BackupProgress {
@@ -12,8 +13,32 @@ interface BackupProgress {
     totalBytes: number;
     status: string;
     error: string;
+    warning?: string;
 }
 
+// Define S3 destination settings interface
+interface S3Settings {
+    endpoint: string;
+    region: string;
+    bucket: string;
+    prefix: string;
+    accessKeyId: string;
+    secretAccessKey: string;
+}
+
+const emptyS3Settings: S3Settings = { endpoint: '', region: '', bucket: '', prefix: '', accessKeyId: '', secretAccessKey: '' };
+
+const formatBytes = (bytes: number): string => {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let value = bytes;
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    return unit === 0 ? `${value} B` : `${value.toFixed(1)} ${units[unit]}`;
+};
+
 // Define backup configuration interface
 interface BackupConfig {
     id: string;
@@ -21,6 +46,7 @@ interface BackupConfig {
     sourcePaths: string[];
     destinationPath: string;
     ignorePatterns: string[];
+    storage?: { s3?: S3Settings }; // Remote storage; destinationPath then only holds local progress state
     schedule: string; // 'manual', 'hourly', 'daily', 'weekly', 'monthly'
     enabled: boolean;
     lastBackup?: string;
@@ -45,6 +71,7 @@ interface DeploymentState {
     status: string;
     progress: DeploymentProgress;
     config: {
+        SnapshotID: string;
         snapshotPath: string;
         targetPath: string;
         casBaseDir: string;
@@ -70,6 +97,11 @@ function BackupApp() {
     const [formIgnorePatterns, setFormIgnorePatterns] = useState<string[]>([]);
     const [newIgnorePattern, setNewIgnorePattern] = useState<string>('');
     const [formSchedule, setFormSchedule] = useState<string>('manual');
+    const [formPassphrase, setFormPassphrase] = useState<string>('');
+    const [formUseS3, setFormUseS3] = useState<boolean>(false);
+    const [formS3, setFormS3] = useState<S3Settings>(emptyS3Settings);
+    // Repository passphrases by destination; kept in memory only, never saved to localStorage
+    const [repoPassphrases, setRepoPassphrases] = useState<Record<string, string>>({});
     
     const [selectedSourceIndex, setSelectedSourceIndex] = useState<number | null>(null);
     const [selectedIgnoreIndex, setSelectedIgnoreIndex] = useState<number | null>(null);
@@ -95,10 +127,23 @@ function BackupApp() {
     
     // Deployment form state
     const [showDeployForm, setShowDeployForm] = useState<boolean>(false);
-    const [deploySnapshotPath, setDeploySnapshotPath] = useState<string>('');
+    const [deploySnapshotID, setDeploySnapshotID] = useState<string>('');
+    const [deploySnapshots, setDeploySnapshots] = useState<backend.Snapshot[]>([]);
     const [deployTargetPath, setDeployTargetPath] = useState<string>('');
     const [deployCASBaseDir, setDeployCASBaseDir] = useState<string>('');
     const [deployIgnorePatterns, setDeployIgnorePatterns] = useState<string[]>([]);
+    const [deployPassphrase, setDeployPassphrase] = useState<string>('');
+
+    // Repository check state
+    const [checkStatus, setCheckStatus] = useState<string>('Idle');
+    const [checkProgress, setCheckProgress] = useState<backend.CheckProgress | null>(null);
+
+    // Snapshot copy state
+    const [copyStatus, setCopyStatus] = useState<string>('Idle');
+    const [copyProgress, setCopyProgress] = useState<backend.CopyProgress | null>(null);
+
+    // Space usage of the selected backup's repository
+    const [spaceStats, setSpaceStats] = useState<{ name: string; stats: backend.RepositoryStats } | null>(null);
 
     // Auto-scroll activity log to bottom when new entries are added
     useEffect(() => {
@@ -182,6 +227,9 @@ function BackupApp() {
                 if (parsedProgress.error) {
                     addLog(`Progress Error: ${parsedProgress.error}`);
                 }
+                if (parsedProgress.warning) {
+                    addLog(`Warning: ${parsedProgress.warning}`);
+                }
             } catch (e) {
                 addLog(`Error parsing progress update: ${e}`);
                 console.error("Error parsing progress update:", e, jsonProgress);
@@ -271,6 +319,38 @@ function BackupApp() {
             }
         });
 
+        EventsOn('app:check:status', (status: string) => {
+            setCheckStatus(status);
+            if (status !== 'Running') {
+                setCheckProgress(null);
+                App.GetCheckState().then(state => {
+                    const report = state?.report;
+                    if (!report) return;
+                    const issues = [
+                        ...(report.broken_snapshots || []).map(i => `Broken snapshot ${i.id}: ${i.error}`),
+                        ...(report.missing_objects || []).map(i => `Missing object ${i.id} (${i.snapshot}: ${i.path})`),
+                        ...(report.corrupt_objects || []).map(i => `Corrupt object ${i.id}${i.path ? ` (${i.snapshot}: ${i.path})` : ''}: ${i.error}`),
+                    ];
+                    issues.forEach(issue => addLog(`Check: ${issue}`));
+                }).catch(err => console.error("Error getting check state:", err));
+            }
+        });
+
+        EventsOn('app:check:progress', (progress: backend.CheckProgress) => {
+            setCheckProgress(progress);
+        });
+
+        EventsOn('app:copy:status', (status: string) => {
+            setCopyStatus(status);
+            if (status !== 'Running') {
+                setCopyProgress(null);
+            }
+        });
+
+        EventsOn('app:copy:progress', (progress: backend.CopyProgress) => {
+            setCopyProgress(progress);
+        });
+
         setTimeout(checkExistingBackupState, 500);
 
         // Cleanup event listeners on component unmount
@@ -281,6 +361,10 @@ function BackupApp() {
             EventsOff('app:backup:resumable');
             EventsOff('app:deployment:status');
             EventsOff('app:deployment:progress');
+            EventsOff('app:check:status');
+            EventsOff('app:check:progress');
+            EventsOff('app:copy:status');
+            EventsOff('app:copy:progress');
         };
     }, []);
 
@@ -393,6 +477,8 @@ function BackupApp() {
         setFormIgnorePatterns([...backup.ignorePatterns]);
         setNewIgnorePattern('');
         setFormSchedule(backup.schedule);
+        setFormUseS3(!!backup.storage?.s3);
+        setFormS3(backup.storage?.s3 || emptyS3Settings);
         setShowEditForm(true);
     };
 
@@ -434,7 +520,7 @@ function BackupApp() {
         addLog(`Starting backup: ${backup.name}`);
         setProgress(null);
         
-        App.StartBackup(backup.destinationPath, backup.sourcePaths, backup.ignorePatterns).catch(err => {
+        App.StartBackup(backup.destinationPath, backup.sourcePaths, backup.ignorePatterns, repoPassphrases[backup.destinationPath] || '', backend.StorageConfig.createFrom(backup.storage || {})).catch(err => {
             console.error("Error initiating backup:", err);
             addLog(`Error initiating backup: ${err}`);
             setIsProcessing(false);
@@ -548,10 +634,11 @@ function BackupApp() {
                 name: backup.name,
                 sourcePaths: backup.sourcePaths,
                 destinationPath: backup.destinationPath,
-                ignorePatterns: backup.ignorePatterns
+                ignorePatterns: backup.ignorePatterns,
+                storage: backup.storage || {}
             };
             
-            await App.RestartBackup(config);
+            await App.RestartBackup(main.BackupConfig.createFrom(config));
             addLog(`Restarting backup: ${backup.name}`);
         } catch (err: any) {
             addLog(`Error restarting backup: ${err}`);
@@ -567,6 +654,9 @@ function BackupApp() {
         setFormIgnorePatterns([]);
         setNewIgnorePattern('');
         setFormSchedule('manual');
+        setFormPassphrase('');
+        setFormUseS3(false);
+        setFormS3(emptyS3Settings);
         setSelectedSourceIndex(null);
         setSelectedIgnoreIndex(null);
         setEditingBackup(null);
@@ -585,6 +675,20 @@ function BackupApp() {
             alert('Please select a destination directory.');
             return;
         }
+        if (formUseS3 && (!formS3.endpoint.trim() || !formS3.bucket.trim())) {
+            alert('Please enter the S3 endpoint and bucket.');
+            return;
+        }
+        const formStorage = formUseS3 ? { s3: formS3 } : undefined;
+        if (formDestinationPath.startsWith('sftp://') && !formUseS3) {
+            App.ValidateBackupPath(formDestinationPath)
+                .then(ok => addLog(ok ? `Connected to ${formDestinationPath}` : `Warning: ${formDestinationPath} does not exist yet`))
+                .catch(err => addLog(`Warning: Cannot connect to ${formDestinationPath}: ${err}`));
+        }
+
+        if (formPassphrase) {
+            setRepoPassphrases(prev => ({ ...prev, [formDestinationPath]: formPassphrase }));
+        }
 
         if (showEditForm && editingBackup) {
             // Update existing backup
@@ -596,6 +700,7 @@ function BackupApp() {
                         sourcePaths: formSourcePaths,
                         destinationPath: formDestinationPath,
                         ignorePatterns: formIgnorePatterns,
+                        storage: formStorage,
                         schedule: formSchedule
                     };
                 }
@@ -611,6 +716,7 @@ function BackupApp() {
                 sourcePaths: formSourcePaths,
                 destinationPath: formDestinationPath,
                 ignorePatterns: formIgnorePatterns,
+                storage: formStorage,
                 schedule: formSchedule,
                 enabled: true
             };
@@ -708,14 +814,15 @@ function BackupApp() {
 
     // Deployment handler functions
     const handleStartDeployment = async () => {
-        if (!deploySnapshotPath || !deployTargetPath || !deployCASBaseDir) {
+        if (!deploySnapshotID || !deployTargetPath || !deployCASBaseDir) {
             addLog('Error: Please fill in all deployment fields');
             return;
         }
 
         try {
-            addLog(`Starting deployment from ${deploySnapshotPath} to ${deployTargetPath}`);
-            App.StartDeployment(deploySnapshotPath, deployTargetPath, deployCASBaseDir, deployIgnorePatterns);
+            addLog(`Starting deployment of snapshot ${deploySnapshotID} to ${deployTargetPath}`);
+            App.StartDeployment(deploySnapshotID, deployTargetPath, deployCASBaseDir, deployIgnorePatterns, deployPassphrase || repoPassphrases[deployCASBaseDir] || '');
+            setDeployPassphrase('');
             setShowDeployForm(false);
         } catch (err: any) {
             addLog(`Error starting deployment: ${err}`);
@@ -738,14 +845,90 @@ function BackupApp() {
         }
     };
 
-    const handleSelectSnapshotFile = async () => {
+    const handleCheckBackup = async (backup: BackupConfig) => {
+        const answer = prompt('Percentage of the stored data to read back and verify (0-100):', '10');
+        if (answer === null) return;
+        const percent = Number(answer);
+        if (isNaN(percent) || percent < 0 || percent > 100) {
+            addLog(`Invalid percentage: ${answer}`);
+            return;
+        }
+        try {
+            await App.StartCheck(backup.destinationPath, percent);
+        } catch (err: any) {
+            addLog(`Error starting check: ${err}`);
+            console.error("Error starting check:", err);
+        }
+    };
+
+    const handleCopyBackup = async (backup: BackupConfig) => {
+        const destination = prompt(`Copy snapshots of "${backup.name}" to which destination (path or sftp:// URL)?`, '');
+        if (!destination) return;
+        const tags = prompt('Only snapshots with any of these tags (comma-separated, empty for all):', '');
+        if (tags === null) return;
+        const since = prompt('Only snapshots taken on or after this date (YYYY-MM-DD, empty for all):', '');
+        if (since === null) return;
+        if (since && isNaN(Date.parse(since))) {
+            addLog(`Invalid date: ${since}`);
+            return;
+        }
+        const filter = backend.SnapshotFilter.createFrom({
+            ids: [],
+            tags: tags.split(',').map(tag => tag.trim()).filter(tag => tag !== ''),
+            after: since ? new Date(since).toISOString() : undefined,
+        });
+        try {
+            await App.StartCopy(backup.destinationPath, destination, filter);
+        } catch (err: any) {
+            addLog(`Error starting copy: ${err}`);
+            console.error("Error starting copy:", err);
+        }
+    };
+
+    const handleStopCopy = async () => {
         try {
-            const selectedFile = await App.SelectSnapshotFile();
-            if (selectedFile) {
-                setDeploySnapshotPath(selectedFile);
+            await App.StopCopy();
+        } catch (err: any) {
+            addLog(`Error stopping copy: ${err}`);
+            console.error("Error stopping copy:", err);
+        }
+    };
+
+    const handleShowSpace = async (backup: BackupConfig) => {
+        try {
+            const stats = await App.GetRepositoryStats(backup.destinationPath);
+            setSpaceStats({ name: backup.name, stats });
+        } catch (err: any) {
+            addLog(`Error getting space usage: ${err}`);
+            console.error("Error getting space usage:", err);
+        }
+    };
+
+    const handleStopCheck = async () => {
+        try {
+            await App.StopCheck();
+        } catch (err: any) {
+            addLog(`Error stopping check: ${err}`);
+            console.error("Error stopping check:", err);
+        }
+    };
+
+    const handleLoadDeploySnapshots = async () => {
+        if (!deployCASBaseDir) {
+            addLog('Error: Please enter the CAS base directory first');
+            return;
+        }
+        try {
+            if (deployPassphrase) {
+                await App.SetRepositoryPassphrase(deployCASBaseDir, deployPassphrase);
             }
+            const snapshots = await App.ListSnapshots(deployCASBaseDir, backend.SnapshotQuery.createFrom({}));
+            snapshots.reverse(); // Newest first
+            setDeploySnapshots(snapshots);
+            setDeploySnapshotID(snapshots.length > 0 ? snapshots[0].id : '');
         } catch (err: any) {
-            console.error("Error selecting snapshot file:", err);
+            addLog(`Error listing snapshots: ${err}`);
+            console.error("Error listing snapshots:", err);
         }
     };
 
@@ -896,7 +1079,7 @@ function BackupApp() {
                                                 </svg>
                                                 <div>
                                                     <p className="text-sm font-medium text-gray-700">Destination</p>
-                                                    <p className="text-gray-900 truncate">{backup.destinationPath || 'Not set'}</p>
+                                                    <p className="text-gray-900 truncate">{backup.storage?.s3 ? `s3://${backup.storage.s3.bucket}/${backup.storage.s3.prefix}` : backup.destinationPath || 'Not set'}</p>
                                                 </div>
                                             </div>
                                             
@@ -935,6 +1118,35 @@ function BackupApp() {
                                                 </svg>
                                                 Restart
                                             </button>
+                                            <button
+                                                onClick={() => handleCheckBackup(backup)}
+                                                disabled={checkStatus === 'Running'}
+                                                className="btn bg-gradient-to-r from-teal-500 to-teal-600 hover:from-teal-600 hover:to-teal-700 disabled:from-gray-400 disabled:to-gray-500 text-white font-medium py-2.5 px-5 rounded-lg transition-all duration-200 shadow hover:shadow-lg flex items-center gap-2 disabled:opacity-60 disabled:cursor-not-allowed"
+                                            >
+                                                <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                                                    <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M9 12l2 2 4-4m5.618-4.016A11.955 11.955 0 0112 2.944a11.955 11.955 0 01-8.618 3.04A12.02 12.02 0 003 9c0 5.591 3.824 10.29 9 11.622 5.176-1.332 9-6.03 9-11.622 0-1.042-.133-2.052-.382-3.016z" />
+                                                </svg>
+                                                Verify
+                                            </button>
+                                            <button
+                                                onClick={() => handleShowSpace(backup)}
+                                                className="btn bg-gradient-to-r from-indigo-500 to-indigo-600 hover:from-indigo-600 hover:to-indigo-700 text-white font-medium py-2.5 px-5 rounded-lg transition-all duration-200 shadow hover:shadow-lg flex items-center gap-2"
+                                            >
+                                                <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                                                    <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M9 19v-6a2 2 0 00-2-2H5a2 2 0 00-2 2v6a2 2 0 002 2h2a2 2 0 002-2zm0 0V9a2 2 0 012-2h2a2 2 0 012 2v10m-6 0a2 2 0 002 2h2a2 2 0 002-2m0 0V5a2 2 0 012-2h2a2 2 0 012 2v14a2 2 0 01-2 2h-2a2 2 0 01-2-2z" />
+                                                </svg>
+                                                Space
+                                            </button>
+                                            <button
+                                                onClick={() => handleCopyBackup(backup)}
+                                                disabled={copyStatus === 'Running'}
+                                                className="btn bg-gradient-to-r from-sky-500 to-sky-600 hover:from-sky-600 hover:to-sky-700 disabled:from-gray-400 disabled:to-gray-500 text-white font-medium py-2.5 px-5 rounded-lg transition-all duration-200 shadow hover:shadow-lg flex items-center gap-2 disabled:opacity-60 disabled:cursor-not-allowed"
+                                            >
+                                                <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                                                    <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M8 16H6a2 2 0 01-2-2V6a2 2 0 012-2h8a2 2 0 012 2v2m-6 12h8a2 2 0 002-2v-8a2 2 0 00-2-2h-8a2 2 0 00-2 2v8a2 2 0 002 2z" />
+                                                </svg>
+                                                Copy
+                                            </button>
                                             <button
                                                 onClick={() => handleToggleBackup(backup.id)}
                                                 className={`btn font-medium py-2.5 px-5 rounded-lg transition-all duration-200 shadow hover:shadow-lg flex items-center gap-2 ${
@@ -1127,6 +1339,123 @@ function BackupApp() {
                             </p>
                         </div>
                         
+                        {/* Space Usage Display */}
+                        {spaceStats && (
+                            <div className="bg-gradient-to-r from-indigo-50 to-blue-50 p-6 rounded-xl border-l-4 border-l-indigo-500 mb-6 shadow-inner">
+                                <div className="flex items-center justify-between mb-4">
+                                    <h3 className="text-lg font-semibold text-gray-800">Space Usage: {spaceStats.name}</h3>
+                                    <button onClick={() => setSpaceStats(null)} className="text-gray-500 hover:text-gray-700 text-sm">Close</button>
+                                </div>
+
+                                <div className="grid grid-cols-3 gap-4 mb-4 text-sm">
+                                    <div>
+                                        <p className="text-gray-600">Backed up (all snapshots)</p>
+                                        <p className="font-semibold text-gray-900">{formatBytes(spaceStats.stats.total_logical_bytes)}</p>
+                                    </div>
+                                    <div>
+                                        <p className="text-gray-600">Stored</p>
+                                        <p className="font-semibold text-gray-900">{formatBytes(spaceStats.stats.unique_stored_bytes)} ({formatBytes(spaceStats.stats.repository_bytes)} on disk)</p>
+                                    </div>
+                                    <div>
+                                        <p className="text-gray-600">Dedup ratio</p>
+                                        <p className="font-semibold text-gray-900">{spaceStats.stats.dedup_ratio.toFixed(2)}x</p>
+                                    </div>
+                                </div>
+
+                                <div className="space-y-2">
+                                    {(spaceStats.stats.snapshots || []).map(snapshot => {
+                                        const max = Math.max(1, ...(spaceStats.stats.snapshots || []).map(s => s.stored_bytes));
+                                        return (
+                                            <div key={snapshot.id} className="text-sm">
+                                                <div className="flex justify-between text-gray-700">
+                                                    <span className="truncate">{snapshot.id} ({snapshot.files} files, {formatBytes(snapshot.logical_bytes)})</span>
+                                                    <span>+{formatBytes(snapshot.new_bytes)} new, {formatBytes(snapshot.exclusive_bytes)} exclusive</span>
+                                                </div>
+                                                <div className="relative w-full bg-gray-200 rounded-full h-2 overflow-hidden">
+                                                    <div className="absolute h-2 bg-indigo-300" style={{ width: `${(snapshot.stored_bytes / max) * 100}%` }}></div>
+                                                    <div className="absolute h-2 bg-indigo-600" style={{ width: `${(snapshot.exclusive_bytes / max) * 100}%` }}></div>
+                                                </div>
+                                            </div>
+                                        );
+                                    })}
+                                </div>
+                            </div>
+                        )}
+
+                        {/* Snapshot Copy Progress Display */}
+                        {copyProgress && (
+                            <div className="bg-gradient-to-r from-sky-50 to-blue-50 p-6 rounded-xl border-l-4 border-l-sky-500 mb-6 shadow-inner">
+                                <div className="flex items-center justify-between mb-4">
+                                    <div className="flex items-center gap-3">
+                                        <div className="w-3 h-3 rounded-full bg-sky-500 animate-pulse"></div>
+                                        <h3 className="text-lg font-semibold text-gray-800">Copying Snapshots</h3>
+                                    </div>
+                                    <button
+                                        onClick={handleStopCopy}
+                                        className="btn bg-gradient-to-r from-red-500 to-red-600 hover:from-red-600 hover:to-red-700 text-white font-medium py-1.5 px-4 rounded-lg transition-all duration-200 shadow hover:shadow-lg"
+                                    >
+                                        Stop
+                                    </button>
+                                </div>
+
+                                <div className="space-y-3">
+                                    <div className="flex items-center justify-between">
+                                        <span className="text-gray-700 font-medium">Snapshots{copyProgress.snapshot ? ` (${copyProgress.snapshot})` : ''}:</span>
+                                        <span className="text-sky-600 font-semibold">{copyProgress.snapshots_done} / {copyProgress.snapshots_total}</span>
+                                    </div>
+
+                                    <div className="w-full bg-gray-200 rounded-full h-2 overflow-hidden">
+                                        <div
+                                            className="bg-gradient-to-r from-sky-500 to-blue-600 h-2 rounded-full transition-all duration-500 ease-out"
+                                            style={{ width: `${copyProgress.snapshots_total > 0 ? (copyProgress.snapshots_done / copyProgress.snapshots_total) * 100 : 0}%` }}
+                                        ></div>
+                                    </div>
+
+                                    <div className="text-sm text-gray-600">
+                                        {copyProgress.copied_objects} objects ({formatBytes(copyProgress.copied_bytes)}) transferred
+                                    </div>
+                                </div>
+                            </div>
+                        )}
+
+                        {/* Repository Check Progress Display */}
+                        {checkProgress && (
+                            <div className="bg-gradient-to-r from-teal-50 to-cyan-50 p-6 rounded-xl border-l-4 border-l-teal-500 mb-6 shadow-inner">
+                                <div className="flex items-center justify-between mb-4">
+                                    <div className="flex items-center gap-3">
+                                        <div className="w-3 h-3 rounded-full bg-teal-500 animate-pulse"></div>
+                                        <h3 className="text-lg font-semibold text-gray-800">Verifying Repository</h3>
+                                    </div>
+                                    <button
+                                        onClick={handleStopCheck}
+                                        className="btn bg-gradient-to-r from-red-500 to-red-600 hover:from-red-600 hover:to-red-700 text-white font-medium py-1.5 px-4 rounded-lg transition-all duration-200 shadow hover:shadow-lg"
+                                    >
+                                        Stop
+                                    </button>
+                                </div>
+
+                                <div className="space-y-3">
+                                    <div className="flex items-center justify-between">
+                                        <span className="text-gray-700 font-medium">Checking {checkProgress.phase}:</span>
+                                        <span className="text-teal-600 font-semibold">{checkProgress.done} / {checkProgress.total}</span>
+                                    </div>
+
+                                    <div className="w-full bg-gray-200 rounded-full h-2 overflow-hidden">
+                                        <div
+                                            className="bg-gradient-to-r from-teal-500 to-cyan-600 h-2 rounded-full transition-all duration-500 ease-out"
+                                            style={{ width: `${checkProgress.total > 0 ? (checkProgress.done / checkProgress.total) * 100 : 0}%` }}
+                                        ></div>
+                                    </div>
+
+                                    {checkProgress.issues > 0 && (
+                                        <div className="text-sm text-red-700 bg-red-50 p-3 rounded-lg border-l-4 border-l-red-500">
+                                            <span className="font-medium">Problems found so far:</span> {checkProgress.issues}
+                                        </div>
+                                    )}
+                                </div>
+                            </div>
+                        )}
+
                         {/* Deployment Progress Display */}
                         {deploymentProgress && (
                             <div className="bg-gradient-to-r from-purple-50 to-pink-50 p-6 rounded-xl border-l-4 border-l-purple-500 mb-6 shadow-inner">
@@ -1442,9 +1771,10 @@ function BackupApp() {
                                     <div className="flex-1 relative">
                                         <input
                                             type="text"
-                                            value={formDestinationPath || 'No destination selected'}
-                                            readOnly
-                                            className="focus-ring w-full px-4 py-3 pr-10 border border-gray-300 rounded-lg text-base bg-gray-50 text-gray-700 cursor-not-allowed"
+                                            value={formDestinationPath}
+                                            onChange={(e) => setFormDestinationPath(e.target.value.trim())}
+                                            placeholder="Select a folder, or enter sftp://user@host/path"
+                                            className="focus-ring w-full px-4 py-3 pr-10 border border-gray-300 rounded-lg text-base bg-gray-50 text-gray-700"
                                         />
                                         <div className="absolute right-3 top-1/2 transform -translate-y-1/2">
                                             {formDestinationPath ? (
@@ -1469,6 +1799,52 @@ function BackupApp() {
                                         Select Destination
                                     </button>
                                 </div>
+                                <input
+                                    type="password"
+                                    value={formPassphrase}
+                                    onChange={(e) => setFormPassphrase(e.target.value)}
+                                    placeholder="Encryption passphrase (optional)"
+                                    autoComplete="new-password"
+                                    className="focus-ring w-full mt-3 px-4 py-3 border border-gray-300 rounded-lg text-base"
+                                />
+                                <p className="text-sm text-gray-500 mt-2">
+                                    A passphrase encrypts a new destination. For an encrypted destination it is required to run the backup.
+                                    It is kept for this session only and cannot be recovered if lost.
+                                </p>
+                                <label className="flex items-center gap-2 mt-4 text-gray-700">
+                                    <input
+                                        type="checkbox"
+                                        checked={formUseS3}
+                                        onChange={(e) => setFormUseS3(e.target.checked)}
+                                    />
+                                    Store backups in an S3-compatible bucket
+                                </label>
+                                {formUseS3 && (
+                                    <div className="grid grid-cols-2 gap-3 mt-3">
+                                        {([
+                                            ['endpoint', 'Endpoint (e.g. https://s3.amazonaws.com or http://nas:9000)', 'text'],
+                                            ['region', 'Region (default us-east-1)', 'text'],
+                                            ['bucket', 'Bucket', 'text'],
+                                            ['prefix', 'Prefix (optional)', 'text'],
+                                            ['accessKeyId', 'Access key ID', 'text'],
+                                            ['secretAccessKey', 'Secret access key', 'password'],
+                                        ] as [keyof S3Settings, string, string][]).map(([field, placeholder, type]) => (
+                                            <input
+                                                key={field}
+                                                type={type}
+                                                value={formS3[field]}
+                                                onChange={(e) => setFormS3(prev => ({ ...prev, [field]: e.target.value }))}
+                                                placeholder={placeholder}
+                                                autoComplete="off"
+                                                className="focus-ring w-full px-4 py-3 border border-gray-300 rounded-lg text-base"
+                                            />
+                                        ))}
+                                        <p className="col-span-2 text-sm text-gray-500">
+                                            The destination directory above then only keeps the local progress and resume state.
+                                            Credentials are saved with the backup configuration; leave them empty to use AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+                                        </p>
+                                    </div>
+                                )}
                             </div>
 
                         <div className="flex gap-3 justify-end pt-6 border-t border-gray-200">
@@ -1614,27 +1990,37 @@ function BackupApp() {
                             </div>
 
                             <div className="space-y-6">
-                                {/* Snapshot File Selection */}
+                                {/* Snapshot Selection */}
                                 <div>
                                     <label className="block text-sm font-medium text-gray-700 mb-2">
-                                        Snapshot File
+                                        Snapshot
                                     </label>
                                     <div className="flex gap-3">
-                                        <input
-                                            type="text"
-                                            value={deploySnapshotPath}
-                                            onChange={(e) => setDeploySnapshotPath(e.target.value)}
-                                            placeholder="Select snapshot file to deploy from..."
-                                            className="flex-1 px-4 py-3 border border-gray-300 rounded-lg focus:ring-2 focus:ring-purple-500 focus:border-transparent"
-                                        />
+                                        <select
+                                            value={deploySnapshotID}
+                                            onChange={(e) => setDeploySnapshotID(e.target.value)}
+                                            className="flex-1 px-4 py-3 border border-gray-300 rounded-lg bg-white focus:ring-2 focus:ring-purple-500 focus:border-transparent"
+                                        >
+                                            {deploySnapshots.length === 0 && (
+                                                <option value="">Load the snapshots of the CAS base directory...</option>
+                                            )}
+                                            {deploySnapshots.map((snapshot) => (
+                                                <option key={snapshot.id} value={snapshot.id}>
+                                                    {new Date(snapshot.timestamp).toLocaleString()}
+                                                    {snapshot.config_name ? ` · ${snapshot.config_name}` : ''}
+                                                    {snapshot.hostname ? ` · ${snapshot.hostname}` : ''}
+                                                    {snapshot.tags && snapshot.tags.length > 0 ? ` · ${snapshot.tags.join(', ')}` : ''}
+                                                </option>
+                                            ))}
+                                        </select>
                                         <button
-                                            onClick={handleSelectSnapshotFile}
+                                            onClick={handleLoadDeploySnapshots}
                                             className="btn bg-gray-100 hover:bg-gray-200 text-gray-700 font-medium py-3 px-6 rounded-lg transition-all duration-200 flex items-center gap-2"
                                         >
                                             <svg className="w-5 h-5" fill="none" stroke="currentColor" viewBox="0 0 24 24">
-                                                <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M9 13h6m-3-3v6m5 5H7a2 2 0 01-2-2V5a2 2 0 012-2h5.586a1 1 0 01.707.293l5.414 5.414a1 1 0 01.293.707V19a2 2 0 01-2 2z" />
+                                                <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M4 4v5h.582m15.356 2A8.001 8.001 0 004.582 9m0 0H9m11 11v-5h-.581m0 0a8.003 8.003 0 01-15.357-2m15.357 2H15" />
                                             </svg>
-                                            Browse
+                                            Load
                                         </button>
                                     </div>
                                 </div>
@@ -1678,6 +2064,21 @@ function BackupApp() {
                                     />
                                 </div>
 
+                                {/* Repository Passphrase */}
+                                <div>
+                                    <label className="block text-sm font-medium text-gray-700 mb-2">
+                                        Passphrase
+                                    </label>
+                                    <input
+                                        type="password"
+                                        value={deployPassphrase}
+                                        onChange={(e) => setDeployPassphrase(e.target.value)}
+                                        placeholder="Only needed for encrypted backups..."
+                                        autoComplete="off"
+                                        className="w-full px-4 py-3 border border-gray-300 rounded-lg focus:ring-2 focus:ring-purple-500 focus:border-transparent"
+                                    />
+                                </div>
+
                                 {/* Deployment Options Info */}
                                 <div className="bg-purple-50 border border-purple-200 rounded-lg p-4">
                                     <div className="flex items-center gap-2 mb-2">
@@ -1,23 +1,63 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
-import {main} from '../models';
+import {backend,main} from '../models';
+
+export function ApplyRetention(arg1:string,arg2:backend.RetentionPolicy,arg3:boolean):Promise<backend.RetentionResult>;
+
+export function ApplyTombstones(arg1:string,arg2:string):Promise<number>;
+
+export function BrowseSnapshot(arg1:string,arg2:string,arg3:number,arg4:string):Promise<Array<backend.TreeNode>>;
 
 export function CheckAllBackupStates():Promise<Record<string, main.BackupState>>;
 
+export function DiffSnapshots(arg1:string,arg2:string,arg3:string):Promise<Array<backend.SnapshotChange>>;
+
+export function DisableAppendOnly(arg1:string,arg2:string):Promise<void>;
+
+export function EnableAppendOnly(arg1:string):Promise<string>;
+
+export function FindLatestSnapshot(arg1:string,arg2:backend.SnapshotQuery):Promise<backend.Snapshot>;
+
 export function GetBackupState():Promise<main.BackupState>;
 
+export function GetCheckState():Promise<main.CheckState>;
+
+export function GetCopyState():Promise<main.CopyState>;
+
 export function GetDeploymentState():Promise<main.DeploymentState>;
 
+export function GetQuotaStatus(arg1:string):Promise<backend.QuotaStatus>;
+
+export function GetRepositoryConfig(arg1:string):Promise<backend.RepoConfig>;
+
+export function GetRepositoryLocks(arg1:string):Promise<Array<backend.LockInfo>>;
+
+export function GetRepositoryStats(arg1:string):Promise<backend.RepositoryStats>;
+
+export function GetSnapshot(arg1:string,arg2:string):Promise<backend.Snapshot>;
+
 export function GetSuggestedBackupPaths():Promise<Array<string>>;
 
 export function GetSuggestedIgnorePatterns():Promise<Array<string>>;
 
 export function GetSystemInfo():Promise<Record<string, any>>;
 
+export function GetTombstones(arg1:string):Promise<Array<backend.Tombstone>>;
+
 export function Greet(arg1:string):Promise<string>;
 
+export function InitRepository(arg1:string,arg2:string,arg3:string):Promise<backend.RepoConfig>;
+
+export function ListSnapshots(arg1:string,arg2:backend.SnapshotQuery):Promise<Array<backend.Snapshot>>;
+
 export function PauseBackup():Promise<void>;
 
+export function PruneRepository(arg1:string,arg2:boolean):Promise<backend.PruneStats>;
+
+export function RemoveSnapshot(arg1:string,arg2:string):Promise<boolean>;
+
+export function RepairRepository(arg1:string):Promise<backend.RepairReport>;
+
 export function RestartBackup(arg1:main.BackupConfig):Promise<void>;
 
 export function ResumeBackup():Promise<void>;
@@ -26,20 +66,38 @@ export function SelectDeployTargetDirectory():Promise<string>;
 
 export function SelectDestinationDirectory():Promise<string>;
 
-export function SelectSnapshotFile():Promise<string>;
-
 export function SelectSourceDirectory():Promise<string>;
 
+export function SetCompressionLevel(arg1:string,arg2:number):Promise<void>;
+
+export function SetMaxFileSize(arg1:string,arg2:number):Promise<void>;
+
+export function SetParity(arg1:string,arg2:number,arg3:number):Promise<void>;
+
+export function SetQuota(arg1:string,arg2:backend.QuotaConfig):Promise<void>;
+
+export function SetRepositoryPassphrase(arg1:string,arg2:string):Promise<void>;
+
 export function SetSavedBackups(arg1:Array<main.BackupConfig>):Promise<void>;
 
-export function StartBackup(arg1:string,arg2:Array<string>,arg3:Array<string>):Promise<void>;
+export function StartBackup(arg1:string,arg2:Array<string>,arg3:Array<string>,arg4:string,arg5:backend.StorageConfig):Promise<void>;
+
+export function StartCheck(arg1:string,arg2:number):Promise<void>;
+
+export function StartCopy(arg1:string,arg2:string,arg3:backend.SnapshotFilter):Promise<void>;
 
-export function StartDeployment(arg1:string,arg2:string,arg3:string,arg4:Array<string>):Promise<void>;
+export function StartDeployment(arg1:string,arg2:string,arg3:string,arg4:Array<string>,arg5:string):Promise<void>;
 
 export function StopBackup():Promise<void>;
 
+export function StopCheck():Promise<void>;
+
+export function StopCopy():Promise<void>;
+
 export function StopDeployment():Promise<void>;
 
 export function TestConnection():Promise<string>;
 
+export function UnlockRepository(arg1:string,arg2:boolean):Promise<number>;
+
 export function ValidateBackupPath(arg1:string):Promise<boolean>;
@@ -2,18 +2,74 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function ApplyRetention(arg1, arg2, arg3) {
+  return window['go']['main']['App']['ApplyRetention'](arg1, arg2, arg3);
+}
+
+export function ApplyTombstones(arg1, arg2) {
+  return window['go']['main']['App']['ApplyTombstones'](arg1, arg2);
+}
+
+export function BrowseSnapshot(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['BrowseSnapshot'](arg1, arg2, arg3, arg4);
+}
+
 export function CheckAllBackupStates() {
   return window['go']['main']['App']['CheckAllBackupStates']();
 }
 
+export function DiffSnapshots(arg1, arg2, arg3) {
+  return window['go']['main']['App']['DiffSnapshots'](arg1, arg2, arg3);
+}
+
+export function DisableAppendOnly(arg1, arg2) {
+  return window['go']['main']['App']['DisableAppendOnly'](arg1, arg2);
+}
+
+export function EnableAppendOnly(arg1) {
+  return window['go']['main']['App']['EnableAppendOnly'](arg1);
+}
+
+export function FindLatestSnapshot(arg1, arg2) {
+  return window['go']['main']['App']['FindLatestSnapshot'](arg1, arg2);
+}
+
 export function GetBackupState() {
   return window['go']['main']['App']['GetBackupState']();
 }
 
+export function GetCheckState() {
+  return window['go']['main']['App']['GetCheckState']();
+}
+
+export function GetCopyState() {
+  return window['go']['main']['App']['GetCopyState']();
+}
+
 export function GetDeploymentState() {
   return window['go']['main']['App']['GetDeploymentState']();
 }
 
+export function GetQuotaStatus(arg1) {
+  return window['go']['main']['App']['GetQuotaStatus'](arg1);
+}
+
+export function GetRepositoryConfig(arg1) {
+  return window['go']['main']['App']['GetRepositoryConfig'](arg1);
+}
+
+export function GetRepositoryLocks(arg1) {
+  return window['go']['main']['App']['GetRepositoryLocks'](arg1);
+}
+
+export function GetRepositoryStats(arg1) {
+  return window['go']['main']['App']['GetRepositoryStats'](arg1);
+}
+
+export function GetSnapshot(arg1, arg2) {
+  return window['go']['main']['App']['GetSnapshot'](arg1, arg2);
+}
+
 export function GetSuggestedBackupPaths() {
   return window['go']['main']['App']['GetSuggestedBackupPaths']();
 }
@@ -26,14 +82,38 @@ export function GetSystemInfo() {
   return window['go']['main']['App']['GetSystemInfo']();
 }
 
+export function GetTombstones(arg1) {
+  return window['go']['main']['App']['GetTombstones'](arg1);
+}
+
 export function Greet(arg1) {
   return window['go']['main']['App']['Greet'](arg1);
 }
 
+export function InitRepository(arg1, arg2, arg3) {
+  return window['go']['main']['App']['InitRepository'](arg1, arg2, arg3);
+}
+
+export function ListSnapshots(arg1, arg2) {
+  return window['go']['main']['App']['ListSnapshots'](arg1, arg2);
+}
+
 export function PauseBackup() {
   return window['go']['main']['App']['PauseBackup']();
 }
 
+export function PruneRepository(arg1, arg2) {
+  return window['go']['main']['App']['PruneRepository'](arg1, arg2);
+}
+
+export function RemoveSnapshot(arg1, arg2) {
+  return window['go']['main']['App']['RemoveSnapshot'](arg1, arg2);
+}
+
+export function RepairRepository(arg1) {
+  return window['go']['main']['App']['RepairRepository'](arg1);
+}
+
 export function RestartBackup(arg1) {
   return window['go']['main']['App']['RestartBackup'](arg1);
 }
@@ -50,30 +130,62 @@ export function SelectDestinationDirectory() {
   return window['go']['main']['App']['SelectDestinationDirectory']();
 }
 
-export function SelectSnapshotFile() {
-  return window['go']['main']['App']['SelectSnapshotFile']();
-}
-
 export function SelectSourceDirectory() {
   return window['go']['main']['App']['SelectSourceDirectory']();
 }
 
+export function SetCompressionLevel(arg1, arg2) {
+  return window['go']['main']['App']['SetCompressionLevel'](arg1, arg2);
+}
+
+export function SetMaxFileSize(arg1, arg2) {
+  return window['go']['main']['App']['SetMaxFileSize'](arg1, arg2);
+}
+
+export function SetParity(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SetParity'](arg1, arg2, arg3);
+}
+
+export function SetQuota(arg1, arg2) {
+  return window['go']['main']['App']['SetQuota'](arg1, arg2);
+}
+
+export function SetRepositoryPassphrase(arg1, arg2) {
+  return window['go']['main']['App']['SetRepositoryPassphrase'](arg1, arg2);
+}
+
 export function SetSavedBackups(arg1) {
   return window['go']['main']['App']['SetSavedBackups'](arg1);
 }
 
-export function StartBackup(arg1, arg2, arg3) {
-  return window['go']['main']['App']['StartBackup'](arg1, arg2, arg3);
+export function StartBackup(arg1, arg2, arg3, arg4, arg5) {
+  return window['go']['main']['App']['StartBackup'](arg1, arg2, arg3, arg4, arg5);
+}
+
+export function StartCheck(arg1, arg2) {
+  return window['go']['main']['App']['StartCheck'](arg1, arg2);
 }
 
-export function StartDeployment(arg1, arg2, arg3, arg4) {
-  return window['go']['main']['App']['StartDeployment'](arg1, arg2, arg3, arg4);
+export function StartCopy(arg1, arg2, arg3) {
+  return window['go']['main']['App']['StartCopy'](arg1, arg2, arg3);
+}
+
+export function StartDeployment(arg1, arg2, arg3, arg4, arg5) {
+  return window['go']['main']['App']['StartDeployment'](arg1, arg2, arg3, arg4, arg5);
 }
 
 export function StopBackup() {
   return window['go']['main']['App']['StopBackup']();
 }
 
+export function StopCheck() {
+  return window['go']['main']['App']['StopCheck']();
+}
+
+export function StopCopy() {
+  return window['go']['main']['App']['StopCopy']();
+}
+
 export function StopDeployment() {
   return window['go']['main']['App']['StopDeployment']();
 }
@@ -82,6 +194,10 @@ export function TestConnection() {
   return window['go']['main']['App']['TestConnection']();
 }
 
+export function UnlockRepository(arg1, arg2) {
+  return window['go']['main']['App']['UnlockRepository'](arg1, arg2);
+}
+
 export function ValidateBackupPath(arg1) {
   return window['go']['main']['App']['ValidateBackupPath'](arg1);
 }
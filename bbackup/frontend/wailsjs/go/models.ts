@@ -6,8 +6,11 @@ export namespace backend {
 	    currentFile: string;
 	    bytesTransferred: number;
 	    totalBytes: number;
+	    logicalBytes: number;
+	    compressedBytes: number;
 	    status: string;
 	    error: string;
+	    warning?: string;
 	
 	    static createFrom(source: any = {}) {
 	        return new BackupProgress(source);
@@ -20,57 +23,1017 @@ export namespace backend {
 	        this.currentFile = source["currentFile"];
 	        this.bytesTransferred = source["bytesTransferred"];
 	        this.totalBytes = source["totalBytes"];
+	        this.logicalBytes = source["logicalBytes"];
+	        this.compressedBytes = source["compressedBytes"];
 	        this.status = source["status"];
 	        this.error = source["error"];
+	        this.warning = source["warning"];
+	    }
+	}
+	export class CheckIssue {
+	    id: string;
+	    snapshot: string;
+	    path: string;
+	    error: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new CheckIssue(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.snapshot = source["snapshot"];
+	        this.path = source["path"];
+	        this.error = source["error"];
+	    }
+	}
+	export class CheckProgress {
+	    phase: string;
+	    done: number;
+	    total: number;
+	    currentItem: string;
+	    issues: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new CheckProgress(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.phase = source["phase"];
+	        this.done = source["done"];
+	        this.total = source["total"];
+	        this.currentItem = source["currentItem"];
+	        this.issues = source["issues"];
+	    }
+	}
+	export class CheckReport {
+	    snapshots: number;
+	    stored_objects: number;
+	    referenced_objects: number;
+	    read_objects: number;
+	    broken_snapshots: CheckIssue[];
+	    missing_objects: CheckIssue[];
+	    corrupt_objects: CheckIssue[];
+	    orphaned_objects: CheckIssue[];
+	
+	    static createFrom(source: any = {}) {
+	        return new CheckReport(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.snapshots = source["snapshots"];
+	        this.stored_objects = source["stored_objects"];
+	        this.referenced_objects = source["referenced_objects"];
+	        this.read_objects = source["read_objects"];
+	        this.broken_snapshots = this.convertValues(source["broken_snapshots"], CheckIssue);
+	        this.missing_objects = this.convertValues(source["missing_objects"], CheckIssue);
+	        this.corrupt_objects = this.convertValues(source["corrupt_objects"], CheckIssue);
+	        this.orphaned_objects = this.convertValues(source["orphaned_objects"], CheckIssue);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class ChunkerConfig {
+	    min_size: number;
+	    avg_size: number;
+	    max_size: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ChunkerConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.min_size = source["min_size"];
+	        this.avg_size = source["avg_size"];
+	        this.max_size = source["max_size"];
+	    }
+	}
+	export class CopyProgress {
+	    snapshot: string;
+	    snapshots_done: number;
+	    snapshots_total: number;
+	    copied_objects: number;
+	    copied_bytes: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new CopyProgress(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.snapshot = source["snapshot"];
+	        this.snapshots_done = source["snapshots_done"];
+	        this.snapshots_total = source["snapshots_total"];
+	        this.copied_objects = source["copied_objects"];
+	        this.copied_bytes = source["copied_bytes"];
+	    }
+	}
+	export class CopyStats {
+	    snapshots: number;
+	    copied_snapshots: number;
+	    skipped_snapshots: number;
+	    copied_objects: number;
+	    copied_bytes: number;
+	    existing_objects: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new CopyStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.snapshots = source["snapshots"];
+	        this.copied_snapshots = source["copied_snapshots"];
+	        this.skipped_snapshots = source["skipped_snapshots"];
+	        this.copied_objects = source["copied_objects"];
+	        this.copied_bytes = source["copied_bytes"];
+	        this.existing_objects = source["existing_objects"];
 	    }
 	}
 	export class DeploymentConfig {
+	    SnapshotID: string;
 	    SnapshotPath: string;
 	    TargetPath: string;
 	    CASBaseDir: string;
 	    PreserveModTimes: boolean;
 	    UseHardLinks: boolean;
 	    IgnorePatterns: string[];
+	    storage: StorageConfig;
+	
+	    static createFrom(source: any = {}) {
+	        return new DeploymentConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.SnapshotID = source["SnapshotID"];
+	        this.SnapshotPath = source["SnapshotPath"];
+	        this.TargetPath = source["TargetPath"];
+	        this.CASBaseDir = source["CASBaseDir"];
+	        this.PreserveModTimes = source["PreserveModTimes"];
+	        this.UseHardLinks = source["UseHardLinks"];
+	        this.IgnorePatterns = source["IgnorePatterns"];
+	        this.storage = this.convertValues(source["storage"], StorageConfig);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class DeploymentProgress {
+	    totalFiles: number;
+	    filesProcessed: number;
+	    filesSkipped: number;
+	    filesCopied: number;
+	    currentFile: string;
+	    bytesCopied: number;
+	    status: string;
+	    error: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new DeploymentProgress(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.totalFiles = source["totalFiles"];
+	        this.filesProcessed = source["filesProcessed"];
+	        this.filesSkipped = source["filesSkipped"];
+	        this.filesCopied = source["filesCopied"];
+	        this.currentFile = source["currentFile"];
+	        this.bytesCopied = source["bytesCopied"];
+	        this.status = source["status"];
+	        this.error = source["error"];
+	    }
+	}
+	export class FileEntry {
+	    path: string;
+	    hash: string;
+	    chunks?: string[];
+	    size: number;
+	    mode: number;
+	    // Go type: time
+	    mod_time: any;
+	    type?: string;
+	    link_target?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new FileEntry(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.path = source["path"];
+	        this.hash = source["hash"];
+	        this.chunks = source["chunks"];
+	        this.size = source["size"];
+	        this.mode = source["mode"];
+	        this.mod_time = this.convertValues(source["mod_time"], null);
+	        this.type = source["type"];
+	        this.link_target = source["link_target"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class LockInfo {
+	    exclusive: boolean;
+	    operation: string;
+	    hostname: string;
+	    pid: number;
+	    // Go type: time
+	    created: any;
+	    // Go type: time
+	    refreshed: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new LockInfo(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.exclusive = source["exclusive"];
+	        this.operation = source["operation"];
+	        this.hostname = source["hostname"];
+	        this.pid = source["pid"];
+	        this.created = this.convertValues(source["created"], null);
+	        this.refreshed = this.convertValues(source["refreshed"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class ParityConfig {
+	    data_shards: number;
+	    parity_shards: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ParityConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.data_shards = source["data_shards"];
+	        this.parity_shards = source["parity_shards"];
+	    }
+	}
+	export class PruneStats {
+	    snapshots: number;
+	    referenced_objects: number;
+	    unreferenced_objects: number;
+	    unreferenced_bytes: number;
+	    newly_marked: number;
+	    pending_objects: number;
+	    deletable_objects: number;
+	    deletable_bytes: number;
+	    deleted_objects: number;
+	    deleted_bytes: number;
+	    removed_packs: number;
+	    repacked_packs: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new PruneStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.snapshots = source["snapshots"];
+	        this.referenced_objects = source["referenced_objects"];
+	        this.unreferenced_objects = source["unreferenced_objects"];
+	        this.unreferenced_bytes = source["unreferenced_bytes"];
+	        this.newly_marked = source["newly_marked"];
+	        this.pending_objects = source["pending_objects"];
+	        this.deletable_objects = source["deletable_objects"];
+	        this.deletable_bytes = source["deletable_bytes"];
+	        this.deleted_objects = source["deleted_objects"];
+	        this.deleted_bytes = source["deleted_bytes"];
+	        this.removed_packs = source["removed_packs"];
+	        this.repacked_packs = source["repacked_packs"];
+	    }
+	}
+	export class QuotaConfig {
+	    max_bytes: number;
+	    warn_percent: number;
+	    retention: RetentionPolicy;
+	
+	    static createFrom(source: any = {}) {
+	        return new QuotaConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.max_bytes = source["max_bytes"];
+	        this.warn_percent = source["warn_percent"];
+	        this.retention = this.convertValues(source["retention"], RetentionPolicy);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class QuotaStatus {
+	    used_bytes: number;
+	    max_bytes: number;
+	    percent: number;
+	    warning: boolean;
+	    exceeded: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new QuotaStatus(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.used_bytes = source["used_bytes"];
+	        this.max_bytes = source["max_bytes"];
+	        this.percent = source["percent"];
+	        this.warning = source["warning"];
+	        this.exceeded = source["exceeded"];
+	    }
+	}
+	export class RepairProgress {
+	    done: number;
+	    total: number;
+	    currentItem: string;
+	    repaired: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new RepairProgress(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.done = source["done"];
+	        this.total = source["total"];
+	        this.currentItem = source["currentItem"];
+	        this.repaired = source["repaired"];
+	    }
+	}
+	export class RepairReport {
+	    checked_files: number;
+	    damaged_blocks: number;
+	    repaired_files: string[];
+	    unrepairable_files: CheckIssue[];
+	    added_parity: number;
+	    missing_parity: number;
+	    removed_parity: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new RepairReport(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.checked_files = source["checked_files"];
+	        this.damaged_blocks = source["damaged_blocks"];
+	        this.repaired_files = source["repaired_files"];
+	        this.unrepairable_files = this.convertValues(source["unrepairable_files"], CheckIssue);
+	        this.added_parity = source["added_parity"];
+	        this.missing_parity = source["missing_parity"];
+	        this.removed_parity = source["removed_parity"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class RepoConfig {
+	    version: number;
+	    id: string;
+	    hash_algorithm: string;
+	    chunker: ChunkerConfig;
+	    compression_level: number;
+	    encrypted: boolean;
+	    parity: ParityConfig;
+	    quota: QuotaConfig;
+	    max_file_size: number;
+	    append_only: boolean;
+	    maintenance_key_hash?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new RepoConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.version = source["version"];
+	        this.id = source["id"];
+	        this.hash_algorithm = source["hash_algorithm"];
+	        this.chunker = this.convertValues(source["chunker"], ChunkerConfig);
+	        this.compression_level = source["compression_level"];
+	        this.encrypted = source["encrypted"];
+	        this.parity = this.convertValues(source["parity"], ParityConfig);
+	        this.quota = this.convertValues(source["quota"], QuotaConfig);
+	        this.max_file_size = source["max_file_size"];
+	        this.append_only = source["append_only"];
+	        this.maintenance_key_hash = source["maintenance_key_hash"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class RepositoryStats {
+	    snapshots: SnapshotStats[];
+	    total_logical_bytes: number;
+	    unique_stored_bytes: number;
+	    dedup_ratio: number;
+	    repository_bytes: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new RepositoryStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.snapshots = this.convertValues(source["snapshots"], SnapshotStats);
+	        this.total_logical_bytes = source["total_logical_bytes"];
+	        this.unique_stored_bytes = source["unique_stored_bytes"];
+	        this.dedup_ratio = source["dedup_ratio"];
+	        this.repository_bytes = source["repository_bytes"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class RetentionPolicy {
+	    keep_last: number;
+	    keep_daily: number;
+	    keep_weekly: number;
+	    keep_monthly: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new RetentionPolicy(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.keep_last = source["keep_last"];
+	        this.keep_daily = source["keep_daily"];
+	        this.keep_weekly = source["keep_weekly"];
+	        this.keep_monthly = source["keep_monthly"];
+	    }
+	}
+	export class RetentionResult {
+	    kept: string[];
+	    removed: string[];
+	    tombstoned: boolean;
+	    prune?: PruneStats;
+	
+	    static createFrom(source: any = {}) {
+	        return new RetentionResult(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.kept = source["kept"];
+	        this.removed = source["removed"];
+	        this.tombstoned = source["tombstoned"];
+	        this.prune = this.convertValues(source["prune"], PruneStats);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class S3Config {
+	    endpoint: string;
+	    region: string;
+	    bucket: string;
+	    prefix: string;
+	    accessKeyId: string;
+	    secretAccessKey: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new S3Config(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.endpoint = source["endpoint"];
+	        this.region = source["region"];
+	        this.bucket = source["bucket"];
+	        this.prefix = source["prefix"];
+	        this.accessKeyId = source["accessKeyId"];
+	        this.secretAccessKey = source["secretAccessKey"];
+	    }
+	}
+	export class SFTPConfig {
+	    host: string;
+	    port: number;
+	    user: string;
+	    path: string;
+	    keyFile: string;
+	    knownHostsFile: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new SFTPConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.host = source["host"];
+	        this.port = source["port"];
+	        this.user = source["user"];
+	        this.path = source["path"];
+	        this.keyFile = source["keyFile"];
+	        this.knownHostsFile = source["knownHostsFile"];
+	    }
+	}
+	export class Snapshot {
+	    id: string;
+	    // Go type: time
+	    timestamp: any;
+	    source: string[];
+	    files?: Record<string, FileEntry>;
+	    roots?: string[];
+	    source_dirs?: FileEntry[];
+	    tags?: string[];
+	    hash_algorithm?: string;
+	    hostname?: string;
+	    username?: string;
+	    config_id?: string;
+	    config_name?: string;
+	    parent?: string;
+	    description?: string;
+	    summary?: SnapshotSummary;
+	
+	    static createFrom(source: any = {}) {
+	        return new Snapshot(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.timestamp = this.convertValues(source["timestamp"], null);
+	        this.source = source["source"];
+	        this.files = this.convertValues(source["files"], FileEntry, true);
+	        this.roots = source["roots"];
+	        this.source_dirs = this.convertValues(source["source_dirs"], FileEntry);
+	        this.tags = source["tags"];
+	        this.hash_algorithm = source["hash_algorithm"];
+	        this.hostname = source["hostname"];
+	        this.username = source["username"];
+	        this.config_id = source["config_id"];
+	        this.config_name = source["config_name"];
+	        this.parent = source["parent"];
+	        this.description = source["description"];
+	        this.summary = this.convertValues(source["summary"], SnapshotSummary);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class SnapshotChange {
+	    source: number;
+	    path: string;
+	    change: string;
+	    old?: FileEntry;
+	    new?: FileEntry;
+	
+	    static createFrom(source: any = {}) {
+	        return new SnapshotChange(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.source = source["source"];
+	        this.path = source["path"];
+	        this.change = source["change"];
+	        this.old = this.convertValues(source["old"], FileEntry);
+	        this.new = this.convertValues(source["new"], FileEntry);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class SnapshotFilter {
+	    ids: string[];
+	    tags: string[];
+	    // Go type: time
+	    after: any;
+	    // Go type: time
+	    before: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new SnapshotFilter(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.ids = source["ids"];
+	        this.tags = source["tags"];
+	        this.after = this.convertValues(source["after"], null);
+	        this.before = this.convertValues(source["before"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class SnapshotQuery {
+	    hostname: string;
+	    config_id: string;
+	    tag: string;
 	
 	    static createFrom(source: any = {}) {
-	        return new DeploymentConfig(source);
+	        return new SnapshotQuery(source);
 	    }
 	
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
-	        this.SnapshotPath = source["SnapshotPath"];
-	        this.TargetPath = source["TargetPath"];
-	        this.CASBaseDir = source["CASBaseDir"];
-	        this.PreserveModTimes = source["PreserveModTimes"];
-	        this.UseHardLinks = source["UseHardLinks"];
-	        this.IgnorePatterns = source["IgnorePatterns"];
+	        this.hostname = source["hostname"];
+	        this.config_id = source["config_id"];
+	        this.tag = source["tag"];
 	    }
 	}
-	export class DeploymentProgress {
-	    totalFiles: number;
-	    filesProcessed: number;
-	    filesSkipped: number;
-	    filesCopied: number;
-	    currentFile: string;
-	    bytesCopied: number;
-	    status: string;
-	    error: string;
+	export class SnapshotStats {
+	    id: string;
+	    // Go type: time
+	    timestamp: any;
+	    parent?: string;
+	    files: number;
+	    logical_bytes: number;
+	    stored_bytes: number;
+	    new_bytes: number;
+	    exclusive_bytes: number;
 	
 	    static createFrom(source: any = {}) {
-	        return new DeploymentProgress(source);
+	        return new SnapshotStats(source);
 	    }
 	
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
-	        this.totalFiles = source["totalFiles"];
-	        this.filesProcessed = source["filesProcessed"];
-	        this.filesSkipped = source["filesSkipped"];
-	        this.filesCopied = source["filesCopied"];
-	        this.currentFile = source["currentFile"];
-	        this.bytesCopied = source["bytesCopied"];
-	        this.status = source["status"];
-	        this.error = source["error"];
+	        this.id = source["id"];
+	        this.timestamp = this.convertValues(source["timestamp"], null);
+	        this.parent = source["parent"];
+	        this.files = source["files"];
+	        this.logical_bytes = source["logical_bytes"];
+	        this.stored_bytes = source["stored_bytes"];
+	        this.new_bytes = source["new_bytes"];
+	        this.exclusive_bytes = source["exclusive_bytes"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class SnapshotSummary {
+	    // Go type: time
+	    start_time: any;
+	    // Go type: time
+	    end_time: any;
+	    errors: number;
+	    files_new: number;
+	    files_changed: number;
+	    files_unchanged: number;
+	    skipped: number;
+	    total_bytes: number;
+	    bytes_added: number;
+	    warnings?: string[];
+	
+	    static createFrom(source: any = {}) {
+	        return new SnapshotSummary(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.start_time = this.convertValues(source["start_time"], null);
+	        this.end_time = this.convertValues(source["end_time"], null);
+	        this.errors = source["errors"];
+	        this.files_new = source["files_new"];
+	        this.files_changed = source["files_changed"];
+	        this.files_unchanged = source["files_unchanged"];
+	        this.skipped = source["skipped"];
+	        this.total_bytes = source["total_bytes"];
+	        this.bytes_added = source["bytes_added"];
+	        this.warnings = source["warnings"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class StorageConfig {
+	    s3?: S3Config;
+	    sftp?: SFTPConfig;
+	
+	    static createFrom(source: any = {}) {
+	        return new StorageConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.s3 = this.convertValues(source["s3"], S3Config);
+	        this.sftp = this.convertValues(source["sftp"], SFTPConfig);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Tombstone {
+	    snapshot: string;
+	    // Go type: time
+	    requested: any;
+	    hostname: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Tombstone(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.snapshot = source["snapshot"];
+	        this.requested = this.convertValues(source["requested"], null);
+	        this.hostname = source["hostname"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class TreeNode {
+	    name: string;
+	    type: string;
+	    subtree?: string;
+	    hash?: string;
+	    chunks?: string[];
+	    size?: number;
+	    link_target?: string;
+	    mode?: number;
+	    // Go type: time
+	    mod_time: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new TreeNode(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.type = source["type"];
+	        this.subtree = source["subtree"];
+	        this.hash = source["hash"];
+	        this.chunks = source["chunks"];
+	        this.size = source["size"];
+	        this.link_target = source["link_target"];
+	        this.mode = source["mode"];
+	        this.mod_time = this.convertValues(source["mod_time"], null);
 	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
 	}
 
 }
@@ -83,6 +1046,9 @@ export namespace main {
 	    sourcePaths: string[];
 	    destinationPath: string;
 	    ignorePatterns: string[];
+	    storage: backend.StorageConfig;
+	    tags?: string[];
+	    description?: string;
 	
 	    static createFrom(source: any = {}) {
 	        return new BackupConfig(source);
@@ -95,7 +1061,28 @@ export namespace main {
 	        this.sourcePaths = source["sourcePaths"];
 	        this.destinationPath = source["destinationPath"];
 	        this.ignorePatterns = source["ignorePatterns"];
+	        this.storage = this.convertValues(source["storage"], backend.StorageConfig);
+	        this.tags = source["tags"];
+	        this.description = source["description"];
 	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
 	}
 	export class BackupState {
 	    id: string;
@@ -143,6 +1130,102 @@ export namespace main {
 		    return a;
 		}
 	}
+	export class CheckState {
+	    id: string;
+	    status: string;
+	    destinationPath: string;
+	    progress: backend.CheckProgress;
+	    report?: backend.CheckReport;
+	    error?: string;
+	    // Go type: time
+	    startTime: any;
+	    // Go type: time
+	    lastUpdateTime: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new CheckState(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.status = source["status"];
+	        this.destinationPath = source["destinationPath"];
+	        this.progress = this.convertValues(source["progress"], backend.CheckProgress);
+	        this.report = this.convertValues(source["report"], backend.CheckReport);
+	        this.error = source["error"];
+	        this.startTime = this.convertValues(source["startTime"], null);
+	        this.lastUpdateTime = this.convertValues(source["lastUpdateTime"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class CopyState {
+	    id: string;
+	    status: string;
+	    sourcePath: string;
+	    destinationPath: string;
+	    filter: backend.SnapshotFilter;
+	    progress: backend.CopyProgress;
+	    stats?: backend.CopyStats;
+	    error?: string;
+	    // Go type: time
+	    startTime: any;
+	    // Go type: time
+	    lastUpdateTime: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new CopyState(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.status = source["status"];
+	        this.sourcePath = source["sourcePath"];
+	        this.destinationPath = source["destinationPath"];
+	        this.filter = this.convertValues(source["filter"], backend.SnapshotFilter);
+	        this.progress = this.convertValues(source["progress"], backend.CopyProgress);
+	        this.stats = this.convertValues(source["stats"], backend.CopyStats);
+	        this.error = source["error"];
+	        this.startTime = this.convertValues(source["startTime"], null);
+	        this.lastUpdateTime = this.convertValues(source["lastUpdateTime"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
 	export class DeploymentState {
 	    id: string;
 	    status: string;